@@ -0,0 +1,84 @@
+// Command fsentry contains maintenance tools for an fsentry storage.
+//
+// Usage:
+//
+//	fsentry fsck [-repair] [-json] <root>
+//
+// fsck takes the file lock of the root, so it waits for the processes that open the storage with WithFileLock.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/HardDie/fsentry"
+	pkgFsentry "github.com/HardDie/fsentry/pkg/fsentry"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "fsck":
+		os.Exit(fsck(os.Args[2:]))
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: fsentry fsck [-repair] [-json] <root>")
+}
+
+// fsck checks the storage and prints found problems. It returns 1 if there are problems left unrepaired.
+func fsck(args []string) int {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	isRepair := flags.Bool("repair", false, "fix found problems")
+	isJSON := flags.Bool("json", false, "print the report as json")
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		usage()
+		return 2
+	}
+
+	// The storage can be used by other processes, so the check waits until they finish their operations.
+	db := fsentry.NewFSEntry(flags.Arg(0), fsentry.WithFileLock(pkgFsentry.FileLockFolder, 0))
+	report, err := db.Check(pkgFsentry.CheckOptions{
+		Repair: *isRepair,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err.Error())
+		return 2
+	}
+
+	if *isJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "	")
+		_ = enc.Encode(report)
+	} else {
+		for _, problem := range report.Problems {
+			status := ""
+			if problem.IsRepaired {
+				status = " (repaired)"
+			}
+			path := filepath.Join(append(problem.Path, problem.Name)...)
+			fmt.Printf("%s: %s: %s%s\n", problem.Kind, path, problem.Message, status)
+		}
+		fmt.Printf("checked %d folders, %d entries, %d binaries, found %d problems\n",
+			report.Folders, report.Entries, report.Binaries, len(report.Problems))
+	}
+
+	for _, problem := range report.Problems {
+		if !problem.IsRepaired {
+			return 1
+		}
+	}
+	return 0
+}
@@ -5,6 +5,6 @@ go 1.19
 require (
 	github.com/hectane/go-acl v0.0.0-20230122075934-ca0b05cb1adb
 	github.com/otiai10/copy v1.11.0
+	golang.org/x/sys v0.10.0
+	golang.org/x/text v0.14.0
 )
-
-require golang.org/x/sys v0.0.0-20220715151400-c0bba94af5f8 // indirect
@@ -1,10 +1,39 @@
 package binary
 
+import (
+	"io"
+
+	"github.com/HardDie/fsentry/pkg/fsentry"
+)
+
 type Service interface {
+	ResolveID(path, name string) (string, error)
+	MigrateID(path, id, name string) (string, error)
+	ChangeID(path, oldID, newID string) error
 	Create(path, name string, data []byte) error
+	CreateWithOptions(path, name string, data []byte, opts fsentry.BinaryOptions) (*fsentry.Binary, error)
+	CreateFrom(path, name string, r io.Reader, opts fsentry.BinaryOptions) (*fsentry.Binary, error)
 	Get(path, name string) ([]byte, error)
+	Open(path, name string) (io.ReadSeekCloser, error)
+	ReadRange(path, name string, offset, length int64) ([]byte, error)
+	GetInfo(path, name string) (*fsentry.Binary, error)
+	GetInfoByID(path, id string) (*fsentry.Binary, error)
 	Move(path, oldName, newName string) error
 	Update(path, name string, data []byte) error
+	UpdateFrom(path, name string, r io.Reader) (*fsentry.Binary, error)
+	Stage(dir, name string, r io.Reader) (*Staged, error)
+	Commit(path, name string, staged *Staged) (*fsentry.Binary, error)
+	Discard(staged *Staged)
 	Remove(path, name string) error
 	Duplicate(path, oldName, newName string) ([]byte, error)
+	Relocate(srcPath, srcName, dstPath, dstName string, opts fsentry.RelocateOptions) error
+}
+
+// Staged is a content written into a temporary file by Stage, which can replace the binary with Commit.
+type Staged struct {
+	FullPath string
+	Size     int64
+	Checksum string
+	// ContentType is detected from the content, it's used if a new binary is created.
+	ContentType string
 }
@@ -1,99 +1,850 @@
 package service
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/HardDie/fsentry/internal/binary"
 	"github.com/HardDie/fsentry/internal/fs"
+	"github.com/HardDie/fsentry/internal/journal"
 	"github.com/HardDie/fsentry/internal/utils"
+	"github.com/HardDie/fsentry/pkg/fsentry"
 	"github.com/HardDie/fsentry/pkg/fsentry_error"
+	"github.com/HardDie/fsentry/pkg/fsentry_storage"
+	"github.com/HardDie/fsentry/pkg/fsentry_types"
 )
 
 const (
 	binaryFileSuffix = ".bin"
+	// binaryInfoSuffix is the suffix of the hidden file with the metadata, it is stored next to the binary
+	// with the name "." + id + ".bin.info.json", so it's skipped when listing a folder.
+	binaryInfoSuffix = ".info.json"
+	// sniffLen is the number of bytes used to detect the content type.
+	sniffLen = 512
+	// stageFilePrefix is a prefix of temporary files with the content written by Stage,
+	// they are temporary files of the storage, so they are removed on Init.
+	stageFilePrefix = fsentry_storage.TempFilePrefix + "stage-"
 )
 
+type InternalBinary struct {
+	ID          string                     `json:"id"`
+	Name        fsentry_types.QuotedString `json:"name"`
+	CreatedAt   *time.Time                 `json:"createdAt"`
+	UpdatedAt   *time.Time                 `json:"updatedAt"`
+	Size        int64                      `json:"size"`
+	ContentType string                     `json:"contentType"`
+	Checksum    string                     `json:"checksum"`
+	Data        json.RawMessage            `json:"data"`
+}
+
+func toExternalBinary(in InternalBinary) fsentry.Binary {
+	ext := fsentry.Binary{
+		ID:          in.ID,
+		Name:        in.Name.String(),
+		Size:        in.Size,
+		ContentType: in.ContentType,
+		Checksum:    in.Checksum,
+		Data:        in.Data,
+	}
+	if in.CreatedAt != nil {
+		ext.CreatedAt = *in.CreatedAt
+	}
+	if in.UpdatedAt == nil {
+		in.UpdatedAt = in.CreatedAt
+	}
+	if in.UpdatedAt != nil {
+		ext.UpdatedAt = *in.UpdatedAt
+	}
+	return ext
+}
+
 type Service struct {
 	fs       fs.FS
+	journal  journal.Service
 	isPretty bool
+	naming   utils.Naming
 	now      func() time.Time
 }
 
 func New(
 	fs fs.FS,
+	journal journal.Service,
 	isPretty bool,
+	naming utils.Naming,
 ) Service {
 	return Service{
 		fs:       fs,
+		journal:  journal,
 		isPretty: isPretty,
+		naming:   naming,
 		now:      time.Now,
 	}
 }
 
 func (s Service) Create(path, name string, data []byte) error {
-	id := utils.NameToID(name)
-	if id == "" {
-		return fsentry_error.ErrorBadName
+	_, err := s.CreateWithOptions(path, name, data, fsentry.BinaryOptions{})
+	return err
+}
+
+func (s Service) CreateWithOptions(path, name string, data []byte, opts fsentry.BinaryOptions) (*fsentry.Binary, error) {
+	return s.CreateFrom(path, name, bytes.NewReader(data), opts)
+}
+
+// CreateFrom creates the binary with the content from the reader, and then the metadata file.
+// If the process is killed in between, the binary is left without the metadata, like binaries created by older versions.
+func (s Service) CreateFrom(path, name string, r io.Reader, opts fsentry.BinaryOptions) (*fsentry.Binary, error) {
+	id, err := s.newID(path, name)
+	if err != nil {
+		return nil, err
+	}
+
+	dataJSON, err := utils.StructToJSON(opts.Data, s.isPretty)
+	if err != nil {
+		return nil, err
 	}
 
 	fullPath := filepath.Join(path, id+binaryFileSuffix)
 
-	return s.fs.CreateFile(fullPath, data)
+	// The check is done before reading a possibly large content.
+	isExist, err := s.fs.IsFileExist(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	if isExist {
+		return nil, fsentry_error.ErrorExist
+	}
+
+	// The size, checksum and content type are calculated while the content is written.
+	content := newContentHash()
+	err = fs.CreateFileFrom(s.fs, fullPath, io.TeeReader(r, content))
+	if err != nil {
+		return nil, err
+	}
+
+	now := s.now().UTC()
+	inBin := content.info(id, name, opts.ContentType)
+	inBin.CreatedAt = &now
+	inBin.UpdatedAt = &now
+	inBin.Data = dataJSON
+
+	// The metadata file of a missing binary is a leftover, so it is replaced.
+	err = s.writeInfo(infoPath(path, id), inBin)
+	if err != nil {
+		if e := s.fs.RemoveFile(fullPath); e != nil {
+			log.Printf("error remove binary %q after error write info: %q", fullPath, e.Error())
+		}
+		return nil, err
+	}
+
+	extBin := toExternalBinary(inBin)
+	return &extBin, nil
 }
 func (s Service) Get(path, name string) ([]byte, error) {
-	id := utils.NameToID(name)
-	if id == "" {
-		return nil, fsentry_error.ErrorBadName
+	id, err := s.resolveID(path, name)
+	if err != nil {
+		return nil, err
 	}
 
 	fullPath := filepath.Join(path, id+binaryFileSuffix)
 
 	return s.fs.ReadFile(fullPath)
 }
+
+// Open opens the content of the binary for reading. The reader must be closed.
+func (s Service) Open(path, name string) (io.ReadSeekCloser, error) {
+	id, err := s.resolveID(path, name)
+	if err != nil {
+		return nil, err
+	}
+
+	fullPath := filepath.Join(path, id+binaryFileSuffix)
+
+	return fs.OpenFile(s.fs, fullPath)
+}
+
+// ReadRange returns up to length bytes of the content starting at the offset, less if the content ends earlier.
+// An offset after the end of the content is an ErrorBadRange.
+func (s Service) ReadRange(path, name string, offset, length int64) ([]byte, error) {
+	if offset < 0 || length < 0 {
+		return nil, fsentry_error.ErrorBadRange
+	}
+
+	file, err := s.Open(path, name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Printf("error close binary %q: %q", name, err.Error())
+		}
+	}()
+
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, fsentry_error.Wrap(err, fsentry_error.ErrorInternal)
+	}
+	if offset > size {
+		return nil, fsentry_error.ErrorBadRange
+	}
+	if length > size-offset {
+		length = size - offset
+	}
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return nil, fsentry_error.Wrap(err, fsentry_error.ErrorInternal)
+	}
+
+	data := make([]byte, length)
+	_, err = io.ReadFull(file, data)
+	if err != nil {
+		return nil, fsentry_error.Wrap(err, fsentry_error.ErrorInternal)
+	}
+	return data, nil
+}
+
+// GetInfo returns the metadata of the binary. For binaries created by older versions there is no metadata file,
+// so the size, checksum and content type are calculated from the content, and the timestamps are zero.
+func (s Service) GetInfo(path, name string) (*fsentry.Binary, error) {
+	id, err := s.resolveID(path, name)
+	if err != nil {
+		return nil, err
+	}
+
+	inBin, err := s.getInfo(path, id)
+	if err != nil {
+		return nil, err
+	}
+
+	extBin := toExternalBinary(*inBin)
+	return &extBin, nil
+}
+
+// GetInfoByID returns the metadata of the binary without reading its content, it's used to list folders.
+// For binaries created by older versions only ID and Name are set.
+func (s Service) GetInfoByID(path, id string) (*fsentry.Binary, error) {
+	inBin, err := s.readInfo(infoPath(path, id))
+	if err != nil {
+		return nil, err
+	}
+	if inBin == nil {
+		return &fsentry.Binary{ID: id, Name: id}, nil
+	}
+
+	extBin := toExternalBinary(*inBin)
+	return &extBin, nil
+}
 func (s Service) Move(path, oldName, newName string) error {
-	oldID := utils.NameToID(oldName)
-	if oldID == "" {
-		return fsentry_error.ErrorBadName
+	oldID, err := s.resolveID(path, oldName)
+	if err != nil {
+		return err
+	}
+
+	newID, err := s.naming.RenameID(oldID, newName, s.objects(path))
+	if err != nil {
+		return err
+	}
+
+	inBin, err := s.getInfo(path, oldID)
+	if err != nil {
+		return err
+	}
+	now := s.now().UTC()
+	inBin.ID = newID
+	inBin.Name = fsentry_types.QS(newName)
+	inBin.UpdatedAt = &now
+	if inBin.CreatedAt == nil {
+		inBin.CreatedAt = &now
+	}
+	infoJSON, err := utils.StructToJSON(*inBin, s.isPretty)
+	if err != nil {
+		return err
+	}
+
+	if oldID == newID {
+		// The binary keeps its ID, only the name is updated.
+		return s.writeInfoRaw(infoPath(path, newID), infoJSON)
 	}
+	return s.move(path, oldID, newID, infoJSON)
+}
 
-	newID := utils.NameToID(newName)
-	if newID == "" {
-		return fsentry_error.ErrorBadName
+// ChangeID renames the binary and its metadata to the new ID and keeps the name, the timestamps and the data.
+// It is used to migrate IDs to new rules.
+func (s Service) ChangeID(path, oldID, newID string) error {
+	isExist, err := s.isExist(path, newID)
+	if err != nil {
+		return err
+	}
+	if isExist {
+		return fsentry_error.ErrorExist
 	}
 
+	inBin, err := s.getInfo(path, oldID)
+	if err != nil {
+		return err
+	}
+	inBin.ID = newID
+	infoJSON, err := utils.StructToJSON(*inBin, s.isPretty)
+	if err != nil {
+		return err
+	}
+	return s.move(path, oldID, newID, infoJSON)
+}
+
+// move renames the binary and writes the metadata for the new ID.
+func (s Service) move(path, oldID, newID string, infoJSON []byte) error {
 	oldFullPath := filepath.Join(path, oldID+binaryFileSuffix)
 	newFullPath := filepath.Join(path, newID+binaryFileSuffix)
+	newInfoFullPath := infoPath(path, newID)
 
-	return s.fs.Rename(oldFullPath, newFullPath)
+	// Like for entries, if the process is killed between renaming and updating the metadata,
+	// the move will be finished on the next Init().
+	recordID, err := s.journal.Begin(journal.Record{
+		Operation: journal.OperationMove,
+		SrcPath:   oldFullPath,
+		DstPath:   newFullPath,
+		MetaPath:  newInfoFullPath,
+		Meta:      infoJSON,
+		// The metadata of the old name is removed after the new one is written.
+		OldMetaPath: infoPath(path, oldID),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = s.fs.Rename(oldFullPath, newFullPath)
+	if err != nil {
+		s.commit(recordID)
+		return err
+	}
+
+	err = s.writeInfoRaw(newInfoFullPath, infoJSON)
+	if err == nil {
+		s.removeInfo(infoPath(path, oldID))
+		s.commit(recordID)
+		return nil
+	}
+
+	// Rollback the binary to the old name, so it stays with its metadata.
+	e := s.fs.Rename(newFullPath, oldFullPath)
+	if e != nil {
+		// The journal record is kept, so the move will be finished on the next Init().
+		log.Printf("error rename binary %q back after error move: %q", newFullPath, e.Error())
+		return fsentry_error.Wrap(err, e)
+	}
+	s.commit(recordID)
+	return err
 }
+
 func (s Service) Update(path, name string, data []byte) error {
-	id := utils.NameToID(name)
-	if id == "" {
-		return fsentry_error.ErrorBadName
+	_, err := s.UpdateFrom(path, name, bytes.NewReader(data))
+	return err
+}
+
+// UpdateFrom replaces the content of the binary with the data from the reader and then its metadata.
+// If the process is killed in between, the size and checksum in the metadata can describe the previous content.
+func (s Service) UpdateFrom(path, name string, r io.Reader) (*fsentry.Binary, error) {
+	id, err := s.resolveID(path, name)
+	if err != nil {
+		return nil, err
+	}
+
+	fullPath := filepath.Join(path, id+binaryFileSuffix)
+	infoFullPath := infoPath(path, id)
+
+	oldInBin, err := s.readInfo(infoFullPath)
+	if err != nil {
+		return nil, err
+	}
+
+	content := newContentHash()
+	err = fs.UpdateFileFrom(s.fs, fullPath, io.TeeReader(r, content))
+	if err != nil {
+		return nil, err
+	}
+
+	// The name, creation date, content type and custom payload are kept.
+	now := s.now().UTC()
+	oldInfo := InternalBinary{Name: fsentry_types.QS(name)}
+	if oldInBin != nil {
+		oldInfo = *oldInBin
+	}
+	inBin := content.info(id, oldInfo.Name.String(), oldInfo.ContentType)
+	inBin.CreatedAt = oldInfo.CreatedAt
+	if inBin.CreatedAt == nil {
+		inBin.CreatedAt = &now
+	}
+	inBin.UpdatedAt = &now
+	inBin.Data = oldInfo.Data
+
+	err = s.writeInfo(infoFullPath, inBin)
+	if err != nil {
+		return nil, err
+	}
+
+	extBin := toExternalBinary(inBin)
+	return &extBin, nil
+}
+
+// Stage writes the content from the reader into a temporary file in the folder dir, so a long write doesn't need
+// the lock of the binary. Commit renames the file, so the folder must be on the same file system as the binary.
+// The temporary file must be passed to Commit or Discard, a file left by a killed process is removed by Init.
+func (s Service) Stage(dir, name string, r io.Reader) (*binary.Staged, error) {
+	if !s.naming.IsValidName(name) {
+		return nil, fsentry_error.ErrorBadName
+	}
+
+	suffix, err := utils.RandomHex(8)
+	if err != nil {
+		return nil, err
+	}
+	tmpFullPath := filepath.Join(dir, stageFilePrefix+suffix)
+
+	content := newContentHash()
+	err = fs.CreateFileFrom(s.fs, tmpFullPath, io.TeeReader(r, content))
+	if err != nil {
+		return nil, err
+	}
+	info := content.info("", "", "")
+	return &binary.Staged{
+		FullPath:    tmpFullPath,
+		Size:        info.Size,
+		Checksum:    info.Checksum,
+		ContentType: info.ContentType,
+	}, nil
+}
+
+// Commit replaces the content of the binary with the staged file, or creates a new binary,
+// if there is no binary with this name. The metadata is updated like in UpdateFrom.
+func (s Service) Commit(path, name string, staged *binary.Staged) (*fsentry.Binary, error) {
+	id, err := s.newID(path, name)
+	if err != nil {
+		s.Discard(staged)
+		return nil, err
 	}
 
 	fullPath := filepath.Join(path, id+binaryFileSuffix)
+	infoFullPath := infoPath(path, id)
+
+	isExist, err := s.fs.IsFileExist(fullPath)
+	if err != nil {
+		s.Discard(staged)
+		return nil, err
+	}
+	var oldInBin *InternalBinary
+	if isExist {
+		oldInBin, err = s.readInfo(infoFullPath)
+		if err != nil {
+			s.Discard(staged)
+			return nil, err
+		}
+	}
+
+	err = s.fs.Rename(staged.FullPath, fullPath)
+	if err != nil {
+		s.Discard(staged)
+		return nil, err
+	}
+
+	now := s.now().UTC()
+	inBin := InternalBinary{
+		ID:          id,
+		Name:        fsentry_types.QS(name),
+		CreatedAt:   &now,
+		UpdatedAt:   &now,
+		Size:        staged.Size,
+		ContentType: staged.ContentType,
+		Checksum:    staged.Checksum,
+	}
+	if oldInBin != nil {
+		// The name, creation date, content type and custom payload are kept.
+		inBin.Name = oldInBin.Name
+		if oldInBin.CreatedAt != nil {
+			inBin.CreatedAt = oldInBin.CreatedAt
+		}
+		inBin.ContentType = oldInBin.ContentType
+		inBin.Data = oldInBin.Data
+	}
+
+	err = s.writeInfo(infoFullPath, inBin)
+	if err != nil {
+		return nil, err
+	}
 
-	return s.fs.UpdateFile(fullPath, data)
+	extBin := toExternalBinary(inBin)
+	return &extBin, nil
+}
+
+// Discard removes the staged file.
+func (s Service) Discard(staged *binary.Staged) {
+	if err := s.fs.RemoveFile(staged.FullPath); err != nil && !errors.Is(err, fsentry_error.ErrorNotExist) {
+		log.Printf("error remove staged binary %q: %q", staged.FullPath, err.Error())
+	}
 }
 func (s Service) Remove(path, name string) error {
-	id := utils.NameToID(name)
-	if id == "" {
-		return fsentry_error.ErrorBadName
+	id, err := s.resolveID(path, name)
+	if err != nil {
+		return err
 	}
 
 	fullPath := filepath.Join(path, id+binaryFileSuffix)
 
-	return s.fs.RemoveFile(fullPath)
+	err = s.fs.RemoveFile(fullPath)
+	if err != nil {
+		return err
+	}
+	s.removeInfo(infoPath(path, id))
+	return nil
 }
 func (s Service) Duplicate(path, oldName, newName string) ([]byte, error) {
+	oldID, err := s.resolveID(path, oldName)
+	if err != nil {
+		return nil, err
+	}
+
+	inBin, err := s.getInfo(path, oldID)
+	if err != nil {
+		return nil, err
+	}
 	data, err := s.Get(path, oldName)
 	if err != nil {
 		return nil, err
 	}
-	err = s.Create(path, newName, data)
+	_, err = s.CreateWithOptions(path, newName, data, fsentry.BinaryOptions{
+		ContentType: inBin.ContentType,
+		Data:        inBin.Data,
+	})
 	if err != nil {
 		return nil, err
 	}
 	return data, nil
 }
+
+// Relocate moves or copies the binary into another folder. Like for entries, all changes are done
+// with renames under a journal record, so they are rolled back if a rename fails or the process is killed.
+func (s Service) Relocate(srcPath, srcName, dstPath, dstName string, opts fsentry.RelocateOptions) error {
+	srcID, err := s.resolveID(srcPath, srcName)
+	if err != nil {
+		return err
+	}
+	dstID, err := s.newID(dstPath, dstName)
+	if err != nil {
+		return err
+	}
+
+	srcFullPath := filepath.Join(srcPath, srcID+binaryFileSuffix)
+	dstFullPath := filepath.Join(dstPath, dstID+binaryFileSuffix)
+	if srcFullPath == dstFullPath {
+		return fsentry_error.ErrorExist
+	}
+
+	inBin, err := s.getInfo(srcPath, srcID)
+	if err != nil {
+		return err
+	}
+	isExist, err := s.fs.IsFileExist(dstFullPath)
+	if err != nil {
+		return err
+	}
+	if isExist && !opts.Overwrite {
+		return fsentry_error.ErrorExist
+	}
+
+	// A moved binary keeps its creation date, a copy is a new binary.
+	now := s.now().UTC()
+	inBin.ID = dstID
+	inBin.Name = fsentry_types.QS(dstName)
+	inBin.UpdatedAt = &now
+	if opts.Copy || inBin.CreatedAt == nil {
+		inBin.CreatedAt = &now
+	}
+	infoJSON, err := utils.StructToJSON(*inBin, s.isPretty)
+	if err != nil {
+		return err
+	}
+
+	srcInfoFullPath := infoPath(srcPath, srcID)
+	dstInfoFullPath := infoPath(dstPath, dstID)
+	isSrcInfoExist, err := s.fs.IsFileExist(srcInfoFullPath)
+	if err != nil {
+		return err
+	}
+	isDstInfoExist, err := s.fs.IsFileExist(dstInfoFullPath)
+	if err != nil {
+		return err
+	}
+
+	suffix, err := utils.RandomHex(8)
+	if err != nil {
+		return err
+	}
+	tmpFullPath := filepath.Join(dstPath, utils.RelocateFolderPrefix+suffix)
+	err = s.fs.CreateFolder(tmpFullPath)
+	if err != nil {
+		return err
+	}
+	removeTmp := func() {
+		if e := s.fs.RemoveFolder(tmpFullPath); e != nil {
+			log.Printf("error remove temporary folder %q after error relocate: %q", tmpFullPath, e.Error())
+		}
+	}
+
+	newInfoFullPath := filepath.Join(tmpFullPath, "info")
+	err = s.fs.CreateFile(newInfoFullPath, infoJSON)
+	if err != nil {
+		removeTmp()
+		return err
+	}
+
+	var steps []journal.Step
+	if isExist {
+		steps = append(steps, journal.Step{SrcPath: dstFullPath, DstPath: filepath.Join(tmpFullPath, "dst")})
+	}
+	if isDstInfoExist {
+		steps = append(steps, journal.Step{SrcPath: dstInfoFullPath, DstPath: filepath.Join(tmpFullPath, "info-old")})
+	}
+	if opts.Copy {
+		// The copy is prepared first, so the destination is replaced by a rename.
+		newFullPath := filepath.Join(tmpFullPath, "new")
+		err = s.copyFile(srcFullPath, newFullPath)
+		if err != nil {
+			removeTmp()
+			return err
+		}
+		steps = append(steps, journal.Step{SrcPath: newFullPath, DstPath: dstFullPath})
+	} else {
+		steps = append(steps, journal.Step{SrcPath: srcFullPath, DstPath: dstFullPath})
+		if isSrcInfoExist {
+			steps = append(steps, journal.Step{SrcPath: srcInfoFullPath, DstPath: filepath.Join(tmpFullPath, "src-info")})
+		}
+	}
+	steps = append(steps, journal.Step{SrcPath: newInfoFullPath, DstPath: dstInfoFullPath})
+
+	return s.journal.Apply(journal.Record{
+		Operation: journal.OperationRelocate,
+		SrcPath:   srcFullPath,
+		DstPath:   dstFullPath,
+		TmpPath:   tmpFullPath,
+		Steps:     steps,
+	})
+}
+
+// getInfo returns the metadata of the binary, for binaries without the metadata file it's calculated from the content.
+func (s Service) getInfo(path, id string) (*InternalBinary, error) {
+	fullPath := filepath.Join(path, id+binaryFileSuffix)
+
+	isExist, err := s.fs.IsFileExist(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	if !isExist {
+		return nil, fsentry_error.ErrorNotExist
+	}
+
+	inBin, err := s.readInfo(infoPath(path, id))
+	if err != nil {
+		return nil, err
+	}
+	if inBin != nil {
+		return inBin, nil
+	}
+
+	file, err := fs.OpenFile(s.fs, fullPath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Printf("error close binary %q: %q", fullPath, err.Error())
+		}
+	}()
+	content := newContentHash()
+	_, err = io.Copy(content, file)
+	if err != nil {
+		return nil, fsentry_error.Wrap(err, fsentry_error.ErrorInternal)
+	}
+	res := content.info(id, id, "")
+	return &res, nil
+}
+func (s Service) copyFile(srcFullPath, dstFullPath string) error {
+	file, err := fs.OpenFile(s.fs, srcFullPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Printf("error close binary %q: %q", srcFullPath, err.Error())
+		}
+	}()
+	return fs.CreateFileFrom(s.fs, dstFullPath, file)
+}
+
+// readInfo reads the metadata file, nil is returned if there is no such file.
+func (s Service) readInfo(infoFullPath string) (*InternalBinary, error) {
+	data, err := s.fs.ReadFile(infoFullPath)
+	if err != nil {
+		if errors.Is(err, fsentry_error.ErrorNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	inBin, err := utils.JSONToStruct[InternalBinary](data)
+	if err != nil {
+		return nil, err
+	}
+	if inBin == nil {
+		return nil, fsentry_error.ErrorInternal
+	}
+	return inBin, nil
+}
+func (s Service) writeInfo(infoFullPath string, inBin InternalBinary) error {
+	infoJSON, err := utils.StructToJSON(inBin, s.isPretty)
+	if err != nil {
+		return err
+	}
+	return s.writeInfoRaw(infoFullPath, infoJSON)
+}
+
+// writeInfoRaw replaces the metadata file or creates it, if the binary had no metadata.
+func (s Service) writeInfoRaw(infoFullPath string, infoJSON []byte) error {
+	err := s.fs.UpdateFile(infoFullPath, infoJSON)
+	if errors.Is(err, fsentry_error.ErrorNotExist) {
+		err = s.fs.CreateFile(infoFullPath, infoJSON)
+	}
+	return err
+}
+func (s Service) removeInfo(infoFullPath string) {
+	err := s.fs.RemoveFile(infoFullPath)
+	if err != nil && !errors.Is(err, fsentry_error.ErrorNotExist) {
+		log.Printf("error remove binary info %q: %q", infoFullPath, err.Error())
+	}
+}
+
+// ResolveID returns the ID of the existing binary with the name.
+func (s Service) ResolveID(path, name string) (string, error) {
+	id, err := s.resolveID(path, name)
+	if err != nil {
+		return "", err
+	}
+	isExist, err := s.isExist(path, id)
+	if err != nil {
+		return "", err
+	}
+	if !isExist {
+		return "", fsentry_error.ErrorNotExist
+	}
+	return id, nil
+}
+
+// MigrateID returns the ID the object should have with the current rules of IDs.
+func (s Service) MigrateID(path, id, name string) (string, error) {
+	return s.naming.MigrateID(id, name, s.objects(path))
+}
+func (s Service) resolveID(path, name string) (string, error) {
+	return s.naming.ResolveID(name, s.objects(path))
+}
+func (s Service) newID(path, name string) (string, error) {
+	return s.naming.NewID(name, s.objects(path))
+}
+func (s Service) objects(path string) utils.Objects {
+	return utils.Objects{
+		IsExist: func(id string) (bool, error) {
+			return s.isExist(path, id)
+		},
+		GetName: func(id string) (string, error) {
+			return s.readName(infoPath(path, id), id)
+		},
+		ListIDs: func(fn func(id string) bool) error {
+			return s.listIDs(path, fn)
+		},
+	}
+}
+
+// readName reads only the name from the metadata of the binary. Binaries created by older versions
+// have no metadata, their ID is used as the name.
+func (s Service) readName(infoFullPath, id string) (string, error) {
+	r, err := fs.OpenFile(s.fs, infoFullPath)
+	if errors.Is(err, fsentry_error.ErrorNotExist) {
+		return id, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	return utils.ReadName(r)
+}
+func (s Service) listIDs(path string, fn func(id string) bool) error {
+	err := s.fs.ListFunc(path, func(file os.DirEntry) error {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") || !strings.HasSuffix(file.Name(), binaryFileSuffix) {
+			return nil
+		}
+		if !fn(strings.TrimSuffix(file.Name(), binaryFileSuffix)) {
+			return fsentry.SkipAll
+		}
+		return nil
+	})
+	if errors.Is(err, fsentry.SkipAll) {
+		return nil
+	}
+	return err
+}
+func (s Service) isExist(path, id string) (bool, error) {
+	return s.fs.IsFileExist(filepath.Join(path, id+binaryFileSuffix))
+}
+func (s Service) commit(recordID string) {
+	if err := s.journal.Commit(recordID); err != nil {
+		log.Printf("error commit journal record %q: %q", recordID, err.Error())
+	}
+}
+
+func infoPath(path, id string) string {
+	return filepath.Join(path, "."+id+binaryFileSuffix+binaryInfoSuffix)
+}
+
+// contentHash collects the size, checksum and the beginning of the content while it is written,
+// so the metadata of a large binary is calculated without reading it again.
+type contentHash struct {
+	hash   hash.Hash
+	size   int64
+	header []byte
+}
+
+func newContentHash() *contentHash {
+	return &contentHash{
+		hash: sha256.New(),
+	}
+}
+func (h *contentHash) Write(p []byte) (int, error) {
+	h.hash.Write(p)
+	h.size += int64(len(p))
+	// http.DetectContentType only looks at the first 512 bytes.
+	if n := sniffLen - len(h.header); n > 0 {
+		if n > len(p) {
+			n = len(p)
+		}
+		h.header = append(h.header, p[:n]...)
+	}
+	return len(p), nil
+}
+func (h *contentHash) info(id, name, contentType string) InternalBinary {
+	if contentType == "" {
+		contentType = http.DetectContentType(h.header)
+	}
+	return InternalBinary{
+		ID:          id,
+		Name:        fsentry_types.QS(name),
+		Size:        h.size,
+		ContentType: contentType,
+		Checksum:    hex.EncodeToString(h.hash.Sum(nil)),
+	}
+}
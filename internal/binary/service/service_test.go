@@ -1,12 +1,20 @@
 package service
 
 import (
+	"encoding/json"
 	"errors"
+	"io"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 
+	"github.com/HardDie/fsentry/internal/fs"
 	fsStorage "github.com/HardDie/fsentry/internal/fs/storage"
+	journalService "github.com/HardDie/fsentry/internal/journal/service"
+	"github.com/HardDie/fsentry/internal/utils"
+	"github.com/HardDie/fsentry/pkg/fsentry"
 	"github.com/HardDie/fsentry/pkg/fsentry_error"
 )
 
@@ -18,7 +26,7 @@ func TestBinaryCreate(t *testing.T) {
 		}
 		defer os.RemoveAll(dir)
 
-		s := New(fsStorage.New(), true)
+		s := New(fsStorage.New(), journalService.New(fsStorage.New(), dir), true, utils.Naming{})
 		err = s.Create(dir, "success", nil)
 		if err != nil {
 			t.Fatal(err)
@@ -36,7 +44,7 @@ func TestBinaryGet(t *testing.T) {
 		name := "success"
 		payload := []byte("check")
 
-		s := New(fsStorage.New(), true)
+		s := New(fsStorage.New(), journalService.New(fsStorage.New(), dir), true, utils.Naming{})
 		err = s.Create(dir, name, payload)
 		if err != nil {
 			t.Fatal(err)
@@ -65,7 +73,7 @@ func TestBinaryMove(t *testing.T) {
 
 		payload := []byte("check")
 
-		s := New(fsStorage.New(), true)
+		s := New(fsStorage.New(), journalService.New(fsStorage.New(), dir), true, utils.Naming{})
 		err = s.Create(dir, oldName, payload)
 		if err != nil {
 			t.Fatal(err)
@@ -92,7 +100,83 @@ func TestBinaryMove(t *testing.T) {
 			t.Fatalf("error wait: %q; got: %q", fsentry_error.ErrorNotExist, err)
 		}
 	})
+	t.Run("failed rollback", func(t *testing.T) {
+		dir, err := os.MkdirTemp("", "move_binary_failed_rollback")
+		if err != nil {
+			t.Fatal("error creating temp dir", err)
+		}
+		defer os.RemoveAll(dir)
+
+		storage := &failFS{FS: fsStorage.New()}
+		journal := journalService.New(storage, dir)
+		s := New(storage, journal, true, utils.Naming{})
+		err = s.Create(dir, "b1", []byte("check"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Writing the metadata and renaming the binary back fail.
+		storage.failSuffix = "b2.bin.info.json"
+		storage.failRename = filepath.Join(dir, "b2.bin")
+		err = s.Move(dir, "b1", "b2")
+		if err == nil {
+			t.Fatal("move must fail")
+		}
+
+		// The record is kept, so the move is finished by the recovery.
+		records, err := journal.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != 1 {
+			t.Fatal("the journal record must be kept", records)
+		}
+		storage.failSuffix = ""
+		storage.failRename = ""
+		err = journal.Recover()
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := s.GetInfo(dir, "b2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.ID != "b2" {
+			t.Fatal("bad ID of the recovered binary", info.ID)
+		}
+		_, err = os.Stat(filepath.Join(dir, ".b1.bin.info.json"))
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Fatal("the old metadata must be removed", err)
+		}
+	})
+}
+
+// failFS fails writes of files with the suffix and renames of the path.
+type failFS struct {
+	fs.FS
+	failSuffix string
+	failRename string
 }
+
+func (f *failFS) CreateFile(path string, data []byte) error {
+	if f.failSuffix != "" && strings.HasSuffix(path, f.failSuffix) {
+		return errors.New("create failed")
+	}
+	return f.FS.CreateFile(path, data)
+}
+func (f *failFS) UpdateFile(path string, data []byte) error {
+	if f.failSuffix != "" && strings.HasSuffix(path, f.failSuffix) {
+		return errors.New("update failed")
+	}
+	return f.FS.UpdateFile(path, data)
+}
+func (f *failFS) Rename(oldPath, newPath string) error {
+	if f.failRename != "" && oldPath == f.failRename {
+		return errors.New("rename failed")
+	}
+	return f.FS.Rename(oldPath, newPath)
+}
+
 func TestBinaryUpdate(t *testing.T) {
 	t.Run("success", func(t *testing.T) {
 		dir, err := os.MkdirTemp("", "update_binary_success")
@@ -104,7 +188,7 @@ func TestBinaryUpdate(t *testing.T) {
 		name := "success"
 		payload := []byte("check")
 
-		s := New(fsStorage.New(), true)
+		s := New(fsStorage.New(), journalService.New(fsStorage.New(), dir), true, utils.Naming{})
 		err = s.Create(dir, name, payload)
 		if err != nil {
 			t.Fatal(err)
@@ -135,7 +219,7 @@ func TestBinaryRemove(t *testing.T) {
 		name := "success"
 		payload := []byte("check")
 
-		s := New(fsStorage.New(), true)
+		s := New(fsStorage.New(), journalService.New(fsStorage.New(), dir), true, utils.Naming{})
 		err = s.Create(dir, name, payload)
 		if err != nil {
 			t.Fatal(err)
@@ -159,7 +243,7 @@ func TestBinaryDuplicate(t *testing.T) {
 		newName := "success_duplicate"
 		payload := []byte("check")
 
-		s := New(fsStorage.New(), true)
+		s := New(fsStorage.New(), journalService.New(fsStorage.New(), dir), true, utils.Naming{})
 		err = s.Create(dir, oldName, payload)
 		if err != nil {
 			t.Fatal(err)
@@ -174,3 +258,192 @@ func TestBinaryDuplicate(t *testing.T) {
 		}
 	})
 }
+func TestBinaryInfo(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		dir, err := os.MkdirTemp("", "info_binary_success")
+		if err != nil {
+			t.Fatal("error creating temp dir", err)
+		}
+		defer os.RemoveAll(dir)
+
+		s := New(fsStorage.New(), journalService.New(fsStorage.New(), dir), true, utils.Naming{})
+		created, err := s.CreateWithOptions(dir, "Success Info", []byte("check"), fsentry.BinaryOptions{
+			ContentType: "application/x-check",
+			Data:        map[string]string{"key": "value"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if created.ID != "success_info" || created.Name != "Success Info" || created.Size != 5 {
+			t.Fatal("bad binary info", created)
+		}
+		if created.Checksum != "20f65c28671b40937c5bf23acc7c6f37e5a5ec0622e347b57685725df5ba9e50" {
+			t.Fatal("bad checksum", created.Checksum)
+		}
+
+		err = s.Update(dir, "Success Info", []byte("checked"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := s.GetInfo(dir, "Success Info")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size != 7 || info.Checksum == created.Checksum {
+			t.Fatal("size and checksum must be updated", info)
+		}
+		var data map[string]string
+		err = json.Unmarshal(info.Data, &data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.ContentType != created.ContentType || data["key"] != "value" || !info.CreatedAt.Equal(created.CreatedAt) {
+			t.Fatal("content type, data and creation date must be kept", info)
+		}
+
+		err = s.Move(dir, "Success Info", "Moved")
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err = s.GetInfo(dir, "Moved")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.ID != "moved" || info.Name != "Moved" || !info.CreatedAt.Equal(created.CreatedAt) {
+			t.Fatal("moved binary must keep its info", info)
+		}
+		_, err = os.Stat(infoPath(dir, "success_info"))
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Fatal("old info file must be removed", err)
+		}
+
+		err = s.Remove(dir, "Moved")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = os.Stat(infoPath(dir, "moved"))
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Fatal("info file must be removed", err)
+		}
+	})
+	t.Run("without info", func(t *testing.T) {
+		dir, err := os.MkdirTemp("", "info_binary_without_info")
+		if err != nil {
+			t.Fatal("error creating temp dir", err)
+		}
+		defer os.RemoveAll(dir)
+
+		// Binaries created by older versions have no info file.
+		err = os.WriteFile(filepath.Join(dir, "old.bin"), []byte("<html></html>"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s := New(fsStorage.New(), journalService.New(fsStorage.New(), dir), true, utils.Naming{})
+		info, err := s.GetInfo(dir, "old")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Name != "old" || info.Size != 13 || info.ContentType != "text/html; charset=utf-8" || !info.CreatedAt.IsZero() {
+			t.Fatal("info must be calculated from the content", info)
+		}
+		info, err = s.GetInfoByID(dir, "old")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Name != "old" || info.Size != 0 {
+			t.Fatal("content must not be read", info)
+		}
+	})
+}
+func TestBinaryStream(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		dir, err := os.MkdirTemp("", "stream_binary_success")
+		if err != nil {
+			t.Fatal("error creating temp dir", err)
+		}
+		defer os.RemoveAll(dir)
+
+		s := New(fsStorage.New(), journalService.New(fsStorage.New(), dir), true, utils.Naming{})
+		created, err := s.CreateFrom(dir, "stream", strings.NewReader("0123456789"), fsentry.BinaryOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if created.Size != 10 || created.ContentType != "text/plain; charset=utf-8" {
+			t.Fatal("bad binary info", created)
+		}
+
+		file, err := s.Open(dir, "stream")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = file.Seek(5, io.SeekStart)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "56789" {
+			t.Fatal("bad content", string(data))
+		}
+
+		tests := []struct {
+			offset, length int64
+			want           string
+			err            error
+		}{
+			{offset: 2, length: 3, want: "234"},
+			{offset: 8, length: 10, want: "89"},
+			{offset: 10, length: 1, want: ""},
+			{offset: 11, length: 1, err: fsentry_error.ErrorBadRange},
+			{offset: -1, length: 1, err: fsentry_error.ErrorBadRange},
+		}
+		for _, tc := range tests {
+			data, err := s.ReadRange(dir, "stream", tc.offset, tc.length)
+			if !errors.Is(err, tc.err) || string(data) != tc.want {
+				t.Fatalf("ReadRange(%d, %d): got %q %v, want %q %v", tc.offset, tc.length, data, err, tc.want, tc.err)
+			}
+		}
+
+		staged, err := s.Stage(dir, "stream", strings.NewReader("new"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err = s.Get(dir, "stream")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "0123456789" {
+			t.Fatal("binary must be changed only on commit", string(data))
+		}
+		updated, err := s.Commit(dir, "stream", staged)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if updated.Size != 3 || !updated.CreatedAt.Equal(created.CreatedAt) {
+			t.Fatal("binary must be updated", updated)
+		}
+
+		staged, err = s.Stage(dir, "stream_new", strings.NewReader("new"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.Commit(dir, "stream_new", staged)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err = s.Get(dir, "stream_new")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "new" {
+			t.Fatal("binary must be created", string(data))
+		}
+	})
+}
@@ -5,10 +5,18 @@ import (
 )
 
 type Service interface {
+	ResolveID(path, name string) (string, error)
+	MigrateID(path, id, name string) (string, error)
+	ChangeID(path, oldID, newID string) error
 	Create(path, name string, data interface{}) (*fsentry.Entry, error)
 	Get(path, name string) (*fsentry.Entry, error)
+	GetByID(path, id string) (*fsentry.Entry, error)
 	Move(path, oldName, newName string) (*fsentry.Entry, error)
 	Update(path, name string, data interface{}) (*fsentry.Entry, error)
+	UpdateIf(path, name string, data interface{}, expectedRevision uint64) (*fsentry.Entry, error)
+	Patch(path, name string, patch fsentry.Patch) (*fsentry.Entry, error)
 	Remove(path, name string) error
 	Duplicate(path, oldName, newName string) (*fsentry.Entry, error)
+	Relocate(srcPath, srcName, dstPath, dstName string, opts fsentry.RelocateOptions) (*fsentry.Entry, error)
+	Check(path, id string, isRepair bool) ([]fsentry.CheckProblem, error)
 }
@@ -2,10 +2,16 @@ package service
 
 import (
 	"encoding/json"
+	"errors"
+	"log"
+	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/HardDie/fsentry/internal/fs"
+	"github.com/HardDie/fsentry/internal/journal"
+	"github.com/HardDie/fsentry/internal/jsonpatch"
 	"github.com/HardDie/fsentry/internal/utils"
 	"github.com/HardDie/fsentry/pkg/fsentry"
 	"github.com/HardDie/fsentry/pkg/fsentry_error"
@@ -21,6 +27,7 @@ type InternalEntry struct {
 	Name      fsentry_types.QuotedString `json:"name"`
 	CreatedAt *time.Time                 `json:"createdAt"`
 	UpdatedAt *time.Time                 `json:"updatedAt"`
+	Revision  uint64                     `json:"revision"`
 	Data      json.RawMessage            `json:"data"`
 }
 
@@ -30,21 +37,23 @@ func toInternalEntry(ext fsentry.Entry) InternalEntry {
 		Name:      fsentry_types.QS(ext.Name),
 		CreatedAt: &ext.CreatedAt,
 		UpdatedAt: &ext.UpdatedAt,
+		Revision:  ext.Revision,
 		Data:      ext.Data,
 	}
 }
 func toExternalEntry(in InternalEntry) fsentry.Entry {
 	ext := fsentry.Entry{
-		ID:   in.ID,
-		Name: in.Name.String(),
-		Data: in.Data,
+		ID:       in.ID,
+		Name:     in.Name.String(),
+		Revision: in.Revision,
+		Data:     in.Data,
 	}
 	if in.CreatedAt == nil {
 		now := time.Now().UTC()
 		in.CreatedAt = &now
 	}
 	ext.CreatedAt = *in.CreatedAt
-	if in.UpdatedAt != nil {
+	if in.UpdatedAt == nil {
 		in.UpdatedAt = in.CreatedAt
 	}
 	ext.UpdatedAt = *in.UpdatedAt
@@ -53,26 +62,32 @@ func toExternalEntry(in InternalEntry) fsentry.Entry {
 
 type Service struct {
 	fs       fs.FS
+	journal  journal.Service
 	isPretty bool
+	naming   utils.Naming
 	now      func() time.Time
 }
 
 func New(
 	fs fs.FS,
+	journal journal.Service,
 	isPretty bool,
+	naming utils.Naming,
 ) Service {
 	return Service{
 		fs:       fs,
+		journal:  journal,
 		isPretty: isPretty,
+		naming:   naming,
 		now:      time.Now,
 	}
 }
 
 func (s Service) Create(path, name string, data interface{}) (*fsentry.Entry, error) {
 	// Check if it is possible to translate a name into a valid ID.
-	id := utils.NameToID(name)
-	if id == "" {
-		return nil, fsentry_error.ErrorBadName
+	id, err := s.newID(path, name)
+	if err != nil {
+		return nil, err
 	}
 
 	// Prepare a custom payload and convert it to a json byte slice.
@@ -88,11 +103,15 @@ func (s Service) Create(path, name string, data interface{}) (*fsentry.Entry, er
 }
 func (s Service) Get(path, name string) (*fsentry.Entry, error) {
 	// Check if it is possible to translate a name into a valid ID.
-	id := utils.NameToID(name)
-	if id == "" {
-		return nil, fsentry_error.ErrorBadName
+	id, err := s.resolveID(path, name)
+	if err != nil {
+		return nil, err
 	}
 
+	return s.GetByID(path, id)
+}
+
+func (s Service) GetByID(path, id string) (*fsentry.Entry, error) {
 	fullPath := filepath.Join(path, id+entryFileSuffix)
 
 	data, err := s.fs.ReadFile(fullPath)
@@ -112,15 +131,15 @@ func (s Service) Get(path, name string) (*fsentry.Entry, error) {
 }
 func (s Service) Move(path, oldName, newName string) (*fsentry.Entry, error) {
 	// Check if the old entry name is a valid entry name.
-	oldID := utils.NameToID(oldName)
-	if oldID == "" {
-		return nil, fsentry_error.ErrorBadName
+	oldID, err := s.resolveID(path, oldName)
+	if err != nil {
+		return nil, err
 	}
 
 	// Check if the new entry name is a valid entry name.
-	newID := utils.NameToID(newName)
-	if newID == "" {
-		return nil, fsentry_error.ErrorBadName
+	newID, err := s.naming.RenameID(oldID, newName, s.objects(path))
+	if err != nil {
+		return nil, err
 	}
 
 	// newFullPath - path to the new entry to which the old one will be moved.
@@ -131,7 +150,7 @@ func (s Service) Move(path, oldName, newName string) (*fsentry.Entry, error) {
 	if err != nil {
 		return nil, err
 	}
-	if isExist {
+	if isExist && newID != oldID {
 		return nil, fsentry_error.ErrorExist
 	}
 
@@ -153,6 +172,7 @@ func (s Service) Move(path, oldName, newName string) (*fsentry.Entry, error) {
 		Name:      fsentry_types.QS(newName),
 		CreatedAt: oldInEnt.CreatedAt,
 		UpdatedAt: &now,
+		Revision:  oldInEnt.Revision,
 		Data:      oldInEnt.Data,
 	}
 
@@ -161,31 +181,206 @@ func (s Service) Move(path, oldName, newName string) (*fsentry.Entry, error) {
 		return nil, err
 	}
 
-	// The operation of renaming a entry is cheaper and faster than updating file data,
-	// so we will first try moving the old entry to the new name.
-	err = s.fs.Rename(oldFullPath, newFullPath)
+	if newID == oldID {
+		// The entry keeps its ID, only the name is updated.
+		err = s.fs.UpdateFile(oldFullPath, newEntJSON)
+		if err != nil {
+			return nil, err
+		}
+		newExtEnt := toExternalEntry(newInEnt)
+		return &newExtEnt, nil
+	}
+
+	err = s.move(oldFullPath, newFullPath, newEntJSON)
 	if err != nil {
 		return nil, err
 	}
 
-	// If the entry has been successfully renamed, we attempt to update the data.
-	err = s.fs.UpdateFile(newFullPath, newEntJSON)
-	if err == nil {
-		// Good. Returns information about the renamed entry.
-		newExtEnt := toExternalEntry(newInEnt)
-		return &newExtEnt, nil
+	// Good. Returns information about the renamed entry.
+	newExtEnt := toExternalEntry(newInEnt)
+	return &newExtEnt, nil
+}
+func (s Service) Update(path, name string, data interface{}) (*fsentry.Entry, error) {
+	return s.update(path, name, data, nil)
+}
+
+// UpdateIf updates the entry only if its stored revision is equal to the expected one,
+// otherwise fsentry_error.ErrorConflict is returned.
+func (s Service) UpdateIf(path, name string, data interface{}, expectedRevision uint64) (*fsentry.Entry, error) {
+	return s.update(path, name, data, &expectedRevision)
+}
+
+// Patch applies the patch to the stored data of the entry.
+func (s Service) Patch(path, name string, patch fsentry.Patch) (*fsentry.Entry, error) {
+	return s.updateData(path, name, func(data json.RawMessage) (json.RawMessage, error) {
+		return jsonpatch.Apply(data, patch)
+	}, nil)
+}
+func (s Service) Remove(path, name string) error {
+	// Check if it is possible to translate a name into a valid ID.
+	id, err := s.resolveID(path, name)
+	if err != nil {
+		return err
 	}
 
-	// If our attempt to update the data file fails, we assume the data file has an old value,
-	// in which case we must rename it to the old name to keep the entry valid.
-	err = s.fs.Rename(newFullPath, oldFullPath)
+	fullPath := filepath.Join(path, id+entryFileSuffix)
+
+	return s.fs.RemoveFile(fullPath)
+}
+func (s Service) Duplicate(path, oldName, newName string) (*fsentry.Entry, error) {
+	oldExtEnt, err := s.Get(path, oldName)
 	if err != nil {
 		return nil, err
 	}
 
-	return nil, nil
+	// Check if the new entry name is a valid entry name.
+	newID, err := s.newID(path, newName)
+	if err != nil {
+		return nil, err
+	}
+
+	newFullPath := filepath.Join(path, newID+entryFileSuffix)
+
+	return s.createRaw(newFullPath, newName, newID, oldExtEnt.Data)
 }
-func (s Service) Update(path, name string, data interface{}) (*fsentry.Entry, error) {
+
+// Relocate moves or copies the entry into another folder. The new entry is prepared in a hidden folder inside
+// the destination folder, and then the objects are renamed into their places under a journal record,
+// so if a rename fails or the process is killed, the source and the destination are restored.
+func (s Service) Relocate(srcPath, srcName, dstPath, dstName string, opts fsentry.RelocateOptions) (*fsentry.Entry, error) {
+	srcID, err := s.resolveID(srcPath, srcName)
+	if err != nil {
+		return nil, err
+	}
+	dstID, err := s.newID(dstPath, dstName)
+	if err != nil {
+		return nil, err
+	}
+
+	srcFullPath := filepath.Join(srcPath, srcID+entryFileSuffix)
+	dstFullPath := filepath.Join(dstPath, dstID+entryFileSuffix)
+	if srcFullPath == dstFullPath {
+		return nil, fsentry_error.ErrorExist
+	}
+
+	oldExtEnt, err := s.GetByID(srcPath, srcID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check if the name of the new entry is not occupied by an existing entry.
+	isExist, err := s.fs.IsFileExist(dstFullPath)
+	if err != nil {
+		return nil, err
+	}
+	if isExist && !opts.Overwrite {
+		return nil, fsentry_error.ErrorExist
+	}
+
+	// A moved entry keeps its history, a copy is a new entry.
+	now := s.now().UTC()
+	newInEnt := InternalEntry{
+		ID:        dstID,
+		Name:      fsentry_types.QS(dstName),
+		CreatedAt: &oldExtEnt.CreatedAt,
+		UpdatedAt: &now,
+		Revision:  oldExtEnt.Revision,
+		Data:      oldExtEnt.Data,
+	}
+	if opts.Copy {
+		newInEnt.CreatedAt = &now
+		newInEnt.Revision = 1
+	}
+	newEntJSON, err := utils.StructToJSON(newInEnt, s.isPretty)
+	if err != nil {
+		return nil, err
+	}
+
+	suffix, err := utils.RandomHex(8)
+	if err != nil {
+		return nil, err
+	}
+	tmpFullPath := filepath.Join(dstPath, utils.RelocateFolderPrefix+suffix)
+	err = s.fs.CreateFolder(tmpFullPath)
+	if err != nil {
+		return nil, err
+	}
+	newFullPath := filepath.Join(tmpFullPath, "new")
+	err = s.fs.CreateFile(newFullPath, newEntJSON)
+	if err != nil {
+		if e := s.fs.RemoveFolder(tmpFullPath); e != nil {
+			log.Printf("error remove temporary folder %q after error relocate: %q", tmpFullPath, e.Error())
+		}
+		return nil, err
+	}
+
+	var steps []journal.Step
+	if !opts.Copy {
+		steps = append(steps, journal.Step{SrcPath: srcFullPath, DstPath: filepath.Join(tmpFullPath, "src")})
+	}
+	if isExist {
+		steps = append(steps, journal.Step{SrcPath: dstFullPath, DstPath: filepath.Join(tmpFullPath, "dst")})
+	}
+	steps = append(steps, journal.Step{SrcPath: newFullPath, DstPath: dstFullPath})
+
+	err = s.journal.Apply(journal.Record{
+		Operation: journal.OperationRelocate,
+		SrcPath:   srcFullPath,
+		DstPath:   dstFullPath,
+		TmpPath:   tmpFullPath,
+		Steps:     steps,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	newExtEnt := toExternalEntry(newInEnt)
+	return &newExtEnt, nil
+}
+func (s Service) Check(path, id string, isRepair bool) ([]fsentry.CheckProblem, error) {
+	fullPath := filepath.Join(path, id+entryFileSuffix)
+
+	data, err := s.fs.ReadFile(fullPath)
+	if err != nil {
+		return nil, err
+	}
+
+	problems, fixedJSON, err := utils.CheckMeta(data, id, s.now().UTC(), s.isPretty)
+	if err != nil {
+		return nil, err
+	}
+	for i := range problems {
+		problems[i].Name = id + entryFileSuffix
+	}
+	if !isRepair || fixedJSON == nil {
+		return problems, nil
+	}
+
+	err = s.fs.UpdateFile(fullPath, fixedJSON)
+	if err != nil {
+		return nil, err
+	}
+	for i := range problems {
+		problems[i].IsRepaired = true
+	}
+	return problems, nil
+}
+
+// update rewrites the data of the entry and increases its revision. If expectedRevision is set,
+// the stored revision must be equal to it.
+func (s Service) update(path, name string, data interface{}, expectedRevision *uint64) (*fsentry.Entry, error) {
+	// Prepare a custom payload and convert it to a json byte slice.
+	dataJSON, err := utils.StructToJSON(data, s.isPretty)
+	if err != nil {
+		return nil, err
+	}
+	return s.updateData(path, name, func(json.RawMessage) (json.RawMessage, error) {
+		return dataJSON, nil
+	}, expectedRevision)
+}
+
+// updateData replaces the data of the entry with the result of fn, which gets the stored data.
+func (s Service) updateData(path, name string, fn func(data json.RawMessage) (json.RawMessage, error), expectedRevision *uint64) (*fsentry.Entry, error) {
 	oldExtEnt, err := s.Get(path, name)
 	if err != nil {
 		return nil, err
@@ -193,10 +388,12 @@ func (s Service) Update(path, name string, data interface{}) (*fsentry.Entry, er
 	if oldExtEnt == nil {
 		return nil, fsentry_error.ErrorInternal
 	}
+	if expectedRevision != nil && oldExtEnt.Revision != *expectedRevision {
+		return nil, fsentry_error.ErrorConflict
+	}
 	fullPath := filepath.Join(path, oldExtEnt.ID+entryFileSuffix)
 
-	// Prepare a custom payload and convert it to a json byte slice.
-	dataJSON, err := utils.StructToJSON(data, s.isPretty)
+	dataJSON, err := fn(oldExtEnt.Data)
 	if err != nil {
 		return nil, err
 	}
@@ -204,6 +401,7 @@ func (s Service) Update(path, name string, data interface{}) (*fsentry.Entry, er
 	inEnt := toInternalEntry(*oldExtEnt)
 	inEnt.Data = dataJSON
 	inEnt.UpdatedAt = utils.Allocate(s.now().UTC())
+	inEnt.Revision++
 
 	entJSON, err := utils.StructToJSON(inEnt, s.isPretty)
 	if err != nil {
@@ -218,34 +416,78 @@ func (s Service) Update(path, name string, data interface{}) (*fsentry.Entry, er
 	newExtEnt := toExternalEntry(inEnt)
 	return &newExtEnt, nil
 }
-func (s Service) Remove(path, name string) error {
-	// Check if it is possible to translate a name into a valid ID.
-	id := utils.NameToID(name)
-	if id == "" {
-		return fsentry_error.ErrorBadName
-	}
 
-	fullPath := filepath.Join(path, id+entryFileSuffix)
+// ChangeID renames the file of the entry to the new ID and keeps the name, the timestamps and the data.
+// It is used to migrate IDs to new rules.
+func (s Service) ChangeID(path, oldID, newID string) error {
+	oldFullPath := filepath.Join(path, oldID+entryFileSuffix)
+	newFullPath := filepath.Join(path, newID+entryFileSuffix)
 
-	return s.fs.RemoveFile(fullPath)
+	isExist, err := s.fs.IsFileExist(newFullPath)
+	if err != nil {
+		return err
+	}
+	if isExist {
+		return fsentry_error.ErrorExist
+	}
+
+	data, err := s.fs.ReadFile(oldFullPath)
+	if err != nil {
+		return err
+	}
+	inEnt, err := utils.JSONToStruct[InternalEntry](data)
+	if err != nil {
+		return err
+	}
+	inEnt.ID = newID
+	entJSON, err := utils.StructToJSON(*inEnt, s.isPretty)
+	if err != nil {
+		return err
+	}
+	return s.move(oldFullPath, newFullPath, entJSON)
 }
-func (s Service) Duplicate(path, oldName, newName string) (*fsentry.Entry, error) {
-	oldExtEnt, err := s.Get(path, oldName)
+
+// move renames the entry file and then writes the new content into it.
+func (s Service) move(oldFullPath, newFullPath string, newEntJSON []byte) error {
+	// The intent is written to the journal first, so if the process is killed
+	// between renaming and updating the data, the move will be finished on the next Init().
+	recordID, err := s.journal.Begin(journal.Record{
+		Operation: journal.OperationMove,
+		SrcPath:   oldFullPath,
+		DstPath:   newFullPath,
+		MetaPath:  newFullPath,
+		Meta:      newEntJSON,
+	})
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	// Check if the new entry name is a valid entry name.
-	newID := utils.NameToID(newName)
-	if newID == "" {
-		return nil, fsentry_error.ErrorBadName
+	// The operation of renaming a entry is cheaper and faster than updating file data,
+	// so we will first try moving the old entry to the new name.
+	err = s.fs.Rename(oldFullPath, newFullPath)
+	if err != nil {
+		s.commit(recordID)
+		return err
 	}
 
-	newFullPath := filepath.Join(path, newID+entryFileSuffix)
+	// If the entry has been successfully renamed, we attempt to update the data.
+	err = s.fs.UpdateFile(newFullPath, newEntJSON)
+	if err == nil {
+		s.commit(recordID)
+		return nil
+	}
 
-	return s.createRaw(newFullPath, newName, newID, oldExtEnt.Data)
+	// If our attempt to update the data file fails, we assume the data file has an old value,
+	// in which case we must rename it to the old name to keep the entry valid.
+	e := s.fs.Rename(newFullPath, oldFullPath)
+	if e != nil {
+		// The journal record is kept, so the move will be finished on the next Init().
+		log.Printf("error rename entry %q back after error update: %q", newFullPath, e.Error())
+		return fsentry_error.Wrap(err, e)
+	}
+	s.commit(recordID)
+	return err
 }
-
 func (s Service) createRaw(fullPath, name, id string, dataJSON json.RawMessage) (*fsentry.Entry, error) {
 	// Creating and filling in information about a new entry.
 	now := s.now().UTC()
@@ -254,6 +496,7 @@ func (s Service) createRaw(fullPath, name, id string, dataJSON json.RawMessage)
 		Name:      fsentry_types.QS(name),
 		CreatedAt: &now,
 		UpdatedAt: &now,
+		Revision:  1,
 		Data:      dataJSON,
 	}
 
@@ -271,3 +514,76 @@ func (s Service) createRaw(fullPath, name, id string, dataJSON json.RawMessage)
 	extEntry := toExternalEntry(inEntry)
 	return &extEntry, nil
 }
+
+// ResolveID returns the ID of the existing entry with the name.
+func (s Service) ResolveID(path, name string) (string, error) {
+	id, err := s.resolveID(path, name)
+	if err != nil {
+		return "", err
+	}
+	isExist, err := s.isExist(path, id)
+	if err != nil {
+		return "", err
+	}
+	if !isExist {
+		return "", fsentry_error.ErrorNotExist
+	}
+	return id, nil
+}
+
+// MigrateID returns the ID the object should have with the current rules of IDs.
+func (s Service) MigrateID(path, id, name string) (string, error) {
+	return s.naming.MigrateID(id, name, s.objects(path))
+}
+func (s Service) resolveID(path, name string) (string, error) {
+	return s.naming.ResolveID(name, s.objects(path))
+}
+func (s Service) newID(path, name string) (string, error) {
+	return s.naming.NewID(name, s.objects(path))
+}
+func (s Service) objects(path string) utils.Objects {
+	return utils.Objects{
+		IsExist: func(id string) (bool, error) {
+			return s.isExist(path, id)
+		},
+		GetName: func(id string) (string, error) {
+			return s.readName(filepath.Join(path, id+entryFileSuffix))
+		},
+		ListIDs: func(fn func(id string) bool) error {
+			return s.listIDs(path, fn)
+		},
+	}
+}
+
+// readName reads only the name of the entry, so looking for a name among many entries doesn't parse their data.
+func (s Service) readName(fullPath string) (string, error) {
+	r, err := fs.OpenFile(s.fs, fullPath)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	return utils.ReadName(r)
+}
+func (s Service) listIDs(path string, fn func(id string) bool) error {
+	err := s.fs.ListFunc(path, func(file os.DirEntry) error {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") || !strings.HasSuffix(file.Name(), entryFileSuffix) {
+			return nil
+		}
+		if !fn(strings.TrimSuffix(file.Name(), entryFileSuffix)) {
+			return fsentry.SkipAll
+		}
+		return nil
+	})
+	if errors.Is(err, fsentry.SkipAll) {
+		return nil
+	}
+	return err
+}
+func (s Service) isExist(path, id string) (bool, error) {
+	return s.fs.IsFileExist(filepath.Join(path, id+entryFileSuffix))
+}
+func (s Service) commit(recordID string) {
+	if err := s.journal.Commit(recordID); err != nil {
+		log.Printf("error commit journal record %q: %q", recordID, err.Error())
+	}
+}
@@ -7,6 +7,8 @@ import (
 	"testing"
 
 	fsStorage "github.com/HardDie/fsentry/internal/fs/storage"
+	journalService "github.com/HardDie/fsentry/internal/journal/service"
+	"github.com/HardDie/fsentry/internal/utils"
 	"github.com/HardDie/fsentry/pkg/fsentry"
 	"github.com/HardDie/fsentry/pkg/fsentry_error"
 )
@@ -19,7 +21,7 @@ func TestEntryCreate(t *testing.T) {
 		}
 		defer os.RemoveAll(dir)
 
-		s := New(fsStorage.New(), true)
+		s := New(fsStorage.New(), journalService.New(fsStorage.New(), dir), true, utils.Naming{})
 		_, err = s.Create(dir, "success", nil)
 		if err != nil {
 			t.Fatal(err)
@@ -36,7 +38,7 @@ func TestEntryGet(t *testing.T) {
 
 		name := "success"
 
-		s := New(fsStorage.New(), true)
+		s := New(fsStorage.New(), journalService.New(fsStorage.New(), dir), true, utils.Naming{})
 		ent, err := s.Create(dir, name, nil)
 		if err != nil {
 			t.Fatal(err)
@@ -63,7 +65,7 @@ func TestEntryMove(t *testing.T) {
 		oldName := "success"
 		newName := "success_moved"
 
-		s := New(fsStorage.New(), true)
+		s := New(fsStorage.New(), journalService.New(fsStorage.New(), dir), true, utils.Naming{})
 		info, err := s.Create(dir, oldName, nil)
 		if err != nil {
 			t.Fatal(err)
@@ -104,7 +106,7 @@ func TestEntryUpdate(t *testing.T) {
 
 		name := "success"
 
-		s := New(fsStorage.New(), true)
+		s := New(fsStorage.New(), journalService.New(fsStorage.New(), dir), true, utils.Naming{})
 		ent, err := s.Create(dir, name, []byte("hello world"))
 		if err != nil {
 			t.Fatal(err)
@@ -127,6 +129,98 @@ func TestEntryUpdate(t *testing.T) {
 		}
 	})
 }
+func TestEntryUpdateIf(t *testing.T) {
+	t.Run("revision", func(t *testing.T) {
+		dir, err := os.MkdirTemp("", "update_if_entry_revision")
+		if err != nil {
+			t.Fatal("error creating temp dir", err)
+		}
+		defer os.RemoveAll(dir)
+
+		s := New(fsStorage.New(), journalService.New(fsStorage.New(), dir), true, utils.Naming{})
+		obj, err := s.Create(dir, "success", []byte("hello world"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if obj.Revision != 1 {
+			t.Fatal("new entry must have revision 1, got", obj.Revision)
+		}
+
+		obj, err = s.UpdateIf(dir, "success", []byte("first writer"), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if obj.Revision != 2 {
+			t.Fatal("updated entry must have revision 2, got", obj.Revision)
+		}
+
+		// The second writer has read the entry before the first update.
+		_, err = s.UpdateIf(dir, "success", []byte("second writer"), 1)
+		if !errors.Is(err, fsentry_error.ErrorConflict) {
+			t.Fatal("expected conflict error, got", err)
+		}
+
+		obj, err = s.Move(dir, "success", "success_moved")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if obj.Revision != 2 {
+			t.Fatal("revision must survive move, got", obj.Revision)
+		}
+
+		obj, err = s.Duplicate(dir, "success_moved", "success_duplicate")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if obj.Revision != 1 {
+			t.Fatal("revision of duplicate must start from 1, got", obj.Revision)
+		}
+	})
+}
+func TestEntryPatch(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		dir, err := os.MkdirTemp("", "patch_entry_success")
+		if err != nil {
+			t.Fatal("error creating temp dir", err)
+		}
+		defer os.RemoveAll(dir)
+
+		s := New(fsStorage.New(), journalService.New(fsStorage.New(), dir), true, utils.Naming{})
+		_, err = s.Create(dir, "success", map[string]interface{}{"title": "old", "tags": []string{"a"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		obj, err := s.Patch(dir, "success", fsentry.MergePatch([]byte(`{"title":"new","count":1}`)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(obj.Data) != `{"count":1,"tags":["a"],"title":"new"}` || obj.Revision != 2 {
+			t.Fatal("bad data after merge patch", string(obj.Data), obj.Revision)
+		}
+
+		obj, err = s.Patch(dir, "success", fsentry.JSONPatch([]byte(`[{"op":"test","path":"/count","value":1},{"op":"add","path":"/tags/-","value":"b"}]`)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(obj.Data) != `{"count":1,"tags":["a","b"],"title":"new"}` || obj.Revision != 3 {
+			t.Fatal("bad data after json patch", string(obj.Data), obj.Revision)
+		}
+
+		// Nothing is changed if a test fails.
+		_, err = s.Patch(dir, "success", fsentry.JSONPatch([]byte(`[{"op":"remove","path":"/title"},{"op":"test","path":"/count","value":2}]`)))
+		if !errors.Is(err, fsentry_error.ErrorPatchTest) {
+			t.Fatal("expected patch test error, got", err)
+		}
+		obj, err = s.Get(dir, "success")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if obj.Revision != 3 {
+			t.Fatal("entry must not be changed, got revision", obj.Revision)
+		}
+	})
+}
 func TestEntryRemove(t *testing.T) {
 	t.Run("success", func(t *testing.T) {
 		dir, err := os.MkdirTemp("", "remove_entry_success")
@@ -137,7 +231,7 @@ func TestEntryRemove(t *testing.T) {
 
 		name := "success"
 
-		s := New(fsStorage.New(), true)
+		s := New(fsStorage.New(), journalService.New(fsStorage.New(), dir), true, utils.Naming{})
 		_, err = s.Create(dir, name, nil)
 		if err != nil {
 			t.Fatal(err)
@@ -160,7 +254,7 @@ func TestEntryDuplicate(t *testing.T) {
 		oldName := "success"
 		newName := "success_duplicate"
 
-		s := New(fsStorage.New(), true)
+		s := New(fsStorage.New(), journalService.New(fsStorage.New(), dir), true, utils.Naming{})
 		ent, err := s.Create(dir, oldName, []byte("some data"))
 		if err != nil {
 			t.Fatal(err)
@@ -0,0 +1,190 @@
+// Package flock implements advisory file locks, which allow several processes to share one root.
+//
+// Lock files are kept in the service folder of the root and are never removed: if a process removed a lock file
+// while another process was waiting for it, the next process would create a new file and both would hold the lock.
+// Files held with Hold are not waited for, so they can be removed after they are released.
+package flock
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/HardDie/fsentry/internal/utils"
+	"github.com/HardDie/fsentry/pkg/fsentry"
+	"github.com/HardDie/fsentry/pkg/fsentry_error"
+)
+
+const (
+	// LockFolder is a folder inside the service folder of the root, where lock files are created.
+	LockFolder = "lock"
+
+	createDirPerm  = 0755
+	createFilePerm = 0666
+	lockFileExt    = ".lock"
+
+	// retryMin and retryMax are bounds of the interval between attempts to take a busy lock.
+	retryMin = 5 * time.Millisecond
+	retryMax = 100 * time.Millisecond
+)
+
+type Locker struct {
+	root    string
+	mode    fsentry.FileLockMode
+	timeout time.Duration
+}
+
+// New returns a locker of the root. A zero timeout means that the lock is waited for without limit.
+func New(root string, mode fsentry.FileLockMode, timeout time.Duration) *Locker {
+	return &Locker{
+		root:    root,
+		mode:    mode,
+		timeout: timeout,
+	}
+}
+
+// IsEnabled reports whether the locker takes file locks.
+func (l *Locker) IsEnabled() bool {
+	return l != nil && l.mode != fsentry.FileLockNone
+}
+
+// Lock locks the folder shared or exclusive, and its parent folders shared. In FileLockRoot mode
+// the path is ignored and the whole root is locked.
+//
+// If the lock is not taken within the timeout, an error with fsentry_error.ErrorLockTimeout is returned,
+// and if the context is canceled while waiting, an error with fsentry_error.ErrorCanceled.
+func (l *Locker) Lock(ctx context.Context, isExclusive bool, path ...string) (unlock func(), err error) {
+	if !l.IsEnabled() {
+		return func() {}, nil
+	}
+	if l.mode == fsentry.FileLockRoot {
+		path = nil
+	}
+
+	dir := filepath.Join(l.root, utils.ServiceFolder, LockFolder)
+	err = os.MkdirAll(dir, createDirPerm)
+	if err != nil {
+		return nil, fsentry_error.Wrap(err, fsentry_error.ErrorInternal)
+	}
+
+	var deadline time.Time
+	if l.timeout > 0 {
+		deadline = time.Now().Add(l.timeout)
+	}
+
+	// Folders are always locked from the root down, so processes can't deadlock each other.
+	files := make([]*os.File, 0, len(path)+1)
+	unlock = func() {
+		for i := len(files) - 1; i >= 0; i-- {
+			// Closing the file releases the lock.
+			if err := files[i].Close(); err != nil {
+				log.Printf("Lock(): error close lock file %q: %s", files[i].Name(), err.Error())
+			}
+		}
+	}
+	for i := 0; i <= len(path); i++ {
+		file, err := lockFile(ctx, filepath.Join(dir, lockName(path[:i])), isExclusive && i == len(path), deadline)
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return unlock, nil
+}
+
+// Hold creates the file and locks it exclusively until release is called, so other processes can find out
+// with IsHeld that the process using the file is alive. The file must not exist.
+func (l *Locker) Hold(name string) (release func(), err error) {
+	if !l.IsEnabled() {
+		return func() {}, nil
+	}
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, createFilePerm)
+	if err != nil {
+		return nil, fsentry_error.Wrap(err, fsentry_error.ErrorInternal)
+	}
+	isLocked, err := tryLock(file, true)
+	if err == nil && !isLocked {
+		err = fmt.Errorf("file %q is busy", name)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fsentry_error.Wrap(err, fsentry_error.ErrorInternal)
+	}
+	return func() {
+		if err := file.Close(); err != nil {
+			log.Printf("Hold(): error close file %q: %s", name, err.Error())
+		}
+	}, nil
+}
+
+// IsHeld reports whether the file is held by Hold of this or another process. A missing file is not held.
+func (l *Locker) IsHeld(name string) (bool, error) {
+	if !l.IsEnabled() {
+		return false, nil
+	}
+	file, err := os.OpenFile(name, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fsentry_error.Wrap(err, fsentry_error.ErrorInternal)
+	}
+	// Closing the file releases the lock, if it was taken.
+	defer file.Close()
+	isLocked, err := tryLock(file, true)
+	if err != nil {
+		return false, fsentry_error.Wrap(err, fsentry_error.ErrorInternal)
+	}
+	return !isLocked, nil
+}
+
+// lockFile opens the lock file and tries to lock it until the deadline. A zero deadline means no limit.
+func lockFile(ctx context.Context, name string, isExclusive bool, deadline time.Time) (*os.File, error) {
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, createFilePerm)
+	if err != nil {
+		return nil, fsentry_error.Wrap(err, fsentry_error.ErrorInternal)
+	}
+
+	retry := retryMin
+	for {
+		isLocked, err := tryLock(file, isExclusive)
+		if err != nil {
+			file.Close()
+			return nil, fsentry_error.Wrap(err, fsentry_error.ErrorInternal)
+		}
+		if isLocked {
+			return file, nil
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			file.Close()
+			return nil, fsentry_error.Wrap(fmt.Errorf("lock file %q is busy", name), fsentry_error.ErrorLockTimeout)
+		}
+
+		timer := time.NewTimer(retry)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			file.Close()
+			return nil, utils.CheckContext(ctx)
+		}
+		retry *= 2
+		if retry > retryMax {
+			retry = retryMax
+		}
+	}
+}
+
+// lockName returns the name of the lock file of the folder. The name is a hash of the path,
+// so folders of any depth have lock files with short names in one folder.
+func lockName(path []string) string {
+	sum := sha1.Sum([]byte(strings.Join(path, "/")))
+	return hex.EncodeToString(sum[:]) + lockFileExt
+}
@@ -0,0 +1,30 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package flock
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// tryLock takes the flock lock of the file without waiting. It returns false if the lock is held by someone else.
+func tryLock(file *os.File, isExclusive bool) (bool, error) {
+	how := syscall.LOCK_SH
+	if isExclusive {
+		how = syscall.LOCK_EX
+	}
+	for {
+		err := syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+		switch {
+		case err == nil:
+			return true, nil
+		case errors.Is(err, syscall.EINTR):
+			continue
+		case errors.Is(err, syscall.EWOULDBLOCK):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+}
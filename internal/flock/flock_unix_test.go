@@ -0,0 +1,168 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package flock
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/HardDie/fsentry/pkg/fsentry"
+	"github.com/HardDie/fsentry/pkg/fsentry_error"
+)
+
+// Each Locker opens its own lock files, and flock locks of different open files conflict
+// like the locks of different processes.
+func TestLock(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+
+	t.Run("root exclusive", func(t *testing.T) {
+		root := t.TempDir()
+		unlock, err := New(root, fsentry.FileLockRoot, timeout).Lock(context.Background(), true, "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// In root mode any other lock must wait, even in another folder.
+		_, err = New(root, fsentry.FileLockRoot, timeout).Lock(context.Background(), false, "b")
+		if !errors.Is(err, fsentry_error.ErrorLockTimeout) {
+			t.Fatalf("expected timeout error, got %v", err)
+		}
+
+		unlock()
+		unlock, err = New(root, fsentry.FileLockRoot, timeout).Lock(context.Background(), true, "b")
+		if err != nil {
+			t.Fatal("lock after unlock:", err)
+		}
+		unlock()
+	})
+
+	t.Run("root shared", func(t *testing.T) {
+		root := t.TempDir()
+		unlock, err := New(root, fsentry.FileLockRoot, timeout).Lock(context.Background(), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer unlock()
+
+		unlock2, err := New(root, fsentry.FileLockRoot, timeout).Lock(context.Background(), false)
+		if err != nil {
+			t.Fatal("second shared lock:", err)
+		}
+		unlock2()
+	})
+
+	t.Run("folder siblings", func(t *testing.T) {
+		root := t.TempDir()
+		unlock, err := New(root, fsentry.FileLockFolder, timeout).Lock(context.Background(), true, "a", "b")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer unlock()
+
+		unlock2, err := New(root, fsentry.FileLockFolder, timeout).Lock(context.Background(), true, "a", "c")
+		if err != nil {
+			t.Fatal("sibling folder:", err)
+		}
+		unlock2()
+	})
+
+	t.Run("folder parent", func(t *testing.T) {
+		root := t.TempDir()
+		unlock, err := New(root, fsentry.FileLockFolder, timeout).Lock(context.Background(), true, "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer unlock()
+
+		_, err = New(root, fsentry.FileLockFolder, timeout).Lock(context.Background(), false, "a", "b")
+		if !errors.Is(err, fsentry_error.ErrorLockTimeout) {
+			t.Fatalf("expected timeout error, got %v", err)
+		}
+	})
+
+	t.Run("wait", func(t *testing.T) {
+		root := t.TempDir()
+		unlock, err := New(root, fsentry.FileLockRoot, 0).Lock(context.Background(), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.AfterFunc(timeout, unlock)
+
+		// Without timeout the lock is waited until it is released.
+		unlock, err = New(root, fsentry.FileLockRoot, 0).Lock(context.Background(), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		unlock()
+	})
+
+	t.Run("none", func(t *testing.T) {
+		root := t.TempDir()
+		unlock, err := New(root, fsentry.FileLockNone, timeout).Lock(context.Background(), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer unlock()
+
+		unlock2, err := New(root, fsentry.FileLockNone, timeout).Lock(context.Background(), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		unlock2()
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		root := t.TempDir()
+		unlock, err := New(root, fsentry.FileLockRoot, 0).Lock(context.Background(), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		_, err = New(root, fsentry.FileLockRoot, 0).Lock(ctx, true)
+		if !errors.Is(err, fsentry_error.ErrorCanceled) || !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected canceled error, got %v", err)
+		}
+	})
+}
+
+func TestHold(t *testing.T) {
+	root := t.TempDir()
+	name := filepath.Join(root, "held")
+	locker := New(root, fsentry.FileLockFolder, 0)
+
+	isHeld, err := locker.IsHeld(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isHeld {
+		t.Fatal("missing file must not be held")
+	}
+
+	release, err := locker.Hold(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Another locker acts like another process.
+	isHeld, err = New(root, fsentry.FileLockFolder, 0).IsHeld(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isHeld {
+		t.Fatal("file must be held")
+	}
+
+	release()
+	isHeld, err = New(root, fsentry.FileLockFolder, 0).IsHeld(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isHeld {
+		t.Fatal("released file must not be held")
+	}
+}
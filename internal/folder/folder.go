@@ -1,15 +1,29 @@
 package folder
 
 import (
+	"context"
+
 	"github.com/HardDie/fsentry/pkg/fsentry"
 )
 
 type Service interface {
+	ResolveID(path, name string) (string, error)
+	// ResolvePath returns the IDs of the folders for the segments of the path, which are IDs or names.
+	ResolvePath(root string, path []string) ([]string, error)
+	MigrateID(path, id, name string) (string, error)
+	ChangeID(path, oldID, newID string) error
 	Create(path, name string, data interface{}) (*fsentry.FolderInfo, error)
 	Get(path, name string) (*fsentry.FolderInfo, error)
+	GetByID(path, id string) (*fsentry.FolderInfo, error)
 	Move(path, oldName, newName string) (*fsentry.FolderInfo, error)
 	Update(path, name string, data interface{}) (*fsentry.FolderInfo, error)
+	UpdateIf(path, name string, data interface{}, expectedRevision uint64) (*fsentry.FolderInfo, error)
+	Patch(path, name string, patch fsentry.Patch) (*fsentry.FolderInfo, error)
 	Remove(path, name string) error
-	Duplicate(path, oldName, newName string) (*fsentry.FolderInfo, error)
+	// Duplicate stops copying the folder when the context is canceled.
+	Duplicate(ctx context.Context, path, oldName, newName string) (*fsentry.FolderInfo, error)
 	MoveWithoutTimestamp(path, oldName, newName string) (*fsentry.FolderInfo, error)
+	// Relocate stops copying the folder when the context is canceled.
+	Relocate(ctx context.Context, srcPath, srcName, dstPath, dstName string, opts fsentry.RelocateOptions) (*fsentry.FolderInfo, error)
+	Check(path, id string, isRepair bool) ([]fsentry.CheckProblem, error)
 }
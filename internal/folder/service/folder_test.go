@@ -1,12 +1,16 @@
 package service
 
 import (
+	"context"
 	"errors"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
 	fsStorage "github.com/HardDie/fsentry/internal/fs/storage"
+	journalService "github.com/HardDie/fsentry/internal/journal/service"
+	"github.com/HardDie/fsentry/internal/utils"
 	"github.com/HardDie/fsentry/pkg/fsentry"
 	"github.com/HardDie/fsentry/pkg/fsentry_error"
 )
@@ -19,7 +23,7 @@ func TestFolderCreate(t *testing.T) {
 		}
 		defer os.RemoveAll(dir)
 
-		s := New(fsStorage.New(), true)
+		s := New(fsStorage.New(), journalService.New(fsStorage.New(), dir), true, utils.Naming{})
 		_, err = s.Create(dir, "success", nil)
 		if err != nil {
 			t.Fatal(err)
@@ -36,7 +40,7 @@ func TestFolderGet(t *testing.T) {
 
 		name := "success"
 
-		s := New(fsStorage.New(), true)
+		s := New(fsStorage.New(), journalService.New(fsStorage.New(), dir), true, utils.Naming{})
 		info, err := s.Create(dir, name, nil)
 		if err != nil {
 			t.Fatal(err)
@@ -62,7 +66,7 @@ func TestFolderMove(t *testing.T) {
 		oldName := "success"
 		newName := "success_moved"
 
-		s := New(fsStorage.New(), true)
+		s := New(fsStorage.New(), journalService.New(fsStorage.New(), dir), true, utils.Naming{})
 		info, err := s.Create(dir, oldName, nil)
 		if err != nil {
 			t.Fatal(err)
@@ -103,7 +107,7 @@ func TestFolderUpdate(t *testing.T) {
 
 		name := "success"
 
-		s := New(fsStorage.New(), true)
+		s := New(fsStorage.New(), journalService.New(fsStorage.New(), dir), true, utils.Naming{})
 		info, err := s.Create(dir, name, []byte("hello world"))
 		if err != nil {
 			t.Fatal(err)
@@ -126,6 +130,98 @@ func TestFolderUpdate(t *testing.T) {
 		}
 	})
 }
+func TestFolderUpdateIf(t *testing.T) {
+	t.Run("revision", func(t *testing.T) {
+		dir, err := os.MkdirTemp("", "update_if_folder_revision")
+		if err != nil {
+			t.Fatal("error creating temp dir", err)
+		}
+		defer os.RemoveAll(dir)
+
+		s := New(fsStorage.New(), journalService.New(fsStorage.New(), dir), true, utils.Naming{})
+		obj, err := s.Create(dir, "success", []byte("hello world"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if obj.Revision != 1 {
+			t.Fatal("new folder must have revision 1, got", obj.Revision)
+		}
+
+		obj, err = s.UpdateIf(dir, "success", []byte("first writer"), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if obj.Revision != 2 {
+			t.Fatal("updated folder must have revision 2, got", obj.Revision)
+		}
+
+		// The second writer has read the folder before the first update.
+		_, err = s.UpdateIf(dir, "success", []byte("second writer"), 1)
+		if !errors.Is(err, fsentry_error.ErrorConflict) {
+			t.Fatal("expected conflict error, got", err)
+		}
+
+		obj, err = s.Move(dir, "success", "success_moved")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if obj.Revision != 2 {
+			t.Fatal("revision must survive move, got", obj.Revision)
+		}
+
+		obj, err = s.Duplicate(context.Background(), dir, "success_moved", "success_duplicate")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if obj.Revision != 1 {
+			t.Fatal("revision of duplicate must start from 1, got", obj.Revision)
+		}
+	})
+}
+func TestFolderPatch(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		dir, err := os.MkdirTemp("", "patch_folder_success")
+		if err != nil {
+			t.Fatal("error creating temp dir", err)
+		}
+		defer os.RemoveAll(dir)
+
+		s := New(fsStorage.New(), journalService.New(fsStorage.New(), dir), true, utils.Naming{})
+		_, err = s.Create(dir, "success", map[string]interface{}{"title": "old", "tags": []string{"a"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		obj, err := s.Patch(dir, "success", fsentry.MergePatch([]byte(`{"title":"new","count":1}`)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(obj.Data) != `{"count":1,"tags":["a"],"title":"new"}` || obj.Revision != 2 {
+			t.Fatal("bad data after merge patch", string(obj.Data), obj.Revision)
+		}
+
+		obj, err = s.Patch(dir, "success", fsentry.JSONPatch([]byte(`[{"op":"test","path":"/count","value":1},{"op":"add","path":"/tags/-","value":"b"}]`)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(obj.Data) != `{"count":1,"tags":["a","b"],"title":"new"}` || obj.Revision != 3 {
+			t.Fatal("bad data after json patch", string(obj.Data), obj.Revision)
+		}
+
+		// Nothing is changed if a test fails.
+		_, err = s.Patch(dir, "success", fsentry.JSONPatch([]byte(`[{"op":"remove","path":"/title"},{"op":"test","path":"/count","value":2}]`)))
+		if !errors.Is(err, fsentry_error.ErrorPatchTest) {
+			t.Fatal("expected patch test error, got", err)
+		}
+		obj, err = s.Get(dir, "success")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if obj.Revision != 3 {
+			t.Fatal("folder must not be changed, got revision", obj.Revision)
+		}
+	})
+}
 func TestFolderRemove(t *testing.T) {
 	t.Run("success", func(t *testing.T) {
 		dir, err := os.MkdirTemp("", "remove_folder_success")
@@ -136,7 +232,7 @@ func TestFolderRemove(t *testing.T) {
 
 		name := "success"
 
-		s := New(fsStorage.New(), true)
+		s := New(fsStorage.New(), journalService.New(fsStorage.New(), dir), true, utils.Naming{})
 		_, err = s.Create(dir, name, nil)
 		if err != nil {
 			t.Fatal(err)
@@ -159,13 +255,13 @@ func TestFolderDuplicate(t *testing.T) {
 		oldName := "success"
 		newName := "success_duplicate"
 
-		s := New(fsStorage.New(), true)
+		s := New(fsStorage.New(), journalService.New(fsStorage.New(), dir), true, utils.Naming{})
 		ent, err := s.Create(dir, oldName, []byte("some data"))
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		duplicateEnt, err := s.Duplicate(dir, oldName, newName)
+		duplicateEnt, err := s.Duplicate(context.Background(), dir, oldName, newName)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -185,7 +281,7 @@ func TestFolderMoveWithoutTimestamp(t *testing.T) {
 		oldName := "success"
 		newName := "success_moved"
 
-		s := New(fsStorage.New(), true)
+		s := New(fsStorage.New(), journalService.New(fsStorage.New(), dir), true, utils.Naming{})
 		info, err := s.Create(dir, oldName, nil)
 		if err != nil {
 			t.Fatal(err)
@@ -217,6 +313,103 @@ func TestFolderMoveWithoutTimestamp(t *testing.T) {
 	})
 }
 
+func TestFolderResolvePath(t *testing.T) {
+	dir, err := os.MkdirTemp("", "resolve_path_folder")
+	if err != nil {
+		t.Fatal("error creating temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := New(fsStorage.New(), journalService.New(fsStorage.New(), dir), true, utils.Naming{})
+	parent, err := s.Create(dir, "My Folder", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	child, err := s.Create(filepath.Join(dir, parent.ID), "Child", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		path []string
+		want []string
+	}{
+		{"ids", []string{parent.ID, child.ID}, []string{parent.ID, child.ID}},
+		{"names", []string{"My Folder", "Child"}, []string{parent.ID, child.ID}},
+		{"not exist", []string{"Not Exist", "Child"}, []string{"not_exist", "child"}},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ids, err := s.ResolvePath(dir, tc.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(ids, "/") != strings.Join(tc.want, "/") {
+				t.Fatalf("Expected %q, got %q", tc.want, ids)
+			}
+		})
+	}
+
+	for _, path := range [][]string{{".."}, {parent.ID, ".."}, {"/etc"}, {"a/b"}, {".fsentry"}, {"con"}, {""}, {"!!!"}} {
+		_, err = s.ResolvePath(dir, path)
+		if !errors.Is(err, fsentry_error.ErrorBadPath) {
+			t.Fatalf("Expected bad path error for %q, got %v", path, err)
+		}
+	}
+}
+func FuzzFolderResolvePath(f *testing.F) {
+	dir, err := os.MkdirTemp("", "fuzz_resolve_path_folder")
+	if err != nil {
+		f.Fatal("error creating temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := New(fsStorage.New(), journalService.New(fsStorage.New(), dir), true, utils.Naming{})
+	_, err = s.Create(dir, "My Folder", nil)
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	tests := [][2]string{
+		{"My Folder", ".."},
+		{"..", "my_folder"},
+		{"my_folder", "../../etc"},
+		{"/etc", "passwd"},
+		{"My Folder", "..\\..\\x"},
+		{".fsentry", "journal"},
+		{"con", "aux"},
+	}
+	for _, tc := range tests {
+		f.Add(tc[0], tc[1])
+	}
+
+	f.Fuzz(func(t *testing.T, first, second string) {
+		ids, err := s.ResolvePath(dir, []string{first, second})
+		if err != nil {
+			if !errors.Is(err, fsentry_error.ErrorBadPath) {
+				t.Fatalf("Expected bad path error for %q/%q, got %v", first, second, err)
+			}
+			return
+		}
+
+		// Resolved paths are always nested folders inside the root.
+		rel, err := filepath.Rel(dir, filepath.Join(append([]string{dir}, ids...)...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts := strings.Split(rel, string(filepath.Separator))
+		if len(parts) != 2 || strings.Join(parts, "/") != strings.Join(ids, "/") {
+			t.Fatalf("Path %q/%q escapes the root: %q", first, second, rel)
+		}
+		for _, id := range ids {
+			if !utils.IsValidID(id) {
+				t.Fatalf("Path %q/%q resolved to a bad ID %q", first, second, id)
+			}
+		}
+	})
+}
 func compareInfo(t *testing.T, got, want *fsentry.FolderInfo) bool {
 	if want == nil && got == nil {
 		return true
@@ -1,12 +1,19 @@
 package service
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/HardDie/fsentry/internal/fs"
+	"github.com/HardDie/fsentry/internal/journal"
+	"github.com/HardDie/fsentry/internal/jsonpatch"
 	"github.com/HardDie/fsentry/internal/utils"
 	"github.com/HardDie/fsentry/pkg/fsentry"
 	"github.com/HardDie/fsentry/pkg/fsentry_error"
@@ -22,6 +29,7 @@ type InternalInfo struct {
 	Name      fsentry_types.QuotedString `json:"name"`
 	CreatedAt *time.Time                 `json:"createdAt"`
 	UpdatedAt *time.Time                 `json:"updatedAt"`
+	Revision  uint64                     `json:"revision"`
 	Data      json.RawMessage            `json:"data"`
 }
 type UpdateInfoRequest struct {
@@ -30,6 +38,10 @@ type UpdateInfoRequest struct {
 	CreatedAt *time.Time       `json:"createdAt"`
 	UpdatedAt *time.Time       `json:"updatedAt"`
 	Data      *json.RawMessage `json:"data"`
+	// ExpectedRevision allows the update only if the stored revision is equal to it.
+	ExpectedRevision *uint64 `json:"-"`
+	// Patch is applied to the stored data, after Data if both are set.
+	Patch *fsentry.Patch `json:"-"`
 }
 
 func toInternalInfo(ext fsentry.FolderInfo) InternalInfo {
@@ -38,21 +50,23 @@ func toInternalInfo(ext fsentry.FolderInfo) InternalInfo {
 		Name:      fsentry_types.QS(ext.Name),
 		CreatedAt: &ext.CreatedAt,
 		UpdatedAt: &ext.UpdatedAt,
+		Revision:  ext.Revision,
 		Data:      ext.Data,
 	}
 }
 func toExternalInfo(in InternalInfo) fsentry.FolderInfo {
 	ext := fsentry.FolderInfo{
-		ID:   in.ID,
-		Name: in.Name.String(),
-		Data: in.Data,
+		ID:       in.ID,
+		Name:     in.Name.String(),
+		Revision: in.Revision,
+		Data:     in.Data,
 	}
 	if in.CreatedAt == nil {
 		now := time.Now().UTC()
 		in.CreatedAt = &now
 	}
 	ext.CreatedAt = *in.CreatedAt
-	if in.UpdatedAt != nil {
+	if in.UpdatedAt == nil {
 		in.UpdatedAt = in.CreatedAt
 	}
 	ext.UpdatedAt = *in.UpdatedAt
@@ -61,26 +75,32 @@ func toExternalInfo(in InternalInfo) fsentry.FolderInfo {
 
 type Service struct {
 	fs       fs.FS
+	journal  journal.Service
 	isPretty bool
+	naming   utils.Naming
 	now      func() time.Time
 }
 
 func New(
 	fs fs.FS,
+	journal journal.Service,
 	isPretty bool,
+	naming utils.Naming,
 ) Service {
 	return Service{
 		fs:       fs,
+		journal:  journal,
 		isPretty: isPretty,
+		naming:   naming,
 		now:      time.Now,
 	}
 }
 
 func (s Service) Create(path, name string, data interface{}) (*fsentry.FolderInfo, error) {
 	// Check if it is possible to translate a name into a valid ID.
-	id := utils.NameToID(name)
-	if id == "" {
-		return nil, fsentry_error.ErrorBadName
+	id, err := s.newID(path, name)
+	if err != nil {
+		return nil, err
 	}
 
 	// Prepare a custom payload and convert it to a json byte slice.
@@ -96,6 +116,7 @@ func (s Service) Create(path, name string, data interface{}) (*fsentry.FolderInf
 		Name:      fsentry_types.QS(name),
 		CreatedAt: &now,
 		UpdatedAt: &now,
+		Revision:  1,
 		Data:      dataJSON,
 	}
 
@@ -134,26 +155,32 @@ func (s Service) Create(path, name string, data interface{}) (*fsentry.FolderInf
 }
 func (s Service) Get(path, name string) (*fsentry.FolderInfo, error) {
 	// Check if it is possible to translate a name into a valid ID.
-	id := utils.NameToID(name)
-	if id == "" {
-		return nil, fsentry_error.ErrorBadName
+	id, err := s.resolveID(path, name)
+	if err != nil {
+		return nil, err
 	}
 
 	fullPath := filepath.Join(path, id)
 
 	return s.getInfo(fullPath)
 }
+
+func (s Service) GetByID(path, id string) (*fsentry.FolderInfo, error) {
+	fullPath := filepath.Join(path, id)
+
+	return s.getInfo(fullPath)
+}
 func (s Service) Move(path, oldName, newName string) (*fsentry.FolderInfo, error) {
 	// Check if the old folder name is a valid folder name.
-	oldID := utils.NameToID(oldName)
-	if oldID == "" {
-		return nil, fsentry_error.ErrorBadName
+	oldID, err := s.resolveID(path, oldName)
+	if err != nil {
+		return nil, err
 	}
 
 	// Check if the new folder name is a valid folder name.
-	newID := utils.NameToID(newName)
-	if newID == "" {
-		return nil, fsentry_error.ErrorBadName
+	newID, err := s.naming.RenameID(oldID, newName, s.objects(path))
+	if err != nil {
+		return nil, err
 	}
 
 	// newFullPath - path to the new folder to which the old one will be moved.
@@ -164,7 +191,7 @@ func (s Service) Move(path, oldName, newName string) (*fsentry.FolderInfo, error
 	if err != nil {
 		return nil, err
 	}
-	if isExist {
+	if isExist && newID != oldID {
 		return nil, fsentry_error.ErrorExist
 	}
 
@@ -176,14 +203,13 @@ func (s Service) Move(path, oldName, newName string) (*fsentry.FolderInfo, error
 		return nil, err
 	}
 
-	newInfoFilePath := filepath.Join(newFullPath, infoFileSuffix)
-
 	now := s.now().UTC()
 	newInInfo := InternalInfo{
 		ID:        newID,
 		Name:      fsentry_types.QS(newName),
 		CreatedAt: &oldExtInfo.CreatedAt,
 		UpdatedAt: &now,
+		Revision:  oldExtInfo.Revision,
 		Data:      oldExtInfo.Data,
 	}
 
@@ -192,35 +218,29 @@ func (s Service) Move(path, oldName, newName string) (*fsentry.FolderInfo, error
 		return nil, err
 	}
 
-	// The operation of renaming a folder is cheaper and faster than updating file data,
-	// so we will first try moving the old folder to the new name.
-	err = s.fs.Rename(oldFullPath, newFullPath)
+	err = s.move(oldFullPath, newFullPath, newInfoJSON)
 	if err != nil {
 		return nil, err
 	}
 
-	// If the folder has been successfully renamed, we attempt to update the meta info about the folder.
-	err = s.fs.UpdateFile(newInfoFilePath, newInfoJSON)
-	if err == nil {
-		// Good. Returns information about the renamed folder.
-		newExtInfo := toExternalInfo(newInInfo)
-		return &newExtInfo, nil
-	}
-
-	// If our attempt to update the meta info file fails, we assume the meta info file has an old value,
-	// in which case we must rename it to the old name to keep the folder valid.
-	err = s.fs.Rename(newFullPath, oldFullPath)
-	if err != nil {
-		return nil, err
-	}
-
-	return nil, nil
+	// Good. Returns information about the renamed folder.
+	newExtInfo := toExternalInfo(newInInfo)
+	return &newExtInfo, nil
 }
 func (s Service) Update(path, name string, data interface{}) (*fsentry.FolderInfo, error) {
+	return s.update(path, name, data, nil)
+}
+
+// UpdateIf updates the folder only if its stored revision is equal to the expected one,
+// otherwise fsentry_error.ErrorConflict is returned.
+func (s Service) UpdateIf(path, name string, data interface{}, expectedRevision uint64) (*fsentry.FolderInfo, error) {
+	return s.update(path, name, data, &expectedRevision)
+}
+func (s Service) update(path, name string, data interface{}, expectedRevision *uint64) (*fsentry.FolderInfo, error) {
 	// Check if it is possible to translate a name into a valid ID.
-	id := utils.NameToID(name)
-	if id == "" {
-		return nil, fsentry_error.ErrorBadName
+	id, err := s.resolveID(path, name)
+	if err != nil {
+		return nil, err
 	}
 
 	// Prepare a custom payload and convert it to a json byte slice.
@@ -232,8 +252,9 @@ func (s Service) Update(path, name string, data interface{}) (*fsentry.FolderInf
 	fullPath := filepath.Join(path, id)
 
 	extInfo, err := s.updateInfo(fullPath, UpdateInfoRequest{
-		Data:      utils.Allocate[json.RawMessage](dataJSON),
-		UpdatedAt: utils.Allocate(s.now().UTC()),
+		Data:             utils.Allocate[json.RawMessage](dataJSON),
+		UpdatedAt:        utils.Allocate(s.now().UTC()),
+		ExpectedRevision: expectedRevision,
 	})
 	if err != nil {
 		return nil, err
@@ -241,11 +262,27 @@ func (s Service) Update(path, name string, data interface{}) (*fsentry.FolderInf
 
 	return extInfo, nil
 }
+
+// Patch applies the patch to the stored data of the folder.
+func (s Service) Patch(path, name string, patch fsentry.Patch) (*fsentry.FolderInfo, error) {
+	// Check if it is possible to translate a name into a valid ID.
+	id, err := s.resolveID(path, name)
+	if err != nil {
+		return nil, err
+	}
+
+	fullPath := filepath.Join(path, id)
+
+	return s.updateInfo(fullPath, UpdateInfoRequest{
+		UpdatedAt: utils.Allocate(s.now().UTC()),
+		Patch:     &patch,
+	})
+}
 func (s Service) Remove(path, name string) error {
 	// Check if it is possible to translate a name into a valid ID.
-	id := utils.NameToID(name)
-	if id == "" {
-		return fsentry_error.ErrorBadName
+	id, err := s.resolveID(path, name)
+	if err != nil {
+		return err
 	}
 
 	fullPath := filepath.Join(path, id)
@@ -266,19 +303,19 @@ func (s Service) Remove(path, name string) error {
 		return fsentry_error.ErrorFolderCorrupted
 	}
 
-	return s.fs.RemoveFolder(fullPath)
+	return s.remove(path, fullPath)
 }
-func (s Service) Duplicate(path, oldName, newName string) (*fsentry.FolderInfo, error) {
+func (s Service) Duplicate(ctx context.Context, path, oldName, newName string) (*fsentry.FolderInfo, error) {
 	// Check if the old folder name is a valid folder name.
-	oldID := utils.NameToID(oldName)
-	if oldID == "" {
-		return nil, fsentry_error.ErrorBadName
+	oldID, err := s.resolveID(path, oldName)
+	if err != nil {
+		return nil, err
 	}
 
 	// Check if the new folder name is a valid folder name.
-	newID := utils.NameToID(newName)
-	if newID == "" {
-		return nil, fsentry_error.ErrorBadName
+	newID, err := s.newID(path, newName)
+	if err != nil {
+		return nil, err
 	}
 
 	// newFullPath - path to the new folder to which the old one will be moved.
@@ -307,6 +344,7 @@ func (s Service) Duplicate(path, oldName, newName string) (*fsentry.FolderInfo,
 		Name:      fsentry_types.QS(newName),
 		CreatedAt: &now,
 		UpdatedAt: &now,
+		Revision:  1,
 		Data:      oldExtInfo.Data,
 	}
 
@@ -315,39 +353,25 @@ func (s Service) Duplicate(path, oldName, newName string) (*fsentry.FolderInfo,
 		return nil, err
 	}
 
-	newInfoFilePath := filepath.Join(newFullPath, infoFileSuffix)
-
-	err = s.fs.CopyFolder(oldFullPath, newFullPath)
+	err = s.duplicate(ctx, path, oldFullPath, newFullPath, newInfoJSON)
 	if err != nil {
-		// Clean up if attempt was unsuccessful
-		if e := s.fs.RemoveFolder(newFullPath); e != nil {
-			log.Printf("error remove invalid folder %q after error copy: %q", newFullPath, e.Error())
-		}
 		return nil, err
 	}
 
-	err = s.fs.UpdateFile(newInfoFilePath, newInfoJSON)
-	if err != nil {
-		// Clean up if attempt was unsuccessful
-		if e := s.fs.RemoveFolder(newFullPath); e != nil {
-			log.Printf("error remove invalid folder %q after error info update: %q", newFullPath, e.Error())
-		}
-		return nil, err
-	}
 	newExtInfo := toExternalInfo(newInInfo)
 	return &newExtInfo, nil
 }
 func (s Service) MoveWithoutTimestamp(path, oldName, newName string) (*fsentry.FolderInfo, error) {
 	// Check if the old folder name is a valid folder name.
-	oldID := utils.NameToID(oldName)
-	if oldID == "" {
-		return nil, fsentry_error.ErrorBadName
+	oldID, err := s.resolveID(path, oldName)
+	if err != nil {
+		return nil, err
 	}
 
 	// Check if the new folder name is a valid folder name.
-	newID := utils.NameToID(newName)
-	if newID == "" {
-		return nil, fsentry_error.ErrorBadName
+	newID, err := s.naming.RenameID(oldID, newName, s.objects(path))
+	if err != nil {
+		return nil, err
 	}
 
 	// newFullPath - path to the new folder to which the old one will be moved.
@@ -358,7 +382,7 @@ func (s Service) MoveWithoutTimestamp(path, oldName, newName string) (*fsentry.F
 	if err != nil {
 		return nil, err
 	}
-	if isExist {
+	if isExist && newID != oldID {
 		return nil, fsentry_error.ErrorExist
 	}
 
@@ -370,13 +394,12 @@ func (s Service) MoveWithoutTimestamp(path, oldName, newName string) (*fsentry.F
 		return nil, err
 	}
 
-	newInfoFilePath := filepath.Join(newFullPath, infoFileSuffix)
-
 	newInInfo := InternalInfo{
 		ID:        newID,
 		Name:      fsentry_types.QS(newName),
 		CreatedAt: &oldExtInfo.CreatedAt,
 		UpdatedAt: &oldExtInfo.UpdatedAt,
+		Revision:  oldExtInfo.Revision,
 		Data:      oldExtInfo.Data,
 	}
 
@@ -385,31 +408,482 @@ func (s Service) MoveWithoutTimestamp(path, oldName, newName string) (*fsentry.F
 		return nil, err
 	}
 
+	err = s.move(oldFullPath, newFullPath, newInfoJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	// Good. Returns information about the renamed folder.
+	newExtInfo := toExternalInfo(newInInfo)
+	return &newExtInfo, nil
+}
+
+// ChangeID renames the folder to the new ID and keeps the name, the timestamps and the data.
+// It is used to migrate IDs to new rules.
+func (s Service) ChangeID(path, oldID, newID string) error {
+	oldFullPath := filepath.Join(path, oldID)
+	newFullPath := filepath.Join(path, newID)
+
+	isExist, err := s.fs.IsFolderExist(newFullPath)
+	if err != nil {
+		return err
+	}
+	if isExist {
+		return fsentry_error.ErrorExist
+	}
+
+	extInfo, err := s.getInfo(oldFullPath)
+	if err != nil {
+		return err
+	}
+	inInfo := InternalInfo{
+		ID:        newID,
+		Name:      fsentry_types.QS(extInfo.Name),
+		CreatedAt: &extInfo.CreatedAt,
+		UpdatedAt: &extInfo.UpdatedAt,
+		Revision:  extInfo.Revision,
+		Data:      extInfo.Data,
+	}
+	infoJSON, err := utils.StructToJSON(inInfo, s.isPretty)
+	if err != nil {
+		return err
+	}
+	return s.move(oldFullPath, newFullPath, infoJSON)
+}
+
+// Relocate moves or copies the folder with all its content into another folder. The changes are prepared
+// in a hidden folder inside the destination folder and then applied with renames under a journal record,
+// so if a rename fails or the process is killed, the source and the destination are restored.
+func (s Service) Relocate(ctx context.Context, srcPath, srcName, dstPath, dstName string, opts fsentry.RelocateOptions) (*fsentry.FolderInfo, error) {
+	srcID, err := s.resolveID(srcPath, srcName)
+	if err != nil {
+		return nil, err
+	}
+	dstID, err := s.newID(dstPath, dstName)
+	if err != nil {
+		return nil, err
+	}
+
+	srcFullPath := filepath.Join(srcPath, srcID)
+	dstFullPath := filepath.Join(dstPath, dstID)
+	if srcFullPath == dstFullPath {
+		return nil, fsentry_error.ErrorExist
+	}
+	// A folder can't be placed inside itself.
+	if strings.HasPrefix(dstFullPath, srcFullPath+string(filepath.Separator)) {
+		return nil, fsentry_error.ErrorBadPath
+	}
+
+	oldExtInfo, err := s.getInfo(srcFullPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check if the name of the new folder is not occupied by an existing folder.
+	isExist, err := s.fs.IsFolderExist(dstFullPath)
+	if err != nil {
+		return nil, err
+	}
+	if isExist && !opts.Overwrite {
+		return nil, fsentry_error.ErrorExist
+	}
+
+	// A moved folder keeps its history, a copy is a new folder.
+	now := s.now().UTC()
+	newInInfo := InternalInfo{
+		ID:        dstID,
+		Name:      fsentry_types.QS(dstName),
+		CreatedAt: &oldExtInfo.CreatedAt,
+		UpdatedAt: &now,
+		Revision:  oldExtInfo.Revision,
+		Data:      oldExtInfo.Data,
+	}
+	if opts.Copy {
+		newInInfo.CreatedAt = &now
+		newInInfo.Revision = 1
+	}
+	newInfoJSON, err := utils.StructToJSON(newInInfo, s.isPretty)
+	if err != nil {
+		return nil, err
+	}
+
+	suffix, err := utils.RandomHex(8)
+	if err != nil {
+		return nil, err
+	}
+	tmpFullPath := filepath.Join(dstPath, utils.RelocateFolderPrefix+suffix)
+	err = s.fs.CreateFolder(tmpFullPath)
+	if err != nil {
+		return nil, err
+	}
+
+	steps, err := s.prepareRelocate(ctx, srcFullPath, tmpFullPath, newInfoJSON, opts.Copy)
+	if err != nil {
+		if e := s.fs.RemoveFolder(tmpFullPath); e != nil {
+			log.Printf("error remove temporary folder %q after error relocate: %q", tmpFullPath, e.Error())
+		}
+		return nil, err
+	}
+	if isExist {
+		steps = append(steps, journal.Step{SrcPath: dstFullPath, DstPath: filepath.Join(tmpFullPath, "dst")})
+	}
+	steps = append(steps, journal.Step{SrcPath: filepath.Join(tmpFullPath, "new"), DstPath: dstFullPath})
+
+	err = s.journal.Apply(journal.Record{
+		Operation: journal.OperationRelocate,
+		SrcPath:   srcFullPath,
+		DstPath:   dstFullPath,
+		TmpPath:   tmpFullPath,
+		Steps:     steps,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	newExtInfo := toExternalInfo(newInInfo)
+	return &newExtInfo, nil
+}
+func (s Service) Check(path, id string, isRepair bool) ([]fsentry.CheckProblem, error) {
+	infoFilePath := filepath.Join(path, id, infoFileSuffix)
+
+	data, err := s.fs.ReadFile(infoFilePath)
+	if errors.Is(err, fsentry_error.ErrorNotExist) {
+		problem := fsentry.CheckProblem{
+			Kind:    fsentry.ProblemMissingInfo,
+			Name:    id,
+			Message: "folder has no " + infoFileSuffix + " file",
+		}
+		if !isRepair {
+			return []fsentry.CheckProblem{problem}, nil
+		}
+
+		// Restore the meta info, the original name is lost, so the ID is used instead.
+		now := s.now().UTC()
+		infoJSON, err := utils.StructToJSON(InternalInfo{
+			ID:        id,
+			Name:      fsentry_types.QS(id),
+			CreatedAt: &now,
+			UpdatedAt: &now,
+			Revision:  1,
+			Data:      json.RawMessage("null"),
+		}, s.isPretty)
+		if err != nil {
+			return nil, err
+		}
+		err = s.fs.CreateFile(infoFilePath, infoJSON)
+		if err != nil {
+			return nil, err
+		}
+		problem.IsRepaired = true
+		return []fsentry.CheckProblem{problem}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	problems, fixedJSON, err := utils.CheckMeta(data, id, s.now().UTC(), s.isPretty)
+	if err != nil {
+		return nil, err
+	}
+	for i := range problems {
+		problems[i].Name = id
+	}
+	if !isRepair || fixedJSON == nil {
+		return problems, nil
+	}
+
+	err = s.fs.UpdateFile(infoFilePath, fixedJSON)
+	if err != nil {
+		return nil, err
+	}
+	for i := range problems {
+		problems[i].IsRepaired = true
+	}
+	return problems, nil
+}
+
+// move renames the folder and then rewrites its meta info. The intent is written to the journal first,
+// so if the process is killed between these steps, the operation will be finished on the next Init().
+func (s Service) move(oldFullPath, newFullPath string, newInfoJSON []byte) error {
+	newInfoFilePath := filepath.Join(newFullPath, infoFileSuffix)
+	if oldFullPath == newFullPath {
+		// The folder keeps its ID, only the name is updated.
+		return s.fs.UpdateFile(newInfoFilePath, newInfoJSON)
+	}
+
+	recordID, err := s.journal.Begin(journal.Record{
+		Operation: journal.OperationMove,
+		SrcPath:   oldFullPath,
+		DstPath:   newFullPath,
+		MetaPath:  newInfoFilePath,
+		Meta:      newInfoJSON,
+	})
+	if err != nil {
+		return err
+	}
+
 	// The operation of renaming a folder is cheaper and faster than updating file data,
 	// so we will first try moving the old folder to the new name.
 	err = s.fs.Rename(oldFullPath, newFullPath)
 	if err != nil {
-		return nil, err
+		s.commit(recordID)
+		return err
 	}
 
 	// If the folder has been successfully renamed, we attempt to update the meta info about the folder.
 	err = s.fs.UpdateFile(newInfoFilePath, newInfoJSON)
 	if err == nil {
-		// Good. Returns information about the renamed folder.
-		newExtInfo := toExternalInfo(newInInfo)
-		return &newExtInfo, nil
+		s.commit(recordID)
+		return nil
 	}
 
 	// If our attempt to update the meta info file fails, we assume the meta info file has an old value,
 	// in which case we must rename it to the old name to keep the folder valid.
-	err = s.fs.Rename(newFullPath, oldFullPath)
+	e := s.fs.Rename(newFullPath, oldFullPath)
+	if e != nil {
+		// The journal record is kept, so the move will be finished on the next Init().
+		log.Printf("error rename folder %q back after error info update: %q", newFullPath, e.Error())
+		return fsentry_error.Wrap(err, e)
+	}
+	s.commit(recordID)
+	return err
+}
+
+// duplicate copies the folder into a hidden temporary folder, updates the meta info of the copy
+// and only then renames it to the new name, so an unfinished copy is never visible.
+// If the process is killed in the middle, the temporary folder will be removed on the next Init(),
+// and if the context is canceled, it is removed right away.
+func (s Service) duplicate(ctx context.Context, path, oldFullPath, newFullPath string, newInfoJSON []byte) error {
+	suffix, err := utils.RandomHex(8)
+	if err != nil {
+		return err
+	}
+	tmpFullPath := filepath.Join(path, utils.DuplicateFolderPrefix+suffix)
+
+	recordID, err := s.journal.Begin(journal.Record{
+		Operation: journal.OperationDuplicate,
+		SrcPath:   oldFullPath,
+		DstPath:   newFullPath,
+		TmpPath:   tmpFullPath,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = fs.CopyFolder(ctx, s.fs, oldFullPath, tmpFullPath)
+	if err == nil {
+		err = s.fs.UpdateFile(filepath.Join(tmpFullPath, infoFileSuffix), newInfoJSON)
+	}
+	if err == nil {
+		// The last chance to cancel, after renaming the copy is visible.
+		err = utils.CheckContext(ctx)
+	}
+	if err == nil {
+		err = s.fs.Rename(tmpFullPath, newFullPath)
+	}
+	if err != nil {
+		// Clean up if attempt was unsuccessful
+		if e := s.fs.RemoveFolder(tmpFullPath); e != nil {
+			// The journal record is kept, so the folder will be removed on the next Init().
+			log.Printf("error remove invalid folder %q after error duplicate: %q", tmpFullPath, e.Error())
+			return err
+		}
+		s.commit(recordID)
+		return err
+	}
+
+	s.commit(recordID)
+	return nil
+}
+
+// prepareRelocate prepares the new folder in tmpFullPath/new and returns the steps to put it there.
+// A copy is made right away, and a moved folder is renamed into the temporary folder by the steps,
+// with its meta info replaced by renames too, so undoing the steps restores the old meta info.
+func (s Service) prepareRelocate(ctx context.Context, srcFullPath, tmpFullPath string, newInfoJSON []byte, isCopy bool) ([]journal.Step, error) {
+	newFullPath := filepath.Join(tmpFullPath, "new")
+	if isCopy {
+		err := fs.CopyFolder(ctx, s.fs, srcFullPath, newFullPath)
+		if err != nil {
+			return nil, err
+		}
+		err = s.fs.UpdateFile(filepath.Join(newFullPath, infoFileSuffix), newInfoJSON)
+		if err != nil {
+			return nil, err
+		}
+		// The last chance to cancel, after the steps the copy is visible.
+		return nil, utils.CheckContext(ctx)
+	}
+
+	newInfoFilePath := filepath.Join(tmpFullPath, "info")
+	err := s.fs.CreateFile(newInfoFilePath, newInfoJSON)
 	if err != nil {
 		return nil, err
 	}
+	return []journal.Step{
+		{SrcPath: srcFullPath, DstPath: newFullPath},
+		{SrcPath: filepath.Join(newFullPath, infoFileSuffix), DstPath: filepath.Join(tmpFullPath, "info-old")},
+		{SrcPath: newInfoFilePath, DstPath: filepath.Join(newFullPath, infoFileSuffix)},
+	}, nil
+}
+
+// remove renames the folder to a hidden temporary name and then removes it, so a partially removed folder
+// is never visible. If the process is killed in the middle, removing will be finished on the next Init().
+func (s Service) remove(path, fullPath string) error {
+	suffix, err := utils.RandomHex(8)
+	if err != nil {
+		return err
+	}
+	tmpFullPath := filepath.Join(path, utils.RemoveFolderPrefix+suffix)
+
+	recordID, err := s.journal.Begin(journal.Record{
+		Operation: journal.OperationRemove,
+		SrcPath:   fullPath,
+		TmpPath:   tmpFullPath,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = s.fs.Rename(fullPath, tmpFullPath)
+	if err != nil {
+		s.commit(recordID)
+		return err
+	}
+
+	err = s.fs.RemoveFolder(tmpFullPath)
+	if err != nil {
+		// The folder is already hidden, and the journal record is kept,
+		// so removing will be finished on the next Init().
+		log.Printf("error remove folder %q: %q", tmpFullPath, err.Error())
+		return nil
+	}
+
+	s.commit(recordID)
+	return nil
+}
+
+// ResolveID returns the ID of the existing folder with the name.
+func (s Service) ResolveID(path, name string) (string, error) {
+	id, err := s.resolveID(path, name)
+	if err != nil {
+		return "", err
+	}
+	isExist, err := s.isExist(path, id)
+	if err != nil {
+		return "", err
+	}
+	if !isExist {
+		return "", fsentry_error.ErrorNotExist
+	}
+	return id, nil
+}
 
-	return nil, nil
+// ResolvePath returns the IDs of the nested folders inside root for the segments of the path.
+// A segment is the ID or the name of a folder, an existing ID is preferred, so paths of IDs always work.
+// Segments that could point outside of their parent folder are an ErrorBadPath.
+//
+// Segments of missing folders are converted to IDs without reading the storage, so the operation
+// with the path fails like before.
+func (s Service) ResolvePath(root string, path []string) ([]string, error) {
+	ids := make([]string, 0, len(path))
+	fullPath := root
+	isFound := true
+	for _, segment := range path {
+		err := utils.CheckPathSegment(segment)
+		if err != nil {
+			return nil, err
+		}
+		id := segment
+		if isFound {
+			id, isFound, err = s.resolveSegment(fullPath, segment)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if !isFound && !utils.IsValidID(id) {
+			id = s.naming.NameToID(segment)
+			if id == "" {
+				return nil, fsentry_error.Wrap(fmt.Errorf("path segment %q", segment), fsentry_error.ErrorBadPath)
+			}
+		}
+		ids = append(ids, id)
+		fullPath = filepath.Join(fullPath, id)
+	}
+	return ids, nil
+}
+func (s Service) resolveSegment(path, segment string) (string, bool, error) {
+	if utils.IsValidID(segment) {
+		isExist, err := s.isExist(path, segment)
+		if err != nil || isExist {
+			return segment, isExist, err
+		}
+	}
+	id, err := s.ResolveID(path, segment)
+	if errors.Is(err, fsentry_error.ErrorNotExist) || errors.Is(err, fsentry_error.ErrorBadName) {
+		return segment, false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return id, true, nil
 }
 
+// MigrateID returns the ID the object should have with the current rules of IDs.
+func (s Service) MigrateID(path, id, name string) (string, error) {
+	return s.naming.MigrateID(id, name, s.objects(path))
+}
+func (s Service) resolveID(path, name string) (string, error) {
+	return s.naming.ResolveID(name, s.objects(path))
+}
+func (s Service) newID(path, name string) (string, error) {
+	return s.naming.NewID(name, s.objects(path))
+}
+func (s Service) objects(path string) utils.Objects {
+	return utils.Objects{
+		IsExist: func(id string) (bool, error) {
+			return s.isExist(path, id)
+		},
+		GetName: func(id string) (string, error) {
+			return s.readName(filepath.Join(path, id, infoFileSuffix))
+		},
+		ListIDs: func(fn func(id string) bool) error {
+			return s.listIDs(path, fn)
+		},
+	}
+}
+
+// readName reads only the name of the folder, so looking for a name among many folders doesn't parse their data.
+func (s Service) readName(infoFilePath string) (string, error) {
+	r, err := fs.OpenFile(s.fs, infoFilePath)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	return utils.ReadName(r)
+}
+func (s Service) listIDs(path string, fn func(id string) bool) error {
+	err := s.fs.ListFunc(path, func(file os.DirEntry) error {
+		if !file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+			return nil
+		}
+		if !fn(file.Name()) {
+			return fsentry.SkipAll
+		}
+		return nil
+	})
+	if errors.Is(err, fsentry.SkipAll) {
+		return nil
+	}
+	return err
+}
+func (s Service) isExist(path, id string) (bool, error) {
+	return s.fs.IsFolderExist(filepath.Join(path, id))
+}
+func (s Service) commit(recordID string) {
+	if err := s.journal.Commit(recordID); err != nil {
+		log.Printf("error commit journal record %q: %q", recordID, err.Error())
+	}
+}
 func (s Service) getInfo(fullPath string) (*fsentry.FolderInfo, error) {
 	infoFilePath := filepath.Join(fullPath, infoFileSuffix)
 
@@ -439,7 +913,12 @@ func (s Service) updateInfo(fullPath string, req UpdateInfoRequest) (*fsentry.Fo
 		log.Println("extInfo is nil")
 		return nil, fsentry_error.ErrorInternal
 	}
+	if req.ExpectedRevision != nil && oldExtInfo.Revision != *req.ExpectedRevision {
+		return nil, fsentry_error.ErrorConflict
+	}
 	inInfo := toInternalInfo(*oldExtInfo)
+	// Every change of the meta info is a new revision.
+	inInfo.Revision++
 
 	if req.ID != nil {
 		inInfo.ID = *req.ID
@@ -456,6 +935,12 @@ func (s Service) updateInfo(fullPath string, req UpdateInfoRequest) (*fsentry.Fo
 	if req.Data != nil {
 		inInfo.Data = *req.Data
 	}
+	if req.Patch != nil {
+		inInfo.Data, err = jsonpatch.Apply(inInfo.Data, *req.Patch)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	infoJSON, err := utils.StructToJSON(inInfo, s.isPretty)
 	if err != nil {
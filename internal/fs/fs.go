@@ -1,18 +1,94 @@
 package fs
 
-import "os"
-
-type FS interface {
-	CreateFile(path string, data []byte) error
-	ReadFile(path string) ([]byte, error)
-	UpdateFile(path string, data []byte) error
-	RemoveFile(path string) error
-	CreateFolder(path string) error
-	CreateAllFolder(path string) error
-	RemoveFolder(path string) error
-	Rename(oldPath, newPath string) error
-	CopyFolder(srcPath, dstPath string) error
-	List(path string) ([]os.FileInfo, error)
-	IsFileExist(path string) (isExist bool, err error)
-	IsFolderExist(path string) (isExist bool, err error)
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"github.com/HardDie/fsentry/internal/utils"
+	"github.com/HardDie/fsentry/pkg/fsentry_storage"
+)
+
+// FS is the storage backend used by all services, the public interface is used, so that
+// backends implemented outside the module can be passed in.
+type FS = fsentry_storage.Storage
+
+// CopyFolder copies the folder and stops when the context is canceled, if the storage supports it.
+func CopyFolder(ctx context.Context, fs FS, srcPath, dstPath string) error {
+	err := utils.CheckContext(ctx)
+	if err != nil {
+		return err
+	}
+	if copier, ok := fs.(fsentry_storage.ContextCopier); ok {
+		return copier.CopyFolderContext(ctx, srcPath, dstPath)
+	}
+	return fs.CopyFolder(srcPath, dstPath)
+}
+
+// OpenFile opens the file for reading. If the storage does not support streaming, the whole file is read into memory.
+func OpenFile(fs FS, path string) (io.ReadSeekCloser, error) {
+	if streamer, ok := fs.(fsentry_storage.FileStreamer); ok {
+		return streamer.OpenFile(path)
+	}
+	data, err := fs.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return nopCloser{bytes.NewReader(data)}, nil
+}
+
+// CreateFileFrom creates the file with the data from the reader.
+// If the storage does not support streaming, the whole data is read into memory first.
+func CreateFileFrom(fs FS, path string, r io.Reader) error {
+	if streamer, ok := fs.(fsentry_storage.FileStreamer); ok {
+		return streamer.CreateFileFrom(path, r)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return fs.CreateFile(path, data)
+}
+
+// UpdateFileFrom replaces the content of the file with the data from the reader.
+// If the storage does not support streaming, the whole data is read into memory first.
+func UpdateFileFrom(fs FS, path string, r io.Reader) error {
+	if streamer, ok := fs.(fsentry_storage.FileStreamer); ok {
+		return streamer.UpdateFileFrom(path, r)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return fs.UpdateFile(path, data)
+}
+
+// NoSync returns the storage that does not flush the folder after writing a file, if the storage supports it,
+// and a function that flushes the folder. For other storages the same storage and a function doing nothing are returned.
+func NoSync(fs FS) (FS, func(path string) error) {
+	syncer, ok := fs.(fsentry_storage.FolderSyncer)
+	if !ok {
+		return fs, func(path string) error { return nil }
+	}
+	return noSyncFS{FS: fs, syncer: syncer}, syncer.SyncFolder
+}
+
+type noSyncFS struct {
+	FS
+	syncer fsentry_storage.FolderSyncer
+}
+
+func (f noSyncFS) CreateFile(path string, data []byte) error {
+	return f.syncer.CreateFileNoSync(path, data)
+}
+func (f noSyncFS) UpdateFile(path string, data []byte) error {
+	return f.syncer.UpdateFileNoSync(path, data)
+}
+
+type nopCloser struct {
+	*bytes.Reader
+}
+
+func (nopCloser) Close() error {
+	return nil
 }
@@ -1,17 +1,25 @@
 package storage
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	iofs "io/fs"
 	"log"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"syscall"
 
 	"github.com/otiai10/copy"
 
 	"github.com/HardDie/fsentry/pkg/fsentry_error"
+	"github.com/HardDie/fsentry/pkg/fsentry_storage"
 )
 
 const (
@@ -19,8 +27,14 @@ const (
 	CreateFileFlags = os.O_WRONLY | os.O_CREATE | os.O_EXCL
 	UpdateFileFlags = os.O_WRONLY | os.O_TRUNC
 	CreateFilePerm  = 0666
+	ListBatchSize   = 256
+	// TempFilePrefix is a prefix of hidden temporary files that are used to write data atomically.
+	TempFilePrefix = fsentry_storage.TempFilePrefix
 )
 
+// linkFile creates hard links, it's replaced in tests to emulate file systems without them.
+var linkFile = os.Link
+
 type FS struct{}
 
 func New() FS {
@@ -28,40 +42,128 @@ func New() FS {
 }
 
 // CreateFile allows you to create a file and fill it with some binary data.
+//
+// The data is written to a temporary file next to the destination, which is then linked to the destination path,
+// so in case of a crash or a full disk the destination file will either not exist or will contain all the data.
+// On file systems without hard links the temporary file is renamed instead, and a crash may leave an empty file.
 func (r FS) CreateFile(path string, data []byte) error {
-	file, err := os.OpenFile(path, CreateFileFlags, CreateFilePerm)
+	err := r.CreateFileNoSync(path, data)
 	if err != nil {
-		if e := isKnownError(err); e != nil {
-			if errors.Is(e, fsentry_error.ErrorIsDirectory) {
-				return fsentry_error.Wrap(err, fsentry_error.ErrorExist)
-			}
-			return e
-		}
-		return fsentry_error.Wrap(err, fsentry_error.ErrorInternal)
+		return err
+	}
+	r.syncFolder(filepath.Dir(path))
+	return nil
+}
+
+// CreateFileNoSync is like CreateFile, but the folder is not flushed to the disk, call SyncFolder for it.
+func (r FS) CreateFileNoSync(path string, data []byte) error {
+	return r.createFile(path, bytes.NewReader(data))
+}
+
+// CreateFileFrom is like CreateFile, but the data is copied from the reader, so a large file is not kept in memory.
+func (r FS) CreateFileFrom(path string, src io.Reader) error {
+	err := r.createFile(path, src)
+	if err != nil {
+		return err
+	}
+	r.syncFolder(filepath.Dir(path))
+	return nil
+}
+func (r FS) createFile(path string, src io.Reader) error {
+	tmpPath, err := r.writeTempFile(filepath.Dir(path), src, CreateFilePerm)
+	if err != nil {
+		return err
 	}
 	defer func() {
-		if err = file.Sync(); err != nil {
-			log.Printf("CreateFile(): error sync file %q: %s", path, err.Error())
-		}
-		if err = file.Close(); err != nil {
-			log.Printf("CreateFile(): error close file %q: %s", path, err.Error())
+		// The temp file is already renamed, if hard links are not supported.
+		if err := os.Remove(tmpPath); err != nil && !os.IsNotExist(err) {
+			log.Printf("CreateFile(): error remove temp file %q: %s", tmpPath, err.Error())
 		}
 	}()
 
-	n, err := file.Write(data)
+	// Unlike rename, link fails if the destination already exists.
+	err = linkFile(tmpPath, path)
+	if isLinkNotSupported(err) {
+		err = renameNew(tmpPath, path)
+	}
 	if err != nil {
-		// TODO: process different types of errors
+		if errors.Is(err, iofs.ErrExist) {
+			return fsentry_error.Wrap(err, fsentry_error.ErrorExist)
+		}
+		if e := isKnownError(err); e != nil {
+			return e
+		}
 		return fsentry_error.Wrap(err, fsentry_error.ErrorInternal)
 	}
-	if n != len(data) {
-		log.Printf("CreateFile(): the size of input and written data is different. Received: %d, written: %d", len(data), n)
+	return nil
+}
+
+// renameNew moves the temp file to the path, which must not exist, on file systems without hard links,
+// like FAT or some network shares. The destination is created first to fail if it exists, so a crash
+// may leave it empty.
+func renameNew(tmpPath, path string) error {
+	file, err := os.OpenFile(path, CreateFileFlags, CreateFilePerm)
+	if err != nil {
+		return err
+	}
+	err = file.Close()
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		if e := os.Remove(path); e != nil {
+			log.Printf("CreateFile(): error remove file %q: %s", path, e.Error())
+		}
+		return err
 	}
 	return nil
 }
 
+// isLinkNotSupported reports whether the hard link failed because the file system does not support them.
+func isLinkNotSupported(err error) bool {
+	var syscallErr syscall.Errno
+	if !errors.As(err, &syscallErr) {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		// ERROR_INVALID_FUNCTION and ERROR_NOT_SUPPORTED
+		return uintptr(syscallErr) == 1 || uintptr(syscallErr) == 50
+	}
+	// ENOTSUP and EOPNOTSUPP are the same error on some systems, so they can't be cases of a switch.
+	return syscallErr == syscall.ENOTSUP || syscallErr == syscall.EOPNOTSUPP || syscallErr == syscall.EPERM ||
+		syscallErr == syscall.EXDEV || syscallErr == syscall.ENOSYS
+}
+
 // UpdateFile allows you to update a file.
+//
+// The data is written to a temporary file next to the destination, which then replaces the destination file,
+// so in case of a crash or a full disk the destination file will contain either the old or the new data.
 func (r FS) UpdateFile(path string, data []byte) error {
-	file, err := os.OpenFile(path, UpdateFileFlags, CreateFilePerm)
+	err := r.UpdateFileNoSync(path, data)
+	if err != nil {
+		return err
+	}
+	r.syncFolder(filepath.Dir(path))
+	return nil
+}
+
+// UpdateFileNoSync is like UpdateFile, but the folder is not flushed to the disk, call SyncFolder for it.
+func (r FS) UpdateFileNoSync(path string, data []byte) error {
+	return r.updateFile(path, bytes.NewReader(data))
+}
+
+// UpdateFileFrom is like UpdateFile, but the data is copied from the reader, so a large file is not kept in memory.
+func (r FS) UpdateFileFrom(path string, src io.Reader) error {
+	err := r.updateFile(path, src)
+	if err != nil {
+		return err
+	}
+	r.syncFolder(filepath.Dir(path))
+	return nil
+}
+func (r FS) updateFile(path string, src io.Reader) error {
+	// Check if the destination is an existing file that we are allowed to write to.
+	file, err := os.OpenFile(path, os.O_WRONLY, CreateFilePerm)
 	if err != nil {
 		if e := isKnownError(err); e != nil {
 			switch {
@@ -74,22 +176,28 @@ func (r FS) UpdateFile(path string, data []byte) error {
 		}
 		return fsentry_error.Wrap(err, fsentry_error.ErrorInternal)
 	}
-	defer func() {
-		if err = file.Sync(); err != nil {
-			log.Printf("UpdateFile(): error sync file %q: %s", path, err.Error())
-		}
-		if err = file.Close(); err != nil {
-			log.Printf("UpdateFile(): error close file %q: %s", path, err.Error())
-		}
-	}()
-
-	n, err := file.Write(data)
+	stat, err := file.Stat()
+	if e := file.Close(); e != nil {
+		log.Printf("UpdateFile(): error close file %q: %s", path, e.Error())
+	}
 	if err != nil {
-		// TODO: process different types of errors
 		return fsentry_error.Wrap(err, fsentry_error.ErrorInternal)
 	}
-	if n != len(data) {
-		log.Printf("UpdateFile(): the size of input and written data is different. Received: %d, written: %d", len(data), n)
+
+	tmpPath, err := r.writeTempFile(filepath.Dir(path), src, stat.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		if e := os.Remove(tmpPath); e != nil {
+			log.Printf("UpdateFile(): error remove temp file %q: %s", tmpPath, e.Error())
+		}
+		if e := isKnownError(err); e != nil {
+			return e
+		}
+		return fsentry_error.Wrap(err, fsentry_error.ErrorInternal)
 	}
 	return nil
 }
@@ -126,6 +234,31 @@ func (r FS) ReadFile(path string) ([]byte, error) {
 	return data, nil
 }
 
+// OpenFile opens the file for reading. The opened file keeps its content even if it is replaced
+// by UpdateFile or removed, because the file is replaced with a rename.
+func (r FS) OpenFile(path string) (io.ReadSeekCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if e := isKnownError(err); e != nil {
+			return nil, e
+		}
+		return nil, fsentry_error.Wrap(err, fsentry_error.ErrorInternal)
+	}
+	stat, err := file.Stat()
+	if err == nil && stat.IsDir() {
+		err = fsentry_error.Wrap(fmt.Errorf("%q is a folder", path), fsentry_error.ErrorNotExist)
+	} else if err != nil {
+		err = fsentry_error.Wrap(err, fsentry_error.ErrorInternal)
+	}
+	if err != nil {
+		if e := file.Close(); e != nil {
+			log.Printf("OpenFile(): error close file %q: %s", path, e.Error())
+		}
+		return nil, err
+	}
+	return file, nil
+}
+
 // RemoveFile allows you to delete a file or an empty folder.
 // If the folder is not empty, an ErrorExist error will be returned.
 func (r FS) RemoveFile(path string) error {
@@ -195,7 +328,23 @@ func (r FS) Rename(oldPath, newPath string) error {
 
 // CopyFolder will recursively copy the source folder to the desired destination path.
 func (r FS) CopyFolder(srcPath, dstPath string) error {
-	err := copy.Copy(srcPath, dstPath)
+	return r.CopyFolderContext(context.Background(), srcPath, dstPath)
+}
+
+// CopyFolderContext is like CopyFolder, but stops copying before the next file when the context is canceled.
+func (r FS) CopyFolderContext(ctx context.Context, srcPath, dstPath string) error {
+	err := copy.Copy(srcPath, dstPath, copy.Options{
+		// Do not copy files of unfinished writes.
+		Skip: func(srcinfo os.FileInfo, src, dest string) (bool, error) {
+			if err := ctx.Err(); err != nil {
+				return false, err
+			}
+			return strings.HasPrefix(srcinfo.Name(), TempFilePrefix), nil
+		},
+	})
+	if ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+		return fsentry_error.Wrap(err, fsentry_error.ErrorCanceled)
+	}
 	if err != nil {
 		// TODO: process different types of errors
 		return fsentry_error.Wrap(err, fsentry_error.ErrorInternal)
@@ -207,19 +356,75 @@ func (r FS) CopyFolder(srcPath, dstPath string) error {
 func (r FS) List(path string) ([]os.FileInfo, error) {
 	f, err := os.Open(path)
 	if err != nil {
-		// TODO: process different types of errors
+		if e := isKnownError(err); e != nil {
+			return nil, e
+		}
 		return nil, fsentry_error.Wrap(err, fsentry_error.ErrorInternal)
 	}
 	defer f.Close()
 
 	files, err := f.Readdir(0)
 	if err != nil {
-		// TODO: process different types of errors
+		if e := isKnownError(err); e != nil {
+			return nil, e
+		}
 		return nil, fsentry_error.Wrap(err, fsentry_error.ErrorInternal)
 	}
 	return files, nil
 }
 
+// ListFunc reads objects on the specified path in batches of ListBatchSize and calls fn for each of them,
+// so a directory with a large number of objects is never loaded into memory at once.
+// If fn returns an error, reading stops and that error is returned.
+func (r FS) ListFunc(path string, fn func(entry os.DirEntry) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if e := isKnownError(err); e != nil {
+			return e
+		}
+		return fsentry_error.Wrap(err, fsentry_error.ErrorInternal)
+	}
+	defer f.Close()
+
+	for {
+		entries, err := f.ReadDir(ListBatchSize)
+		for _, entry := range entries {
+			if e := fn(entry); e != nil {
+				return e
+			}
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if e := isKnownError(err); e != nil {
+				return e
+			}
+			return fsentry_error.Wrap(err, fsentry_error.ErrorInternal)
+		}
+	}
+}
+
+// CleanupTemp recursively removes temporary files left in the folder after interrupted writes.
+func (r FS) CleanupTemp(path string) error {
+	err := filepath.WalkDir(path, func(filePath string, entry iofs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || !strings.HasPrefix(entry.Name(), TempFilePrefix) {
+			return nil
+		}
+		return os.Remove(filePath)
+	})
+	if err != nil {
+		if e := isKnownError(err); e != nil {
+			return e
+		}
+		return fsentry_error.Wrap(err, fsentry_error.ErrorInternal)
+	}
+	return nil
+}
+
 // IsFileExist checks if an object that is a file, not a folder, exists at the specified path.
 func (r FS) IsFileExist(path string) (isExist bool, err error) {
 	stat, err := os.Stat(path)
@@ -262,6 +467,90 @@ func (r FS) IsFolderExist(path string) (isExist bool, err error) {
 	return true, nil
 }
 
+// writeTempFile creates a new hidden temporary file in the folder, writes the data into it and flushes it to the disk.
+// The path to the temporary file is returned, the caller is responsible for renaming or removing it.
+func (r FS) writeTempFile(folder string, src io.Reader, perm os.FileMode) (string, error) {
+	var suffix [8]byte
+	_, err := rand.Read(suffix[:])
+	if err != nil {
+		return "", fsentry_error.Wrap(err, fsentry_error.ErrorInternal)
+	}
+	tmpPath := filepath.Join(folder, TempFilePrefix+hex.EncodeToString(suffix[:]))
+
+	file, err := os.OpenFile(tmpPath, CreateFileFlags, perm)
+	if err != nil {
+		if e := isKnownError(err); e != nil {
+			return "", e
+		}
+		return "", fsentry_error.Wrap(err, fsentry_error.ErrorInternal)
+	}
+
+	reader := &sourceReader{Reader: src}
+	_, err = io.Copy(file, reader)
+	if err == nil {
+		err = file.Sync()
+	}
+	if e := file.Close(); e != nil && err == nil {
+		err = e
+	}
+	if err != nil {
+		if e := os.Remove(tmpPath); e != nil {
+			log.Printf("writeTempFile(): error remove temp file %q: %s", tmpPath, e.Error())
+		}
+		if reader.err != nil {
+			// The data could not be read, it's not a problem of the storage.
+			return "", reader.err
+		}
+		// TODO: process different types of errors
+		return "", fsentry_error.Wrap(err, fsentry_error.ErrorInternal)
+	}
+	return tmpPath, nil
+}
+
+// SyncFolder flushes the folder to the disk, so that the created, renamed or removed files in it will survive a crash.
+func (r FS) SyncFolder(path string) error {
+	if runtime.GOOS == "windows" {
+		// windows does not allow to open folders for syncing
+		return nil
+	}
+	folder, err := os.Open(path)
+	if err != nil {
+		if e := isKnownError(err); e != nil {
+			return e
+		}
+		return fsentry_error.Wrap(err, fsentry_error.ErrorInternal)
+	}
+	err = folder.Sync()
+	if e := folder.Close(); e != nil {
+		log.Printf("SyncFolder(): error close folder %q: %s", path, e.Error())
+	}
+	if err != nil {
+		return fsentry_error.Wrap(err, fsentry_error.ErrorInternal)
+	}
+	return nil
+}
+
+// syncFolder flushes the folder after a single write, an error is only logged, because the write itself is done.
+func (r FS) syncFolder(path string) {
+	if err := r.SyncFolder(path); err != nil {
+		log.Printf("syncFolder(): error sync folder %q: %s", path, err.Error())
+	}
+}
+
+// sourceReader remembers the error of the source reader, so it can be separated from the errors of writing.
+type sourceReader struct {
+	io.Reader
+	err error
+}
+
+func (r *sourceReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
 func isKnownError(err error) error {
 	var pathErr *iofs.PathError
 	if errors.As(err, &pathErr) {
@@ -0,0 +1,162 @@
+package storage_test
+
+import (
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/HardDie/fsentry"
+	pkgFsentry "github.com/HardDie/fsentry/pkg/fsentry"
+)
+
+// benchmarkParallelCreateEntry creates entries from parallel goroutines, each goroutine writes into
+// its own folder if isSiblings is set, otherwise all goroutines write into the same folder.
+func benchmarkParallelCreateEntry(b *testing.B, isSiblings bool) {
+	dir, err := os.MkdirTemp("", "benchmark_parallel_create_entry")
+	if err != nil {
+		b.Fatal("error creating temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db := fsentry.NewFSEntry(dir)
+	err = db.Init()
+	if err != nil {
+		b.Fatal("error init:", err)
+	}
+
+	var workers, entries int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		folder := "shared"
+		if isSiblings {
+			folder = "folder_" + strconv.FormatInt(atomic.AddInt64(&workers, 1), 10)
+		}
+		_, err := db.CreateFolder(folder, nil)
+		if err != nil && !isSiblings {
+			// The shared folder is created by the first goroutine.
+			_, err = db.GetFolder(folder)
+		}
+		if err != nil {
+			b.Error("error create folder:", err)
+			return
+		}
+
+		for pb.Next() {
+			name := "entry_" + strconv.FormatInt(atomic.AddInt64(&entries, 1), 10)
+			_, err := db.CreateEntry(name, nil, folder)
+			if err != nil {
+				b.Error("error create entry:", err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkParallelCreateEntrySiblingFolders(b *testing.B) {
+	benchmarkParallelCreateEntry(b, true)
+}
+func BenchmarkParallelCreateEntrySameFolder(b *testing.B) {
+	benchmarkParallelCreateEntry(b, false)
+}
+
+// BenchmarkParallelCreateEntryDuringDuplicate creates entries in sibling folders while another folder
+// is duplicated over and over, the duplication must not block the writers.
+func BenchmarkParallelCreateEntryDuringDuplicate(b *testing.B) {
+	dir, err := os.MkdirTemp("", "benchmark_parallel_duplicate")
+	if err != nil {
+		b.Fatal("error creating temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db := fsentry.NewFSEntry(dir)
+	err = db.Init()
+	if err != nil {
+		b.Fatal("error init:", err)
+	}
+	_, err = db.CreateFolder("big", nil)
+	if err != nil {
+		b.Fatal("error create folder:", err)
+	}
+	for i := 0; i < 1000; i++ {
+		_, err = db.CreateEntry("entry_"+strconv.Itoa(i), nil, "big")
+		if err != nil {
+			b.Fatal("error create entry:", err)
+		}
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			name := "copy_" + strconv.Itoa(i)
+			_, err := db.DuplicateFolder("big", name)
+			if err != nil {
+				b.Error("error duplicate:", err)
+				return
+			}
+			err = db.RemoveFolder(name)
+			if err != nil {
+				b.Error("error remove:", err)
+				return
+			}
+		}
+	}()
+
+	var workers, entries int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		folder := "folder_" + strconv.FormatInt(atomic.AddInt64(&workers, 1), 10)
+		_, err := db.CreateFolder(folder, nil)
+		if err != nil {
+			b.Error("error create folder:", err)
+			return
+		}
+		for pb.Next() {
+			name := "entry_" + strconv.FormatInt(atomic.AddInt64(&entries, 1), 10)
+			_, err := db.CreateEntry(name, nil, folder)
+			if err != nil {
+				b.Error("error create entry:", err)
+				return
+			}
+		}
+	})
+	b.StopTimer()
+	close(stop)
+	<-done
+}
+
+// BenchmarkBatchCreateEntry creates entries in one folder with Batch, compare it with BenchmarkParallelCreateEntrySameFolder.
+func BenchmarkBatchCreateEntry(b *testing.B) {
+	dir, err := os.MkdirTemp("", "benchmark_batch_create_entry")
+	if err != nil {
+		b.Fatal("error creating temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db := fsentry.NewFSEntry(dir)
+	err = db.Init()
+	if err != nil {
+		b.Fatal("error init:", err)
+	}
+
+	ops := make([]pkgFsentry.BatchOp, b.N)
+	for i := range ops {
+		ops[i] = pkgFsentry.BatchOp{
+			Action: pkgFsentry.BatchCreateEntry,
+			Name:   "entry_" + strconv.Itoa(i),
+		}
+	}
+	b.ResetTimer()
+	for i, res := range db.Batch(ops, pkgFsentry.BatchOptions{}) {
+		if res.Err != nil {
+			b.Fatal("error create entry:", i, res.Err)
+		}
+	}
+}
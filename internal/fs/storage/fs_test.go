@@ -6,11 +6,15 @@ import (
 	"path/filepath"
 	"reflect"
 	"runtime"
+	"strconv"
+	"syscall"
 	"testing"
 
 	acl "github.com/hectane/go-acl"
 
 	"github.com/HardDie/fsentry/pkg/fsentry_error"
+	"github.com/HardDie/fsentry/pkg/fsentry_storage"
+	"github.com/HardDie/fsentry/pkg/fsentry_storage/storagetest"
 )
 
 func TestCreateFile(t *testing.T) {
@@ -98,6 +102,49 @@ func TestCreateFile(t *testing.T) {
 			t.Fatalf("error wait: %q; got: %q", fsentry_error.ErrorPermissions, err)
 		}
 	})
+
+	t.Run("no_hard_links", func(t *testing.T) {
+		dir, err := os.MkdirTemp("", "create_file_no_hard_links")
+		if err != nil {
+			t.Fatal("error creating temp dir", err)
+		}
+		defer os.RemoveAll(dir)
+
+		// Emulate a file system without hard links, like FAT.
+		linkFile = func(oldname, newname string) error {
+			return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.ENOTSUP}
+		}
+		defer func() {
+			linkFile = os.Link
+		}()
+
+		filePath := filepath.Join(dir, "file")
+
+		f := New()
+		err = f.CreateFile(filePath, []byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.CreateFile(filePath, []byte("world"))
+		if !errors.Is(err, fsentry_error.ErrorExist) {
+			t.Fatalf("error wait: %q; got: %q", fsentry_error.ErrorExist, err)
+		}
+
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "hello" {
+			t.Fatalf("data wait: %q; got: %q", "hello", data)
+		}
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 1 {
+			t.Fatal("temp files must be removed", files)
+		}
+	})
 }
 func TestReadFile(t *testing.T) {
 	t.Run("success", func(t *testing.T) {
@@ -854,9 +901,180 @@ func TestRemoveFolder(t *testing.T) {
 	})
 }
 
+func TestCleanupTemp(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		dir, err := os.MkdirTemp("", "cleanup_temp_success")
+		if err != nil {
+			t.Fatal("error creating temp dir", err)
+		}
+		defer os.RemoveAll(dir)
+
+		folderPath := filepath.Join(dir, "folder")
+		filePath := filepath.Join(folderPath, "file")
+		tmpPath := filepath.Join(folderPath, TempFilePrefix+"interrupted")
+
+		f := New()
+		err = f.CreateFolder(folderPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.CreateFile(filePath, []byte("init"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.UpdateFile(filePath, []byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Successful writes must not leave temporary files
+		files, err := f.List(folderPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 1 {
+			t.Fatalf("wait only one file; got: %d", len(files))
+		}
+
+		// Simulate an interrupted write
+		err = os.WriteFile(tmpPath, []byte("hel"), CreateFilePerm)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = f.CleanupTemp(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		isExist, err := f.IsFileExist(tmpPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isExist {
+			t.Fatal("temp file must be removed")
+		}
+		isExist, err = f.IsFileExist(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !isExist {
+			t.Fatal("data file must be kept")
+		}
+	})
+}
+
+func TestListFunc(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		dir, err := os.MkdirTemp("", "list_func_success")
+		if err != nil {
+			t.Fatal("error creating temp dir", err)
+		}
+		defer os.RemoveAll(dir)
+
+		f := New()
+		// More objects than in one batch
+		want := make(map[string]struct{})
+		for i := 0; i < ListBatchSize+10; i++ {
+			name := "file_" + strconv.Itoa(i)
+			err = f.CreateFile(filepath.Join(dir, name), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want[name] = struct{}{}
+		}
+
+		got := make(map[string]struct{})
+		err = f.ListFunc(dir, func(entry os.DirEntry) error {
+			got[entry.Name()] = struct{}{}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(want, got) {
+			t.Fatalf("wait %d objects; got %d", len(want), len(got))
+		}
+	})
+
+	t.Run("stop", func(t *testing.T) {
+		dir, err := os.MkdirTemp("", "list_func_stop")
+		if err != nil {
+			t.Fatal("error creating temp dir", err)
+		}
+		defer os.RemoveAll(dir)
+
+		f := New()
+		for i := 0; i < 3; i++ {
+			err = f.CreateFile(filepath.Join(dir, strconv.Itoa(i)), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		errStop := errors.New("stop")
+		calls := 0
+		err = f.ListFunc(dir, func(entry os.DirEntry) error {
+			calls++
+			return errStop
+		})
+		if !errors.Is(err, errStop) {
+			t.Fatalf("error wait: %q; got: %q", errStop, err)
+		}
+		if calls != 1 {
+			t.Fatalf("wait 1 call; got %d", calls)
+		}
+	})
+
+	t.Run("not_exist", func(t *testing.T) {
+		dir, err := os.MkdirTemp("", "list_func_not_exist")
+		if err != nil {
+			t.Fatal("error creating temp dir", err)
+		}
+		defer os.RemoveAll(dir)
+
+		f := New()
+		err = f.ListFunc(filepath.Join(dir, "not_exist"), func(entry os.DirEntry) error {
+			return nil
+		})
+		if !errors.Is(err, fsentry_error.ErrorNotExist) {
+			t.Fatalf("error wait: %q; got: %q", fsentry_error.ErrorNotExist, err)
+		}
+	})
+
+	t.Run("file", func(t *testing.T) {
+		dir, err := os.MkdirTemp("", "list_func_file")
+		if err != nil {
+			t.Fatal("error creating temp dir", err)
+		}
+		defer os.RemoveAll(dir)
+
+		filePath := filepath.Join(dir, "file")
+
+		f := New()
+		err = f.CreateFile(filePath, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = f.ListFunc(filePath, func(entry os.DirEntry) error {
+			return nil
+		})
+		if !errors.Is(err, fsentry_error.ErrorNotDirectory) {
+			t.Fatalf("error wait: %q; got: %q", fsentry_error.ErrorNotDirectory, err)
+		}
+	})
+}
+
 func chmod(name string, mode os.FileMode) error {
 	if runtime.GOOS == "windows" {
 		return acl.Chmod(name, mode)
 	}
 	return os.Chmod(name, mode)
 }
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) fsentry_storage.Storage {
+		return New()
+	})
+}
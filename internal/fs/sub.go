@@ -0,0 +1,67 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Sub returns the storage whose paths are relative to the folder of the storage, the folder must exist.
+// It's used by transactions, that keep their changes in a hidden folder of the root.
+func Sub(fs FS, dir string) FS {
+	return subFS{
+		fs:  fs,
+		dir: dir,
+	}
+}
+
+type subFS struct {
+	fs  FS
+	dir string
+}
+
+func (f subFS) path(path string) string {
+	return filepath.Join(f.dir, path)
+}
+
+func (f subFS) CreateFile(path string, data []byte) error {
+	return f.fs.CreateFile(f.path(path), data)
+}
+func (f subFS) ReadFile(path string) ([]byte, error) {
+	return f.fs.ReadFile(f.path(path))
+}
+func (f subFS) UpdateFile(path string, data []byte) error {
+	return f.fs.UpdateFile(f.path(path), data)
+}
+func (f subFS) RemoveFile(path string) error {
+	return f.fs.RemoveFile(f.path(path))
+}
+func (f subFS) CreateFolder(path string) error {
+	return f.fs.CreateFolder(f.path(path))
+}
+func (f subFS) CreateAllFolder(path string) error {
+	return f.fs.CreateAllFolder(f.path(path))
+}
+func (f subFS) RemoveFolder(path string) error {
+	return f.fs.RemoveFolder(f.path(path))
+}
+func (f subFS) Rename(oldPath, newPath string) error {
+	return f.fs.Rename(f.path(oldPath), f.path(newPath))
+}
+func (f subFS) CopyFolder(srcPath, dstPath string) error {
+	return f.fs.CopyFolder(f.path(srcPath), f.path(dstPath))
+}
+func (f subFS) List(path string) ([]os.FileInfo, error) {
+	return f.fs.List(f.path(path))
+}
+func (f subFS) ListFunc(path string, fn func(entry os.DirEntry) error) error {
+	return f.fs.ListFunc(f.path(path), fn)
+}
+func (f subFS) IsFileExist(path string) (isExist bool, err error) {
+	return f.fs.IsFileExist(f.path(path))
+}
+func (f subFS) IsFolderExist(path string) (isExist bool, err error) {
+	return f.fs.IsFolderExist(f.path(path))
+}
+func (f subFS) CleanupTemp(path string) error {
+	return f.fs.CleanupTemp(f.path(path))
+}
@@ -0,0 +1,53 @@
+package journal
+
+type Operation string
+
+const (
+	// OperationMove renames SrcPath to DstPath, replaces the content of MetaPath with Meta and removes OldMetaPath,
+	// if it's set. It is replayed on recovery: if the rename has been done, the metadata is written again
+	// and the old metadata is removed.
+	OperationMove Operation = "move"
+	// OperationDuplicate copies a folder into a hidden TmpPath, updates its metadata and renames it to DstPath.
+	// It is rolled back on recovery: the unfinished copy in TmpPath is removed.
+	OperationDuplicate Operation = "duplicate"
+	// OperationRemove renames SrcPath to a hidden TmpPath and then removes it.
+	// It is replayed on recovery if the rename has been done, otherwise SrcPath is left untouched.
+	OperationRemove Operation = "remove"
+	// OperationTx applies a transaction with renames from Steps: replaced and removed objects are moved
+	// into the hidden TmpPath, and new objects prepared in TmpPath are moved to their places.
+	// It is rolled back on recovery: applied steps are renamed back in the reverse order and TmpPath is removed.
+	OperationTx Operation = "tx"
+	// OperationRelocate moves or copies an object into another folder with renames from Steps, like OperationTx.
+	// It is rolled back on recovery the same way.
+	OperationRelocate Operation = "relocate"
+)
+
+// Step is a rename of SrcPath to DstPath. It has been applied if SrcPath does not exist and DstPath exists.
+type Step struct {
+	SrcPath string `json:"srcPath"`
+	DstPath string `json:"dstPath"`
+}
+
+// Record describes the intent of a multi-step operation. It is written before the first step
+// and removed after the last one, so any record found on Init() belongs to an interrupted operation.
+type Record struct {
+	ID        string    `json:"id"`
+	Operation Operation `json:"operation"`
+	SrcPath   string    `json:"srcPath"`
+	DstPath   string    `json:"dstPath,omitempty"`
+	TmpPath   string    `json:"tmpPath,omitempty"`
+	MetaPath  string    `json:"metaPath,omitempty"`
+	Meta      []byte    `json:"meta,omitempty"`
+	// OldMetaPath is the metadata file of the old name, for objects that keep the metadata in a separate file.
+	OldMetaPath string `json:"oldMetaPath,omitempty"`
+	Steps       []Step `json:"steps,omitempty"`
+}
+
+type Service interface {
+	Begin(rec Record) (string, error)
+	Commit(id string) error
+	List() ([]Record, error)
+	Recover() error
+	Undo(steps []Step) error
+	Apply(rec Record) error
+}
@@ -0,0 +1,265 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/HardDie/fsentry/internal/fs"
+	"github.com/HardDie/fsentry/internal/journal"
+	"github.com/HardDie/fsentry/internal/utils"
+	"github.com/HardDie/fsentry/pkg/fsentry_error"
+)
+
+const (
+	journalFolder    = "journal"
+	recordFileSuffix = ".json"
+)
+
+type Service struct {
+	fs   fs.FS
+	path string
+}
+
+func New(
+	fs fs.FS,
+	root string,
+) Service {
+	return Service{
+		fs:   fs,
+		path: filepath.Join(root, utils.ServiceFolder, journalFolder),
+	}
+}
+
+// Begin writes a record about the operation that is going to be performed and returns the record ID.
+func (s Service) Begin(rec journal.Record) (string, error) {
+	suffix, err := utils.RandomHex(4)
+	if err != nil {
+		return "", err
+	}
+	// The ID starts with a timestamp, so records can be recovered in the same order as they were written.
+	rec.ID = fmt.Sprintf("%020d_%s", time.Now().UnixNano(), suffix)
+
+	data, err := utils.StructToJSON(rec, false)
+	if err != nil {
+		return "", err
+	}
+
+	recordPath := filepath.Join(s.path, rec.ID+recordFileSuffix)
+	err = s.fs.CreateFile(recordPath, data)
+	if errors.Is(err, fsentry_error.ErrorNotExist) {
+		// The journal folder is created on the first operation.
+		err = s.fs.CreateAllFolder(s.path)
+		if err != nil {
+			return "", err
+		}
+		err = s.fs.CreateFile(recordPath, data)
+	}
+	if err != nil {
+		return "", err
+	}
+	return rec.ID, nil
+}
+
+// Commit removes the record when the operation has been completed or safely rolled back.
+func (s Service) Commit(id string) error {
+	return s.fs.RemoveFile(filepath.Join(s.path, id+recordFileSuffix))
+}
+
+// List returns the records of all unfinished operations in the order they were written.
+// Invalid records are returned with an empty Operation.
+func (s Service) List() ([]journal.Record, error) {
+	isExist, err := s.fs.IsFolderExist(s.path)
+	if err != nil {
+		return nil, err
+	}
+	if !isExist {
+		return nil, nil
+	}
+
+	files, err := s.fs.List(s.path)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || strings.HasPrefix(name, ".") || filepath.Ext(name) != recordFileSuffix {
+			continue
+		}
+		ids = append(ids, strings.TrimSuffix(name, recordFileSuffix))
+	}
+	sort.Strings(ids)
+
+	res := make([]journal.Record, 0, len(ids))
+	for _, id := range ids {
+		recordPath := filepath.Join(s.path, id+recordFileSuffix)
+
+		data, err := s.fs.ReadFile(recordPath)
+		if err != nil {
+			return nil, err
+		}
+		rec, err := utils.JSONToStruct[journal.Record](data)
+		if err != nil {
+			// Records are created atomically, so an invalid record could not have been followed by any step.
+			log.Printf("List(): invalid journal record %q: %s", recordPath, err.Error())
+			res = append(res, journal.Record{ID: id})
+			continue
+		}
+		rec.ID = id
+		res = append(res, *rec)
+	}
+	return res, nil
+}
+
+// Recover finishes or rolls back all operations that have been interrupted, and removes their records.
+func (s Service) Recover() error {
+	records, err := s.List()
+	if err != nil {
+		return err
+	}
+
+	for _, rec := range records {
+		if rec.Operation != "" {
+			log.Printf("Recover(): recover interrupted %s operation of %q", rec.Operation, rec.SrcPath)
+			err = s.recover(rec)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = s.Commit(rec.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s Service) recover(rec journal.Record) error {
+	switch rec.Operation {
+	case journal.OperationMove:
+		isSrcExist, err := s.isExist(rec.SrcPath)
+		if err != nil {
+			return err
+		}
+		isDstExist, err := s.isExist(rec.DstPath)
+		if err != nil {
+			return err
+		}
+		if isSrcExist || !isDstExist {
+			// The object was not renamed or was renamed back.
+			return nil
+		}
+		// The object was renamed, but the metadata could be old, write it again.
+		// The metadata of a binary is a separate file, which may not be created yet.
+		err = s.fs.UpdateFile(rec.MetaPath, rec.Meta)
+		if errors.Is(err, fsentry_error.ErrorNotExist) {
+			err = s.fs.CreateFile(rec.MetaPath, rec.Meta)
+		}
+		if err != nil || rec.OldMetaPath == "" {
+			return err
+		}
+		err = s.fs.RemoveFile(rec.OldMetaPath)
+		if errors.Is(err, fsentry_error.ErrorNotExist) {
+			return nil
+		}
+		return err
+	case journal.OperationDuplicate:
+		// Remove the unfinished copy, if the copy is finished it has already been renamed.
+		return s.fs.RemoveFolder(rec.TmpPath)
+	case journal.OperationRemove:
+		// If the folder was not renamed, there is nothing to remove, otherwise finish removing.
+		return s.fs.RemoveFolder(rec.TmpPath)
+	case journal.OperationTx, journal.OperationRelocate:
+		// The transaction is not finished, so all its applied steps are undone.
+		err := s.Undo(rec.Steps)
+		if err != nil {
+			return err
+		}
+		return s.fs.RemoveFolder(rec.TmpPath)
+	}
+	log.Printf("recover(): unknown journal operation %q", rec.Operation)
+	return nil
+}
+
+// Undo renames back the applied steps in the reverse order. The steps that have not been applied are skipped,
+// so it can be called again after an interruption.
+func (s Service) Undo(steps []journal.Step) error {
+	for i := len(steps) - 1; i >= 0; i-- {
+		step := steps[i]
+		isSrcExist, err := s.isExist(step.SrcPath)
+		if err != nil {
+			return err
+		}
+		isDstExist, err := s.isExist(step.DstPath)
+		if err != nil {
+			return err
+		}
+		if isSrcExist || !isDstExist {
+			continue
+		}
+		err = s.fs.Rename(step.DstPath, step.SrcPath)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Apply performs an operation made of renames from rec.Steps, whose objects are prepared in rec.TmpPath.
+// The record is written first, then the steps are renamed in order and TmpPath is removed. If a step fails,
+// the applied steps are undone, and if that fails too, the record is kept, so the operation is rolled back
+// on the next Init().
+func (s Service) Apply(rec journal.Record) error {
+	recordID, err := s.Begin(rec)
+	if err != nil {
+		s.removeTmp(rec.TmpPath)
+		return err
+	}
+
+	for i, step := range rec.Steps {
+		err = s.fs.Rename(step.SrcPath, step.DstPath)
+		if err == nil {
+			continue
+		}
+
+		if e := s.Undo(rec.Steps[:i]); e != nil {
+			log.Printf("Apply(): error roll back %s operation: %s", rec.Operation, e.Error())
+			return fsentry_error.Wrap(err, e)
+		}
+		s.removeTmp(rec.TmpPath)
+		s.commit(recordID)
+		return err
+	}
+
+	// The operation is applied, the old objects are not needed anymore.
+	s.commit(recordID)
+	s.removeTmp(rec.TmpPath)
+	return nil
+}
+
+func (s Service) commit(recordID string) {
+	if err := s.Commit(recordID); err != nil {
+		log.Printf("Apply(): error commit journal record %q: %s", recordID, err.Error())
+	}
+}
+func (s Service) removeTmp(tmpPath string) {
+	if err := s.fs.RemoveFolder(tmpPath); err != nil {
+		log.Printf("Apply(): error remove temporary folder %q: %s", tmpPath, err.Error())
+	}
+}
+
+// isExist checks if a file or a folder exists at the specified path.
+func (s Service) isExist(path string) (bool, error) {
+	isExist, err := s.fs.IsFileExist(path)
+	if errors.Is(err, fsentry_error.ErrorBadPath) {
+		// It's a folder
+		return true, nil
+	}
+	return isExist, err
+}
@@ -0,0 +1,433 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	fsStorage "github.com/HardDie/fsentry/internal/fs/storage"
+	"github.com/HardDie/fsentry/internal/journal"
+)
+
+func TestJournalCommit(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		dir, err := os.MkdirTemp("", "commit_journal_success")
+		if err != nil {
+			t.Fatal("error creating temp dir", err)
+		}
+		defer os.RemoveAll(dir)
+
+		s := New(fsStorage.New(), dir)
+		id, err := s.Begin(journal.Record{
+			Operation: journal.OperationRemove,
+			SrcPath:   filepath.Join(dir, "src"),
+			TmpPath:   filepath.Join(dir, "tmp"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.Commit(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		files, err := os.ReadDir(s.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 0 {
+			t.Fatal("journal must be empty after commit")
+		}
+	})
+}
+func TestJournalRecover(t *testing.T) {
+	t.Run("move", func(t *testing.T) {
+		dir, err := os.MkdirTemp("", "recover_journal_move")
+		if err != nil {
+			t.Fatal("error creating temp dir", err)
+		}
+		defer os.RemoveAll(dir)
+
+		srcPath := filepath.Join(dir, "src.json")
+		dstPath := filepath.Join(dir, "dst.json")
+		meta := []byte("new")
+
+		fs := fsStorage.New()
+		err = fs.CreateFile(srcPath, []byte("old"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s := New(fs, dir)
+		_, err = s.Begin(journal.Record{
+			Operation: journal.OperationMove,
+			SrcPath:   srcPath,
+			DstPath:   dstPath,
+			MetaPath:  dstPath,
+			Meta:      meta,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The process was killed after renaming, but before updating.
+		err = fs.Rename(srcPath, dstPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = s.Recover()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := fs.ReadFile(dstPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(data, meta) {
+			t.Fatalf("bad data after recover; got: %q, want: %q", string(data), string(meta))
+		}
+		assertJournalEmpty(t, s)
+	})
+
+	t.Run("move_binary", func(t *testing.T) {
+		dir, err := os.MkdirTemp("", "recover_journal_move_binary")
+		if err != nil {
+			t.Fatal("error creating temp dir", err)
+		}
+		defer os.RemoveAll(dir)
+
+		srcPath := filepath.Join(dir, "src.bin")
+		dstPath := filepath.Join(dir, "dst.bin")
+		srcInfoPath := filepath.Join(dir, ".src.bin.info.json")
+		dstInfoPath := filepath.Join(dir, ".dst.bin.info.json")
+
+		fs := fsStorage.New()
+		err = fs.CreateFile(srcPath, []byte("data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fs.CreateFile(srcInfoPath, []byte("old"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s := New(fs, dir)
+		_, err = s.Begin(journal.Record{
+			Operation:   journal.OperationMove,
+			SrcPath:     srcPath,
+			DstPath:     dstPath,
+			MetaPath:    dstInfoPath,
+			Meta:        []byte("new"),
+			OldMetaPath: srcInfoPath,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The process was killed after renaming, but before writing the metadata.
+		err = fs.Rename(srcPath, dstPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = s.Recover()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := fs.ReadFile(dstInfoPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "new" {
+			t.Fatalf("bad metadata after recover; got: %q, want: %q", string(data), "new")
+		}
+		isExist, err := fs.IsFileExist(srcInfoPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isExist {
+			t.Fatal("old metadata must be removed")
+		}
+		assertJournalEmpty(t, s)
+	})
+
+	t.Run("move_not_started", func(t *testing.T) {
+		dir, err := os.MkdirTemp("", "recover_journal_move_not_started")
+		if err != nil {
+			t.Fatal("error creating temp dir", err)
+		}
+		defer os.RemoveAll(dir)
+
+		srcPath := filepath.Join(dir, "src.json")
+		dstPath := filepath.Join(dir, "dst.json")
+
+		fs := fsStorage.New()
+		err = fs.CreateFile(srcPath, []byte("old"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s := New(fs, dir)
+		_, err = s.Begin(journal.Record{
+			Operation: journal.OperationMove,
+			SrcPath:   srcPath,
+			DstPath:   dstPath,
+			MetaPath:  dstPath,
+			Meta:      []byte("new"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = s.Recover()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		isExist, err := fs.IsFileExist(dstPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isExist {
+			t.Fatal("not started move must not be replayed")
+		}
+		assertJournalEmpty(t, s)
+	})
+
+	t.Run("duplicate", func(t *testing.T) {
+		dir, err := os.MkdirTemp("", "recover_journal_duplicate")
+		if err != nil {
+			t.Fatal("error creating temp dir", err)
+		}
+		defer os.RemoveAll(dir)
+
+		tmpPath := filepath.Join(dir, ".tmp")
+
+		fs := fsStorage.New()
+		s := New(fs, dir)
+		_, err = s.Begin(journal.Record{
+			Operation: journal.OperationDuplicate,
+			SrcPath:   filepath.Join(dir, "src"),
+			DstPath:   filepath.Join(dir, "dst"),
+			TmpPath:   tmpPath,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The process was killed while copying.
+		err = fs.CreateFolder(tmpPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = s.Recover()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		isExist, err := fs.IsFolderExist(tmpPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isExist {
+			t.Fatal("unfinished copy must be removed")
+		}
+		assertJournalEmpty(t, s)
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		dir, err := os.MkdirTemp("", "recover_journal_remove")
+		if err != nil {
+			t.Fatal("error creating temp dir", err)
+		}
+		defer os.RemoveAll(dir)
+
+		srcPath := filepath.Join(dir, "src")
+		tmpPath := filepath.Join(dir, ".tmp")
+
+		fs := fsStorage.New()
+		err = fs.CreateFolder(srcPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s := New(fs, dir)
+		_, err = s.Begin(journal.Record{
+			Operation: journal.OperationRemove,
+			SrcPath:   srcPath,
+			TmpPath:   tmpPath,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The process was killed after renaming, but before removing.
+		err = fs.Rename(srcPath, tmpPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = s.Recover()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		isExist, err := fs.IsFolderExist(tmpPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isExist {
+			t.Fatal("folder must be removed")
+		}
+		assertJournalEmpty(t, s)
+	})
+	t.Run("tx", func(t *testing.T) {
+		dir, err := os.MkdirTemp("", "recover_journal_tx")
+		if err != nil {
+			t.Fatal("error creating temp dir", err)
+		}
+		defer os.RemoveAll(dir)
+
+		entryPath := filepath.Join(dir, "e1.json")
+		tmpPath := filepath.Join(dir, ".tmp")
+		stagePath := filepath.Join(tmpPath, "stage-1")
+		backupPath := filepath.Join(tmpPath, "backup-0")
+
+		fs := fsStorage.New()
+		err = fs.CreateFile(entryPath, []byte("old"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fs.CreateAllFolder(tmpPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fs.CreateFile(stagePath, []byte("new"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s := New(fs, dir)
+		_, err = s.Begin(journal.Record{
+			Operation: journal.OperationTx,
+			SrcPath:   dir,
+			TmpPath:   tmpPath,
+			Steps: []journal.Step{
+				{SrcPath: entryPath, DstPath: backupPath},
+				{SrcPath: stagePath, DstPath: entryPath},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The process was killed after all renames, but before the record was committed.
+		err = fs.Rename(entryPath, backupPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fs.Rename(stagePath, entryPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = s.Recover()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := fs.ReadFile(entryPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "old" {
+			t.Fatal("transaction must be rolled back, got", string(data))
+		}
+		isExist, err := fs.IsFolderExist(tmpPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isExist {
+			t.Fatal("transaction folder must be removed")
+		}
+		assertJournalEmpty(t, s)
+	})
+}
+
+func assertJournalEmpty(t *testing.T, s Service) {
+	files, err := os.ReadDir(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Fatal("journal must be empty after recover")
+	}
+}
+func TestJournalApply(t *testing.T) {
+	t.Run("rollback", func(t *testing.T) {
+		dir, err := os.MkdirTemp("", "apply_journal_rollback")
+		if err != nil {
+			t.Fatal("error creating temp dir", err)
+		}
+		defer os.RemoveAll(dir)
+
+		srcPath := filepath.Join(dir, "e1.json")
+		dstPath := filepath.Join(dir, "e2.json")
+		tmpPath := filepath.Join(dir, ".tmp")
+
+		fs := fsStorage.New()
+		err = fs.CreateFile(srcPath, []byte("src"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fs.CreateFile(dstPath, []byte("dst"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fs.CreateFolder(tmpPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s := New(fs, dir)
+		err = s.Apply(journal.Record{
+			Operation: journal.OperationRelocate,
+			SrcPath:   srcPath,
+			DstPath:   dstPath,
+			TmpPath:   tmpPath,
+			Steps: []journal.Step{
+				{SrcPath: dstPath, DstPath: filepath.Join(tmpPath, "dst")},
+				{SrcPath: srcPath, DstPath: dstPath},
+				// The last step fails, because there is no such object.
+				{SrcPath: filepath.Join(tmpPath, "missing"), DstPath: srcPath},
+			},
+		})
+		if err == nil {
+			t.Fatal("expected error of the last step")
+		}
+
+		for path, expected := range map[string]string{srcPath: "src", dstPath: "dst"} {
+			data, err := fs.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != expected {
+				t.Fatalf("steps must be rolled back, %q contains %q", path, string(data))
+			}
+		}
+		isExist, err := fs.IsFolderExist(tmpPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isExist {
+			t.Fatal("temporary folder must be removed")
+		}
+		records, err := s.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != 0 {
+			t.Fatal("record must be committed", records)
+		}
+	})
+}
@@ -0,0 +1,421 @@
+// Package jsonpatch applies JSON Merge Patch (RFC 7386) and JSON Patch (RFC 6902) documents to json data.
+package jsonpatch
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/HardDie/fsentry/pkg/fsentry"
+	"github.com/HardDie/fsentry/pkg/fsentry_error"
+)
+
+// Apply applies the patch to the data and returns the new data. Empty data is treated as null.
+//
+// A malformed patch, or an operation on a missing value is an ErrorBadPatch error,
+// a failed test operation is an ErrorPatchTest error.
+func Apply(data json.RawMessage, patch fsentry.Patch) (json.RawMessage, error) {
+	doc, err := decode(data)
+	if err != nil {
+		return nil, fsentry_error.Wrap(err, fsentry_error.ErrorInternal)
+	}
+
+	switch patch.Type {
+	case fsentry.PatchMerge:
+		p, err := decode(patch.Document)
+		if err != nil {
+			return nil, fsentry_error.Wrap(err, fsentry_error.ErrorBadPatch)
+		}
+		doc = merge(doc, p)
+	case fsentry.PatchJSON:
+		doc, err = applyOperations(doc, patch.Document)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fsentry_error.Wrap(fmt.Errorf("unknown patch type %d", patch.Type), fsentry_error.ErrorBadPatch)
+	}
+
+	res, err := json.Marshal(doc)
+	if err != nil {
+		return nil, fsentry_error.Wrap(err, fsentry_error.ErrorInternal)
+	}
+	return res, nil
+}
+
+// decode unmarshals the json keeping numbers as is, so they are not rounded.
+func decode(data []byte) (interface{}, error) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var res interface{}
+	err := dec.Decode(&res)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// merge applies a merge patch as described in RFC 7386.
+func merge(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+	for key, value := range p {
+		if value == nil {
+			delete(t, key)
+			continue
+		}
+		t[key] = merge(t[key], value)
+	}
+	return t
+}
+
+// applyOperations applies the operations of a JSON Patch one by one. The document is changed in place,
+// the caller doesn't use it if an error is returned.
+func applyOperations(doc interface{}, document json.RawMessage) (interface{}, error) {
+	var ops []map[string]json.RawMessage
+	err := json.Unmarshal(document, &ops)
+	if err != nil {
+		return nil, fsentry_error.Wrap(err, fsentry_error.ErrorBadPatch)
+	}
+	for i, op := range ops {
+		doc, err = applyOperation(doc, op)
+		if err != nil {
+			return nil, fmt.Errorf("operation %d: %w", i, err)
+		}
+	}
+	return doc, nil
+}
+
+func applyOperation(doc interface{}, op map[string]json.RawMessage) (interface{}, error) {
+	var name string
+	err := unmarshalMember(op, "op", &name)
+	if err != nil {
+		return nil, err
+	}
+	path, err := pointerMember(op, "path")
+	if err != nil {
+		return nil, err
+	}
+
+	switch name {
+	case "add":
+		value, err := valueMember(op)
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, path, value)
+	case "remove":
+		doc, _, err = remove(doc, path)
+		return doc, err
+	case "replace":
+		value, err := valueMember(op)
+		if err != nil {
+			return nil, err
+		}
+		doc, _, err = remove(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, path, value)
+	case "move":
+		from, err := pointerMember(op, "from")
+		if err != nil {
+			return nil, err
+		}
+		if len(path) > len(from) && isPrefix(from, path) {
+			return nil, fsentry_error.Wrap(fmt.Errorf("can't move a value into itself"), fsentry_error.ErrorBadPatch)
+		}
+		doc, value, err := remove(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, path, value)
+	case "copy":
+		from, err := pointerMember(op, "from")
+		if err != nil {
+			return nil, err
+		}
+		value, err := get(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, path, deepCopy(value))
+	case "test":
+		value, err := valueMember(op)
+		if err != nil {
+			return nil, err
+		}
+		actual, err := get(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !isEqual(actual, value) {
+			return nil, fsentry_error.Wrap(fmt.Errorf("value of %q is not equal", formatPointer(path)), fsentry_error.ErrorPatchTest)
+		}
+		return doc, nil
+	default:
+		return nil, fsentry_error.Wrap(fmt.Errorf("unknown operation %q", name), fsentry_error.ErrorBadPatch)
+	}
+}
+
+func unmarshalMember(op map[string]json.RawMessage, key string, v interface{}) error {
+	raw, ok := op[key]
+	if !ok {
+		return fsentry_error.Wrap(fmt.Errorf("missing %q member", key), fsentry_error.ErrorBadPatch)
+	}
+	err := json.Unmarshal(raw, v)
+	if err != nil {
+		return fsentry_error.Wrap(err, fsentry_error.ErrorBadPatch)
+	}
+	return nil
+}
+
+func valueMember(op map[string]json.RawMessage) (interface{}, error) {
+	raw, ok := op["value"]
+	if !ok {
+		return nil, fsentry_error.Wrap(fmt.Errorf("missing %q member", "value"), fsentry_error.ErrorBadPatch)
+	}
+	value, err := decode(raw)
+	if err != nil {
+		return nil, fsentry_error.Wrap(err, fsentry_error.ErrorBadPatch)
+	}
+	return value, nil
+}
+
+func pointerMember(op map[string]json.RawMessage, key string) ([]string, error) {
+	var pointer string
+	err := unmarshalMember(op, key, &pointer)
+	if err != nil {
+		return nil, err
+	}
+	return parsePointer(pointer)
+}
+
+// parsePointer splits a JSON Pointer (RFC 6901) into unescaped reference tokens.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fsentry_error.Wrap(fmt.Errorf("pointer %q must start with /", pointer), fsentry_error.ErrorBadPatch)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+func formatPointer(tokens []string) string {
+	var b strings.Builder
+	for _, token := range tokens {
+		b.WriteString("/")
+		b.WriteString(strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1"))
+	}
+	return b.String()
+}
+
+func isPrefix(prefix, tokens []string) bool {
+	for i := range prefix {
+		if prefix[i] != tokens[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// get returns the value on the path.
+func get(doc interface{}, path []string) (interface{}, error) {
+	for i, token := range path {
+		switch v := doc.(type) {
+		case map[string]interface{}:
+			value, ok := v[token]
+			if !ok {
+				return nil, missing(path[:i+1])
+			}
+			doc = value
+		case []interface{}:
+			index, err := arrayIndex(token, len(v)-1)
+			if err != nil {
+				return nil, err
+			}
+			doc = v[index]
+		default:
+			return nil, missing(path[:i+1])
+		}
+	}
+	return doc, nil
+}
+
+// add inserts the value on the path, the parent of the path must exist. The new document is returned,
+// because an array can't be extended in place.
+func add(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return change(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch v := parent.(type) {
+		case map[string]interface{}:
+			v[token] = value
+			return v, nil
+		case []interface{}:
+			if token == "-" {
+				return append(v, value), nil
+			}
+			index, err := arrayIndex(token, len(v))
+			if err != nil {
+				return nil, err
+			}
+			v = append(v, nil)
+			copy(v[index+1:], v[index:])
+			v[index] = value
+			return v, nil
+		default:
+			return nil, missing(path)
+		}
+	})
+}
+
+// remove removes the value on the path, and returns the new document and the removed value.
+func remove(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, doc, nil
+	}
+	var removed interface{}
+	doc, err := change(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch v := parent.(type) {
+		case map[string]interface{}:
+			value, ok := v[token]
+			if !ok {
+				return nil, missing(path)
+			}
+			removed = value
+			delete(v, token)
+			return v, nil
+		case []interface{}:
+			index, err := arrayIndex(token, len(v)-1)
+			if err != nil {
+				return nil, err
+			}
+			removed = v[index]
+			return append(v[:index], v[index+1:]...), nil
+		default:
+			return nil, missing(path)
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return doc, removed, nil
+}
+
+// change calls fn with the parent of the path and the last token, and puts the returned parent back into the document.
+func change(doc interface{}, path []string, fn func(parent interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return fn(doc, path[0])
+	}
+	child, err := get(doc, path[:1])
+	if err != nil {
+		return nil, err
+	}
+	child, err = change(child, path[1:], fn)
+	if err != nil {
+		return nil, err
+	}
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		v[path[0]] = child
+	case []interface{}:
+		// The index has been checked by get.
+		index, _ := strconv.Atoi(path[0])
+		v[index] = child
+	}
+	return doc, nil
+}
+
+// arrayIndex parses the index of an array element, which must not be greater than max.
+func arrayIndex(token string, max int) (int, error) {
+	// Only digits without leading zeros are allowed, so "+1" and "01" are not indexes.
+	index, err := strconv.Atoi(token)
+	if err != nil || token[0] < '0' || token[0] > '9' || (len(token) > 1 && token[0] == '0') {
+		return 0, fsentry_error.Wrap(fmt.Errorf("bad array index %q", token), fsentry_error.ErrorBadPatch)
+	}
+	if index > max {
+		return 0, fsentry_error.Wrap(fmt.Errorf("array index %d is out of range", index), fsentry_error.ErrorBadPatch)
+	}
+	return index, nil
+}
+
+func missing(path []string) error {
+	return fsentry_error.Wrap(fmt.Errorf("value %q not exist", formatPointer(path)), fsentry_error.ErrorBadPatch)
+}
+
+func deepCopy(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		res := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			res[key] = deepCopy(value)
+		}
+		return res
+	case []interface{}:
+		res := make([]interface{}, len(v))
+		for i, value := range v {
+			res[i] = deepCopy(value)
+		}
+		return res
+	default:
+		return v
+	}
+}
+
+// isEqual compares json values, numbers are equal if their values are equal, like 1 and 1.0.
+func isEqual(a, b interface{}) bool {
+	switch a := a.(type) {
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for key, value := range a {
+			other, ok := b[key]
+			if !ok || !isEqual(value, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !isEqual(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		x, okX := new(big.Rat).SetString(a.String())
+		y, okY := new(big.Rat).SetString(b.String())
+		return okX && okY && x.Cmp(y) == 0
+	default:
+		return a == b
+	}
+}
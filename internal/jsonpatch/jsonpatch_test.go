@@ -0,0 +1,142 @@
+package jsonpatch
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/HardDie/fsentry/pkg/fsentry"
+	"github.com/HardDie/fsentry/pkg/fsentry_error"
+)
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   string
+		patch  fsentry.Patch
+		result string
+		err    error
+	}{
+		// Examples from RFC 7386.
+		{
+			name:   "merge",
+			data:   `{"title":"Goodbye!","author":{"givenName":"John","familyName":"Doe"},"tags":["example","sample"],"content":"This will be unchanged"}`,
+			patch:  fsentry.MergePatch([]byte(`{"title":"Hello!","phoneNumber":"+01-123-456-7890","author":{"familyName":null},"tags":["example"]}`)),
+			result: `{"author":{"givenName":"John"},"content":"This will be unchanged","phoneNumber":"+01-123-456-7890","tags":["example"],"title":"Hello!"}`,
+		},
+		{
+			name:   "merge not object",
+			data:   `{"a":"b"}`,
+			patch:  fsentry.MergePatch([]byte(`["c"]`)),
+			result: `["c"]`,
+		},
+		{
+			name:   "merge into null",
+			data:   ``,
+			patch:  fsentry.MergePatch([]byte(`{"a":{"bb":{"ccc":null}}}`)),
+			result: `{"a":{"bb":{}}}`,
+		},
+		{
+			name:   "merge numbers",
+			data:   `{"big":12345678901234567890}`,
+			patch:  fsentry.MergePatch([]byte(`{"small":1.50}`)),
+			result: `{"big":12345678901234567890,"small":1.50}`,
+		},
+		// Examples from RFC 6902.
+		{
+			name:   "add",
+			data:   `{"foo":["bar","baz"]}`,
+			patch:  fsentry.JSONPatch([]byte(`[{"op":"add","path":"/foo/1","value":"qux"},{"op":"add","path":"/child","value":{"grandchild":{}}}]`)),
+			result: `{"child":{"grandchild":{}},"foo":["bar","qux","baz"]}`,
+		},
+		{
+			name:   "remove",
+			data:   `{"baz":"qux","foo":["bar","qux","baz"]}`,
+			patch:  fsentry.JSONPatch([]byte(`[{"op":"remove","path":"/baz"},{"op":"remove","path":"/foo/1"}]`)),
+			result: `{"foo":["bar","baz"]}`,
+		},
+		{
+			name:   "replace",
+			data:   `{"baz":"qux","foo":"bar"}`,
+			patch:  fsentry.JSONPatch([]byte(`[{"op":"replace","path":"/baz","value":null}]`)),
+			result: `{"baz":null,"foo":"bar"}`,
+		},
+		{
+			name:   "move",
+			data:   `{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"},"list":["all","grass","cows","eat"]}`,
+			patch:  fsentry.JSONPatch([]byte(`[{"op":"move","from":"/foo/waldo","path":"/qux/thud"},{"op":"move","from":"/list/1","path":"/list/3"}]`)),
+			result: `{"foo":{"bar":"baz"},"list":["all","cows","eat","grass"],"qux":{"corge":"grault","thud":"fred"}}`,
+		},
+		{
+			name:   "copy",
+			data:   `{"a":{"b":[1]}}`,
+			patch:  fsentry.JSONPatch([]byte(`[{"op":"copy","from":"/a","path":"/c"},{"op":"add","path":"/c/b/-","value":2}]`)),
+			result: `{"a":{"b":[1]},"c":{"b":[1,2]}}`,
+		},
+		{
+			name:   "escaped pointer",
+			data:   `{"a/b":{"m~n":1}}`,
+			patch:  fsentry.JSONPatch([]byte(`[{"op":"test","path":"/a~1b/m~0n","value":1.0},{"op":"replace","path":"","value":[]}]`)),
+			result: `[]`,
+		},
+		{
+			name:  "test failed",
+			data:  `{"baz":"qux","foo":["a",2,"c"]}`,
+			patch: fsentry.JSONPatch([]byte(`[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":"2"}]`)),
+			err:   fsentry_error.ErrorPatchTest,
+		},
+		{
+			name:  "missing value",
+			data:  `{"foo":"bar"}`,
+			patch: fsentry.JSONPatch([]byte(`[{"op":"remove","path":"/baz"}]`)),
+			err:   fsentry_error.ErrorBadPatch,
+		},
+		{
+			name:  "missing parent",
+			data:  `{"foo":"bar"}`,
+			patch: fsentry.JSONPatch([]byte(`[{"op":"add","path":"/baz/bat","value":"qux"}]`)),
+			err:   fsentry_error.ErrorBadPatch,
+		},
+		{
+			name:  "bad index",
+			data:  `{"foo":["bar"]}`,
+			patch: fsentry.JSONPatch([]byte(`[{"op":"add","path":"/foo/01","value":"qux"}]`)),
+			err:   fsentry_error.ErrorBadPatch,
+		},
+		{
+			name:  "move into itself",
+			data:  `{"foo":{"bar":1}}`,
+			patch: fsentry.JSONPatch([]byte(`[{"op":"move","from":"/foo","path":"/foo/bar/baz"}]`)),
+			err:   fsentry_error.ErrorBadPatch,
+		},
+		{
+			name:  "unknown operation",
+			data:  `{}`,
+			patch: fsentry.JSONPatch([]byte(`[{"op":"merge","path":"/foo"}]`)),
+			err:   fsentry_error.ErrorBadPatch,
+		},
+		{
+			name:  "not a list",
+			data:  `{}`,
+			patch: fsentry.JSONPatch([]byte(`{"op":"add","path":"/foo","value":1}`)),
+			err:   fsentry_error.ErrorBadPatch,
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := Apply([]byte(tc.data), tc.patch)
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) {
+					t.Fatalf("expected error %v, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(result) != tc.result {
+				t.Fatalf("expected %s, got %s", tc.result, string(result))
+			}
+		})
+	}
+}
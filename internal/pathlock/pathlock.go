@@ -0,0 +1,181 @@
+// Package pathlock implements hierarchical locks for objects of a tree.
+//
+// An object is locked together with all its parent folders: the parents are locked shared and the object itself
+// is locked shared or exclusive. So an exclusive lock on a folder waits for all operations inside it, while
+// operations on sibling folders do not block each other.
+package pathlock
+
+import (
+	"context"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// keySeparator joins the path elements into a key. It is less than any other character,
+// so a key of a parent folder always goes before the keys of objects inside it.
+const keySeparator = "\x00"
+
+// Target is an object to be locked.
+type Target struct {
+	// Path is a list of folders from the root to the object, the root itself is an empty path.
+	Path        []string
+	IsExclusive bool
+}
+
+type Locker struct {
+	m     sync.Mutex
+	nodes map[string]*node
+}
+
+// node is a read-write lock of one object, all its fields are protected by the mutex of the Locker.
+// Unlike sync.RWMutex, waiting for it can be canceled.
+type node struct {
+	// readers is the number of shared holders, or -1 if the node is locked exclusively.
+	readers int
+	// writers is the number of goroutines waiting for the exclusive lock. New shared locks wait for them,
+	// so that writers are not starved by readers.
+	writers int
+	// wait is closed and replaced every time the node is released.
+	wait chan struct{}
+	// refs is the number of goroutines that hold or wait for the lock.
+	refs int
+}
+
+func New() *Locker {
+	return &Locker{
+		nodes: make(map[string]*node),
+	}
+}
+
+// Lock locks all targets and their parent folders and returns a function that releases the locks.
+//
+// All locks are taken in the same order by every call, so two operations that lock several objects,
+// like moving an object, can never wait for each other.
+func (l *Locker) Lock(targets ...Target) (unlock func()) {
+	// The background context is never canceled, so there is no error.
+	unlock, _ = l.LockContext(context.Background(), targets...)
+	return unlock
+}
+
+// LockContext is like Lock, but stops waiting when the context is canceled. In this case all locks
+// taken so far are released and the error of the context is returned.
+func (l *Locker) LockContext(ctx context.Context, targets ...Target) (unlock func(), err error) {
+	// isExclusive contains all required locks, an object locked both ways is locked exclusively.
+	isExclusive := make(map[string]bool)
+	for _, target := range targets {
+		elems := splitPath(target.Path)
+		for i := 0; i < len(elems); i++ {
+			key := strings.Join(elems[:i], keySeparator)
+			if _, ok := isExclusive[key]; !ok {
+				isExclusive[key] = false
+			}
+		}
+		key := strings.Join(elems, keySeparator)
+		isExclusive[key] = isExclusive[key] || target.IsExclusive
+	}
+
+	keys := make([]string, 0, len(isExclusive))
+	for key := range isExclusive {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	nodes := make([]*node, 0, len(keys))
+	unlock = func() {
+		l.m.Lock()
+		defer l.m.Unlock()
+
+		for i := len(nodes) - 1; i >= 0; i-- {
+			l.release(keys[i], nodes[i], isExclusive[keys[i]])
+		}
+	}
+	for _, key := range keys {
+		n, err := l.acquire(ctx, key, isExclusive[key])
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		nodes = append(nodes, n)
+	}
+	return unlock, nil
+}
+
+// acquire waits until the node can be locked, or the context is canceled.
+func (l *Locker) acquire(ctx context.Context, key string, isExclusive bool) (*node, error) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	n, ok := l.nodes[key]
+	if !ok {
+		n = &node{
+			wait: make(chan struct{}),
+		}
+		l.nodes[key] = n
+	}
+	n.refs++
+	if isExclusive {
+		n.writers++
+	}
+
+	for {
+		switch {
+		case isExclusive && n.readers == 0:
+			n.writers--
+			n.readers = -1
+			return n, nil
+		case !isExclusive && n.readers >= 0 && n.writers == 0:
+			n.readers++
+			return n, nil
+		}
+
+		wait := n.wait
+		l.m.Unlock()
+		select {
+		case <-wait:
+			l.m.Lock()
+		case <-ctx.Done():
+			l.m.Lock()
+			if isExclusive {
+				// Shared locks could wait only for this goroutine.
+				n.writers--
+				l.notify(n)
+			}
+			l.unref(key, n)
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// release unlocks the node and wakes up the waiting goroutines, the mutex of the Locker must be held.
+func (l *Locker) release(key string, n *node, isExclusive bool) {
+	if isExclusive {
+		n.readers = 0
+	} else {
+		n.readers--
+	}
+	l.notify(n)
+	l.unref(key, n)
+}
+
+func (l *Locker) notify(n *node) {
+	close(n.wait)
+	n.wait = make(chan struct{})
+}
+
+func (l *Locker) unref(key string, n *node) {
+	n.refs--
+	if n.refs == 0 {
+		delete(l.nodes, key)
+	}
+}
+
+// splitPath returns the elements of the path, so that "a/b" and "a", "b" are the same object.
+func splitPath(path []string) []string {
+	joined := filepath.ToSlash(filepath.Join(path...))
+	if joined == "" || joined == "." {
+		return nil
+	}
+	return strings.Split(strings.TrimPrefix(joined, "/"), "/")
+}
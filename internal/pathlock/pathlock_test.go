@@ -0,0 +1,125 @@
+package pathlock
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLock(t *testing.T) {
+	t.Run("siblings", func(t *testing.T) {
+		l := New()
+		unlock := l.Lock(Target{Path: []string{"a", "b"}, IsExclusive: true})
+		defer unlock()
+
+		// A sibling object must not wait for the locked one.
+		done := make(chan struct{})
+		go func() {
+			l.Lock(Target{Path: []string{"a", "c"}, IsExclusive: true})()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("sibling object is blocked")
+		}
+	})
+
+	t.Run("parent", func(t *testing.T) {
+		l := New()
+		unlock := l.Lock(Target{Path: []string{"a"}, IsExclusive: true})
+
+		// An object inside the exclusively locked folder must wait.
+		done := make(chan struct{})
+		go func() {
+			l.Lock(Target{Path: []string{"a", "b", "c"}})()
+			close(done)
+		}()
+		select {
+		case <-done:
+			t.Fatal("object inside the locked folder is not blocked")
+		case <-time.After(50 * time.Millisecond):
+		}
+		unlock()
+		<-done
+	})
+
+	t.Run("same_path", func(t *testing.T) {
+		l := New()
+		// "a/b" and "a", "b" is the same object.
+		unlock := l.Lock(Target{Path: []string{"a/b"}, IsExclusive: true})
+
+		done := make(chan struct{})
+		go func() {
+			l.Lock(Target{Path: []string{"a", "b"}})()
+			close(done)
+		}()
+		select {
+		case <-done:
+			t.Fatal("the same object is not blocked")
+		case <-time.After(50 * time.Millisecond):
+		}
+		unlock()
+		<-done
+	})
+
+	t.Run("deadlock", func(t *testing.T) {
+		l := New()
+		a := Target{Path: []string{"f", "a"}, IsExclusive: true}
+		b := Target{Path: []string{"f", "b"}, IsExclusive: true}
+		parent := Target{Path: []string{"f"}, IsExclusive: true}
+
+		// Objects are passed in different orders, but locked in the same one.
+		var wg sync.WaitGroup
+		for i := 0; i < 100; i++ {
+			wg.Add(3)
+			go func() {
+				defer wg.Done()
+				l.Lock(a, b)()
+			}()
+			go func() {
+				defer wg.Done()
+				l.Lock(b, a)()
+			}()
+			go func() {
+				defer wg.Done()
+				l.Lock(parent)()
+			}()
+		}
+
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("deadlock")
+		}
+		if len(l.nodes) != 0 {
+			t.Fatal("all locks must be released", len(l.nodes))
+		}
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		l := New()
+		unlock := l.Lock(Target{Path: []string{"a"}, IsExclusive: true})
+
+		// Waiting for the lock stops when the context is canceled.
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := l.LockContext(ctx, Target{Path: []string{"a", "b"}}, Target{Path: []string{"c"}})
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatal("expected deadline error, got", err)
+		}
+
+		// The locks taken before the cancellation are released.
+		unlock()
+		if len(l.nodes) != 0 {
+			t.Fatal("all locks must be released", len(l.nodes))
+		}
+	})
+}
@@ -0,0 +1,185 @@
+package service
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/HardDie/fsentry/internal/binary"
+	binaryService "github.com/HardDie/fsentry/internal/binary/service"
+	"github.com/HardDie/fsentry/internal/entry"
+	entryService "github.com/HardDie/fsentry/internal/entry/service"
+	"github.com/HardDie/fsentry/internal/fs"
+	"github.com/HardDie/fsentry/internal/utils"
+	"github.com/HardDie/fsentry/pkg/fsentry"
+	"github.com/HardDie/fsentry/pkg/fsentry_error"
+)
+
+// Batch runs many operations on entries and binaries, and returns a result for each of them.
+// An error of one operation does not stop the others.
+//
+// Operations are grouped by folders: all objects of a folder are locked at once, the operations run in parallel
+// by opts.Workers goroutines, and then the folder is flushed to the disk once. Operations on the same object
+// run in the order they are passed. If the folder can't be flushed, the error is set for all its successful
+// operations. Each operation is atomic, but the batch is not, use Tx for that.
+func (s *Service) Batch(ops []fsentry.BatchOp, opts fsentry.BatchOptions) []fsentry.BatchResult {
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	storage, syncFolder := fs.NoSync(s.fs)
+	b := &batch{
+		service: s,
+		binary:  binaryService.New(storage, s.journal, s.isPretty, s.naming),
+		entry:   entryService.New(storage, s.journal, s.isPretty, s.naming),
+		ops:     make([]fsentry.BatchOp, len(ops)),
+		results: make([]fsentry.BatchResult, len(ops)),
+	}
+	// Operations are grouped by the IDs of their folders, operations with a bad path fail at once.
+	copy(b.ops, ops)
+	for i := range b.ops {
+		b.ops[i].Path, b.results[i].Err = s.resolvePath(b.ops[i].Path)
+	}
+	for _, folder := range s.groupBatch(b.ops, b.results) {
+		b.runFolder(folder, workers, syncFolder)
+	}
+	return b.results
+}
+
+type batch struct {
+	service *Service
+	binary  binary.Service
+	entry   entry.Service
+	ops     []fsentry.BatchOp
+	results []fsentry.BatchResult
+}
+
+// batchFolder is a group of operations on objects of one folder.
+type batchFolder struct {
+	path []string
+	keys []string
+	// objects are indexes of operations on each object, in the order of keys.
+	objects [][]int
+}
+
+// groupBatch groups the operations by folders and by objects inside them, keeping the order of operations.
+// Operations that have already failed are skipped.
+func (s *Service) groupBatch(ops []fsentry.BatchOp, results []fsentry.BatchResult) []*batchFolder {
+	var folders []*batchFolder
+	folderIndex := make(map[string]*batchFolder)
+	objectIndex := make(map[string]int)
+	for i, op := range ops {
+		if results[i].Err != nil {
+			continue
+		}
+		folderKey := strings.Join(op.Path, "/")
+		folder, ok := folderIndex[folderKey]
+		if !ok {
+			folder = &batchFolder{
+				path: op.Path,
+			}
+			folderIndex[folderKey] = folder
+			folders = append(folders, folder)
+		}
+
+		key := s.batchKey(op)
+		objectKey := folderKey + "\x00" + key
+		j, ok := objectIndex[objectKey]
+		if !ok {
+			j = len(folder.keys)
+			objectIndex[objectKey] = j
+			folder.keys = append(folder.keys, key)
+			folder.objects = append(folder.objects, nil)
+		}
+		folder.objects[j] = append(folder.objects[j], i)
+	}
+	return folders
+}
+
+// runFolder locks all objects of the folder and runs their operations by the workers.
+func (b *batch) runFolder(folder *batchFolder, workers int, syncFolder func(path string) error) {
+	unlock, err := b.service.lockObjects(true, folder.path, folder.keys...)
+	if err != nil {
+		b.fail(folder, err)
+		return
+	}
+	defer unlock()
+
+	objects := make(chan []int)
+	var wg sync.WaitGroup
+	if workers > len(folder.objects) {
+		workers = len(folder.objects)
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for indexes := range objects {
+				for _, i := range indexes {
+					b.results[i] = b.run(b.ops[i])
+				}
+			}
+		}()
+	}
+	for _, indexes := range folder.objects {
+		objects <- indexes
+	}
+	close(objects)
+	wg.Wait()
+
+	// Written objects may be lost in a crash, if the folder is not flushed.
+	err = syncFolder(b.service.buildPath(folder.path...))
+	if err != nil {
+		b.service.log.Error("Batch(): error sync folder", "path", strings.Join(folder.path, "/"), "error", err)
+		b.fail(folder, err)
+	}
+}
+
+func (b *batch) run(op fsentry.BatchOp) fsentry.BatchResult {
+	err := utils.CheckContext(b.service.ctx)
+	if err != nil {
+		return fsentry.BatchResult{Err: err}
+	}
+
+	path := b.service.buildPath(op.Path...)
+	var res fsentry.BatchResult
+	switch op.Action {
+	case fsentry.BatchCreateEntry:
+		res.Entry, res.Err = b.entry.Create(path, op.Name, op.Data)
+	case fsentry.BatchUpdateEntry:
+		res.Entry, res.Err = b.entry.Update(path, op.Name, op.Data)
+	case fsentry.BatchRemoveEntry:
+		res.Err = b.entry.Remove(path, op.Name)
+	case fsentry.BatchCreateBinary:
+		res.Err = b.binary.Create(path, op.Name, op.Binary)
+	case fsentry.BatchUpdateBinary:
+		res.Err = b.binary.Update(path, op.Name, op.Binary)
+	case fsentry.BatchRemoveBinary:
+		res.Err = b.binary.Remove(path, op.Name)
+	default:
+		res.Err = fsentry_error.Wrap(fmt.Errorf("unknown batch action %d", op.Action), fsentry_error.ErrorInternal)
+	}
+	return res
+}
+
+// fail sets the error for all operations of the folder, that have been successful.
+func (b *batch) fail(folder *batchFolder, err error) {
+	for _, indexes := range folder.objects {
+		for _, i := range indexes {
+			if b.results[i].Err == nil {
+				b.results[i] = fsentry.BatchResult{Err: err}
+			}
+		}
+	}
+}
+
+func (s *Service) batchKey(op fsentry.BatchOp) string {
+	switch op.Action {
+	case fsentry.BatchCreateBinary, fsentry.BatchUpdateBinary, fsentry.BatchRemoveBinary:
+		return s.binaryKey(op.Name)
+	default:
+		return s.entryKey(op.Name)
+	}
+}
@@ -1,27 +1,367 @@
 package service
 
+import (
+	"errors"
+	"io"
+	"path/filepath"
+	"sync"
+
+	"github.com/HardDie/fsentry/internal/utils"
+	"github.com/HardDie/fsentry/pkg/fsentry"
+	"github.com/HardDie/fsentry/pkg/fsentry_error"
+)
+
 func (s *Service) CreateBinary(name string, data []byte, path ...string) error {
-	s.rwm.Lock()
-	defer s.rwm.Unlock()
+	path, err := s.resolvePath(path)
+	if err != nil {
+		return err
+	}
+	unlock, err := s.lockObjects(true, path, s.binaryKey(name))
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	return s.binary.Create(s.buildPath(path...), name, data)
 }
+func (s *Service) CreateBinaryWithOptions(name string, data []byte, opts fsentry.BinaryOptions, path ...string) (*fsentry.Binary, error) {
+	path, err := s.resolvePath(path)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := s.lockObjects(true, path, s.binaryKey(name))
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return s.binary.CreateWithOptions(s.buildPath(path...), name, data, opts)
+}
 func (s *Service) GetBinary(name string, path ...string) ([]byte, error) {
-	s.rwm.RLock()
-	defer s.rwm.RUnlock()
+	path, err := s.resolvePath(path)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := s.lockObjects(false, path, s.binaryKey(name))
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 	return s.binary.Get(s.buildPath(path...), name)
 }
+func (s *Service) GetBinaryInfo(name string, path ...string) (*fsentry.Binary, error) {
+	path, err := s.resolvePath(path)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := s.lockObjects(false, path, s.binaryKey(name))
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return s.binary.GetInfo(s.buildPath(path...), name)
+}
+
+// CreateBinaryFrom creates a binary with the content from the reader, the content is not kept in memory.
+func (s *Service) CreateBinaryFrom(name string, r io.Reader, path ...string) error {
+	path, err := s.resolvePath(path)
+	if err != nil {
+		return err
+	}
+	unlock, err := s.lockObjects(true, path, s.binaryKey(name))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	_, err = s.binary.CreateFrom(s.buildPath(path...), name, utils.ContextReader(s.ctx, r), fsentry.BinaryOptions{})
+	return err
+}
+
+// OpenBinary opens the content of the binary for reading, the reader must be closed.
+// The binary is not locked while it's open: if it's updated or removed, the reader keeps the old content.
+func (s *Service) OpenBinary(name string, path ...string) (io.ReadSeekCloser, error) {
+	path, err := s.resolvePath(path)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := s.lockObjects(false, path, s.binaryKey(name))
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return s.binary.Open(s.buildPath(path...), name)
+}
+
+// ReadBinaryRange returns up to length bytes of the content starting at the offset.
+func (s *Service) ReadBinaryRange(name string, offset, length int64, path ...string) ([]byte, error) {
+	path, err := s.resolvePath(path)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := s.lockObjects(false, path, s.binaryKey(name))
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return s.binary.ReadRange(s.buildPath(path...), name, offset, length)
+}
+
+// WriteBinary returns a writer that replaces the content of the binary, or creates a new binary.
+// The data is written to a temporary file, and the binary is locked and changed only when the writer is closed,
+// so readers are not blocked and never see a partial content. The writer must always be closed:
+// with Close to replace the binary, or with CloseWithError to discard the written data.
+func (s *Service) WriteBinary(name string, path ...string) (fsentry.BinaryWriter, error) {
+	path, err := s.resolvePath(path)
+	if err != nil {
+		return nil, err
+	}
+	fullPath := s.buildPath(path...)
+	return newBinaryWriter(func(r io.Reader) error {
+		stage, err := s.newWriteStage()
+		if err != nil {
+			return err
+		}
+		defer s.removeWriteStage(stage)
+
+		// No locks are held while the data is written, so the writer doesn't block other operations,
+		// even if they lock the whole storage.
+		staged, err := s.binary.Stage(stage.fullPath, name, utils.ContextReader(s.ctx, r))
+		if err != nil {
+			return err
+		}
+		unlock, err := s.lockObjects(true, path, s.binaryKey(name))
+		if err != nil {
+			s.binary.Discard(staged)
+			return err
+		}
+		defer unlock()
+		_, err = s.binary.Commit(fullPath, name, staged)
+		return err
+	}), nil
+}
+
+// writeStage is a folder inside the stage folder of the root, where one writer keeps its temporary file.
+type writeStage struct {
+	id       string
+	fullPath string
+	release  func()
+}
+
+// newWriteStage creates a folder for the data of a writer. The folder is marked as used before the root
+// is unlocked, so Init of this or another process never sees it unmarked and doesn't remove it.
+func (s *Service) newWriteStage() (*writeStage, error) {
+	unlock, err := s.lockFolder(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	id, err := utils.RandomHex(8)
+	if err != nil {
+		return nil, err
+	}
+	stage := &writeStage{
+		id:       id,
+		fullPath: filepath.Join(s.root, utils.ServiceFolder, stageFolder, id),
+	}
+	err = s.fs.CreateAllFolder(stage.fullPath)
+	if err != nil {
+		return nil, err
+	}
+	// Other processes find out from the held file that the writer is alive.
+	stage.release, err = s.fileLock.Hold(filepath.Join(stage.fullPath, stageHoldFile))
+	if err != nil {
+		s.removeStageFolder(stage.fullPath)
+		return nil, err
+	}
+	s.stages.add(id)
+	return stage, nil
+}
+
+// removeWriteStage removes the folder of the writer with its temporary file, if it was not committed.
+func (s *Service) removeWriteStage(stage *writeStage) {
+	stage.release()
+	s.removeStageFolder(stage.fullPath)
+	s.stages.remove(stage.id)
+}
+func (s *Service) removeStageFolder(fullPath string) {
+	// Init of another process removes the folder, if it finds it released.
+	err := s.fs.RemoveFolder(fullPath)
+	if err != nil && !errors.Is(err, fsentry_error.ErrorNotExist) {
+		s.log.Error("WriteBinary(): error remove stage folder", "path", fullPath, "error", err)
+	}
+}
+
+// cleanupStage removes the folders of writers interrupted by a crash. The folders of running writers
+// of this and other processes are kept.
+func (s *Service) cleanupStage() error {
+	stagePath := filepath.Join(s.root, utils.ServiceFolder, stageFolder)
+	files, err := s.fs.List(stagePath)
+	if errors.Is(err, fsentry_error.ErrorNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if s.stages.has(file.Name()) {
+			continue
+		}
+		fullPath := filepath.Join(stagePath, file.Name())
+		isHeld, err := s.fileLock.IsHeld(filepath.Join(fullPath, stageHoldFile))
+		if err != nil {
+			return err
+		}
+		if isHeld {
+			continue
+		}
+		if file.IsDir() {
+			err = s.fs.RemoveFolder(fullPath)
+		} else {
+			err = s.fs.RemoveFile(fullPath)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stageSet keeps the IDs of the write stages of running writers of the process.
+type stageSet struct {
+	mu  sync.Mutex
+	ids map[string]struct{}
+}
+
+func newStageSet() *stageSet {
+	return &stageSet{
+		ids: make(map[string]struct{}),
+	}
+}
+func (s *stageSet) add(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ids[id] = struct{}{}
+}
+func (s *stageSet) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.ids, id)
+}
+func (s *stageSet) has(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.ids[id]
+	return ok
+}
 func (s *Service) MoveBinary(oldName, newName string, path ...string) error {
-	s.rwm.Lock()
-	defer s.rwm.Unlock()
+	path, err := s.resolvePath(path)
+	if err != nil {
+		return err
+	}
+	unlock, err := s.lockObjects(true, path, s.binaryKey(oldName), s.binaryKey(newName))
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	return s.binary.Move(s.buildPath(path...), oldName, newName)
 }
 func (s *Service) UpdateBinary(name string, data []byte, path ...string) error {
-	s.rwm.Lock()
-	defer s.rwm.Unlock()
+	path, err := s.resolvePath(path)
+	if err != nil {
+		return err
+	}
+	unlock, err := s.lockObjects(true, path, s.binaryKey(name))
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	return s.binary.Update(s.buildPath(path...), name, data)
 }
 func (s *Service) RemoveBinary(name string, path ...string) error {
-	s.rwm.Lock()
-	defer s.rwm.Unlock()
+	path, err := s.resolvePath(path)
+	if err != nil {
+		return err
+	}
+	unlock, err := s.lockObjects(true, path, s.binaryKey(name))
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	return s.binary.Remove(s.buildPath(path...), name)
 }
+
+// RelocateBinary moves or copies the binary into another folder, optionally with a new name.
+// If dst.Name is empty, the name is kept.
+func (s *Service) RelocateBinary(src, dst fsentry.Location, opts fsentry.RelocateOptions) error {
+	if dst.Name == "" {
+		dst.Name = src.Name
+	}
+	err := s.resolveLocations(&src, &dst)
+	if err != nil {
+		return err
+	}
+	unlock, err := s.lockRelocate(src.Path, s.binaryKey(src.Name), dst.Path, s.binaryKey(dst.Name))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return s.binary.Relocate(s.buildPath(src.Path...), src.Name, s.buildPath(dst.Path...), dst.Name, opts)
+}
+
+const (
+	// stageFolder is a folder inside the service folder of the root, where WriteBinary writes the data
+	// until the writer is closed.
+	stageFolder = "stage"
+	// stageHoldFile is a file in the folder of a writer, which is held while the writer is open.
+	stageHoldFile = ".hold"
+)
+
+var (
+	// validate interface.
+	_ fsentry.BinaryWriter = &binaryWriter{}
+)
+
+// binaryWriter passes the written data to a write running in the background, which is finished on Close.
+type binaryWriter struct {
+	pw   *io.PipeWriter
+	done chan error
+
+	once sync.Once
+	err  error
+}
+
+func newBinaryWriter(write func(r io.Reader) error) *binaryWriter {
+	pr, pw := io.Pipe()
+	w := &binaryWriter{
+		pw:   pw,
+		done: make(chan error, 1),
+	}
+	go func() {
+		err := write(pr)
+		// If the write has failed, the next Write returns its error.
+		pr.CloseWithError(err)
+		w.done <- err
+	}()
+	return w
+}
+func (w *binaryWriter) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+func (w *binaryWriter) Close() error {
+	w.once.Do(func() {
+		// The end of the data, the write replaces the binary with the temporary file and returns.
+		w.pw.Close()
+		w.err = <-w.done
+	})
+	return w.err
+}
+func (w *binaryWriter) CloseWithError(err error) error {
+	w.once.Do(func() {
+		// The write gets an error instead of the end of the data, so the temporary file is removed
+		// and the binary is not changed. The error of the caller is not passed, it could be io.EOF.
+		w.pw.CloseWithError(errWriteAborted)
+		<-w.done
+	})
+	return nil
+}
+
+var errWriteAborted = errors.New("write aborted")
@@ -0,0 +1,211 @@
+package service
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/HardDie/fsentry/internal/utils"
+	"github.com/HardDie/fsentry/pkg/fsentry"
+)
+
+const (
+	// quarantineFolder is a folder inside the service folder of the root, where unparsable files are moved on repair.
+	quarantineFolder = "quarantine"
+	folderInfoFile   = ".info.json"
+	// binaryInfoSuffix ends the names of the hidden metadata files of binaries: "." + id + ".bin.info.json".
+	binaryInfoSuffix = binaryFileExt + ".info.json"
+)
+
+// Check walks through the whole storage and returns a report of found inconsistencies.
+// If opts.Repair is set, the found problems are fixed.
+//
+// The whole storage is locked until the end, otherwise temporary objects of running operations would be
+// reported as leftovers.
+func (s *Service) Check(opts fsentry.CheckOptions) (*fsentry.CheckReport, error) {
+	unlock, err := s.lockFolder(true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	report := &fsentry.CheckReport{}
+
+	// Interrupted operations must be finished first, because they leave temporary folders behind.
+	records, err := s.journal.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, rec := range records {
+		report.Problems = append(report.Problems, fsentry.CheckProblem{
+			Kind:       fsentry.ProblemLeftover,
+			Path:       []string{},
+			Name:       rec.ID,
+			Message:    fmt.Sprintf("interrupted %s operation of %q", rec.Operation, rec.SrcPath),
+			IsRepaired: opts.Repair,
+		})
+	}
+	if opts.Repair && len(records) > 0 {
+		err = s.journal.Recover()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = s.checkFolder(report, s.root, nil, opts.Repair)
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// checkFolder checks all objects inside the folder and then all subfolders recursively.
+func (s *Service) checkFolder(report *fsentry.CheckReport, fullPath string, path []string, isRepair bool) error {
+	var folders, entries, binaryInfos []string
+	var leftovers []os.DirEntry
+	binaries := make(map[string]struct{})
+
+	// Every found problem is repaired right away, so the check can be stopped between folders.
+	err := utils.CheckContext(s.ctx)
+	if err != nil {
+		return err
+	}
+
+	// The folder is read first and only then modified, so the listing is not affected by the repair.
+	err = s.fs.ListFunc(fullPath, func(file os.DirEntry) error {
+		name := file.Name()
+		switch {
+		case len(path) == 0 && name == utils.ServiceFolder:
+			// journal and quarantine are not checked
+		case utils.IsLeftover(name):
+			leftovers = append(leftovers, file)
+		case strings.HasPrefix(name, ".") && strings.HasSuffix(name, binaryInfoSuffix) && !file.IsDir():
+			binaryInfos = append(binaryInfos, name)
+		case strings.HasPrefix(name, "."):
+			// skip hidden files, like .info.json
+		case file.IsDir():
+			folders = append(folders, name)
+		case filepath.Ext(name) == entryFileExt:
+			entries = append(entries, strings.TrimSuffix(name, entryFileExt))
+		case filepath.Ext(name) == binaryFileExt:
+			binaries[strings.TrimSuffix(name, binaryFileExt)] = struct{}{}
+			report.Binaries++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	addProblems := func(problems []fsentry.CheckProblem) {
+		for _, problem := range problems {
+			problem.Path = append([]string{}, path...)
+			report.Problems = append(report.Problems, problem)
+		}
+	}
+
+	for _, file := range leftovers {
+		problem := fsentry.CheckProblem{
+			Kind:    fsentry.ProblemLeftover,
+			Name:    file.Name(),
+			Message: "temporary object left by an interrupted operation",
+		}
+		if isRepair {
+			if file.IsDir() {
+				err = s.fs.RemoveFolder(filepath.Join(fullPath, file.Name()))
+			} else {
+				err = s.fs.RemoveFile(filepath.Join(fullPath, file.Name()))
+			}
+			if err != nil {
+				return err
+			}
+			problem.IsRepaired = true
+		}
+		addProblems([]fsentry.CheckProblem{problem})
+	}
+
+	for _, name := range binaryInfos {
+		id := strings.TrimSuffix(strings.TrimPrefix(name, "."), binaryInfoSuffix)
+		if _, ok := binaries[id]; ok {
+			continue
+		}
+		problem := fsentry.CheckProblem{
+			Kind:    fsentry.ProblemOrphanInfo,
+			Name:    name,
+			Message: "metadata of a missing binary",
+		}
+		if isRepair {
+			err = s.fs.RemoveFile(filepath.Join(fullPath, name))
+			if err != nil {
+				return err
+			}
+			problem.IsRepaired = true
+		}
+		addProblems([]fsentry.CheckProblem{problem})
+	}
+
+	for _, id := range entries {
+		report.Entries++
+		problems, err := s.entry.Check(fullPath, id, isRepair)
+		if err != nil {
+			return err
+		}
+		if isRepair && isInvalidJSON(problems) {
+			err = s.quarantine(fullPath, path, id+entryFileExt)
+			if err != nil {
+				return err
+			}
+			problems[0].IsRepaired = true
+		}
+		addProblems(problems)
+	}
+
+	for _, id := range folders {
+		report.Folders++
+		problems, err := s.folder.Check(fullPath, id, isRepair)
+		if err != nil {
+			return err
+		}
+		if isRepair && isInvalidJSON(problems) {
+			err = s.quarantine(filepath.Join(fullPath, id), append(path[:len(path):len(path)], id), folderInfoFile)
+			if err != nil {
+				return err
+			}
+			// Now the info file is missing and will be created again.
+			_, err = s.folder.Check(fullPath, id, isRepair)
+			if err != nil {
+				return err
+			}
+			problems[0].IsRepaired = true
+		}
+		addProblems(problems)
+
+		err = s.checkFolder(report, filepath.Join(fullPath, id), append(path[:len(path):len(path)], id), isRepair)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// quarantine moves the file into the quarantine folder, keeping the path of the folder containing it.
+func (s *Service) quarantine(fullPath string, path []string, name string) error {
+	dstFolder := filepath.Join(append([]string{s.root, utils.ServiceFolder, quarantineFolder}, path...)...)
+	err := s.fs.CreateAllFolder(dstFolder)
+	if err != nil {
+		return err
+	}
+
+	// The same file may be quarantined several times, so a random suffix is added.
+	suffix, err := utils.RandomHex(4)
+	if err != nil {
+		return err
+	}
+	return s.fs.Rename(filepath.Join(fullPath, name), filepath.Join(dstFolder, name+"."+suffix))
+}
+
+// isInvalidJSON reports whether the file cannot be parsed, in this case it is the only problem found.
+func isInvalidJSON(problems []fsentry.CheckProblem) bool {
+	return len(problems) == 1 && problems[0].Kind == fsentry.ProblemInvalidJSON
+}
@@ -5,32 +5,122 @@ import (
 )
 
 func (s *Service) CreateEntry(name string, data interface{}, path ...string) (*fsentry.Entry, error) {
-	s.rwm.Lock()
-	defer s.rwm.Unlock()
+	path, err := s.resolvePath(path)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := s.lockObjects(true, path, s.entryKey(name))
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 	return s.entry.Create(s.buildPath(path...), name, data)
 }
 func (s *Service) GetEntry(name string, path ...string) (*fsentry.Entry, error) {
-	s.rwm.RLock()
-	defer s.rwm.RUnlock()
+	path, err := s.resolvePath(path)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := s.lockObjects(false, path, s.entryKey(name))
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 	return s.entry.Get(s.buildPath(path...), name)
 }
 func (s *Service) MoveEntry(oldName, newName string, path ...string) (*fsentry.Entry, error) {
-	s.rwm.Lock()
-	defer s.rwm.Unlock()
+	path, err := s.resolvePath(path)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := s.lockObjects(true, path, s.entryKey(oldName), s.entryKey(newName))
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 	return s.entry.Move(s.buildPath(path...), oldName, newName)
 }
 func (s *Service) UpdateEntry(name string, data interface{}, path ...string) (*fsentry.Entry, error) {
-	s.rwm.Lock()
-	defer s.rwm.Unlock()
+	path, err := s.resolvePath(path)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := s.lockObjects(true, path, s.entryKey(name))
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 	return s.entry.Update(s.buildPath(path...), name, data)
 }
+
+// UpdateEntryIf updates the entry only if its revision is equal to expectedRevision, otherwise
+// fsentry_error.ErrorConflict is returned. It allows several writers to update the same entry without losing changes.
+func (s *Service) UpdateEntryIf(name string, data interface{}, expectedRevision uint64, path ...string) (*fsentry.Entry, error) {
+	path, err := s.resolvePath(path)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := s.lockObjects(true, path, s.entryKey(name))
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return s.entry.UpdateIf(s.buildPath(path...), name, data, expectedRevision)
+}
+
+// PatchEntry applies a JSON Merge Patch or a JSON Patch to the data of the entry. The stored data is read
+// and written under the lock, so concurrent patches of different fields don't overwrite each other.
+func (s *Service) PatchEntry(name string, patch fsentry.Patch, path ...string) (*fsentry.Entry, error) {
+	path, err := s.resolvePath(path)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := s.lockObjects(true, path, s.entryKey(name))
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return s.entry.Patch(s.buildPath(path...), name, patch)
+}
 func (s *Service) RemoveEntry(name string, path ...string) error {
-	s.rwm.Lock()
-	defer s.rwm.Unlock()
+	path, err := s.resolvePath(path)
+	if err != nil {
+		return err
+	}
+	unlock, err := s.lockObjects(true, path, s.entryKey(name))
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	return s.entry.Remove(s.buildPath(path...), name)
 }
 func (s *Service) DuplicateEntry(srcName, dstName string, path ...string) (*fsentry.Entry, error) {
-	s.rwm.Lock()
-	defer s.rwm.Unlock()
+	path, err := s.resolvePath(path)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := s.lockObjects(true, path, s.entryKey(srcName), s.entryKey(dstName))
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 	return s.entry.Duplicate(s.buildPath(path...), srcName, dstName)
 }
+
+// RelocateEntry moves or copies the entry into another folder, optionally with a new name. If dst.Name is empty,
+// the name is kept. A moved entry keeps its creation time and revision, a copy is a new entry.
+func (s *Service) RelocateEntry(src, dst fsentry.Location, opts fsentry.RelocateOptions) (*fsentry.Entry, error) {
+	if dst.Name == "" {
+		dst.Name = src.Name
+	}
+	err := s.resolveLocations(&src, &dst)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := s.lockRelocate(src.Path, s.entryKey(src.Name), dst.Path, s.entryKey(dst.Name))
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return s.entry.Relocate(s.buildPath(src.Path...), src.Name, s.buildPath(dst.Path...), dst.Name, opts)
+}
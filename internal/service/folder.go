@@ -5,37 +5,135 @@ import (
 )
 
 func (s *Service) CreateFolder(name string, data interface{}, path ...string) (*fsentry.FolderInfo, error) {
-	s.rwm.Lock()
-	defer s.rwm.Unlock()
+	path, err := s.resolvePath(path)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := s.lockFolders(true, path, name)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 	return s.folder.Create(s.buildPath(path...), name, data)
 }
 func (s *Service) GetFolder(name string, path ...string) (*fsentry.FolderInfo, error) {
-	s.rwm.RLock()
-	defer s.rwm.RUnlock()
+	path, err := s.resolvePath(path)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := s.lockFolders(false, path, name)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 	return s.folder.Get(s.buildPath(path...), name)
 }
 func (s *Service) MoveFolder(oldName, newName string, path ...string) (*fsentry.FolderInfo, error) {
-	s.rwm.Lock()
-	defer s.rwm.Unlock()
+	path, err := s.resolvePath(path)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := s.lockFolders(true, path, oldName, newName)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 	return s.folder.Move(s.buildPath(path...), oldName, newName)
 }
 func (s *Service) UpdateFolder(name string, data interface{}, path ...string) (*fsentry.FolderInfo, error) {
-	s.rwm.Lock()
-	defer s.rwm.Unlock()
+	path, err := s.resolvePath(path)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := s.lockFolders(true, path, name)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 	return s.folder.Update(s.buildPath(path...), name, data)
 }
+
+// UpdateFolderIf updates the folder only if its revision is equal to expectedRevision, otherwise
+// fsentry_error.ErrorConflict is returned. It allows several writers to update the same folder without losing changes.
+func (s *Service) UpdateFolderIf(name string, data interface{}, expectedRevision uint64, path ...string) (*fsentry.FolderInfo, error) {
+	path, err := s.resolvePath(path)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := s.lockFolders(true, path, name)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return s.folder.UpdateIf(s.buildPath(path...), name, data, expectedRevision)
+}
+
+// PatchFolder applies a JSON Merge Patch or a JSON Patch to the data of the folder. The stored data is read
+// and written under the lock, so concurrent patches of different fields don't overwrite each other.
+func (s *Service) PatchFolder(name string, patch fsentry.Patch, path ...string) (*fsentry.FolderInfo, error) {
+	path, err := s.resolvePath(path)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := s.lockFolders(true, path, name)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return s.folder.Patch(s.buildPath(path...), name, patch)
+}
 func (s *Service) RemoveFolder(name string, path ...string) error {
-	s.rwm.Lock()
-	defer s.rwm.Unlock()
+	path, err := s.resolvePath(path)
+	if err != nil {
+		return err
+	}
+	unlock, err := s.lockFolders(true, path, name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	return s.folder.Remove(s.buildPath(path...), name)
 }
 func (s *Service) DuplicateFolder(srcName, dstName string, path ...string) (*fsentry.FolderInfo, error) {
-	s.rwm.Lock()
-	defer s.rwm.Unlock()
-	return s.folder.Duplicate(s.buildPath(path...), srcName, dstName)
+	path, err := s.resolvePath(path)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := s.lockFolders(true, path, srcName, dstName)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return s.folder.Duplicate(s.ctx, s.buildPath(path...), srcName, dstName)
 }
 func (s *Service) UpdateFolderNameWithoutTimestamp(oldName, newName string, path ...string) (*fsentry.FolderInfo, error) {
-	s.rwm.Lock()
-	defer s.rwm.Unlock()
+	path, err := s.resolvePath(path)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := s.lockFolders(true, path, oldName, newName)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 	return s.folder.MoveWithoutTimestamp(s.buildPath(path...), oldName, newName)
 }
+
+// RelocateFolder moves or copies the folder with all its content into another folder, optionally with a new name.
+// If dst.Name is empty, the name is kept. A folder can't be placed inside itself, it's an ErrorBadPath.
+// A moved folder keeps its creation time and revision, a copy is a new folder.
+func (s *Service) RelocateFolder(src, dst fsentry.Location, opts fsentry.RelocateOptions) (*fsentry.FolderInfo, error) {
+	if dst.Name == "" {
+		dst.Name = src.Name
+	}
+	err := s.resolveLocations(&src, &dst)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := s.lockRelocateFolders(src.Path, src.Name, dst.Path, dst.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return s.folder.Relocate(s.ctx, s.buildPath(src.Path...), src.Name, s.buildPath(dst.Path...), dst.Name, opts)
+}
@@ -1,14 +1,24 @@
 package service
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
 	"path/filepath"
-	"sync"
+	"strings"
 
 	"github.com/HardDie/fsentry/internal/binary"
 	"github.com/HardDie/fsentry/internal/entry"
+	"github.com/HardDie/fsentry/internal/flock"
 	"github.com/HardDie/fsentry/internal/folder"
 	"github.com/HardDie/fsentry/internal/fs"
+	"github.com/HardDie/fsentry/internal/journal"
+	"github.com/HardDie/fsentry/internal/pathlock"
+	"github.com/HardDie/fsentry/internal/utils"
 	"github.com/HardDie/fsentry/pkg/fsentry"
+	"github.com/HardDie/fsentry/pkg/fsentry_error"
+	"github.com/HardDie/fsentry/pkg/fsentry_storage"
 )
 
 var (
@@ -17,41 +27,77 @@ var (
 )
 
 type Service struct {
+	// ctx is set with WithContext, it cancels waiting for locks and long operations.
+	ctx      context.Context
 	log      fsentry.Logger
 	root     string
-	rwm      sync.RWMutex
+	lock     *pathlock.Locker
+	fileLock *flock.Locker
+	// stages are the folders of the running writers of binaries, which Init must not remove.
+	stages   *stageSet
 	isPretty bool
+	// naming is passed to the kind services created for transactions and batches, and selects how
+	// objects are locked.
+	naming utils.Naming
 
-	fs     fs.FS
-	binary binary.Service
-	entry  entry.Service
-	folder folder.Service
+	fs      fs.FS
+	journal journal.Service
+	binary  binary.Service
+	entry   entry.Service
+	folder  folder.Service
 }
 
 func New(
 	log fsentry.Logger,
 	root string,
 	isPretty bool,
+	naming utils.Naming,
+	fileLock *flock.Locker,
 	fs fs.FS,
+	journal journal.Service,
 	binary binary.Service,
 	entry entry.Service,
 	folder folder.Service,
 ) *Service {
+	if log == nil {
+		log = stdLogger{}
+	}
 	return &Service{
+		ctx:      context.Background(),
 		log:      log,
 		root:     root,
+		lock:     pathlock.New(),
+		fileLock: fileLock,
+		stages:   newStageSet(),
 		isPretty: isPretty,
+		naming:   naming,
 		fs:       fs,
+		journal:  journal,
 		binary:   binary,
 		entry:    entry,
 		folder:   folder,
 	}
 }
 
+// WithContext returns the same storage, whose methods stop waiting for locks and stop long operations,
+// like duplicating a folder or walking through it, when the context is canceled. In this case
+// the error of the context is returned wrapped with fsentry_error.ErrorCanceled.
+//
+// Operations are canceled only between steps that leave the storage consistent, so a canceled operation
+// is either not done or rolled back.
+func (s *Service) WithContext(ctx context.Context) fsentry.IFSEntry {
+	c := *s
+	c.ctx = ctx
+	return &c
+}
+
 // Init check if a repository folder has been created and if not, create one.
 func (s *Service) Init() error {
-	s.rwm.Lock()
-	defer s.rwm.Unlock()
+	unlock, err := s.lockFolder(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
 	// Check if db folder exist
 	isExist, err := s.fs.IsFolderExist(s.root)
@@ -59,7 +105,23 @@ func (s *Service) Init() error {
 		return err
 	}
 	if isExist {
-		return nil
+		// Remove files left after writes interrupted by a crash. Writers of binaries don't lock the root,
+		// so their temporary files are cleaned up separately.
+		err = s.cleanupTemp(s.root, filepath.Join(s.root, utils.ServiceFolder, stageFolder))
+		if err != nil {
+			return err
+		}
+		err = s.cleanupStage()
+		if err != nil {
+			return err
+		}
+		// Finish or roll back multi-step operations interrupted by a crash.
+		err = s.journal.Recover()
+		if err != nil {
+			return err
+		}
+		// Interrupted transactions are rolled back, so the objects they prepared are not needed.
+		return s.cleanupTx()
 	}
 	err = s.fs.CreateAllFolder(s.root)
 	if err != nil {
@@ -70,8 +132,11 @@ func (s *Service) Init() error {
 
 // Drop if you want to delete the fsentry repository you can use this method.
 func (s *Service) Drop() error {
-	s.rwm.Lock()
-	defer s.rwm.Unlock()
+	unlock, err := s.lockFolder(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
 	// Check if db folder exist
 	isExist, err := s.fs.IsFolderExist(s.root)
@@ -82,6 +147,13 @@ func (s *Service) Drop() error {
 		return nil
 	}
 
+	if s.fileLock.IsEnabled() {
+		// Lock files are held by this and other processes, so they are never removed.
+		return s.removeExcept(s.root, utils.ServiceFolder, func() error {
+			return s.removeExcept(filepath.Join(s.root, utils.ServiceFolder), flock.LockFolder, nil)
+		})
+	}
+
 	// Remove db folder
 	err = s.fs.RemoveFolder(s.root)
 	if err != nil {
@@ -91,20 +163,310 @@ func (s *Service) Drop() error {
 	return nil
 }
 
-// List allows you to get a list of objects (folders and entries) on the selected path.
-func (s *Service) List(path ...string) (*fsentry.List, error) {
-	s.rwm.RLock()
-	defer s.rwm.RUnlock()
+// removeExcept removes the content of the folder except the subfolder with the name, which is handled by keep.
+func (s *Service) removeExcept(fullPath, name string, keep func() error) error {
+	files, err := s.fs.List(fullPath)
+	if err != nil {
+		return err
+	}
+	var isKept bool
+	for _, file := range files {
+		switch {
+		case file.Name() == name && file.IsDir():
+			isKept = true
+		case file.IsDir():
+			err = s.fs.RemoveFolder(filepath.Join(fullPath, file.Name()))
+		default:
+			err = s.fs.RemoveFile(filepath.Join(fullPath, file.Name()))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if !isKept || keep == nil {
+		return nil
+	}
+	return keep()
+}
 
-	fullPath := s.buildPath(path...)
-	_, err := s.fs.List(fullPath)
+// cleanupTemp removes temporary files inside the folder, except the files inside the skipped folder.
+func (s *Service) cleanupTemp(fullPath, skipPath string) error {
+	files, err := s.fs.List(fullPath)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	for _, file := range files {
+		filePath := filepath.Join(fullPath, file.Name())
+		switch {
+		case filePath == skipPath:
+		case file.IsDir() && strings.HasPrefix(skipPath, filePath+string(filepath.Separator)):
+			err = s.cleanupTemp(filePath, skipPath)
+		case file.IsDir():
+			err = s.fs.CleanupTemp(filePath)
+		case strings.HasPrefix(file.Name(), fsentry_storage.TempFilePrefix):
+			err = s.fs.RemoveFile(filePath)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanupTx removes the folder with objects prepared by transactions, if it exists.
+func (s *Service) cleanupTx() error {
+	txPath := filepath.Join(s.root, utils.ServiceFolder, txFolder)
+	isExist, err := s.fs.IsFolderExist(txPath)
+	if err != nil || !isExist {
+		return err
 	}
-	return nil, nil
+	return s.fs.RemoveFolder(txPath)
 }
 
 func (s *Service) buildPath(path ...string) string {
 	pathSlice := append([]string{s.root}, path...)
 	return filepath.Join(pathSlice...)
 }
+
+// resolvePath returns the IDs of the folders on the path, which is passed by IDs or names of the folders.
+// The path is resolved before locking, locks and buildPath always get IDs.
+func (s *Service) resolvePath(path []string) ([]string, error) {
+	return s.folder.ResolvePath(s.root, path)
+}
+
+// resolveLocations resolves the paths of the source and the destination of a relocation.
+func (s *Service) resolveLocations(src, dst *fsentry.Location) (err error) {
+	src.Path, err = s.resolvePath(src.Path)
+	if err != nil {
+		return err
+	}
+	dst.Path, err = s.resolvePath(dst.Path)
+	return err
+}
+
+// lockFolder locks the folder itself and its parent folders shared. An exclusive lock of the root
+// folder waits for all other operations.
+func (s *Service) lockFolder(isExclusive bool, path ...string) (unlock func(), err error) {
+	unlock, err = s.lock.LockContext(s.ctx, pathlock.Target{
+		Path:        path,
+		IsExclusive: isExclusive,
+	})
+	if err != nil {
+		return nil, fsentry_error.Wrap(err, fsentry_error.ErrorCanceled)
+	}
+	return s.lockFile(unlock, isExclusive, path)
+}
+
+// lockObjects locks the objects with the keys inside the folder, and the folder with its parents shared.
+// Objects are locked independently, so a slow operation on one of them does not block the others.
+//
+// If IDs don't follow from the names, different names can refer to the same object, so the whole folder
+// is locked instead.
+func (s *Service) lockObjects(isExclusive bool, path []string, keys ...string) (unlock func(), err error) {
+	if !s.naming.IsNameBased() {
+		return s.lockFolder(isExclusive, path...)
+	}
+	targets := make([]pathlock.Target, 0, len(keys))
+	for _, key := range keys {
+		targets = append(targets, pathlock.Target{
+			Path:        append(path[:len(path):len(path)], key),
+			IsExclusive: isExclusive,
+		})
+	}
+	unlock, err = s.lock.LockContext(s.ctx, targets...)
+	if err != nil {
+		return nil, fsentry_error.Wrap(err, fsentry_error.ErrorCanceled)
+	}
+	// Other processes are synchronized on the folder containing the objects, lock files of single objects
+	// would pile up in the root.
+	return s.lockFile(unlock, isExclusive, path)
+}
+
+// lockRelocate locks the source and the destination objects, which can be in different folders.
+// Other processes are synchronized on the closest common folder of them, because locking two folders
+// one by one could deadlock with a process locking them in another order.
+func (s *Service) lockRelocate(srcPath []string, srcKey string, dstPath []string, dstKey string) (unlock func(), err error) {
+	common := commonPath(srcPath, dstPath)
+	if !s.naming.IsNameBased() {
+		return s.lockFolder(true, common...)
+	}
+
+	unlock, err = s.lock.LockContext(s.ctx, pathlock.Target{
+		Path:        append(srcPath[:len(srcPath):len(srcPath)], srcKey),
+		IsExclusive: true,
+	}, pathlock.Target{
+		Path:        append(dstPath[:len(dstPath):len(dstPath)], dstKey),
+		IsExclusive: true,
+	})
+	if err != nil {
+		return nil, fsentry_error.Wrap(err, fsentry_error.ErrorCanceled)
+	}
+	return s.lockFile(unlock, true, common)
+}
+func commonPath(srcPath, dstPath []string) []string {
+	common := 0
+	for common < len(srcPath) && common < len(dstPath) && srcPath[common] == dstPath[common] {
+		common++
+	}
+	return srcPath[:common]
+}
+
+// lockFolders locks the folders with the names inside the folder, like lockObjects. Operations inside
+// a folder lock it by the ID from their path, which is not the ID of the name after a name collision,
+// with IDSlugHash or for legacy IDs, so existing folders are locked by their real IDs. Missing folders
+// are locked by the keys of their names, like in CreateFolder, so they can't be created in the meantime.
+//
+// The IDs are resolved under the lock of the parent folder and checked again once the folders are locked.
+// If a folder has been changed in between, or its ID can't be resolved, the parent folder is locked exclusively.
+func (s *Service) lockFolders(isExclusive bool, path []string, names ...string) (unlock func(), err error) {
+	if !s.naming.IsNameBased() {
+		return s.lockFolder(isExclusive, path...)
+	}
+	keys, ok, err := s.resolveFolderKeys(path, names)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return s.lockFolder(true, path...)
+	}
+	unlock, err = s.lockObjects(isExclusive, path, keys...)
+	if err != nil {
+		return nil, err
+	}
+	if s.isFolderKeys(path, names, keys) {
+		return unlock, nil
+	}
+	unlock()
+	return s.lockFolder(true, path...)
+}
+
+// lockRelocateFolders locks the source and the destination folders by their real IDs, like lockFolders.
+// If they can't be resolved, the closest common folder of them is locked exclusively.
+func (s *Service) lockRelocateFolders(srcPath []string, srcName string, dstPath []string, dstName string) (unlock func(), err error) {
+	if !s.naming.IsNameBased() {
+		return s.lockRelocate(srcPath, srcName, dstPath, dstName)
+	}
+	srcKeys, isSrcOK, err := s.resolveFolderKeys(srcPath, []string{srcName})
+	if err != nil {
+		return nil, err
+	}
+	dstKeys, isDstOK, err := s.resolveFolderKeys(dstPath, []string{dstName})
+	if err != nil {
+		return nil, err
+	}
+	if !isSrcOK || !isDstOK {
+		return s.lockFolder(true, commonPath(srcPath, dstPath)...)
+	}
+	unlock, err = s.lockRelocate(srcPath, srcKeys[0], dstPath, dstKeys[0])
+	if err != nil {
+		return nil, err
+	}
+	if s.isFolderKeys(srcPath, []string{srcName}, srcKeys) && s.isFolderKeys(dstPath, []string{dstName}, dstKeys) {
+		return unlock, nil
+	}
+	unlock()
+	return s.lockFolder(true, commonPath(srcPath, dstPath)...)
+}
+
+// resolveFolderKeys returns the lock keys of the folders with the names under the shared lock of the parent folder.
+func (s *Service) resolveFolderKeys(path []string, names []string) (keys []string, ok bool, err error) {
+	unlock, err := s.lockFolder(false, path...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer unlock()
+	keys, ok = s.folderKeys(path, names)
+	return keys, ok, nil
+}
+
+// isFolderKeys checks that the locked keys are still the keys of the folders.
+func (s *Service) isFolderKeys(path []string, names []string, keys []string) bool {
+	actual, ok := s.folderKeys(path, names)
+	if !ok {
+		return false
+	}
+	for i := range keys {
+		if actual[i] != keys[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// folderKeys returns the IDs of the existing folders with the names, and the keys of the names for the missing ones.
+// The parent folder must be locked.
+func (s *Service) folderKeys(path []string, names []string) ([]string, bool) {
+	fullPath := s.buildPath(path...)
+	keys := make([]string, 0, len(names))
+	for _, name := range names {
+		id, err := s.folder.ResolveID(fullPath, name)
+		switch {
+		case err == nil:
+			keys = append(keys, id)
+		case errors.Is(err, fsentry_error.ErrorNotExist) || errors.Is(err, fsentry_error.ErrorBadName):
+			keys = append(keys, s.folderKey(name))
+		default:
+			return nil, false
+		}
+	}
+	return keys, true
+}
+
+// lockFile takes the file lock of the folder after the lock of the process, so goroutines waiting for
+// the same object do not hold the file lock. If the file lock fails, the process lock is released.
+//
+// The operation is not started if the context has been canceled while waiting for the locks.
+func (s *Service) lockFile(unlock func(), isExclusive bool, path []string) (func(), error) {
+	unlockFile, err := s.fileLock.Lock(s.ctx, isExclusive, path...)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	err = utils.CheckContext(s.ctx)
+	if err != nil {
+		unlockFile()
+		unlock()
+		return nil, err
+	}
+	return func() {
+		unlockFile()
+		unlock()
+	}, nil
+}
+
+// stdLogger writes messages with the standard logger, if no logger is set with WithLogger.
+type stdLogger struct{}
+
+func (stdLogger) Debug(msg string, args ...any) { stdLog("DEBUG", msg, args) }
+func (stdLogger) Info(msg string, args ...any)  { stdLog("INFO", msg, args) }
+func (stdLogger) Warn(msg string, args ...any)  { stdLog("WARN", msg, args) }
+func (stdLogger) Error(msg string, args ...any) { stdLog("ERROR", msg, args) }
+
+// stdLog formats the message with key-value pairs of the arguments.
+func stdLog(level, msg string, args []any) {
+	var b strings.Builder
+	b.WriteString(level + " " + msg)
+	for i := 0; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			fmt.Fprintf(&b, " %v", args[i])
+			break
+		}
+		fmt.Fprintf(&b, " %v=%v", args[i], args[i+1])
+	}
+	log.Print(b.String())
+}
+
+// folderKey, entryKey and binaryKey return lock keys of objects, so that an entry and a folder
+// with the same ID are locked separately.
+func (s *Service) folderKey(name string) string {
+	if id := s.naming.NameToID(name); id != "" {
+		return id
+	}
+	return name
+}
+func (s *Service) entryKey(name string) string {
+	return s.folderKey(name) + entryFileExt
+}
+func (s *Service) binaryKey(name string) string {
+	return s.folderKey(name) + binaryFileExt
+}
@@ -0,0 +1,361 @@
+package service
+
+import (
+	"container/heap"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/HardDie/fsentry/internal/utils"
+	"github.com/HardDie/fsentry/pkg/fsentry"
+	"github.com/HardDie/fsentry/pkg/fsentry_error"
+)
+
+const (
+	entryFileExt  = ".json"
+	binaryFileExt = ".bin"
+)
+
+// listItemKind defines the order of objects with the same sort key.
+type listItemKind uint8
+
+const (
+	listItemFolder listItemKind = iota
+	listItemEntry
+	listItemBinary
+)
+
+type listItem struct {
+	kind      listItemKind
+	id        string
+	name      string
+	createdAt time.Time
+	updatedAt time.Time
+
+	// isLoaded is set when the metadata of the object has been read.
+	isLoaded    bool
+	isCorrupted bool
+	folder      *fsentry.FolderInfo
+	entry       *fsentry.Entry
+	binary      *fsentry.Binary
+}
+
+// listCursor is the position of the last object on a page, it is passed to the user as a base64 json string.
+type listCursor struct {
+	SortBy     fsentry.ListSort `json:"s"`
+	Descending bool             `json:"d"`
+	Kind       listItemKind     `json:"k"`
+	ID         string           `json:"i"`
+	Name       string           `json:"n,omitempty"`
+	Time       int64            `json:"t,omitempty"`
+}
+
+// List allows you to get a list of objects (folders, entries and binaries) on the selected path.
+// Folders without a readable .info.json file are not skipped, but returned in the CorruptedFolder list.
+func (s *Service) List(path ...string) (*fsentry.List, error) {
+	return s.ListWithOptions(fsentry.ListOptions{}, path...)
+}
+
+// ListWithOptions allows you to get a sorted and filtered list of objects on the selected path page by page.
+// Objects are read from the directory in batches and only the current page is kept in memory.
+func (s *Service) ListWithOptions(opts fsentry.ListOptions, path ...string) (*fsentry.List, error) {
+	path, err := s.resolvePath(path)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := s.lockFolder(false, path...)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return s.list(s.buildPath(path...), opts)
+}
+
+func (s *Service) list(fullPath string, opts fsentry.ListOptions) (*fsentry.List, error) {
+	items, nextCursor, err := s.listItems(fullPath, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &fsentry.List{
+		NextCursor: nextCursor,
+	}
+	for _, item := range items {
+		switch {
+		case item.isCorrupted:
+			res.CorruptedFolder = append(res.CorruptedFolder, item.id)
+		case item.folder != nil:
+			res.Folders = append(res.Folders, *item.folder)
+		case item.entry != nil:
+			res.Entries = append(res.Entries, *item.entry)
+		case item.binary != nil:
+			res.Binaries = append(res.Binaries, item.id)
+			res.BinariesInfo = append(res.BinariesInfo, *item.binary)
+		}
+	}
+	return res, nil
+}
+
+// listItems returns one page of sorted objects with loaded metadata and a cursor to the next page.
+func (s *Service) listItems(fullPath string, opts fsentry.ListOptions) ([]*listItem, string, error) {
+	if opts.Limit < 0 {
+		opts.Limit = 0
+	}
+	if opts.Kinds == 0 {
+		opts.Kinds = fsentry.ListKindAll
+	}
+
+	less := listLess(opts.SortBy, opts.Descending)
+
+	var after *listItem
+	if opts.Cursor != "" {
+		cursor, err := decodeListCursor(opts.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		if cursor.SortBy != opts.SortBy || cursor.Descending != opts.Descending {
+			return nil, "", fsentry_error.ErrorBadCursor
+		}
+		after = cursor.item()
+	}
+
+	// If the objects are sorted by ID and not filtered by name, there is no need
+	// to read the metadata of every object, only the objects on the page.
+	isLazy := opts.SortBy == fsentry.ListSortByID && opts.NamePrefix == ""
+
+	// The heap keeps one extra object to find out if there is a next page.
+	page := &listHeap{less: less}
+	err := s.fs.ListFunc(fullPath, func(file os.DirEntry) error {
+		// Reading a large folder can take a long time.
+		if err := utils.CheckContext(s.ctx); err != nil {
+			return err
+		}
+		item, ok := newListItem(file, opts.Kinds)
+		if !ok {
+			return nil
+		}
+		if !isLazy {
+			if !s.loadListItem(fullPath, item) {
+				return nil
+			}
+			if !strings.HasPrefix(item.name, opts.NamePrefix) {
+				return nil
+			}
+		}
+		if after != nil && !less(after, item) {
+			return nil
+		}
+		if opts.Limit == 0 || page.Len() <= opts.Limit {
+			heap.Push(page, item)
+			return nil
+		}
+		// The page is full, replace the last object if the new one comes before it.
+		if less(item, page.items[0]) {
+			page.items[0] = item
+			heap.Fix(page, 0)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	items := page.items
+	sort.Slice(items, func(i, j int) bool {
+		return less(items[i], items[j])
+	})
+
+	var nextCursor string
+	if opts.Limit > 0 && len(items) > opts.Limit {
+		items = items[:opts.Limit]
+		nextCursor = encodeListCursor(opts, items[len(items)-1])
+	}
+
+	res := items[:0]
+	for _, item := range items {
+		if !item.isLoaded && !s.loadListItem(fullPath, item) {
+			continue
+		}
+		res = append(res, item)
+	}
+	return res, nextCursor, nil
+}
+
+// loadListItem reads metadata of the object. If the object cannot be read, it should be skipped.
+func (s *Service) loadListItem(fullPath string, item *listItem) bool {
+	item.isLoaded = true
+
+	switch item.kind {
+	case listItemFolder:
+		info, err := s.folder.GetByID(fullPath, item.id)
+		if err != nil {
+			item.isCorrupted = true
+			return true
+		}
+		item.folder = info
+		item.name = info.Name
+		item.createdAt = info.CreatedAt
+		item.updatedAt = info.UpdatedAt
+	case listItemEntry:
+		ent, err := s.entry.GetByID(fullPath, item.id)
+		if err != nil {
+			s.log.Warn("List(): error read entry", "path", filepath.Join(fullPath, item.id+entryFileExt), "error", err)
+			return false
+		}
+		item.entry = ent
+		item.name = ent.Name
+		item.createdAt = ent.CreatedAt
+		item.updatedAt = ent.UpdatedAt
+	case listItemBinary:
+		bin, err := s.binary.GetInfoByID(fullPath, item.id)
+		if err != nil {
+			// The content is still available, so the binary is listed without metadata.
+			s.log.Warn("List(): error read binary info", "path", filepath.Join(fullPath, item.id+binaryFileExt), "error", err)
+			bin = &fsentry.Binary{ID: item.id, Name: item.id}
+		}
+		item.binary = bin
+		item.name = bin.Name
+		item.createdAt = bin.CreatedAt
+		item.updatedAt = bin.UpdatedAt
+	}
+	return true
+}
+
+func newListItem(file os.DirEntry, kinds fsentry.ListKind) (*listItem, bool) {
+	name := file.Name()
+
+	if strings.HasPrefix(name, ".") {
+		// skip hidden files, like .info.json
+		return nil, false
+	}
+
+	if file.IsDir() {
+		if kinds&fsentry.ListKindFolders == 0 {
+			return nil, false
+		}
+		return &listItem{kind: listItemFolder, id: name, name: name}, true
+	}
+
+	ext := filepath.Ext(name)
+	id := strings.TrimSuffix(name, ext)
+	switch {
+	case ext == entryFileExt && kinds&fsentry.ListKindEntries != 0:
+		return &listItem{kind: listItemEntry, id: id, name: id}, true
+	case ext == binaryFileExt && kinds&fsentry.ListKindBinaries != 0:
+		return &listItem{kind: listItemBinary, id: id, name: id}, true
+	}
+	return nil, false
+}
+
+// listLess returns a function that reports whether the object a comes before the object b.
+// Objects with equal sort keys are ordered by type and ID, so the order is always the same.
+func listLess(sortBy fsentry.ListSort, isDescending bool) func(a, b *listItem) bool {
+	compare := func(a, b *listItem) int {
+		switch sortBy {
+		case fsentry.ListSortByName:
+			if c := strings.Compare(a.name, b.name); c != 0 {
+				return c
+			}
+		case fsentry.ListSortByCreatedAt:
+			if c := compareTime(a.createdAt, b.createdAt); c != 0 {
+				return c
+			}
+		case fsentry.ListSortByUpdatedAt:
+			if c := compareTime(a.updatedAt, b.updatedAt); c != 0 {
+				return c
+			}
+		}
+		if c := strings.Compare(a.id, b.id); c != 0 {
+			return c
+		}
+		return int(a.kind) - int(b.kind)
+	}
+	return func(a, b *listItem) bool {
+		if isDescending {
+			return compare(a, b) > 0
+		}
+		return compare(a, b) < 0
+	}
+}
+func compareTime(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	}
+	return 0
+}
+
+func encodeListCursor(opts fsentry.ListOptions, item *listItem) string {
+	cursor := listCursor{
+		SortBy:     opts.SortBy,
+		Descending: opts.Descending,
+		Kind:       item.kind,
+		ID:         item.id,
+	}
+	switch opts.SortBy {
+	case fsentry.ListSortByName:
+		cursor.Name = item.name
+	case fsentry.ListSortByCreatedAt:
+		cursor.Time = unixNano(item.createdAt)
+	case fsentry.ListSortByUpdatedAt:
+		cursor.Time = unixNano(item.updatedAt)
+	}
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+func decodeListCursor(in string) (*listCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(in)
+	if err != nil {
+		return nil, fsentry_error.Wrap(err, fsentry_error.ErrorBadCursor)
+	}
+	var cursor listCursor
+	err = json.Unmarshal(data, &cursor)
+	if err != nil {
+		return nil, fsentry_error.Wrap(err, fsentry_error.ErrorBadCursor)
+	}
+	return &cursor, nil
+}
+func (c listCursor) item() *listItem {
+	var t time.Time
+	if c.Time != 0 {
+		t = time.Unix(0, c.Time)
+	}
+	return &listItem{
+		kind:      c.Kind,
+		id:        c.ID,
+		name:      c.Name,
+		createdAt: t,
+		updatedAt: t,
+	}
+}
+
+// unixNano converts the time into nanoseconds, the zero time of objects without metadata is kept as zero.
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// listHeap is a max-heap, the object that comes last in the sort order is on the top.
+type listHeap struct {
+	items []*listItem
+	less  func(a, b *listItem) bool
+}
+
+func (h *listHeap) Len() int           { return len(h.items) }
+func (h *listHeap) Less(i, j int) bool { return h.less(h.items[j], h.items[i]) }
+func (h *listHeap) Swap(i, j int)      { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *listHeap) Push(x any)         { h.items = append(h.items, x.(*listItem)) }
+func (h *listHeap) Pop() any {
+	item := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return item
+}
@@ -0,0 +1,38 @@
+package service
+
+import (
+	"fmt"
+
+	"github.com/HardDie/fsentry/pkg/fsentry"
+	"github.com/HardDie/fsentry/pkg/fsentry_error"
+)
+
+// LookupID returns the ID of the existing object of the kind with the name. If the name had a collision
+// on creation, the ID has a hash of the name, otherwise it's the ID of the name, even if the object
+// was created with another name that has the same ID.
+func (s *Service) LookupID(kind fsentry.ObjectKind, name string, path ...string) (string, error) {
+	path, err := s.resolvePath(path)
+	if err != nil {
+		return "", err
+	}
+	var unlock func()
+	var resolveID func(path, name string) (string, error)
+	switch kind {
+	case fsentry.ObjectFolder:
+		resolveID = s.folder.ResolveID
+		unlock, err = s.lockFolders(false, path, name)
+	case fsentry.ObjectEntry:
+		resolveID = s.entry.ResolveID
+		unlock, err = s.lockObjects(false, path, s.entryKey(name))
+	case fsentry.ObjectBinary:
+		resolveID = s.binary.ResolveID
+		unlock, err = s.lockObjects(false, path, s.binaryKey(name))
+	default:
+		return "", fsentry_error.Wrap(fmt.Errorf("lookup of object kind %d", kind), fsentry_error.ErrorInternal)
+	}
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	return resolveID(s.buildPath(path...), name)
+}
@@ -0,0 +1,152 @@
+package service
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/HardDie/fsentry/internal/utils"
+	"github.com/HardDie/fsentry/pkg/fsentry"
+	"github.com/HardDie/fsentry/pkg/fsentry_error"
+)
+
+// idMigrator is implemented by the services of all kinds of objects.
+type idMigrator interface {
+	MigrateID(path, id, name string) (string, error)
+	ChangeID(path, oldID, newID string) error
+}
+
+// MigrateIDs renames objects whose IDs don't follow the current rules, like objects created by older versions
+// before names were normalized, or after a change of the maximum ID length. Objects keep their names,
+// timestamps and data. Only slugs are migrated, other IDs don't depend on the names.
+//
+// If the new ID of an object is taken by another object, the object keeps its ID and the change is returned
+// with a message. The whole storage is locked until the end.
+func (s *Service) MigrateIDs(opts fsentry.MigrateIDsOptions) ([]fsentry.IDChange, error) {
+	unlock, err := s.lockFolder(true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if !opts.DryRun {
+		// Interrupted moves must be finished first, otherwise their objects would be migrated
+		// under the old IDs.
+		err = s.journal.Recover()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	changes := []fsentry.IDChange{}
+	err = s.migrateFolder(&changes, nil, opts.DryRun)
+	if err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// migrateFolder migrates the objects inside the folder and then all subfolders recursively.
+func (s *Service) migrateFolder(changes *[]fsentry.IDChange, path []string, isDryRun bool) error {
+	// Every object is migrated right away, so the migration can be stopped between folders.
+	err := utils.CheckContext(s.ctx)
+	if err != nil {
+		return err
+	}
+
+	var folders, entries, binaries []string
+	fullPath := s.buildPath(path...)
+	err = s.fs.ListFunc(fullPath, func(file os.DirEntry) error {
+		name := file.Name()
+		switch {
+		case strings.HasPrefix(name, "."):
+			// skip hidden files and service folders
+		case file.IsDir():
+			folders = append(folders, name)
+		case filepath.Ext(name) == entryFileExt:
+			entries = append(entries, strings.TrimSuffix(name, entryFileExt))
+		case filepath.Ext(name) == binaryFileExt:
+			binaries = append(binaries, strings.TrimSuffix(name, binaryFileExt))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Objects that can't be read have no name, they are reported by Check.
+	for _, id := range entries {
+		ent, err := s.entry.GetByID(fullPath, id)
+		if err != nil {
+			continue
+		}
+		_, err = s.migrateObject(changes, s.entry, fsentry.ObjectEntry, path, id, ent.Name, isDryRun)
+		if err != nil {
+			return err
+		}
+	}
+	for _, id := range binaries {
+		info, err := s.binary.GetInfoByID(fullPath, id)
+		if err != nil {
+			continue
+		}
+		_, err = s.migrateObject(changes, s.binary, fsentry.ObjectBinary, path, id, info.Name, isDryRun)
+		if err != nil {
+			return err
+		}
+	}
+	for _, id := range folders {
+		info, err := s.folder.GetByID(fullPath, id)
+		if err == nil {
+			id, err = s.migrateObject(changes, s.folder, fsentry.ObjectFolder, path, id, info.Name, isDryRun)
+			if err != nil {
+				return err
+			}
+		}
+		err = s.migrateFolder(changes, append(path[:len(path):len(path)], id), isDryRun)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateObject renames the object to its new ID, if it has one, and returns the current ID of the object.
+func (s *Service) migrateObject(changes *[]fsentry.IDChange, m idMigrator, kind fsentry.ObjectKind, path []string, id, name string, isDryRun bool) (string, error) {
+	fullPath := s.buildPath(path...)
+	newID, err := m.MigrateID(fullPath, id, name)
+	if err != nil && !errors.Is(err, fsentry_error.ErrorNameCollision) {
+		return id, err
+	}
+	if err == nil && newID == id {
+		return id, nil
+	}
+
+	change := fsentry.IDChange{
+		Kind:  kind,
+		Path:  append([]string{}, path...),
+		Name:  name,
+		OldID: id,
+		NewID: newID,
+	}
+	switch {
+	case err != nil:
+		change.NewID = ""
+		change.Message = err.Error()
+	case !isDryRun:
+		err = m.ChangeID(fullPath, id, newID)
+		if errors.Is(err, fsentry_error.ErrorExist) {
+			change.NewID = ""
+			change.Message = err.Error()
+			break
+		}
+		if err != nil {
+			return id, err
+		}
+		change.IsApplied = true
+		id = newID
+	}
+	*changes = append(*changes, change)
+	return id, nil
+}
@@ -0,0 +1,525 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/HardDie/fsentry/internal/binary"
+	binaryService "github.com/HardDie/fsentry/internal/binary/service"
+	"github.com/HardDie/fsentry/internal/entry"
+	entryService "github.com/HardDie/fsentry/internal/entry/service"
+	"github.com/HardDie/fsentry/internal/folder"
+	folderService "github.com/HardDie/fsentry/internal/folder/service"
+	"github.com/HardDie/fsentry/internal/fs"
+	"github.com/HardDie/fsentry/internal/journal"
+	"github.com/HardDie/fsentry/internal/utils"
+	"github.com/HardDie/fsentry/pkg/fsentry"
+	"github.com/HardDie/fsentry/pkg/fsentry_error"
+	"github.com/HardDie/fsentry/pkg/overlayfs"
+)
+
+const (
+	// txFolder is a folder inside the service folder of the root, where transactions prepare their changes.
+	txFolder = "tx"
+	// txUpperFolder is a folder inside the folder of a transaction, where its changes are kept until the commit.
+	txUpperFolder = "upper"
+)
+
+// Tx runs fn and then writes all changes made by it to the storage at once. If fn returns an error,
+// or the changes can't be written, nothing is changed and the error is returned.
+//
+// The changes are kept in a hidden folder of the root over the storage until fn returns, removed objects
+// are only marked there, so nothing is copied to remove or move a folder. Then the new objects are moved
+// to their places, while the old ones are moved away. The whole storage is locked until the end, so other
+// operations see either none or all of the changes, and fn must not call methods of the storage itself,
+// only of tx. If the process is killed while writing, the transaction is rolled back on the next Init().
+func (s *Service) Tx(fn func(tx fsentry.IFSEntryTx) error) error {
+	unlock, err := s.lockFolder(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	suffix, err := utils.RandomHex(8)
+	if err != nil {
+		return err
+	}
+	c := &txCommit{
+		service: s,
+		tmpPath: filepath.Join(s.root, utils.ServiceFolder, txFolder, suffix),
+	}
+	err = s.fs.CreateAllFolder(c.upperPath("."))
+	if err != nil {
+		return err
+	}
+	// Paths inside the transaction are relative to the root, which is the root of both storages of the overlay.
+	c.upper = fs.Sub(s.fs, c.upperPath("."))
+	c.overlay = overlayfs.New(fs.Sub(s.fs, s.root), c.upper)
+	t := &tx{
+		service: s,
+		binary:  binaryService.New(c.overlay, txJournal{}, s.isPretty, s.naming),
+		entry:   entryService.New(c.overlay, txJournal{}, s.isPretty, s.naming),
+		folder:  folderService.New(c.overlay, txJournal{}, s.isPretty, s.naming),
+	}
+	err = fn(t)
+	if err != nil {
+		c.cleanup()
+		return err
+	}
+
+	return c.commit()
+}
+
+// txCommit collects the steps of applying the changes of a transaction.
+type txCommit struct {
+	service *Service
+	upper   fs.FS
+	overlay *overlayfs.FS
+	tmpPath string
+	steps   []journal.Step
+}
+
+// commit writes the changes from the upper storage of the overlay. The new folders are prepared in
+// the transaction folder first, so the storage is not modified until the journal record is written.
+func (c *txCommit) commit() error {
+	err := c.diffFolder(".")
+	if err != nil {
+		c.cleanup()
+		return err
+	}
+	if len(c.steps) == 0 {
+		// Nothing has been changed.
+		c.cleanup()
+		return nil
+	}
+
+	return c.service.journal.Apply(journal.Record{
+		Operation: journal.OperationTx,
+		SrcPath:   c.service.root,
+		TmpPath:   c.tmpPath,
+		Steps:     c.steps,
+	})
+}
+
+// path and upperPath return the paths of the object of the transaction in the storage and in the upper storage.
+func (c *txCommit) path(path string) string {
+	return filepath.Join(c.service.root, path)
+}
+func (c *txCommit) upperPath(path string) string {
+	return filepath.Join(c.tmpPath, txUpperFolder, path)
+}
+
+// diffFolder compares the folder of the upper storage, that is merged with the folder of the storage,
+// and adds steps for all changed objects inside it.
+func (c *txCommit) diffFolder(path string) error {
+	var files []os.DirEntry
+	err := c.upper.ListFunc(path, func(file os.DirEntry) error {
+		files = append(files, file)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		name := file.Name()
+		switch {
+		case name == overlayfs.OpaqueMarker, name == overlayfs.RedirectMarker:
+			// Opaque and redirected folders are replaced completely by the parent folder.
+		case strings.HasPrefix(name, overlayfs.WhiteoutPrefix):
+			err = c.remove(filepath.Join(path, strings.TrimPrefix(name, overlayfs.WhiteoutPrefix)))
+		case file.IsDir():
+			err = c.diffSubfolder(filepath.Join(path, name))
+		default:
+			err = c.replaceFile(filepath.Join(path, name))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diffSubfolder replaces the folder if it is new, opaque or moved, otherwise compares its content.
+func (c *txCommit) diffSubfolder(path string) error {
+	isOpaque, err := c.upper.IsFileExist(filepath.Join(path, overlayfs.OpaqueMarker))
+	if err != nil {
+		return err
+	}
+	isRedirect, err := c.upper.IsFileExist(filepath.Join(path, overlayfs.RedirectMarker))
+	if err != nil {
+		return err
+	}
+	isExist, err := c.service.fs.IsFolderExist(c.path(path))
+	if err != nil && !errors.Is(err, fsentry_error.ErrorBadPath) {
+		return err
+	}
+	if isOpaque || isRedirect || !isExist {
+		return c.replaceFolder(path)
+	}
+	return c.diffFolder(path)
+}
+
+// replaceFile adds a step to move the file from the upper storage to its path.
+// The current object on the path is moved away first.
+func (c *txCommit) replaceFile(path string) error {
+	err := c.remove(path)
+	if err != nil {
+		return err
+	}
+	c.steps = append(c.steps, journal.Step{
+		SrcPath: c.upperPath(path),
+		DstPath: c.path(path),
+	})
+	return nil
+}
+
+// replaceFolder prepares the visible content of the folder in the transaction folder and adds a step to move it
+// to the path. The current object on the path is moved away first.
+func (c *txCommit) replaceFolder(path string) error {
+	err := c.remove(path)
+	if err != nil {
+		return err
+	}
+	stagePath := filepath.Join(c.tmpPath, fmt.Sprintf("stage-%d", len(c.steps)))
+	err = c.stage(path, stagePath)
+	if err != nil {
+		return err
+	}
+	c.steps = append(c.steps, journal.Step{
+		SrcPath: stagePath,
+		DstPath: c.path(path),
+	})
+	return nil
+}
+
+// remove adds a step to move the current object on the path into the transaction folder, if it exists.
+func (c *txCommit) remove(path string) error {
+	isExist, err := c.service.fs.IsFileExist(c.path(path))
+	if errors.Is(err, fsentry_error.ErrorBadPath) {
+		// It's a folder
+		isExist, err = true, nil
+	}
+	if err != nil {
+		return err
+	}
+	if !isExist {
+		return nil
+	}
+	c.steps = append(c.steps, journal.Step{
+		SrcPath: c.path(path),
+		DstPath: filepath.Join(c.tmpPath, fmt.Sprintf("backup-%d", len(c.steps))),
+	})
+	return nil
+}
+
+// stage recursively builds the visible folder of the overlay in the storage, without the overlay markers.
+// Files of the upper storage are moved, only the lower content of moved folders is copied.
+func (c *txCommit) stage(path, stagePath string) error {
+	err := c.service.fs.CreateFolder(stagePath)
+	if err != nil {
+		return err
+	}
+	var files []os.DirEntry
+	err = c.overlay.ListFunc(path, func(file os.DirEntry) error {
+		files = append(files, file)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		srcPath := filepath.Join(path, file.Name())
+		dstPath := filepath.Join(stagePath, file.Name())
+		if file.IsDir() {
+			err = c.stage(srcPath, dstPath)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		isUpper, err := c.upper.IsFileExist(srcPath)
+		if err != nil {
+			return err
+		}
+		if isUpper {
+			err = c.service.fs.Rename(c.upperPath(srcPath), dstPath)
+		} else {
+			err = c.copyLower(srcPath, dstPath)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyLower copies the file of the storage, which is visible in a moved folder of the overlay.
+func (c *txCommit) copyLower(srcPath, dstPath string) error {
+	data, err := c.overlay.ReadFile(srcPath)
+	if err != nil {
+		return err
+	}
+	return c.service.fs.CreateFile(dstPath, data)
+}
+
+// cleanup removes the transaction folder with the prepared and the old objects.
+func (c *txCommit) cleanup() {
+	if err := c.service.fs.RemoveFolder(c.tmpPath); err != nil {
+		c.service.log.Error("Tx(): error remove transaction folder", "path", c.tmpPath, "error", err)
+	}
+}
+
+// tx runs the operations of a transaction over the overlay, whose upper storage keeps all the changes.
+type tx struct {
+	service *Service
+	binary  binary.Service
+	entry   entry.Service
+	folder  folder.Service
+}
+
+// buildPath resolves the path with the folders of the transaction, which may have been created or renamed in it.
+func (t *tx) buildPath(path []string) (string, error) {
+	// Paths inside the transaction are relative to the root.
+	ids, err := t.folder.ResolvePath(".", path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(append([]string{"."}, ids...)...), nil
+}
+
+func (t *tx) LookupID(kind fsentry.ObjectKind, name string, path ...string) (string, error) {
+	fullPath, err := t.buildPath(path)
+	if err != nil {
+		return "", err
+	}
+	switch kind {
+	case fsentry.ObjectFolder:
+		return t.folder.ResolveID(fullPath, name)
+	case fsentry.ObjectEntry:
+		return t.entry.ResolveID(fullPath, name)
+	case fsentry.ObjectBinary:
+		return t.binary.ResolveID(fullPath, name)
+	}
+	return "", fsentry_error.Wrap(fmt.Errorf("lookup of object kind %d", kind), fsentry_error.ErrorInternal)
+}
+
+func (t *tx) CreateFolder(name string, data interface{}, path ...string) (*fsentry.FolderInfo, error) {
+	fullPath, err := t.buildPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return t.folder.Create(fullPath, name, data)
+}
+func (t *tx) GetFolder(name string, path ...string) (*fsentry.FolderInfo, error) {
+	fullPath, err := t.buildPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return t.folder.Get(fullPath, name)
+}
+func (t *tx) MoveFolder(oldName, newName string, path ...string) (*fsentry.FolderInfo, error) {
+	fullPath, err := t.buildPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return t.folder.Move(fullPath, oldName, newName)
+}
+func (t *tx) UpdateFolder(name string, data interface{}, path ...string) (*fsentry.FolderInfo, error) {
+	fullPath, err := t.buildPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return t.folder.Update(fullPath, name, data)
+}
+func (t *tx) UpdateFolderIf(name string, data interface{}, expectedRevision uint64, path ...string) (*fsentry.FolderInfo, error) {
+	fullPath, err := t.buildPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return t.folder.UpdateIf(fullPath, name, data, expectedRevision)
+}
+func (t *tx) PatchFolder(name string, patch fsentry.Patch, path ...string) (*fsentry.FolderInfo, error) {
+	fullPath, err := t.buildPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return t.folder.Patch(fullPath, name, patch)
+}
+func (t *tx) RemoveFolder(name string, path ...string) error {
+	fullPath, err := t.buildPath(path)
+	if err != nil {
+		return err
+	}
+	return t.folder.Remove(fullPath, name)
+}
+func (t *tx) DuplicateFolder(srcName, dstName string, path ...string) (*fsentry.FolderInfo, error) {
+	fullPath, err := t.buildPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return t.folder.Duplicate(t.service.ctx, fullPath, srcName, dstName)
+}
+
+func (t *tx) CreateEntry(name string, data interface{}, path ...string) (*fsentry.Entry, error) {
+	fullPath, err := t.buildPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return t.entry.Create(fullPath, name, data)
+}
+func (t *tx) GetEntry(name string, path ...string) (*fsentry.Entry, error) {
+	fullPath, err := t.buildPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return t.entry.Get(fullPath, name)
+}
+func (t *tx) MoveEntry(oldName, newName string, path ...string) (*fsentry.Entry, error) {
+	fullPath, err := t.buildPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return t.entry.Move(fullPath, oldName, newName)
+}
+func (t *tx) UpdateEntry(name string, data interface{}, path ...string) (*fsentry.Entry, error) {
+	fullPath, err := t.buildPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return t.entry.Update(fullPath, name, data)
+}
+func (t *tx) UpdateEntryIf(name string, data interface{}, expectedRevision uint64, path ...string) (*fsentry.Entry, error) {
+	fullPath, err := t.buildPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return t.entry.UpdateIf(fullPath, name, data, expectedRevision)
+}
+func (t *tx) PatchEntry(name string, patch fsentry.Patch, path ...string) (*fsentry.Entry, error) {
+	fullPath, err := t.buildPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return t.entry.Patch(fullPath, name, patch)
+}
+func (t *tx) RemoveEntry(name string, path ...string) error {
+	fullPath, err := t.buildPath(path)
+	if err != nil {
+		return err
+	}
+	return t.entry.Remove(fullPath, name)
+}
+func (t *tx) DuplicateEntry(srcName, dstName string, path ...string) (*fsentry.Entry, error) {
+	fullPath, err := t.buildPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return t.entry.Duplicate(fullPath, srcName, dstName)
+}
+
+func (t *tx) CreateBinary(name string, data []byte, path ...string) error {
+	fullPath, err := t.buildPath(path)
+	if err != nil {
+		return err
+	}
+	return t.binary.Create(fullPath, name, data)
+}
+func (t *tx) CreateBinaryWithOptions(name string, data []byte, opts fsentry.BinaryOptions, path ...string) (*fsentry.Binary, error) {
+	fullPath, err := t.buildPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return t.binary.CreateWithOptions(fullPath, name, data, opts)
+}
+func (t *tx) GetBinary(name string, path ...string) ([]byte, error) {
+	fullPath, err := t.buildPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return t.binary.Get(fullPath, name)
+}
+func (t *tx) GetBinaryInfo(name string, path ...string) (*fsentry.Binary, error) {
+	fullPath, err := t.buildPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return t.binary.GetInfo(fullPath, name)
+}
+func (t *tx) CreateBinaryFrom(name string, r io.Reader, path ...string) error {
+	fullPath, err := t.buildPath(path)
+	if err != nil {
+		return err
+	}
+	_, err = t.binary.CreateFrom(fullPath, name, r, fsentry.BinaryOptions{})
+	return err
+}
+func (t *tx) OpenBinary(name string, path ...string) (io.ReadSeekCloser, error) {
+	fullPath, err := t.buildPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return t.binary.Open(fullPath, name)
+}
+func (t *tx) ReadBinaryRange(name string, offset, length int64, path ...string) ([]byte, error) {
+	fullPath, err := t.buildPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return t.binary.ReadRange(fullPath, name, offset, length)
+}
+func (t *tx) WriteBinary(name string, path ...string) (fsentry.BinaryWriter, error) {
+	fullPath, err := t.buildPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return newBinaryWriter(func(r io.Reader) error {
+		staged, err := t.binary.Stage(fullPath, name, r)
+		if err != nil {
+			return err
+		}
+		_, err = t.binary.Commit(fullPath, name, staged)
+		return err
+	}), nil
+}
+func (t *tx) MoveBinary(oldName, newName string, path ...string) error {
+	fullPath, err := t.buildPath(path)
+	if err != nil {
+		return err
+	}
+	return t.binary.Move(fullPath, oldName, newName)
+}
+func (t *tx) UpdateBinary(name string, data []byte, path ...string) error {
+	fullPath, err := t.buildPath(path)
+	if err != nil {
+		return err
+	}
+	return t.binary.Update(fullPath, name, data)
+}
+func (t *tx) RemoveBinary(name string, path ...string) error {
+	fullPath, err := t.buildPath(path)
+	if err != nil {
+		return err
+	}
+	return t.binary.Remove(fullPath, name)
+}
+
+// txJournal is used by the operations inside a transaction. They only change the transaction folder,
+// which is removed after a crash, so there is nothing to recover, the transaction itself is written to the journal on commit.
+type txJournal struct{}
+
+func (txJournal) Begin(rec journal.Record) (string, error) { return "", nil }
+func (txJournal) Commit(id string) error                   { return nil }
+func (txJournal) List() ([]journal.Record, error)          { return nil, nil }
+func (txJournal) Recover() error                           { return nil }
+func (txJournal) Undo(steps []journal.Step) error          { return nil }
+func (txJournal) Apply(rec journal.Record) error {
+	// Only the kind services use the journal inside a transaction, and they apply steps only to relocate objects,
+	// which is not available in transactions.
+	return fsentry_error.Wrap(fmt.Errorf("%s operation in a transaction", rec.Operation), fsentry_error.ErrorInternal)
+}
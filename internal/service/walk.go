@@ -0,0 +1,191 @@
+package service
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/HardDie/fsentry/internal/utils"
+	"github.com/HardDie/fsentry/pkg/fsentry"
+	"github.com/HardDie/fsentry/pkg/fsentry_error"
+)
+
+const (
+	// walkPageSize is the number of objects read from a folder at once while walking.
+	walkPageSize = 256
+)
+
+// walkReadError marks an error that occurred while reading the content of a folder,
+// so that it can be passed to WalkFunc for this folder.
+type walkReadError struct {
+	err error
+}
+
+func (e *walkReadError) Error() string { return e.err.Error() }
+func (e *walkReadError) Unwrap() error { return e.err }
+
+// Walk visits all objects inside the selected path, including the content of all nested folders.
+// Objects of each folder are visited in the order of their IDs, and the content of a folder
+// is visited right after the folder itself. The folder on the selected path is not passed to fn.
+//
+// The storage is locked only while reading a portion of a folder, so fn is allowed to call other methods.
+func (s *Service) Walk(fn fsentry.WalkFunc, path ...string) error {
+	path, err := s.resolvePath(path)
+	if err != nil {
+		return err
+	}
+	err = s.walk(path, fn)
+	if errors.Is(err, fsentry.SkipDir) || errors.Is(err, fsentry.SkipAll) {
+		return nil
+	}
+	var readErr *walkReadError
+	if errors.As(err, &readErr) {
+		return readErr.err
+	}
+	return err
+}
+
+// Tree returns the selected folder with all nested folders, entries and binaries.
+// Corrupted folders are returned with the IsCorrupted flag.
+func (s *Service) Tree(path ...string) (*fsentry.TreeNode, error) {
+	path, err := s.resolvePath(path)
+	if err != nil {
+		return nil, err
+	}
+	root := &fsentry.TreeNode{}
+	if len(path) > 0 {
+		root.ID = path[len(path)-1]
+
+		unlock, err := s.lockFolder(false, path...)
+		if err != nil {
+			return nil, err
+		}
+		info, err := s.folder.GetByID(s.buildPath(path[:len(path)-1]...), root.ID)
+		unlock()
+		if err != nil {
+			root.IsCorrupted = true
+		} else {
+			root.Folder = info
+		}
+	}
+
+	nodes := map[string]*fsentry.TreeNode{
+		strings.Join(path, "/"): root,
+	}
+	err = s.Walk(func(path []string, obj fsentry.WalkObject, err error) error {
+		if err != nil && obj.Kind != fsentry.ObjectCorruptedFolder {
+			return err
+		}
+
+		parent := nodes[strings.Join(path, "/")]
+		switch obj.Kind {
+		case fsentry.ObjectFolder, fsentry.ObjectCorruptedFolder:
+			node := &fsentry.TreeNode{
+				ID:          obj.ID,
+				Folder:      obj.Folder,
+				IsCorrupted: obj.Kind == fsentry.ObjectCorruptedFolder,
+			}
+			parent.Folders = append(parent.Folders, node)
+			nodes[strings.Join(append(path, obj.ID), "/")] = node
+		case fsentry.ObjectEntry:
+			parent.Entries = append(parent.Entries, *obj.Entry)
+		case fsentry.ObjectBinary:
+			parent.Binaries = append(parent.Binaries, obj.ID)
+		}
+		return nil
+	}, path...)
+	if err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+func (s *Service) walk(path []string, fn fsentry.WalkFunc) error {
+	opts := fsentry.ListOptions{
+		Limit: walkPageSize,
+	}
+	for {
+		unlock, err := s.lockFolder(false, path...)
+		if err != nil {
+			return walkError(err)
+		}
+		items, nextCursor, err := s.listItems(s.buildPath(path...), opts)
+		unlock()
+		if err != nil {
+			return walkError(err)
+		}
+
+		for _, item := range items {
+			err = utils.CheckContext(s.ctx)
+			if err != nil {
+				return err
+			}
+			err = s.walkItem(path, item, fn)
+			if err != nil {
+				return err
+			}
+		}
+
+		if nextCursor == "" {
+			return nil
+		}
+		opts.Cursor = nextCursor
+	}
+}
+
+// walkError marks the error of reading a folder, so it is passed to WalkFunc. Cancellation stops walking at once.
+func walkError(err error) error {
+	if errors.Is(err, fsentry_error.ErrorCanceled) {
+		return err
+	}
+	return &walkReadError{err: err}
+}
+
+func (s *Service) walkItem(path []string, item *listItem, fn fsentry.WalkFunc) error {
+	obj := fsentry.WalkObject{
+		ID: item.id,
+	}
+	switch {
+	case item.isCorrupted:
+		obj.Kind = fsentry.ObjectCorruptedFolder
+	case item.folder != nil:
+		obj.Kind = fsentry.ObjectFolder
+		obj.Folder = item.folder
+	case item.entry != nil:
+		obj.Kind = fsentry.ObjectEntry
+		obj.Entry = item.entry
+	default:
+		obj.Kind = fsentry.ObjectBinary
+		obj.Binary = item.binary
+	}
+
+	if item.kind != listItemFolder {
+		return fn(path, obj, nil)
+	}
+
+	var err error
+	if item.isCorrupted {
+		err = fn(path, obj, fsentry_error.ErrorFolderCorrupted)
+	} else {
+		err = fn(path, obj, nil)
+	}
+	if errors.Is(err, fsentry.SkipDir) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	folderPath := make([]string, len(path), len(path)+1)
+	copy(folderPath, path)
+	folderPath = append(folderPath, item.id)
+
+	err = s.walk(folderPath, fn)
+	var readErr *walkReadError
+	if errors.As(err, &readErr) {
+		err = fn(path, obj, readErr.err)
+	}
+	if errors.Is(err, fsentry.SkipDir) {
+		return nil
+	}
+	return err
+}
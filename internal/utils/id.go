@@ -0,0 +1,468 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/HardDie/fsentry/pkg/fsentry"
+	"github.com/HardDie/fsentry/pkg/fsentry_error"
+)
+
+// ulidAlphabet is the Crockford's base32 alphabet in lowercase.
+const ulidAlphabet = "0123456789abcdefghjkmnpqrstvwxyz"
+
+var regID = regexp.MustCompile(`^[\p{L}0-9_-]+$`)
+
+// Objects gives Naming access to the objects of one kind in a folder.
+type Objects struct {
+	IsExist func(id string) (bool, error)
+	GetName func(id string) (string, error)
+	// ListIDs calls fn with the ID of each object in the folder until fn returns false.
+	ListIDs func(fn func(id string) bool) error
+}
+
+// Naming generates IDs of new objects with the strategy and finds IDs of existing objects by their names.
+type Naming struct {
+	Strategy fsentry.IDStrategy
+	// IsStrict returns ErrorNameCollision instead of resolving collisions of slugs.
+	IsStrict bool
+	// MaxIDLength limits the length of slugs in bytes, zero means MaxFilenameLength.
+	MaxIDLength int
+}
+
+// IsNameBased reports whether the ID of an object always follows from its name. Otherwise objects
+// are found by reading their names, and the name can't be used as a lock key.
+func (n Naming) IsNameBased() bool {
+	return (n.Strategy.Kind == fsentry.IDSlug || n.Strategy.Kind == fsentry.IDSlugHash) && !n.Strategy.KeepIDOnRename
+}
+
+// KeepIDOnRename reports whether renamed objects keep their IDs.
+func (n Naming) KeepIDOnRename() bool {
+	return n.Strategy.KeepIDOnRename || n.Strategy.Kind == fsentry.IDUUIDv7 || n.Strategy.Kind == fsentry.IDULID
+}
+
+// IsValidName checks that an object can have the name: slugs can't be empty, and other IDs need
+// a non-empty name to find the object.
+func (n Naming) IsValidName(name string) bool {
+	switch n.Strategy.Kind {
+	case fsentry.IDSlug, fsentry.IDSlugHash:
+		return n.NameToID(name) != ""
+	}
+	return name != ""
+}
+
+// ResolveID returns the ID of an existing object with the name. If the object is not found, the ID
+// the name would resolve to is returned, or ErrorNotExist if there is no such ID.
+func (n Naming) ResolveID(name string, objects Objects) (string, error) {
+	if n.IsNameBased() {
+		return n.slugID(name, objects)
+	}
+	id, ok, err := n.FindID(name, objects)
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		return id, nil
+	}
+	switch n.Strategy.Kind {
+	case fsentry.IDSlug, fsentry.IDSlugHash:
+		// Like with the name based IDs, the object can be accessed by a similar name,
+		// but not by the name it had before a rename.
+		id, err = n.slugID(name, objects)
+		if err != nil {
+			return "", err
+		}
+		ok, err = objects.IsExist(id)
+		if err != nil || !ok {
+			return id, err
+		}
+		objectName, err := objects.GetName(id)
+		if err != nil || n.NameToID(objectName) == n.NameToID(name) {
+			return id, nil
+		}
+		return "", fsentry_error.ErrorNotExist
+	}
+	// The name can be the ID of the object.
+	if IsValidID(name) {
+		return name, nil
+	}
+	return "", fsentry_error.ErrorNotExist
+}
+
+// NewID returns the ID for a new object with the name. If there is already an object with this name,
+// its ID is returned, so the caller reports ErrorExist.
+func (n Naming) NewID(name string, objects Objects) (string, error) {
+	if !n.IsValidName(name) {
+		return "", fsentry_error.ErrorBadName
+	}
+	if n.IsNameBased() {
+		if n.Strategy.Kind == fsentry.IDSlug {
+			return n.newSlugID(name, objects)
+		}
+		return n.slugID(name, objects)
+	}
+	id, ok, err := n.FindID(name, objects)
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		return id, nil
+	}
+
+	switch n.Strategy.Kind {
+	case fsentry.IDSlug:
+		// Renamed objects keep their IDs, so any of the slugs can be taken by an object with another name.
+		id = n.NameToID(name)
+		if id == "" {
+			return "", fsentry_error.ErrorBadName
+		}
+		ok, err = objects.IsExist(id)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return id, nil
+		}
+		if n.IsStrict {
+			return "", fsentry_error.Wrap(fmt.Errorf("ID of %q is taken", name), fsentry_error.ErrorNameCollision)
+		}
+		id = collisionID(id, name, n.maxIDLength())
+	case fsentry.IDSlugHash:
+		id, err = n.slugID(name, objects)
+	case fsentry.IDUUIDv7:
+		id, err = NewUUIDv7()
+	case fsentry.IDULID:
+		id, err = NewULID()
+	case fsentry.IDFunc:
+		if n.Strategy.Func == nil {
+			return "", fsentry_error.Wrap(fmt.Errorf("IDFunc without a function"), fsentry_error.ErrorInternal)
+		}
+		id, err = n.Strategy.Func(name)
+		if err == nil && (!IsValidID(id) || len(id) > n.maxIDLength()) {
+			err = fsentry_error.Wrap(fmt.Errorf("invalid ID %q for %q", id, name), fsentry_error.ErrorBadName)
+		}
+	default:
+		return "", fsentry_error.Wrap(fmt.Errorf("unknown ID kind %d", n.Strategy.Kind), fsentry_error.ErrorInternal)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// The found ID belongs to an object with another name.
+	ok, err = objects.IsExist(id)
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		return "", fsentry_error.Wrap(fmt.Errorf("ID %q of %q is taken", id, name), fsentry_error.ErrorNameCollision)
+	}
+	return id, nil
+}
+
+// RenameID returns the ID of the object with oldID after it is renamed to newName. If renames keep IDs,
+// it's oldID. ErrorExist is returned if there is an object with newName already.
+func (n Naming) RenameID(oldID, newName string, objects Objects) (string, error) {
+	if !n.KeepIDOnRename() {
+		newID, err := n.NewID(newName, objects)
+		if err != nil {
+			return "", err
+		}
+		if newID == oldID {
+			return "", fsentry_error.ErrorExist
+		}
+		return newID, nil
+	}
+	_, ok, err := n.FindID(newName, objects)
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		return "", fsentry_error.ErrorExist
+	}
+	return oldID, nil
+}
+
+// MigrateID returns the ID the object should have with the current rules of slugs, like after
+// a change of NameToID or MaxIDLength. The object keeps its ID if it's still valid for the name.
+// If the new ID is taken by another object, ErrorNameCollision is returned.
+//
+// IDs of other strategies don't follow from the names, so they are never changed.
+func (n Naming) MigrateID(id, name string, objects Objects) (string, error) {
+	if !n.IsNameBased() {
+		return id, nil
+	}
+	newID := n.NameToID(name)
+	if newID == "" {
+		// The name can't be converted anymore, but the object is still accessible by its ID.
+		return id, nil
+	}
+	collision := collisionID(newID, name, n.maxIDLength())
+	if n.Strategy.Kind == fsentry.IDSlugHash {
+		newID = collision
+	}
+	if id == newID || id == collision {
+		return id, nil
+	}
+
+	ok, err := objects.IsExist(newID)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return newID, nil
+	}
+	if n.Strategy.Kind == fsentry.IDSlug && !n.IsStrict {
+		ok, err = objects.IsExist(collision)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return collision, nil
+		}
+	}
+	return "", fsentry_error.Wrap(fmt.Errorf("ID %q of %q is taken", newID, name), fsentry_error.ErrorNameCollision)
+}
+
+// FindID looks for the object with exactly this name. The IDs the name would have if it was not renamed
+// are checked first, so the folder is read only if they belong to other objects.
+func (n Naming) FindID(name string, objects Objects) (id string, ok bool, err error) {
+	var candidate string
+	switch n.Strategy.Kind {
+	case fsentry.IDSlug, fsentry.IDSlugHash:
+		candidate, err = n.slugID(name, objects)
+		if err != nil && !errors.Is(err, fsentry_error.ErrorBadName) {
+			return "", false, err
+		}
+	default:
+		if IsValidID(name) {
+			candidate = name
+		}
+	}
+	if candidate != "" {
+		ok, err = n.hasName(candidate, name, objects)
+		if err != nil || ok {
+			return candidate, ok, err
+		}
+	}
+
+	name = NormalizeName(name)
+	err = objects.ListIDs(func(objectID string) bool {
+		if objectID == candidate {
+			return true
+		}
+		objectName, err := objects.GetName(objectID)
+		if err != nil {
+			// Corrupted objects have no name.
+			return true
+		}
+		if NormalizeName(objectName) == name {
+			id, ok = objectID, true
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return "", false, err
+	}
+	return id, ok, nil
+}
+
+func (n Naming) hasName(id, name string, objects Objects) (bool, error) {
+	ok, err := objects.IsExist(id)
+	if err != nil || !ok {
+		return false, err
+	}
+	objectName, err := objects.GetName(id)
+	if err != nil {
+		return false, nil
+	}
+	return NormalizeName(objectName) == NormalizeName(name), nil
+}
+
+// slugID returns the ID following from the name. For IDSlug it's the ID given to the name on creation:
+// the ID of the name, or the ID with a hash of the name after a collision, or the ID the name had
+// in older versions.
+func (n Naming) slugID(name string, objects Objects) (string, error) {
+	id := n.NameToID(name)
+	if id == "" {
+		return "", fsentry_error.ErrorBadName
+	}
+	collision := collisionID(id, name, n.maxIDLength())
+	if n.Strategy.Kind == fsentry.IDSlugHash {
+		return collision, nil
+	}
+	ok, err := objects.IsExist(collision)
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		return collision, nil
+	}
+	legacyID, err := n.legacyID(id, name, objects)
+	if err != nil || legacyID != "" {
+		return legacyID, err
+	}
+	return id, nil
+}
+
+// newSlugID returns the ID for a new object with IDSlug. If the ID of the name is taken by an object
+// with another name, the ID with a hash of the name is returned, or ErrorNameCollision if IsStrict is set.
+func (n Naming) newSlugID(name string, objects Objects) (string, error) {
+	id := n.NameToID(name)
+	if id == "" {
+		return "", fsentry_error.ErrorBadName
+	}
+	collision := collisionID(id, name, n.maxIDLength())
+	ok, err := objects.IsExist(collision)
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		// The object with this name was created after a collision.
+		return collision, nil
+	}
+	legacyID, err := n.legacyID(id, name, objects)
+	if err != nil {
+		return "", err
+	}
+	if legacyID != "" {
+		ok, err = n.hasName(legacyID, name, objects)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return legacyID, nil
+		}
+	}
+
+	ok, err = objects.IsExist(id)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return id, nil
+	}
+	existName, err := objects.GetName(id)
+	if err != nil {
+		// The existing object cannot be read, so it can't be checked for collision.
+		log.Printf("NewID(): error get name of %q: %s", id, err.Error())
+		return id, nil
+	}
+	if NormalizeName(existName) == NormalizeName(name) {
+		return id, nil
+	}
+	if n.IsStrict {
+		return "", fsentry_error.Wrap(fmt.Errorf("%q has the same ID as %q", name, existName), fsentry_error.ErrorNameCollision)
+	}
+	return collision, nil
+}
+
+// legacyID returns the ID the name had in older versions, if an object with this ID exists and there is
+// no object with the current ID. Otherwise an empty string is returned.
+func (n Naming) legacyID(id, name string, objects Objects) (string, error) {
+	legacyID := legacyNameToID(name)
+	if legacyID == "" || legacyID == id {
+		return "", nil
+	}
+	ok, err := objects.IsExist(id)
+	if err != nil || ok {
+		return "", err
+	}
+	ok, err = objects.IsExist(legacyID)
+	if err != nil || !ok {
+		return "", err
+	}
+	return legacyID, nil
+}
+
+// NameToID returns the slug of the name limited to MaxIDLength.
+func (n Naming) NameToID(name string) string {
+	return NameToIDSize(name, n.maxIDLength())
+}
+func (n Naming) maxIDLength() int {
+	switch {
+	case n.MaxIDLength <= 0:
+		return MaxFilenameLength
+	case n.MaxIDLength < MinIDLength:
+		return MinIDLength
+	}
+	return n.MaxIDLength
+}
+
+// IsValidID checks that the ID can be used as a file name: only lowercase letters, digits,
+// underscores and hyphens.
+func IsValidID(id string) bool {
+	if id == "" || len(id) > MaxFilenameLength || strings.ToLower(id) != id || !regID.MatchString(id) {
+		return false
+	}
+	_, ok := uniqForbiddenNames[id]
+	return !ok
+}
+
+// CheckPathSegment returns ErrorBadPath if the segment of a path can't be the ID or the name of a folder
+// inside the parent folder: empty segments, "." and "..", segments with separators, hidden names
+// of the library files and reserved names.
+func CheckPathSegment(segment string) error {
+	_, isReserved := uniqForbiddenNames[strings.ToLower(segment)]
+	switch {
+	case segment == "", strings.HasPrefix(segment, "."):
+	case strings.ContainsAny(segment, "/\\\x00"), filepath.IsAbs(segment):
+	case isReserved:
+	default:
+		return nil
+	}
+	return fsentry_error.Wrap(fmt.Errorf("path segment %q", segment), fsentry_error.ErrorBadPath)
+}
+
+// NewUUIDv7 returns a random UUID version 7, which starts with the current time in milliseconds.
+func NewUUIDv7() (string, error) {
+	var buf [16]byte
+	_, err := rand.Read(buf[6:])
+	if err != nil {
+		return "", fsentry_error.Wrap(err, fsentry_error.ErrorInternal)
+	}
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(time.Now().UnixMilli()))
+	copy(buf[:6], ts[2:])
+	buf[6] = 0x70 | buf[6]&0x0f
+	buf[8] = 0x80 | buf[8]&0x3f
+
+	s := hex.EncodeToString(buf[:])
+	return s[:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:], nil
+}
+
+// NewULID returns a random ULID in lowercase: 48 bits of the current time in milliseconds
+// and 80 random bits encoded with the Crockford's base32.
+func NewULID() (string, error) {
+	var random [10]byte
+	_, err := rand.Read(random[:])
+	if err != nil {
+		return "", fsentry_error.Wrap(err, fsentry_error.ErrorInternal)
+	}
+
+	var buf [26]byte
+	encodeBase32(buf[:10], uint64(time.Now().UnixMilli()))
+	// 80 random bits are encoded as two halves of 40 bits.
+	var half [8]byte
+	copy(half[3:], random[:5])
+	encodeBase32(buf[10:18], binary.BigEndian.Uint64(half[:]))
+	copy(half[3:], random[5:])
+	encodeBase32(buf[18:], binary.BigEndian.Uint64(half[:]))
+	return string(buf[:]), nil
+}
+
+// encodeBase32 writes the lowest 5*len(dst) bits of the value to dst.
+func encodeBase32(dst []byte, value uint64) {
+	for i := len(dst) - 1; i >= 0; i-- {
+		dst[i] = ulidAlphabet[value&0x1f]
+		value >>= 5
+	}
+}
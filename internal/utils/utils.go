@@ -2,17 +2,65 @@ package utils
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"io"
 	"regexp"
 	"strings"
+	"time"
+	"unicode/utf8"
 
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+
+	"github.com/HardDie/fsentry/pkg/fsentry"
 	"github.com/HardDie/fsentry/pkg/fsentry_error"
+	"github.com/HardDie/fsentry/pkg/fsentry_storage"
+	"github.com/HardDie/fsentry/pkg/fsentry_types"
 )
 
 const (
 	MaxFilenameLength = 200
+	// MinIDLength is the smallest limit of IDs, it leaves room for the hash appended after a collision.
+	MinIDLength = 16
+	// collisionHashSize is the number of bytes of the name hash in the CollisionID.
+	collisionHashSize = 4
+
+	// ServiceFolder is a hidden folder inside the root of the storage for internal files of the library.
+	ServiceFolder = ".fsentry"
+	// ServicePrefix is a prefix of hidden files and folders created by the library. Not all of them are temporary,
+	// like the markers of overlayfs, see IsLeftover.
+	ServicePrefix = ".fsentry-"
+	// RelocateFolderPrefix is a prefix of hidden folders, where objects moved or copied into another folder are prepared.
+	RelocateFolderPrefix = ServicePrefix + "relocate-"
+	// DuplicateFolderPrefix and RemoveFolderPrefix are prefixes of hidden folders for operations that must look
+	// atomic, they are removed on recovery.
+	DuplicateFolderPrefix = ServicePrefix + "duplicate-"
+	RemoveFolderPrefix    = ServicePrefix + "remove-"
 )
 
+// leftoverPrefixes are prefixes of temporary files and folders, which are left only by interrupted operations.
+var leftoverPrefixes = []string{
+	fsentry_storage.TempFilePrefix,
+	RelocateFolderPrefix,
+	DuplicateFolderPrefix,
+	RemoveFolderPrefix,
+}
+
+// IsLeftover reports whether the file or folder with the name is a temporary object of an operation.
+func IsLeftover(name string) bool {
+	for _, prefix := range leftoverPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
 var (
 	reg                = regexp.MustCompile(`[^\p{L}0-9_]+`)
 	uniqForbiddenNames = map[string]struct{}{
@@ -45,20 +93,74 @@ var (
 )
 
 func NameToID(in string) string {
-	// Convert all symbols to lowercase
-	lower := strings.ToLower(in)
+	return NameToIDSize(in, MaxFilenameLength)
+}
+
+// NameToIDSize returns the ID of the name, which is not longer than size bytes. The name is normalized
+// and case folded first, so different forms of the same name get the same ID.
+func NameToIDSize(in string, size int) string {
+	// Convert all symbols to the same form and case
+	folded := NormalizeName(cases.Fold().String(NormalizeName(in)))
 	// Replace all spaces to underscore symbol
-	underscore := strings.ReplaceAll(lower, " ", "_")
+	underscore := strings.ReplaceAll(folded, " ", "_")
 	// Keep only letters, numbers and underscore symbols
-	res := reg.ReplaceAllString(underscore, "")
-	if len(res) > MaxFilenameLength {
-		res = res[0:MaxFilenameLength]
+	res := truncate(reg.ReplaceAllString(underscore, ""), size)
+	if _, ok := uniqForbiddenNames[res]; ok {
+		return ""
 	}
+	return res
+}
+
+// NormalizeName returns the NFC form of the name. Names are compared in this form, because the same
+// letter can be written as one symbol or as a letter with a combining mark.
+func NormalizeName(name string) string {
+	return norm.NFC.String(name)
+}
+
+// legacyNameToID returns the ID the name had before names were normalized, objects created by older versions
+// are found by it until their IDs are migrated.
+func legacyNameToID(in string) string {
+	lower := strings.ToLower(in)
+	underscore := strings.ReplaceAll(lower, " ", "_")
+	res := truncate(reg.ReplaceAllString(underscore, ""), MaxFilenameLength)
 	if _, ok := uniqForbiddenNames[res]; ok {
 		return ""
 	}
 	return res
 }
+
+// CollisionID returns the ID for a name whose ID is already taken by an object with another name.
+// A short hash of the name is appended to the ID, so the same name always gets the same ID.
+func CollisionID(id, name string) string {
+	return collisionID(id, name, MaxFilenameLength)
+}
+func collisionID(id, name string, size int) string {
+	sum := sha256.Sum256([]byte(NormalizeName(name)))
+	suffix := "_" + hex.EncodeToString(sum[:collisionHashSize])
+	return truncate(id, size-len(suffix)) + suffix
+}
+
+// truncate shortens the string to size bytes without splitting a multi-byte letter.
+func truncate(s string, size int) string {
+	if len(s) <= size {
+		return s
+	}
+	for size > 0 && !utf8.RuneStart(s[size]) {
+		size--
+	}
+	return s[:size]
+}
+
+// RandomHex returns a random hex string of size bytes, it is used for names of temporary objects.
+func RandomHex(size int) (string, error) {
+	buf := make([]byte, size)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", fsentry_error.Wrap(err, fsentry_error.ErrorInternal)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
 func Allocate[T any](val T) *T {
 	return &val
 }
@@ -84,6 +186,126 @@ func JSONToStruct[T any](data []byte) (*T, error) {
 	return &res, nil
 }
 
+// ReadName decodes only the name field of the metadata of an entry, a folder or a binary. The name is written
+// right after the ID, so the rest of the metadata, like the data of a large entry, is not read.
+func ReadName(r io.Reader) (string, error) {
+	dec := json.NewDecoder(r)
+	tok, err := dec.Token()
+	if err != nil {
+		return "", fsentry_error.Wrap(err, fsentry_error.ErrorInternal)
+	}
+	if tok != json.Delim('{') {
+		return "", fsentry_error.Wrap(fmt.Errorf("metadata is not a json object"), fsentry_error.ErrorInternal)
+	}
+	for dec.More() {
+		tok, err = dec.Token()
+		if err != nil {
+			return "", fsentry_error.Wrap(err, fsentry_error.ErrorInternal)
+		}
+		if tok == "name" {
+			var name fsentry_types.QuotedString
+			err = dec.Decode(&name)
+			if err != nil {
+				return "", fsentry_error.Wrap(err, fsentry_error.ErrorInternal)
+			}
+			return name.String(), nil
+		}
+		// Skip the value of another field.
+		var value json.RawMessage
+		err = dec.Decode(&value)
+		if err != nil {
+			return "", fsentry_error.Wrap(err, fsentry_error.ErrorInternal)
+		}
+	}
+	return "", fsentry_error.Wrap(fmt.Errorf("metadata has no name"), fsentry_error.ErrorInternal)
+}
+
+// CheckMeta validates the fields shared by entry and folder metadata: the stored ID must be equal to the ID
+// from the file name, and both timestamps must be set. It returns the found problems and the metadata
+// with fixed fields, or nil if there is nothing to fix. Unknown fields are kept as is.
+func CheckMeta(data []byte, id string, now time.Time, isPretty bool) ([]fsentry.CheckProblem, []byte, error) {
+	var meta map[string]json.RawMessage
+	err := json.Unmarshal(data, &meta)
+	if err != nil || meta == nil {
+		problem := fsentry.CheckProblem{
+			Kind:    fsentry.ProblemInvalidJSON,
+			Message: "metadata is not a json object",
+		}
+		if err != nil {
+			problem.Message = err.Error()
+		}
+		return []fsentry.CheckProblem{problem}, nil, nil
+	}
+
+	var problems []fsentry.CheckProblem
+
+	var storedID string
+	if e := json.Unmarshal(meta["id"], &storedID); e != nil || storedID != id {
+		problems = append(problems, fsentry.CheckProblem{
+			Kind:    fsentry.ProblemIDMismatch,
+			Message: fmt.Sprintf("stored ID %q is different from the file name %q", storedID, id),
+		})
+		meta["id"], _ = json.Marshal(id)
+	}
+
+	var createdAt, updatedAt *time.Time
+	_ = json.Unmarshal(meta["createdAt"], &createdAt)
+	_ = json.Unmarshal(meta["updatedAt"], &updatedAt)
+	if createdAt == nil || updatedAt == nil {
+		problems = append(problems, fsentry.CheckProblem{
+			Kind:    fsentry.ProblemMissingTimestamp,
+			Message: "creation or update timestamp is not set",
+		})
+		switch {
+		case createdAt == nil && updatedAt == nil:
+			createdAt = &now
+			updatedAt = &now
+		case createdAt == nil:
+			createdAt = updatedAt
+		default:
+			updatedAt = createdAt
+		}
+		meta["createdAt"], _ = json.Marshal(createdAt)
+		meta["updatedAt"], _ = json.Marshal(updatedAt)
+	}
+
+	if len(problems) == 0 {
+		return nil, nil, nil
+	}
+	fixed, err := StructToJSON(meta, isPretty)
+	if err != nil {
+		return nil, nil, err
+	}
+	return problems, fixed, nil
+}
+
+// CheckContext returns the error of the context wrapped with fsentry_error.ErrorCanceled,
+// if the context is canceled or its deadline is exceeded.
+func CheckContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return fsentry_error.Wrap(err, fsentry_error.ErrorCanceled)
+	}
+	return nil
+}
+
+// ContextReader returns a reader that fails with the error of CheckContext after the context is canceled,
+// so a long write of a large stream can be stopped.
+func ContextReader(ctx context.Context, r io.Reader) io.Reader {
+	return contextReader{ctx: ctx, r: r}
+}
+
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := CheckContext(r.ctx); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
 func Compare[T comparable](a, b *T) bool {
 	switch {
 	case a == nil && b == nil:
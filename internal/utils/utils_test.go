@@ -1,9 +1,17 @@
 package utils
 
 import (
+	"errors"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/HardDie/fsentry/pkg/fsentry"
+	"github.com/HardDie/fsentry/pkg/fsentry_error"
 )
 
 func FuzzNameToIDFile(f *testing.F) {
@@ -38,7 +46,7 @@ func FuzzNameToIDFile(f *testing.F) {
 
 		tmpDirName, err := os.MkdirTemp("", "fsentry")
 		if err != nil {
-			f.Fatal("error creating temp dir", err)
+			t.Fatal("error creating temp dir", err)
 		}
 		defer os.RemoveAll(tmpDirName)
 
@@ -91,7 +99,7 @@ func FuzzNameToIDFolder(f *testing.F) {
 
 		tmpDirName, err := os.MkdirTemp("", "fsentry")
 		if err != nil {
-			f.Fatal("error creating temp dir", err)
+			t.Fatal("error creating temp dir", err)
 		}
 		defer os.RemoveAll(tmpDirName)
 
@@ -107,3 +115,269 @@ func FuzzNameToIDFolder(f *testing.F) {
 		}
 	})
 }
+
+func FuzzCheckPathSegment(f *testing.F) {
+	tests := []string{
+		"", ".", "..", "../..", "..\\..", "/", "/etc", "a/b", "a\\b", "C:\\Windows", "\x00",
+		".fsentry", ".hidden", "con", "CON", "lpt1",
+		"folder", "My Folder", "a..b",
+	}
+	for _, tc := range tests {
+		f.Add(tc)
+	}
+
+	root := filepath.Join("test", "root")
+	f.Fuzz(func(t *testing.T, segment string) {
+		err := CheckPathSegment(segment)
+		if err != nil {
+			if !errors.Is(err, fsentry_error.ErrorBadPath) {
+				t.Fatalf("Expected bad path error for %q, got %v", segment, err)
+			}
+			return
+		}
+
+		// A valid segment is always a single file inside the parent folder.
+		path := filepath.Join(root, segment)
+		if filepath.Dir(path) != root || filepath.Base(path) != segment {
+			t.Fatalf("Segment %q escapes the folder: %q", segment, path)
+		}
+		if strings.HasPrefix(segment, ".") {
+			t.Fatalf("Hidden segment %q", segment)
+		}
+	})
+}
+
+func TestNameToIDTruncate(t *testing.T) {
+	// A two-byte letter crosses the limit, it must not be split.
+	name := strings.Repeat("a", MaxFilenameLength-1) + "ж"
+	id := NameToID(name)
+	if id != strings.Repeat("a", MaxFilenameLength-1) {
+		t.Fatalf("bad ID %q", id)
+	}
+	if !utf8.ValidString(NameToID(strings.Repeat("ж", MaxFilenameLength))) {
+		t.Fatal("ID must be a valid string")
+	}
+}
+
+func TestNewID(t *testing.T) {
+	objects := map[string]string{
+		"hello": "Hello!",
+	}
+	o := Objects{
+		IsExist: func(id string) (bool, error) {
+			_, ok := objects[id]
+			return ok, nil
+		},
+		GetName: func(id string) (string, error) {
+			return objects[id], nil
+		},
+	}
+
+	tests := []struct {
+		name     string
+		isStrict bool
+		want     string
+		err      error
+	}{
+		{name: "world", want: "world"},
+		{name: "Hello!", want: "hello"},
+		{name: "hello", want: CollisionID("hello", "hello")},
+		{name: "HELLO?", want: CollisionID("hello", "HELLO?")},
+		{name: "hello", isStrict: true, err: fsentry_error.ErrorNameCollision},
+		{name: "???", err: fsentry_error.ErrorBadName},
+	}
+	for _, tc := range tests {
+		id, err := Naming{IsStrict: tc.isStrict}.NewID(tc.name, o)
+		if !errors.Is(err, tc.err) || id != tc.want {
+			t.Fatalf("NewID(%q): got %q %v, want %q %v", tc.name, id, err, tc.want, tc.err)
+		}
+	}
+
+	// The object created after a collision is found by its name.
+	objects[CollisionID("hello", "hello")] = "hello"
+	id, err := Naming{}.ResolveID("hello", o)
+	if err != nil || id != CollisionID("hello", "hello") {
+		t.Fatalf("ResolveID: got %q %v", id, err)
+	}
+	id, err = Naming{}.NewID("hello", o)
+	if err != nil || id != CollisionID("hello", "hello") {
+		t.Fatalf("NewID must return the existing ID: got %q %v", id, err)
+	}
+}
+
+func TestGeneratedID(t *testing.T) {
+	uuidRe := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	ulidRe := regexp.MustCompile(`^[0-9a-hjkmnp-tv-z]{26}$`)
+	for i := 0; i < 100; i++ {
+		uuid, err := NewUUIDv7()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !uuidRe.MatchString(uuid) || !IsValidID(uuid) {
+			t.Fatalf("bad UUID %q", uuid)
+		}
+		ulid, err := NewULID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ulidRe.MatchString(ulid) || !IsValidID(ulid) {
+			t.Fatalf("bad ULID %q", ulid)
+		}
+	}
+
+	first, _ := NewULID()
+	time.Sleep(2 * time.Millisecond)
+	second, _ := NewULID()
+	if first[:10] >= second[:10] {
+		t.Fatalf("ULIDs must be ordered by time: %q %q", first, second)
+	}
+}
+
+func TestNaming(t *testing.T) {
+	objects := map[string]string{
+		"hello":  "World",
+		"abc-12": "Other",
+	}
+	o := Objects{
+		IsExist: func(id string) (bool, error) {
+			_, ok := objects[id]
+			return ok, nil
+		},
+		GetName: func(id string) (string, error) {
+			return objects[id], nil
+		},
+		ListIDs: func(fn func(id string) bool) error {
+			for id := range objects {
+				if !fn(id) {
+					break
+				}
+			}
+			return nil
+		},
+	}
+
+	keep := Naming{Strategy: fsentry.IDStrategy{Kind: fsentry.IDSlug, KeepIDOnRename: true}}
+	tests := []struct {
+		name string
+		want string
+		err  error
+	}{
+		{name: "World", want: "hello"},
+		{name: "Hello", err: fsentry_error.ErrorNotExist},
+		{name: "Other", want: "abc-12"},
+		{name: "missing", want: "missing"},
+	}
+	for _, tc := range tests {
+		id, err := keep.ResolveID(tc.name, o)
+		if !errors.Is(err, tc.err) || id != tc.want {
+			t.Fatalf("ResolveID(%q): got %q %v, want %q %v", tc.name, id, err, tc.want, tc.err)
+		}
+	}
+	id, err := keep.NewID("Hello", o)
+	if err != nil || id != CollisionID("hello", "Hello") {
+		t.Fatalf("NewID: got %q %v", id, err)
+	}
+	_, err = keep.RenameID("abc-12", "World", o)
+	if !errors.Is(err, fsentry_error.ErrorExist) {
+		t.Fatalf("RenameID: expected exist error, got %v", err)
+	}
+	id, err = keep.RenameID("abc-12", "New", o)
+	if err != nil || id != "abc-12" {
+		t.Fatalf("RenameID: got %q %v", id, err)
+	}
+
+	uuid := Naming{Strategy: fsentry.IDStrategy{Kind: fsentry.IDUUIDv7}}
+	id, err = uuid.ResolveID("abc-12", o)
+	if err != nil || id != "abc-12" {
+		t.Fatalf("ResolveID by ID: got %q %v", id, err)
+	}
+	_, err = uuid.ResolveID("Not an ID", o)
+	if !errors.Is(err, fsentry_error.ErrorNotExist) {
+		t.Fatalf("ResolveID: expected not exist error, got %v", err)
+	}
+	id, err = uuid.NewID("Other", o)
+	if err != nil || id != "abc-12" {
+		t.Fatalf("NewID must return the existing ID: got %q %v", id, err)
+	}
+
+	taken := Naming{Strategy: fsentry.IDStrategy{Kind: fsentry.IDFunc, Func: func(name string) (string, error) {
+		return "hello", nil
+	}}}
+	_, err = taken.NewID("New", o)
+	if !errors.Is(err, fsentry_error.ErrorNameCollision) {
+		t.Fatalf("NewID: expected name collision error, got %v", err)
+	}
+}
+
+func TestNameToIDNormalize(t *testing.T) {
+	tests := []struct {
+		a, b string
+	}{
+		// NFC and NFD forms.
+		{a: "Caf\u00e9", b: "Cafe\u0301"},
+		{a: "Straße", b: "STRASSE"},
+		{a: "ΌΣΟΣ", b: "όσος"},
+	}
+	for _, tc := range tests {
+		if NameToID(tc.a) != NameToID(tc.b) {
+			t.Fatalf("%q and %q must have the same ID: %q %q", tc.a, tc.b, NameToID(tc.a), NameToID(tc.b))
+		}
+	}
+	if NameToID("Cafe\u0301") != "caf\u00e9" {
+		t.Fatalf("bad ID %q", NameToID("Cafe\u0301"))
+	}
+
+	for _, name := range []string{strings.Repeat("жё", 50), strings.Repeat("漢字", 50), strings.Repeat("é", 50)} {
+		for size := MinIDLength; size < 40; size++ {
+			id := NameToIDSize(name, size)
+			if len(id) > size || len(id) < size-3 || !utf8.ValidString(id) {
+				t.Fatalf("bad ID %q of size %d", id, size)
+			}
+		}
+	}
+}
+
+func TestNamingLegacy(t *testing.T) {
+	// The entry was created by an older version, which removed the combining mark.
+	objects := map[string]string{
+		"cafe": "Cafe\u0301",
+	}
+	o := Objects{
+		IsExist: func(id string) (bool, error) {
+			_, ok := objects[id]
+			return ok, nil
+		},
+		GetName: func(id string) (string, error) {
+			return objects[id], nil
+		},
+	}
+
+	n := Naming{}
+	id, err := n.ResolveID("Cafe\u0301", o)
+	if err != nil || id != "cafe" {
+		t.Fatalf("ResolveID: got %q %v", id, err)
+	}
+	id, err = n.NewID("Cafe\u0301", o)
+	if err != nil || id != "cafe" {
+		t.Fatalf("NewID must return the existing ID: got %q %v", id, err)
+	}
+	id, err = n.MigrateID("cafe", "Cafe\u0301", o)
+	if err != nil || id != "caf\u00e9" {
+		t.Fatalf("MigrateID: got %q %v", id, err)
+	}
+
+	// The new ID is taken by another object.
+	objects["caf\u00e9"] = "CAF\u00c9"
+	id, err = n.MigrateID("cafe", "Cafe\u0301", o)
+	if err != nil || id != collisionID("caf\u00e9", "Cafe\u0301", MaxFilenameLength) {
+		t.Fatalf("MigrateID: got %q %v", id, err)
+	}
+	_, err = Naming{IsStrict: true}.MigrateID("cafe", "Cafe\u0301", o)
+	if !errors.Is(err, fsentry_error.ErrorNameCollision) {
+		t.Fatalf("MigrateID: expected name collision error, got %v", err)
+	}
+	id, err = n.MigrateID("caf\u00e9", "CAF\u00c9", o)
+	if err != nil || id != "caf\u00e9" {
+		t.Fatalf("MigrateID must keep a valid ID: got %q %v", id, err)
+	}
+}
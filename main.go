@@ -5,18 +5,33 @@
 package fsentry
 
 import (
+	"time"
+
 	binaryService "github.com/HardDie/fsentry/internal/binary/service"
 	entryService "github.com/HardDie/fsentry/internal/entry/service"
+	"github.com/HardDie/fsentry/internal/flock"
 	folderService "github.com/HardDie/fsentry/internal/folder/service"
+	"github.com/HardDie/fsentry/internal/fs"
 	fsStorage "github.com/HardDie/fsentry/internal/fs/storage"
+	journalService "github.com/HardDie/fsentry/internal/journal/service"
 	"github.com/HardDie/fsentry/internal/service"
+	"github.com/HardDie/fsentry/internal/utils"
 	"github.com/HardDie/fsentry/pkg/fsentry"
+	"github.com/HardDie/fsentry/pkg/fsentry_storage"
 )
 
 type Config struct {
 	log      fsentry.Logger
 	root     string
 	isPretty bool
+	fs       fs.FS
+
+	isStrictNames bool
+	idStrategy    fsentry.IDStrategy
+	maxIDLength   int
+
+	fileLockMode    fsentry.FileLockMode
+	fileLockTimeout time.Duration
 }
 
 func WithLogger(log fsentry.Logger) func(cfg *Config) {
@@ -33,6 +48,84 @@ func WithPretty() func(cfg *Config) {
 	}
 }
 
+// WithStrictNames disables resolving of name collisions. By default, if a new object has a name
+// whose ID is already taken by an object with another name, like "Hello!" and "hello", a short hash of the name
+// is appended to its ID. With this option fsentry_error.ErrorNameCollision is returned instead.
+func WithStrictNames() func(cfg *Config) {
+	return func(cfg *Config) {
+		cfg.isStrictNames = true
+	}
+}
+
+// WithIDStrategy selects how IDs of new objects are generated, by default they are slugs of the names.
+// With the strategies whose IDs don't follow from the names, like IDUUIDv7, the IDs stay the same
+// when objects are renamed, and objects are still accessed by their names, see fsentry.IDStrategy.
+//
+// Such objects are found by reading the names of the objects in the folder, only the name field of each
+// object is read, but the cost of creating and accessing an object by name grows with the size of the folder.
+// Prefer the default strategy for folders with many objects.
+//
+// The strategy should not be changed for an existing storage: objects created with another strategy
+// are accessible, but may be found slower.
+func WithIDStrategy(strategy fsentry.IDStrategy) func(cfg *Config) {
+	return func(cfg *Config) {
+		cfg.idStrategy = strategy
+	}
+}
+
+// WithMaxIDLength limits the length of IDs derived from names in bytes, 200 by default. Names are cut
+// on letter boundaries, so the limit is kept for any language. Use it for file systems with shorter names:
+// files of objects add up to 15 bytes of suffixes to the ID, like "." + ID + ".bin.info.json".
+// The smallest limit is 16 bytes.
+//
+// After the limit of an existing storage is changed, call MigrateIDs to rename the objects with long IDs.
+func WithMaxIDLength(bytes int) func(cfg *Config) {
+	return func(cfg *Config) {
+		if bytes <= 0 {
+			return
+		}
+		cfg.maxIDLength = bytes
+	}
+}
+
+// WithFileLock allows several processes to work with the same root. Reads take shared and writes take
+// exclusive advisory locks on lock files in the .fsentry folder of the root, the mode selects whether
+// the whole root or each folder has its own lock file.
+//
+// If the lock is not taken within the timeout, the method returns fsentry_error.ErrorLockTimeout.
+// A zero timeout means waiting without limit. Lock files are created on the disk, so the option
+// has no effect for other storages set with WithStorage, like memfs or overlayfs. Lock files are kept
+// by Drop, because other processes may hold them.
+func WithFileLock(mode fsentry.FileLockMode, timeout time.Duration) func(cfg *Config) {
+	return func(cfg *Config) {
+		cfg.fileLockMode = mode
+		cfg.fileLockTimeout = timeout
+	}
+}
+
+// WithStorage replaces the disk storage with another backend, like memfs or your own implementation.
+func WithStorage(backend fsentry_storage.Storage) func(cfg *Config) {
+	return func(cfg *Config) {
+		if backend == nil {
+			return
+		}
+		cfg.fs = backend
+	}
+}
+
+// WithFS replaces the disk storage with another implementation of the file system.
+//
+// Deprecated: use WithStorage.
+func WithFS(fs fsentry_storage.Storage) func(cfg *Config) {
+	return WithStorage(fs)
+}
+
+// NewDiskStorage returns the default storage that keeps files and folders on the disk.
+// It allows to combine the disk with other storages, for example in overlayfs.
+func NewDiskStorage() fsentry_storage.Storage {
+	return fsStorage.New()
+}
+
 func NewFSEntry(root string, ops ...func(fs *Config)) fsentry.IFSEntry {
 	cfg := &Config{
 		root: root,
@@ -41,14 +134,31 @@ func NewFSEntry(root string, ops ...func(fs *Config)) fsentry.IFSEntry {
 		op(cfg)
 	}
 
-	fileStorage := fsStorage.New()
+	var fileStorage fs.FS = fsStorage.New()
+	if cfg.fs != nil {
+		fileStorage = cfg.fs
+	}
+	// Lock files are created on the disk, they can't synchronize processes using another storage.
+	var fileLock *flock.Locker
+	if _, isDisk := fileStorage.(fsStorage.FS); isDisk {
+		fileLock = flock.New(cfg.root, cfg.fileLockMode, cfg.fileLockTimeout)
+	}
+	journal := journalService.New(fileStorage, cfg.root)
+	naming := utils.Naming{
+		Strategy:    cfg.idStrategy,
+		IsStrict:    cfg.isStrictNames,
+		MaxIDLength: cfg.maxIDLength,
+	}
 	return service.New(
 		cfg.log,
 		cfg.root,
 		cfg.isPretty,
+		naming,
+		fileLock,
 		fileStorage,
-		binaryService.New(fileStorage, cfg.isPretty),
-		entryService.New(fileStorage, cfg.isPretty),
-		folderService.New(fileStorage, cfg.isPretty),
+		journal,
+		binaryService.New(fileStorage, journal, cfg.isPretty, naming),
+		entryService.New(fileStorage, journal, cfg.isPretty, naming),
+		folderService.New(fileStorage, journal, cfg.isPretty, naming),
 	)
 }
@@ -1,11 +1,26 @@
 package fsentry
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/HardDie/fsentry/internal/flock"
+	"github.com/HardDie/fsentry/pkg/fsentry"
 	"github.com/HardDie/fsentry/pkg/fsentry_error"
+	"github.com/HardDie/fsentry/pkg/fsentry_storage"
+	"github.com/HardDie/fsentry/pkg/memfs"
+	"github.com/HardDie/fsentry/pkg/overlayfs"
 )
 
 func TestFolder(t *testing.T) {
@@ -722,3 +737,2006 @@ func TestBinary(t *testing.T) {
 		}
 	})
 }
+
+func TestList(t *testing.T) {
+	listDB := NewFSEntry("test")
+	err := listDB.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listDB.Drop()
+
+	t.Run("list", func(t *testing.T) {
+		root := filepath.Join("test", "test_list")
+		db := NewFSEntry(root)
+		err := db.Init()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Try to list not exist folder
+		_, err = db.List("not_exist_folder")
+		if !errors.Is(err, fsentry_error.ErrorNotExist) {
+			t.Fatal("Folder not exist")
+		}
+
+		_, err = db.CreateFolder("Some Folder", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.CreateEntry("Some Entry", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.CreateBinary("some_binary", []byte("data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Folder without .info.json file
+		err = os.Mkdir(filepath.Join(root, "corrupted"), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		list, err := db.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list.Folders) != 1 || list.Folders[0].Name != "Some Folder" {
+			t.Fatal("Bad folders", list.Folders)
+		}
+		if len(list.Entries) != 1 || list.Entries[0].Name != "Some Entry" {
+			t.Fatal("Bad entries", list.Entries)
+		}
+		if len(list.Binaries) != 1 || list.Binaries[0] != "some_binary" {
+			t.Fatal("Bad binaries", list.Binaries)
+		}
+		if len(list.CorruptedFolder) != 1 || list.CorruptedFolder[0] != "corrupted" {
+			t.Fatal("Bad corrupted folders", list.CorruptedFolder)
+		}
+
+		// Empty folder
+		list, err = db.List("some_folder")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list.Folders) != 0 || len(list.Entries) != 0 || len(list.Binaries) != 0 || len(list.CorruptedFolder) != 0 {
+			t.Fatal("Folder must be empty")
+		}
+
+		err = db.Drop()
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("logger", func(t *testing.T) {
+		storage := memfs.New()
+		logger := &testLogger{}
+		db := NewFSEntry("db", WithStorage(storage), WithLogger(logger))
+		err := db.Init()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = storage.CreateFile(filepath.Join("db", "bad.json"), []byte("{"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		list, err := db.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list.Entries) != 0 {
+			t.Fatal("Invalid entry must be skipped", list.Entries)
+		}
+		if len(logger.messages) != 1 || !strings.HasPrefix(logger.messages[0], "List(): error read entry") {
+			t.Fatal("The invalid entry must be logged with the logger", logger.messages)
+		}
+	})
+
+	t.Run("pagination", func(t *testing.T) {
+		db := NewFSEntry(filepath.Join("test", "test_list_pagination"))
+		err := db.Init()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, name := range []string{"e3", "e1", "e5", "e2", "e4"} {
+			_, err = db.CreateEntry(name, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err = db.CreateFolder("f1", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Read all entries page by page in descending order
+		var names []string
+		opts := fsentry.ListOptions{
+			Limit:      2,
+			Kinds:      fsentry.ListKindEntries,
+			SortBy:     fsentry.ListSortByName,
+			Descending: true,
+		}
+		for i := 0; i < 10; i++ {
+			list, err := db.ListWithOptions(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(list.Folders) != 0 {
+				t.Fatal("Folders must be filtered")
+			}
+			for _, ent := range list.Entries {
+				names = append(names, ent.Name)
+			}
+			if list.NextCursor == "" {
+				break
+			}
+			opts.Cursor = list.NextCursor
+		}
+		if strings.Join(names, ",") != "e5,e4,e3,e2,e1" {
+			t.Fatal("Bad order", names)
+		}
+
+		// Filter by name prefix
+		list, err := db.ListWithOptions(fsentry.ListOptions{NamePrefix: "f"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list.Folders) != 1 || len(list.Entries) != 0 || list.NextCursor != "" {
+			t.Fatal("Bad prefix filter")
+		}
+
+		// Try to use a cursor with other sort options
+		_, err = db.ListWithOptions(fsentry.ListOptions{Cursor: opts.Cursor, SortBy: fsentry.ListSortByCreatedAt})
+		if !errors.Is(err, fsentry_error.ErrorBadCursor) {
+			t.Fatal("Bad cursor")
+		}
+
+		err = db.Drop()
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestWalk(t *testing.T) {
+	walkDB := NewFSEntry("test")
+	err := walkDB.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer walkDB.Drop()
+
+	root := filepath.Join("test", "test_walk")
+	db := NewFSEntry(root)
+	err = db.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Drop()
+
+	_, err = db.CreateFolder("f1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateFolder("f2", nil, "f1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateEntry("e1", nil, "f1", "f2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.CreateBinary("b1", []byte("data"), "f1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateFolder("f3", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateEntry("e2", nil, "f3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Folder without .info.json file
+	err = os.MkdirAll(filepath.Join(root, "f3", "corrupted"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("walk", func(t *testing.T) {
+		var visited []string
+		err := db.Walk(func(path []string, obj fsentry.WalkObject, err error) error {
+			if obj.Kind == fsentry.ObjectCorruptedFolder && !errors.Is(err, fsentry_error.ErrorFolderCorrupted) {
+				t.Fatal("Corrupted folder must be reported")
+			}
+			visited = append(visited, strings.Join(append(path, obj.ID), "/"))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "f1,f1/b1,f1/f2,f1/f2/e1,f3,f3/corrupted,f3/e2"
+		if strings.Join(visited, ",") != want {
+			t.Fatal("Bad walk order", visited)
+		}
+	})
+
+	t.Run("skip", func(t *testing.T) {
+		var visited []string
+		err := db.Walk(func(path []string, obj fsentry.WalkObject, err error) error {
+			visited = append(visited, strings.Join(append(path, obj.ID), "/"))
+			switch obj.ID {
+			case "f2":
+				return fsentry.SkipDir
+			case "corrupted":
+				return fsentry.SkipAll
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "f1,f1/b1,f1/f2,f3,f3/corrupted"
+		if strings.Join(visited, ",") != want {
+			t.Fatal("Bad walk order", visited)
+		}
+	})
+
+	t.Run("tree", func(t *testing.T) {
+		tree, err := db.Tree("f1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tree.Folder == nil || tree.Folder.Name != "f1" {
+			t.Fatal("Bad root folder")
+		}
+		if len(tree.Binaries) != 1 || len(tree.Folders) != 1 {
+			t.Fatal("Bad content of the root folder")
+		}
+		if len(tree.Folders[0].Entries) != 1 || tree.Folders[0].Entries[0].Name != "e1" {
+			t.Fatal("Bad content of the nested folder")
+		}
+
+		tree, err = db.Tree()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tree.Folders) != 2 || !tree.Folders[1].Folders[0].IsCorrupted {
+			t.Fatal("Corrupted folder must be in the tree")
+		}
+
+		// Try to get tree of not exist folder
+		_, err = db.Tree("not_exist")
+		if !errors.Is(err, fsentry_error.ErrorNotExist) {
+			t.Fatal("Folder not exist")
+		}
+	})
+}
+
+func TestCheck(t *testing.T) {
+	checkDB := NewFSEntry("test")
+	err := checkDB.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkDB.Drop()
+
+	root := filepath.Join("test", "test_check")
+	db := NewFSEntry(root)
+	err = db.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Drop()
+
+	_, err = db.CreateFolder("f1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateEntry("e1", nil, "f1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Folder without .info.json file
+	err = os.MkdirAll(filepath.Join(root, "f1", "corrupted"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		filepath.Join("f1", "e2.json"):           `{"id":"other","name":"\"e2\"","createdAt":"2023-01-01T00:00:00Z","updatedAt":"2023-01-01T00:00:00Z","data":null}`,
+		filepath.Join("f1", "e3.json"):           `{"id":"e3","name":"\"e3\"","data":null}`,
+		filepath.Join("f1", "bad.json"):          `{"id":`,
+		filepath.Join("f1", ".fsentry-tmp-1234"): ``,
+		filepath.Join("f1", ".b1.bin.info.json"): `{}`,
+		// Markers of overlayfs are not leftovers.
+		filepath.Join("f1", ".fsentry-opaque"):      ``,
+		filepath.Join("f1", ".fsentry-whiteout-e9"): ``,
+	}
+	for name, data := range files {
+		err = os.WriteFile(filepath.Join(root, name), []byte(data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	problemsToString := func(report *fsentry.CheckReport) string {
+		var res []string
+		for _, problem := range report.Problems {
+			res = append(res, fmt.Sprintf("%s:%s:%t", problem.Kind, strings.Join(append(problem.Path, problem.Name), "/"), problem.IsRepaired))
+		}
+		sort.Strings(res)
+		return strings.Join(res, ",")
+	}
+
+	t.Run("check", func(t *testing.T) {
+		report, err := db.Check(fsentry.CheckOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "idMismatch:f1/e2.json:false,invalidJSON:f1/bad.json:false,leftover:f1/.fsentry-tmp-1234:false," +
+			"missingInfo:f1/corrupted:false,missingTimestamp:f1/e3.json:false,orphanInfo:f1/.b1.bin.info.json:false"
+		if got := problemsToString(report); got != want {
+			t.Fatal("Bad problems", got)
+		}
+		if report.Folders != 2 || report.Entries != 4 {
+			t.Fatal("Bad counters", report.Folders, report.Entries)
+		}
+		// Check without repair must not modify the storage.
+		_, err = os.Stat(filepath.Join(root, "f1", "bad.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("repair", func(t *testing.T) {
+		report, err := db.Check(fsentry.CheckOptions{Repair: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "idMismatch:f1/e2.json:true,invalidJSON:f1/bad.json:true,leftover:f1/.fsentry-tmp-1234:true," +
+			"missingInfo:f1/corrupted:true,missingTimestamp:f1/e3.json:true,orphanInfo:f1/.b1.bin.info.json:true"
+		if got := problemsToString(report); got != want {
+			t.Fatal("Bad problems", got)
+		}
+
+		report, err = db.Check(fsentry.CheckOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Problems) != 0 {
+			t.Fatal("Problems must be repaired", problemsToString(report))
+		}
+		_, err = os.Stat(filepath.Join(root, "f1", ".fsentry-whiteout-e9"))
+		if err != nil {
+			t.Fatal("Markers must be kept", err)
+		}
+
+		info, err := db.GetFolder("corrupted", "f1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Name != "corrupted" {
+			t.Fatal("Bad folder name", info.Name)
+		}
+		entry, err := db.GetEntry("e2", "f1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.ID != "e2" {
+			t.Fatal("Bad entry ID", entry.ID)
+		}
+		entry, err = db.GetEntry("e3", "f1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.CreatedAt.IsZero() || !entry.CreatedAt.Equal(entry.UpdatedAt) {
+			t.Fatal("Bad timestamps", entry.CreatedAt, entry.UpdatedAt)
+		}
+		quarantined, err := os.ReadDir(filepath.Join(root, ".fsentry", "quarantine", "f1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(quarantined) != 1 || !strings.HasPrefix(quarantined[0].Name(), "bad.json.") {
+			t.Fatal("Invalid file must be quarantined", quarantined)
+		}
+	})
+}
+
+func TestMemFS(t *testing.T) {
+	root := filepath.Join("test", "test_memfs")
+	db := NewFSEntry(root, WithStorage(memfs.New()))
+	err := db.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Drop()
+
+	_, err = db.CreateFolder("f1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateEntry("e1", "data", "f1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.CreateBinary("b1", []byte("data"), "f1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.DuplicateFolder("f1", "f2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.MoveEntry("e1", "e2", "f2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.RemoveFolder("f1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := db.List("f2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Entries) != 1 || list.Entries[0].Name != "e2" || len(list.Binaries) != 1 {
+		t.Fatal("Bad list", list)
+	}
+	report, err := db.Check(fsentry.CheckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 0 {
+		t.Fatal("Storage must be consistent", report.Problems)
+	}
+
+	// Nothing must be written to the disk.
+	_, err = os.Stat(root)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("Folder must not be created on the disk", err)
+	}
+}
+
+func TestFileLock(t *testing.T) {
+	for _, mode := range []fsentry.FileLockMode{fsentry.FileLockRoot, fsentry.FileLockFolder} {
+		mode := mode
+		t.Run(fmt.Sprint(mode), func(t *testing.T) {
+			root := filepath.Join("test", "test_file_lock")
+			db := NewFSEntry(root, WithFileLock(mode, 50*time.Millisecond))
+			err := db.Init()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Drop()
+
+			_, err = db.CreateFolder("f1", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Another process is writing to the folder.
+			unlock, err := flock.New(root, mode, 0).Lock(context.Background(), true, "f1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = db.CreateEntry("e1", "data", "f1")
+			if !errors.Is(err, fsentry_error.ErrorLockTimeout) {
+				unlock()
+				t.Fatal("Expected lock timeout error, got", err)
+			}
+			unlock()
+
+			_, err = db.CreateEntry("e1", "data", "f1")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Lock files must not be reported as leftovers.
+			report, err := db.Check(fsentry.CheckOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(report.Problems) != 0 {
+				t.Fatal("Storage must be consistent", report.Problems)
+			}
+
+			// Drop removes the objects, but keeps the lock files other processes may hold.
+			err = db.Drop()
+			if err != nil {
+				t.Fatal(err)
+			}
+			files, err := os.ReadDir(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != 1 || files[0].Name() != ".fsentry" {
+				t.Fatal("Only the service folder must be kept", files)
+			}
+			files, err = os.ReadDir(filepath.Join(root, ".fsentry"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != 1 || files[0].Name() != flock.LockFolder {
+				t.Fatal("Only the lock folder must be kept", files)
+			}
+			err = os.RemoveAll(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	t.Run("memfs", func(t *testing.T) {
+		root := filepath.Join("test", "test_file_lock_memfs")
+		db := NewFSEntry(root, WithStorage(memfs.New()), WithFileLock(fsentry.FileLockFolder, 0))
+		err := db.Init()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.CreateEntry("e1", "data")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Lock files are not created for a storage in memory.
+		_, err = os.Stat(root)
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Fatal("Folder must not be created on the disk", err)
+		}
+	})
+}
+
+func TestTx(t *testing.T) {
+	root := filepath.Join("test", "test_tx")
+	db := NewFSEntry(root)
+	err := db.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Drop()
+
+	_, err = db.CreateEntry("updated", "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateEntry("removed", "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateFolder("moved", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateEntry("e1", "data", "moved")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("rollback", func(t *testing.T) {
+		errStop := errors.New("stop")
+		err := db.Tx(func(tx fsentry.IFSEntryTx) error {
+			_, err := tx.CreateFolder("f1", nil)
+			if err != nil {
+				return err
+			}
+			_, err = tx.UpdateEntry("updated", "new")
+			if err != nil {
+				return err
+			}
+			return errStop
+		})
+		if !errors.Is(err, errStop) {
+			t.Fatal("Expected error of the transaction, got", err)
+		}
+
+		_, err = db.GetFolder("f1")
+		if !errors.Is(err, fsentry_error.ErrorNotExist) {
+			t.Fatal("Folder must not be created", err)
+		}
+		entry, err := db.GetEntry("updated")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(entry.Data) != `"old"` {
+			t.Fatal("Entry must not be updated", string(entry.Data))
+		}
+	})
+
+	t.Run("commit", func(t *testing.T) {
+		err := db.Tx(func(tx fsentry.IFSEntryTx) error {
+			_, err := tx.CreateFolder("f1", nil)
+			if err != nil {
+				return err
+			}
+			_, err = tx.CreateEntry("e1", "data", "f1")
+			if err != nil {
+				return err
+			}
+			err = tx.CreateBinary("b1", []byte("data"), "f1")
+			if err != nil {
+				return err
+			}
+			// Changes are visible inside the transaction.
+			_, err = tx.GetEntry("e1", "f1")
+			if err != nil {
+				return err
+			}
+			_, err = tx.UpdateEntry("updated", "new")
+			if err != nil {
+				return err
+			}
+			err = tx.RemoveEntry("removed")
+			if err != nil {
+				return err
+			}
+			_, err = tx.MoveFolder("moved", "moved2")
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = db.GetEntry("e1", "f1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := db.GetBinary("b1", "f1")
+		if err != nil || string(data) != "data" {
+			t.Fatal("Bad binary", string(data), err)
+		}
+		entry, err := db.GetEntry("updated")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(entry.Data) != `"new"` {
+			t.Fatal("Entry must be updated", string(entry.Data))
+		}
+		_, err = db.GetEntry("removed")
+		if !errors.Is(err, fsentry_error.ErrorNotExist) {
+			t.Fatal("Entry must be removed", err)
+		}
+		_, err = db.GetEntry("e1", "moved2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.GetFolder("moved")
+		if !errors.Is(err, fsentry_error.ErrorNotExist) {
+			t.Fatal("Folder must be moved", err)
+		}
+
+		report, err := db.Check(fsentry.CheckOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Problems) != 0 {
+			t.Fatal("Storage must be consistent", report.Problems)
+		}
+		files, err := os.ReadDir(filepath.Join(root, ".fsentry", "tx"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 0 {
+			t.Fatal("Transaction folder must be removed")
+		}
+	})
+
+	t.Run("remove folder", func(t *testing.T) {
+		err := db.Tx(func(tx fsentry.IFSEntryTx) error {
+			_, err := tx.DuplicateFolder("moved2", "moved3")
+			if err != nil {
+				return err
+			}
+			_, err = tx.UpdateEntry("e1", "new", "moved3")
+			if err != nil {
+				return err
+			}
+			err = tx.RemoveFolder("moved2")
+			if err != nil {
+				return err
+			}
+
+			// The removed folder is only marked as removed, its content is not copied.
+			var names []string
+			err = filepath.WalkDir(filepath.Join(root, ".fsentry", "tx"), func(path string, d iofs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if strings.Contains(path, "moved2") && !d.IsDir() {
+					names = append(names, d.Name())
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if len(names) != 1 || !strings.HasPrefix(names[0], overlayfs.WhiteoutPrefix) {
+				t.Error("Removed folder must not be copied", names)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = db.GetFolder("moved2")
+		if !errors.Is(err, fsentry_error.ErrorNotExist) {
+			t.Fatal("Folder must be removed", err)
+		}
+		entry, err := db.GetEntry("e1", "moved3")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(entry.Data) != `"new"` {
+			t.Fatal("Entry must be updated", string(entry.Data))
+		}
+		report, err := db.Check(fsentry.CheckOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Problems) != 0 {
+			t.Fatal("Storage must be consistent", report.Problems)
+		}
+	})
+}
+
+func TestContext(t *testing.T) {
+	root := filepath.Join("test", "test_context")
+	db := NewFSEntry(root)
+	err := db.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Drop()
+
+	_, err = db.CreateFolder("f1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := db.WithContext(ctx).CreateEntry("e1", "data")
+		if !errors.Is(err, fsentry_error.ErrorCanceled) || !errors.Is(err, context.Canceled) {
+			t.Fatal("Expected canceled error, got", err)
+		}
+		_, err = db.WithContext(ctx).DuplicateFolder("f1", "f2")
+		if !errors.Is(err, fsentry_error.ErrorCanceled) {
+			t.Fatal("Expected canceled error, got", err)
+		}
+
+		_, err = db.GetEntry("e1")
+		if !errors.Is(err, fsentry_error.ErrorNotExist) {
+			t.Fatal("Entry must not be created", err)
+		}
+		_, err = db.GetFolder("f2")
+		if !errors.Is(err, fsentry_error.ErrorNotExist) {
+			t.Fatal("Folder must not be duplicated", err)
+		}
+	})
+
+	t.Run("lock wait", func(t *testing.T) {
+		// The transaction holds the lock of the whole storage, so the operation waits until the deadline.
+		err := db.Tx(func(tx fsentry.IFSEntryTx) error {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			_, err := db.WithContext(ctx).GetFolder("f1")
+			if !errors.Is(err, fsentry_error.ErrorCanceled) || !errors.Is(err, context.DeadlineExceeded) {
+				t.Error("Expected canceled error, got", err)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("walk", func(t *testing.T) {
+		_, err := db.CreateEntry("e1", "data", "f1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.CreateEntry("e2", "data", "f1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		var count int
+		err = db.WithContext(ctx).Walk(func(path []string, obj fsentry.WalkObject, err error) error {
+			count++
+			cancel()
+			return nil
+		})
+		if !errors.Is(err, fsentry_error.ErrorCanceled) {
+			t.Fatal("Expected canceled error, got", err)
+		}
+		if count != 1 {
+			t.Fatal("Walk must stop after cancel, visited", count)
+		}
+	})
+}
+
+func TestBatch(t *testing.T) {
+	root := filepath.Join("test", "test_batch")
+	db := NewFSEntry(root)
+	err := db.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Drop()
+
+	_, err = db.CreateFolder("f1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateEntry("exist", "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ops []fsentry.BatchOp
+	for i := 0; i < 50; i++ {
+		ops = append(ops, fsentry.BatchOp{
+			Action: fsentry.BatchCreateEntry,
+			Name:   fmt.Sprintf("e%d", i),
+			Path:   []string{"f1"},
+			Data:   i,
+		})
+	}
+	ops = append(ops,
+		// Operations on the same object run in order.
+		fsentry.BatchOp{Action: fsentry.BatchCreateEntry, Name: "e0", Path: []string{"f1"}},
+		fsentry.BatchOp{Action: fsentry.BatchUpdateEntry, Name: "e1", Path: []string{"f1"}, Data: "new"},
+		fsentry.BatchOp{Action: fsentry.BatchRemoveEntry, Name: "e2", Path: []string{"f1"}},
+		fsentry.BatchOp{Action: fsentry.BatchUpdateEntry, Name: "exist", Data: "new"},
+		fsentry.BatchOp{Action: fsentry.BatchCreateBinary, Name: "b1", Path: []string{"f1"}, Binary: []byte("data")},
+		fsentry.BatchOp{Action: fsentry.BatchUpdateBinary, Name: "b1", Path: []string{"f1"}, Binary: []byte("new")},
+		fsentry.BatchOp{Action: fsentry.BatchCreateEntry, Name: "e1", Path: []string{"missing"}},
+	)
+	results := db.Batch(ops, fsentry.BatchOptions{Workers: 4})
+	if len(results) != len(ops) {
+		t.Fatal("Bad number of results", len(results))
+	}
+	for i := 0; i < 50; i++ {
+		if results[i].Err != nil {
+			t.Fatal(i, results[i].Err)
+		}
+		if results[i].Entry == nil || results[i].Entry.ID != fmt.Sprintf("e%d", i) {
+			t.Fatal("Bad entry", i, results[i].Entry)
+		}
+	}
+	if !errors.Is(results[50].Err, fsentry_error.ErrorExist) {
+		t.Fatal("Expected exist error, got", results[50].Err)
+	}
+	for i := 51; i < 56; i++ {
+		if results[i].Err != nil {
+			t.Fatal(i, results[i].Err)
+		}
+	}
+	if !errors.Is(results[56].Err, fsentry_error.ErrorNotExist) {
+		t.Fatal("Expected not exist error, got", results[56].Err)
+	}
+
+	entry, err := db.GetEntry("e1", "f1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(entry.Data) != `"new"` || entry.Revision != 2 {
+		t.Fatal("Entry must be updated", string(entry.Data), entry.Revision)
+	}
+	_, err = db.GetEntry("e2", "f1")
+	if !errors.Is(err, fsentry_error.ErrorNotExist) {
+		t.Fatal("Entry must be removed", err)
+	}
+	entry, err = db.GetEntry("exist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(entry.Data) != `"new"` {
+		t.Fatal("Entry must be updated", string(entry.Data))
+	}
+	data, err := db.GetBinary("b1", "f1")
+	if err != nil || string(data) != "new" {
+		t.Fatal("Bad binary", string(data), err)
+	}
+	list, err := db.List("f1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Entries) != 49 || len(list.Binaries) != 1 {
+		t.Fatal("Bad content of the folder", len(list.Entries), len(list.Binaries))
+	}
+}
+
+func TestRelocate(t *testing.T) {
+	root := filepath.Join("test", "test_relocate")
+	db := NewFSEntry(root)
+	err := db.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Drop()
+
+	for _, name := range []string{"src", "dst"} {
+		_, err = db.CreateFolder(name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("entry", func(t *testing.T) {
+		created, err := db.CreateEntry("e1", "data", "src")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.UpdateEntry("e1", "new", "src")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		src := fsentry.Location{Path: []string{"src"}, Name: "e1"}
+		dst := fsentry.Location{Path: []string{"dst"}}
+		copied, err := db.RelocateEntry(src, dst, fsentry.RelocateOptions{Copy: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if copied.Revision != 1 || copied.CreatedAt.Before(created.CreatedAt) {
+			t.Fatal("Copy must be a new entry", copied)
+		}
+		_, err = db.RelocateEntry(src, dst, fsentry.RelocateOptions{})
+		if !errors.Is(err, fsentry_error.ErrorExist) {
+			t.Fatal("Expected exist error, got", err)
+		}
+
+		moved, err := db.RelocateEntry(src, dst, fsentry.RelocateOptions{Overwrite: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if moved.Revision != 2 || !moved.CreatedAt.Equal(created.CreatedAt) || string(moved.Data) != `"new"` {
+			t.Fatal("Moved entry must keep its history", moved)
+		}
+		_, err = db.GetEntry("e1", "src")
+		if !errors.Is(err, fsentry_error.ErrorNotExist) {
+			t.Fatal("Entry must be moved", err)
+		}
+
+		// The entry is moved back to the root with a new name.
+		moved, err = db.RelocateEntry(fsentry.Location{Path: []string{"dst"}, Name: "e1"}, fsentry.Location{Name: "e2"}, fsentry.RelocateOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if moved.ID != "e2" || moved.Name != "e2" {
+			t.Fatal("Bad moved entry", moved)
+		}
+		_, err = db.GetEntry("e2")
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("binary", func(t *testing.T) {
+		err := db.CreateBinary("b1", []byte("src"), "src")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.CreateBinary("b1", []byte("dst"), "dst")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		src := fsentry.Location{Path: []string{"src"}, Name: "b1"}
+		dst := fsentry.Location{Path: []string{"dst"}}
+		err = db.RelocateBinary(src, dst, fsentry.RelocateOptions{})
+		if !errors.Is(err, fsentry_error.ErrorExist) {
+			t.Fatal("Expected exist error, got", err)
+		}
+		err = db.RelocateBinary(src, dst, fsentry.RelocateOptions{Overwrite: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := db.GetBinary("b1", "dst")
+		if err != nil || string(data) != "src" {
+			t.Fatal("Binary must be replaced", string(data), err)
+		}
+		_, err = db.GetBinary("b1", "src")
+		if !errors.Is(err, fsentry_error.ErrorNotExist) {
+			t.Fatal("Binary must be moved", err)
+		}
+	})
+
+	t.Run("folder", func(t *testing.T) {
+		created, err := db.CreateFolder("f1", "data", "src")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.CreateEntry("e1", "data", "src", "f1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// A folder can't be moved inside itself.
+		_, err = db.RelocateFolder(fsentry.Location{Name: "src"}, fsentry.Location{Path: []string{"src", "f1"}}, fsentry.RelocateOptions{})
+		if !errors.Is(err, fsentry_error.ErrorBadPath) {
+			t.Fatal("Expected bad path error, got", err)
+		}
+
+		src := fsentry.Location{Path: []string{"src"}, Name: "f1"}
+		dst := fsentry.Location{Path: []string{"dst"}}
+		_, err = db.RelocateFolder(src, dst, fsentry.RelocateOptions{Copy: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.CreateEntry("e2", "data", "dst", "f1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		moved, err := db.RelocateFolder(src, dst, fsentry.RelocateOptions{Overwrite: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !moved.CreatedAt.Equal(created.CreatedAt) || moved.Revision != created.Revision {
+			t.Fatal("Moved folder must keep its history", moved)
+		}
+		list, err := db.List("dst", "f1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list.Entries) != 1 || list.Entries[0].ID != "e1" {
+			t.Fatal("Folder must be replaced", list.Entries)
+		}
+		info, err := db.GetFolder("f1", "dst")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.CreatedAt.Equal(created.CreatedAt) {
+			t.Fatal("Meta info must be updated", info)
+		}
+		_, err = db.GetFolder("f1", "src")
+		if !errors.Is(err, fsentry_error.ErrorNotExist) {
+			t.Fatal("Folder must be moved", err)
+		}
+
+		report, err := db.Check(fsentry.CheckOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Problems) != 0 {
+			t.Fatal("Storage must be consistent", report.Problems)
+		}
+	})
+}
+func TestBinaryInfo(t *testing.T) {
+	root := filepath.Join("test", "test_binary_info")
+	db := NewFSEntry(root)
+	err := db.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Drop()
+
+	_, err = db.CreateFolder("dst", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	created, err := db.CreateBinaryWithOptions("B Image", []byte("\x89PNG\r\n\x1a\n"), fsentry.BinaryOptions{Data: "payload"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Name != "B Image" || created.ContentType != "image/png" || created.Size != 8 {
+		t.Fatal("Bad binary info", created)
+	}
+	err = db.CreateBinary("A Text", []byte("text"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("list", func(t *testing.T) {
+		list, err := db.ListWithOptions(fsentry.ListOptions{SortBy: fsentry.ListSortByName, Kinds: fsentry.ListKindBinaries})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list.BinariesInfo) != 2 || list.BinariesInfo[0].Name != "A Text" || list.BinariesInfo[1].Name != "B Image" {
+			t.Fatal("Binaries must be sorted by name", list.BinariesInfo)
+		}
+		if !reflect.DeepEqual(list.Binaries, []string{"a_text", "b_image"}) {
+			t.Fatal("Binaries must have the same order", list.Binaries)
+		}
+		if list.BinariesInfo[1].Checksum != created.Checksum {
+			t.Fatal("Binary info must be the same", list.BinariesInfo[1])
+		}
+	})
+
+	t.Run("relocate", func(t *testing.T) {
+		src := fsentry.Location{Name: "B Image"}
+		dst := fsentry.Location{Path: []string{"dst"}, Name: "C Image"}
+		err := db.RelocateBinary(src, dst, fsentry.RelocateOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := db.GetBinaryInfo("C Image", "dst")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Name != "C Image" || !info.CreatedAt.Equal(created.CreatedAt) || info.ContentType != "image/png" {
+			t.Fatal("Moved binary must keep its info", info)
+		}
+		_, err = db.GetBinaryInfo("B Image")
+		if !errors.Is(err, fsentry_error.ErrorNotExist) {
+			t.Fatal("Binary must be moved", err)
+		}
+
+		report, err := db.Check(fsentry.CheckOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Problems) != 0 {
+			t.Fatal("Storage must be consistent", report.Problems)
+		}
+	})
+
+	t.Run("tx", func(t *testing.T) {
+		err := db.Tx(func(tx fsentry.IFSEntryTx) error {
+			_, err := tx.CreateBinaryWithOptions("D", []byte("data"), fsentry.BinaryOptions{ContentType: "text/csv"}, "dst")
+			if err != nil {
+				return err
+			}
+			info, err := tx.GetBinaryInfo("D", "dst")
+			if err != nil {
+				return err
+			}
+			if info.ContentType != "text/csv" {
+				t.Fatal("Bad binary info in transaction", info)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := db.GetBinaryInfo("D", "dst")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.ContentType != "text/csv" {
+			t.Fatal("Binary info must be committed", info)
+		}
+	})
+}
+func TestBinaryStream(t *testing.T) {
+	root := filepath.Join("test", "test_binary_stream")
+	db := NewFSEntry(root)
+	err := db.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Drop()
+
+	err = db.CreateBinaryFrom("video", strings.NewReader("old content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("write", func(t *testing.T) {
+		w, err := db.WriteBinary("video")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = w.Write([]byte("new "))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The binary is changed only on Close.
+		r, err := db.OpenBinary("video")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = w.Write([]byte("content"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Close()
+		if string(data) != "old content" {
+			t.Fatal("Opened binary must keep the old content", string(data))
+		}
+
+		data, err = db.ReadBinaryRange("video", 4, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "content" {
+			t.Fatal("Bad range", string(data))
+		}
+		info, err := db.GetBinaryInfo("video")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size != int64(len("new content")) {
+			t.Fatal("Binary info must be updated", info)
+		}
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		w, err := db.WithContext(ctx).WriteBinary("video")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cancel()
+		_, err = w.Write([]byte("lost"))
+		if !errors.Is(err, fsentry_error.ErrorCanceled) {
+			t.Fatal("Expected canceled error, got", err)
+		}
+		err = w.Close()
+		if !errors.Is(err, fsentry_error.ErrorCanceled) {
+			t.Fatal("Expected canceled error, got", err)
+		}
+		data, err := db.GetBinary("video")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "new content" {
+			t.Fatal("Binary must not be changed", string(data))
+		}
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		w, err := db.WriteBinary("aborted")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = w.Write([]byte("partial"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.CloseWithError(errors.New("source failed"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = w.Write([]byte("lost"))
+		if !errors.Is(err, io.ErrClosedPipe) {
+			t.Fatal("Expected closed pipe error, got", err)
+		}
+		// Close after the abort must not create the binary.
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.GetBinary("aborted")
+		if !errors.Is(err, fsentry_error.ErrorNotExist) {
+			t.Fatal("Binary must not be created", err)
+		}
+		report, err := db.Check(fsentry.CheckOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Problems) != 0 {
+			t.Fatal("Written data must be removed", report.Problems)
+		}
+	})
+
+	t.Run("check", func(t *testing.T) {
+		// Processes sharing the root use file locks.
+		locked := NewFSEntry(root, WithFileLock(fsentry.FileLockFolder, 0))
+		w, err := locked.WriteBinary("checked")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = w.Write([]byte("content"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// An open writer holds no locks, so operations locking the whole storage don't wait for it,
+		// and the written data is not removed as a leftover.
+		report, err := locked.Check(fsentry.CheckOptions{Repair: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Problems) != 0 {
+			t.Fatal("Storage must be consistent", report.Problems)
+		}
+		err = locked.Init()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Another process removes only the data of the writers interrupted by a crash.
+		other := NewFSEntry(root, WithFileLock(fsentry.FileLockFolder, 0))
+		err = other.Init()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = locked.CreateEntry("e1", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = w.Write([]byte(" more"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := db.GetBinary("checked")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "content more" {
+			t.Fatal("Bad binary", string(data))
+		}
+
+		// The data of a writer interrupted by a crash is removed.
+		err = os.MkdirAll(filepath.Join(root, ".fsentry", "stage", "1234"), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filepath.Join(root, ".fsentry", "stage", "1234", ".fsentry-tmp-stage-1234"), nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = other.Init()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files, err := os.ReadDir(filepath.Join(root, ".fsentry", "stage"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 0 {
+			t.Fatal("Stage folder must be empty", files)
+		}
+	})
+}
+func TestNameCollision(t *testing.T) {
+	root := filepath.Join("test", "test_name_collision")
+	db := NewFSEntry(root)
+	err := db.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Drop()
+
+	first, err := db.CreateEntry("Hello!", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := db.CreateEntry("hello", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.ID != "hello" || second.ID == first.ID || !strings.HasPrefix(second.ID, "hello_") {
+		t.Fatal("Names must have different IDs", first.ID, second.ID)
+	}
+	_, err = db.CreateEntry("hello", 3)
+	if !errors.Is(err, fsentry_error.ErrorExist) {
+		t.Fatal("Expected exist error, got", err)
+	}
+
+	for _, ent := range []*fsentry.Entry{first, second} {
+		got, err := db.GetEntry(ent.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.ID != ent.ID || got.Name != ent.Name {
+			t.Fatal("Entry must be found by its name", got)
+		}
+		id, err := db.LookupID(fsentry.ObjectEntry, ent.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != ent.ID {
+			t.Fatal("Bad ID", id)
+		}
+	}
+	_, err = db.LookupID(fsentry.ObjectEntry, "world")
+	if !errors.Is(err, fsentry_error.ErrorNotExist) {
+		t.Fatal("Expected not exist error, got", err)
+	}
+
+	list, err := db.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Entries) != 2 {
+		t.Fatal("Both entries must be listed", list.Entries)
+	}
+
+	err = db.RemoveEntry("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := db.GetEntry("Hello!")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != first.ID {
+		t.Fatal("Only the entry with the name must be removed", got)
+	}
+
+	t.Run("strict", func(t *testing.T) {
+		db := NewFSEntry(filepath.Join("test", "test_name_collision_strict"), WithStrictNames())
+		err := db.Init()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Drop()
+
+		_, err = db.CreateFolder("Hello!", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.CreateFolder("hello", nil)
+		if !errors.Is(err, fsentry_error.ErrorNameCollision) {
+			t.Fatal("Expected name collision error, got", err)
+		}
+		_, err = db.CreateFolder("Hello!", nil)
+		if !errors.Is(err, fsentry_error.ErrorExist) {
+			t.Fatal("Expected exist error, got", err)
+		}
+	})
+}
+
+func TestIDStrategy(t *testing.T) {
+	strategies := map[string]fsentry.IDStrategy{
+		"slug_hash": {Kind: fsentry.IDSlugHash, KeepIDOnRename: true},
+		"uuid":      {Kind: fsentry.IDUUIDv7},
+		"ulid":      {Kind: fsentry.IDULID},
+		"func": {Kind: fsentry.IDFunc, KeepIDOnRename: true, Func: func(name string) (string, error) {
+			return fmt.Sprintf("id_%x", name), nil
+		}},
+		"slug_keep": {Kind: fsentry.IDSlug, KeepIDOnRename: true},
+	}
+	for name, strategy := range strategies {
+		name, strategy := name, strategy
+		t.Run(name, func(t *testing.T) {
+			db := NewFSEntry(filepath.Join("test", "test_id_strategy_"+name), WithIDStrategy(strategy))
+			err := db.Init()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Drop()
+
+			folder, err := db.CreateFolder("My Folder", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ent, err := db.CreateEntry("Hello", 1, folder.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = db.CreateEntry("Hello", 2, folder.ID)
+			if !errors.Is(err, fsentry_error.ErrorExist) {
+				t.Fatal("Expected exist error, got", err)
+			}
+			err = db.CreateBinary("File", []byte("data"), folder.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			moved, err := db.MoveEntry("Hello", "World!", folder.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if moved.ID != ent.ID || moved.Name != "World!" {
+				t.Fatal("Renamed entry must keep its ID", ent.ID, moved.ID)
+			}
+			got, err := db.GetEntry("World!", folder.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.ID != ent.ID {
+				t.Fatal("Entry must be found by the new name", got)
+			}
+			_, err = db.GetEntry("Hello", folder.ID)
+			if !errors.Is(err, fsentry_error.ErrorNotExist) {
+				t.Fatal("Expected not exist error, got", err)
+			}
+			id, err := db.LookupID(fsentry.ObjectEntry, "World!", folder.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id != ent.ID {
+				t.Fatal("Bad ID", id)
+			}
+
+			movedFolder, err := db.MoveFolder("My Folder", "Other Folder")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if movedFolder.ID != folder.ID {
+				t.Fatal("Renamed folder must keep its ID", folder.ID, movedFolder.ID)
+			}
+			err = db.MoveBinary("File", "Other File", folder.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			info, err := db.GetBinaryInfo("Other File", folder.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := db.GetBinary(info.Name, folder.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != "data" {
+				t.Fatal("Bad binary data", string(data))
+			}
+
+			_, err = db.CreateEntry("Another", 3, folder.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			list, err := db.List(folder.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(list.Entries) != 2 || len(list.Binaries) != 1 {
+				t.Fatal("Bad list", list.Entries, list.Binaries)
+			}
+			err = db.RemoveEntry("World!", folder.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = db.GetEntry("Another", folder.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	t.Run("slug_hash_ids", func(t *testing.T) {
+		db := NewFSEntry(filepath.Join("test", "test_id_strategy_slug_hash_ids"), WithIDStrategy(fsentry.IDStrategy{Kind: fsentry.IDSlugHash}))
+		err := db.Init()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Drop()
+
+		ent, err := db.CreateEntry("Hello", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(ent.ID, "hello_") {
+			t.Fatal("Bad ID", ent.ID)
+		}
+		moved, err := db.MoveEntry("Hello", "World")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(moved.ID, "world_") {
+			t.Fatal("ID must follow the name", moved.ID)
+		}
+	})
+
+	t.Run("uuid_access_by_id", func(t *testing.T) {
+		db := NewFSEntry(filepath.Join("test", "test_id_strategy_uuid_ids"), WithIDStrategy(fsentry.IDStrategy{Kind: fsentry.IDUUIDv7}))
+		err := db.Init()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Drop()
+
+		ent, err := db.CreateEntry("???", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := db.GetEntry(ent.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Name != "???" {
+			t.Fatal("Entry must be found by its ID", got)
+		}
+	})
+
+	t.Run("bad_func_id", func(t *testing.T) {
+		db := NewFSEntry(filepath.Join("test", "test_id_strategy_bad_func"), WithIDStrategy(fsentry.IDStrategy{
+			Kind: fsentry.IDFunc,
+			Func: func(name string) (string, error) {
+				return "../" + name, nil
+			},
+		}))
+		err := db.Init()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Drop()
+
+		_, err = db.CreateEntry("hello", nil)
+		if !errors.Is(err, fsentry_error.ErrorBadName) {
+			t.Fatal("Expected bad name error, got", err)
+		}
+	})
+}
+
+func TestFolderLock(t *testing.T) {
+	storage := &blockingStorage{Storage: memfs.New()}
+	db := NewFSEntry("db", WithStorage(storage), WithIDStrategy(fsentry.IDStrategy{Kind: fsentry.IDSlugHash}))
+	err := db.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	folder, err := db.CreateFolder("f1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if folder.ID == "f1" {
+		t.Fatal("The ID must have a hash of the name", folder.ID)
+	}
+
+	// waitFor runs the operation while an entry is being created inside the folder, the operation
+	// must wait until the entry is created.
+	waitFor := func(t *testing.T, folderID string, op func() error) {
+		release := storage.block(filepath.Join("db", folderID) + string(filepath.Separator))
+		created := make(chan error, 1)
+		go func() {
+			_, err := db.CreateEntry("e1", "data", folderID)
+			created <- err
+		}()
+		<-storage.blocked
+		done := make(chan error, 1)
+		go func() {
+			done <- op()
+		}()
+		select {
+		case err = <-done:
+			close(release)
+			t.Fatal("The operation must wait for the entry inside the folder", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+		close(release)
+		err := <-created
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = <-done
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("duplicate", func(t *testing.T) {
+		waitFor(t, folder.ID, func() error {
+			_, err := db.DuplicateFolder("f1", "f2")
+			return err
+		})
+		_, err = db.GetEntry("e1", "f2")
+		if err != nil {
+			t.Fatal("The copy must have the entry", err)
+		}
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		copied, err := db.GetFolder("f2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.RemoveEntry("e1", "f2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, copied.ID, func() error {
+			return db.RemoveFolder("f2")
+		})
+		report, err := db.Check(fsentry.CheckOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Problems) != 0 {
+			t.Fatal("Storage must be consistent", report.Problems)
+		}
+	})
+}
+
+// blockingStorage stops the first write of a file with the prefix, until the returned channel is closed.
+type blockingStorage struct {
+	fsentry_storage.Storage
+
+	mu      sync.Mutex
+	prefix  string
+	release chan struct{}
+	blocked chan struct{}
+}
+
+func (s *blockingStorage) block(prefix string) chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prefix = prefix
+	s.release = make(chan struct{})
+	s.blocked = make(chan struct{})
+	return s.release
+}
+func (s *blockingStorage) CreateFile(path string, data []byte) error {
+	s.mu.Lock()
+	isBlocked := s.prefix != "" && strings.HasPrefix(path, s.prefix)
+	if isBlocked {
+		s.prefix = ""
+	}
+	release, blocked := s.release, s.blocked
+	s.mu.Unlock()
+
+	if isBlocked {
+		close(blocked)
+		<-release
+	}
+	return s.Storage.CreateFile(path, data)
+}
+
+func TestMigrateIDs(t *testing.T) {
+	root := filepath.Join("test", "test_migrate_ids")
+	db := NewFSEntry(root)
+	err := db.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Drop()
+
+	longName := strings.Repeat("Long name ", 5)
+	folder, err := db.CreateFolder(longName, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateEntry(longName, 1, folder.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.CreateBinary(longName, []byte("data"), folder.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateEntry("short", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same storage on a file system with shorter names.
+	db = NewFSEntry(root, WithMaxIDLength(20))
+	err = db.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Objects are found by their old IDs before the migration.
+	_, err = db.GetFolder(longName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := db.MigrateIDs(fsentry.MigrateIDsOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 3 {
+		t.Fatal("Bad changes", changes)
+	}
+	for _, change := range changes {
+		if change.IsApplied || change.OldID != folder.ID || change.NewID != "long_name_long_name_" {
+			t.Fatal("Bad change", change)
+		}
+	}
+
+	changes, err = db.MigrateIDs(fsentry.MigrateIDsOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 3 {
+		t.Fatal("Bad changes", changes)
+	}
+	for _, change := range changes {
+		if !change.IsApplied {
+			t.Fatal("Change must be applied", change)
+		}
+	}
+
+	newFolder, err := db.GetFolder(longName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newFolder.ID != "long_name_long_name_" || newFolder.Name != folder.Name || !newFolder.CreatedAt.Equal(folder.CreatedAt) {
+		t.Fatal("Bad folder", newFolder)
+	}
+	ent, err := db.GetEntry(longName, newFolder.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ent.ID != newFolder.ID || string(ent.Data) != "1" {
+		t.Fatal("Bad entry", ent)
+	}
+	data, err := db.GetBinary(longName, newFolder.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "data" {
+		t.Fatal("Bad binary", string(data))
+	}
+
+	changes, err = db.MigrateIDs(fsentry.MigrateIDsOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 0 {
+		t.Fatal("Migrated storage must not change", changes)
+	}
+}
+
+func TestPathNames(t *testing.T) {
+	db := NewFSEntry(filepath.Join("test", "test_path_names"), WithIDStrategy(fsentry.IDStrategy{Kind: fsentry.IDULID}))
+	err := db.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Drop()
+
+	folder, err := db.CreateFolder("My Folder", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := db.CreateFolder("Sub Folder", nil, "My Folder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateEntry("e1", 1, "My Folder", "Sub Folder")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Names and IDs of folders can be mixed in a path.
+	for _, path := range [][]string{{folder.ID, sub.ID}, {"My Folder", sub.ID}, {folder.ID, "Sub Folder"}} {
+		_, err = db.GetEntry("e1", path...)
+		if err != nil {
+			t.Fatal(path, err)
+		}
+	}
+	list, err := db.List("My Folder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Folders) != 1 || list.Folders[0].ID != sub.ID {
+		t.Fatal("Bad list", list.Folders)
+	}
+
+	_, err = db.RelocateEntry(fsentry.Location{Path: []string{"My Folder", "Sub Folder"}, Name: "e1"}, fsentry.Location{Path: []string{"My Folder"}}, fsentry.RelocateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.GetEntry("e1", folder.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Tx(func(tx fsentry.IFSEntryTx) error {
+		_, err := tx.CreateFolder("Tx Folder", nil)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateEntry("e2", 2, "Tx Folder")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.GetEntry("e2", "Tx Folder")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPathEscape(t *testing.T) {
+	root := filepath.Join("test", "test_path_escape")
+	db := NewFSEntry(root)
+	err := db.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Drop()
+
+	// A folder next to the storage must not be reachable.
+	outside := NewFSEntry(filepath.Join("test", "test_path_outside"))
+	err = outside.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outside.Drop()
+	_, err = outside.CreateEntry("secret", "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.CreateFolder("f1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	absPath, err := filepath.Abs(filepath.Join("test", "test_path_outside"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range [][]string{
+		{".."},
+		{"..", "test_path_outside"},
+		{"f1", "..", ".."},
+		{"../test_path_outside"},
+		{absPath},
+		{""},
+		{"."},
+		{".fsentry"},
+		{"con"},
+		{"f1", "LPT1"},
+	} {
+		_, err = db.GetEntry("secret", path...)
+		if !errors.Is(err, fsentry_error.ErrorBadPath) {
+			t.Fatalf("Expected bad path error for %q, got %v", path, err)
+		}
+		err = db.RemoveEntry("secret", path...)
+		if !errors.Is(err, fsentry_error.ErrorBadPath) {
+			t.Fatalf("Expected bad path error for %q, got %v", path, err)
+		}
+		_, err = db.List(path...)
+		if !errors.Is(err, fsentry_error.ErrorBadPath) {
+			t.Fatalf("Expected bad path error for %q, got %v", path, err)
+		}
+		err = db.Walk(func(path []string, obj fsentry.WalkObject, err error) error { return err }, path...)
+		if !errors.Is(err, fsentry_error.ErrorBadPath) {
+			t.Fatalf("Expected bad path error for %q, got %v", path, err)
+		}
+	}
+
+	_, err = db.RelocateFolder(fsentry.Location{Name: "f1"}, fsentry.Location{Path: []string{".."}}, fsentry.RelocateOptions{})
+	if !errors.Is(err, fsentry_error.ErrorBadPath) {
+		t.Fatal("Expected bad path error, got", err)
+	}
+	results := db.Batch([]fsentry.BatchOp{
+		{Action: fsentry.BatchRemoveEntry, Path: []string{".."}, Name: "secret"},
+		{Action: fsentry.BatchCreateEntry, Path: []string{"f1"}, Name: "e1", Data: 1},
+	}, fsentry.BatchOptions{})
+	if !errors.Is(results[0].Err, fsentry_error.ErrorBadPath) || results[1].Err != nil {
+		t.Fatal("Bad batch results", results[0].Err, results[1].Err)
+	}
+	err = db.Tx(func(tx fsentry.IFSEntryTx) error {
+		return tx.RemoveEntry("secret", "..", "test_path_outside")
+	})
+	if !errors.Is(err, fsentry_error.ErrorBadPath) {
+		t.Fatal("Expected bad path error, got", err)
+	}
+
+	_, err = outside.GetEntry("secret")
+	if err != nil {
+		t.Fatal("Entry outside of the storage is changed", err)
+	}
+}
+
+// testLogger keeps the messages of the storage.
+type testLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *testLogger) Debug(msg string, args ...any) { l.log(msg) }
+func (l *testLogger) Info(msg string, args ...any)  { l.log(msg) }
+func (l *testLogger) Warn(msg string, args ...any)  { l.log(msg) }
+func (l *testLogger) Error(msg string, args ...any) { l.log(msg) }
+func (l *testLogger) log(msg string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, msg)
+}
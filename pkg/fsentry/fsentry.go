@@ -1,20 +1,74 @@
 package fsentry
 
 import (
+	"context"
 	"encoding/json"
+	"io"
+	"io/fs"
 	"time"
 )
 
 type List struct {
-	Folders         []string `json:"folders"`
-	Entries         []string `json:"entries"`
+	// Folders contains the meta information of all valid folders on the path.
+	Folders []FolderInfo `json:"folders"`
+	// Entries contains all entries on the path, including their custom payload.
+	Entries []Entry `json:"entries"`
+	// Binaries contains IDs of all binary files on the path, in the same order as BinariesInfo.
+	//
+	// Deprecated: use BinariesInfo, which contains the IDs together with the meta information.
+	Binaries []string `json:"binaries"`
+	// BinariesInfo contains the meta information of all binary files on the path.
+	BinariesInfo []Binary `json:"binariesInfo"`
+	// CorruptedFolder contains IDs of folders that have no readable .info.json file inside.
 	CorruptedFolder []string `json:"corruptedFolder"`
+	// NextCursor is set if the list was limited and there are more objects on the path.
+	// Pass it to ListOptions.Cursor to get the next page.
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// ListKind is a bit mask of object types that will be returned by ListWithOptions.
+type ListKind uint8
+
+const (
+	ListKindFolders ListKind = 1 << iota
+	ListKindEntries
+	ListKindBinaries
+
+	ListKindAll = ListKindFolders | ListKindEntries | ListKindBinaries
+)
+
+// ListSort is a key by which objects will be sorted in ListWithOptions.
+type ListSort uint8
+
+const (
+	ListSortByID ListSort = iota
+	ListSortByName
+	ListSortByCreatedAt
+	ListSortByUpdatedAt
+)
+
+type ListOptions struct {
+	// Limit is the maximum number of objects on one page. Zero means no limit.
+	Limit int
+	// Cursor is an opaque value from List.NextCursor that allows you to continue listing from the previous page.
+	// The cursor is only valid with the same SortBy and Descending values it was received with.
+	Cursor string
+	// SortBy is the key by which objects are sorted. Corrupted folders and binaries created by older versions
+	// have no metadata, so their ID is used as the name, and their timestamps are zero.
+	SortBy ListSort
+	// Descending reverses the sort order.
+	Descending bool
+	// Kinds allows you to get only some types of objects. Zero value means all types.
+	Kinds ListKind
+	// NamePrefix keeps only objects whose original name starts with this prefix.
+	NamePrefix string
 }
 
 type Entry struct {
 	// ID is a name, but it has all special characters removed, all spaces replaced with underscores,
 	// and is shortened to 200 characters because some file systems prohibit files from having long names.
 	// When a file is created, it has the same name as the ID string. File extension is not saved in the ID.
+	// Another IDStrategy can generate IDs in another way.
 	ID string `json:"id"`
 	// Name is the original name that was set by the user without any modification.
 	Name string `json:"name"`
@@ -22,6 +76,9 @@ type Entry struct {
 	CreatedAt time.Time `json:"createdAt"`
 	// UpdatedAt metadata to keep track of when the Entry was last updated.
 	UpdatedAt time.Time `json:"updatedAt"`
+	// Revision is increased on every update of the data. It is kept when the entry is moved,
+	// and starts again from 1 for a duplicate. Objects created by older versions have revision 0.
+	Revision uint64 `json:"revision"`
 	// Data is a custom json payload for custom data.
 	Data json.RawMessage `json:"data"`
 }
@@ -29,6 +86,7 @@ type Entry struct {
 type FolderInfo struct {
 	// ID is a name, but it has all special characters removed, all spaces replaced with underscores,
 	// and is shortened to 200 characters because some file systems prohibit files from having long names.
+	// Another IDStrategy can generate IDs in another way.
 	ID string `json:"id"`
 	// Name is the original name that was set by the user without any modification.
 	Name string `json:"name"`
@@ -36,10 +94,309 @@ type FolderInfo struct {
 	CreatedAt time.Time `json:"createdAt"`
 	// UpdatedAt metadata to keep track of when the Entry was last updated.
 	UpdatedAt time.Time `json:"updatedAt"`
+	// Revision is increased on every update of the data. It is kept when the folder is moved,
+	// and starts again from 1 for a duplicate. Objects created by older versions have revision 0.
+	Revision uint64 `json:"revision"`
 	// Data is a custom json payload for custom data.
 	Data json.RawMessage `json:"data"`
 }
 
+type Binary struct {
+	// ID is the name of the binary file without the .bin extension. By default it's a slug of the name,
+	// limited by WithMaxIDLength, another IDStrategy can generate IDs in another way.
+	ID string `json:"id"`
+	// Name is the original name that was set by the user without any modification.
+	Name string `json:"name"`
+	// CreatedAt metadata for each Binary to track the original creation date.
+	CreatedAt time.Time `json:"createdAt"`
+	// UpdatedAt metadata to keep track of when the content was last updated.
+	UpdatedAt time.Time `json:"updatedAt"`
+	// Size is the length of the content in bytes.
+	Size int64 `json:"size"`
+	// ContentType is the MIME type of the content. It is set on creation and kept when the content is updated.
+	ContentType string `json:"contentType"`
+	// Checksum is the hex encoded SHA-256 hash of the content.
+	Checksum string `json:"checksum"`
+	// Data is a custom json payload for custom data.
+	Data json.RawMessage `json:"data"`
+}
+
+// BinaryWriter writes the content of a binary returned by WriteBinary. The binary is replaced only when
+// the writer is closed with Close, so if the source of the data fails, call CloseWithError instead:
+//
+//	_, err = io.Copy(w, src)
+//	if err != nil {
+//		w.CloseWithError(err)
+//		return err
+//	}
+//	return w.Close()
+type BinaryWriter interface {
+	io.WriteCloser
+	// CloseWithError discards the written data, the binary is not changed. After that Write returns
+	// io.ErrClosedPipe, and Close and CloseWithError do nothing.
+	CloseWithError(err error) error
+}
+
+type BinaryOptions struct {
+	// ContentType is the MIME type of the content. If it's empty, it is detected from the first 512 bytes of the content.
+	ContentType string
+	// Data is a custom payload stored with the binary.
+	Data interface{}
+}
+
+// ObjectKind is the type of object that was found while walking the storage.
+type ObjectKind uint8
+
+const (
+	ObjectFolder ObjectKind = iota + 1
+	ObjectCorruptedFolder
+	ObjectEntry
+	ObjectBinary
+)
+
+// WalkObject describes an object visited by Walk.
+type WalkObject struct {
+	Kind ObjectKind
+	// ID is the ID of the object, for corrupted folders it's the only information available.
+	ID string
+	// Folder is set for ObjectFolder.
+	Folder *FolderInfo
+	// Entry is set for ObjectEntry.
+	Entry *Entry
+	// Binary is set for ObjectBinary.
+	Binary *Binary
+}
+
+var (
+	// SkipDir can be returned from WalkFunc. If it was returned for a folder, Walk will not visit its content,
+	// otherwise Walk will skip the remaining objects in the folder containing the current object.
+	SkipDir = fs.SkipDir
+	// SkipAll can be returned from WalkFunc to stop walking without an error.
+	SkipAll = fs.SkipAll
+)
+
+// WalkFunc is called by Walk for every visited object. The path is a list of folder IDs
+// from the root of the storage to the folder containing the object, it can be passed to other methods as is.
+//
+// For a corrupted folder (without .info.json), the function is called with ErrorFolderCorrupted error.
+// If the function returns nil, Walk will still visit the content of the corrupted folder.
+// If the content of a folder cannot be read, the function is called a second time for this folder with that error.
+// Any error returned by the function, except SkipDir and SkipAll, stops walking and is returned by Walk.
+type WalkFunc func(path []string, obj WalkObject, err error) error
+
+// TreeNode is a folder with all its content, returned by Tree.
+type TreeNode struct {
+	// ID is the ID of the folder, it is empty for the root of the storage.
+	ID string `json:"id"`
+	// Folder is the meta information of the folder, it is nil for the root of the storage and corrupted folders.
+	Folder *FolderInfo `json:"folder,omitempty"`
+	// IsCorrupted is set for folders without a readable .info.json file.
+	IsCorrupted bool `json:"isCorrupted,omitempty"`
+
+	Folders  []*TreeNode `json:"folders"`
+	Entries  []Entry     `json:"entries"`
+	Binaries []string    `json:"binaries"`
+}
+
+// ProblemKind is the type of inconsistency found by Check.
+type ProblemKind string
+
+const (
+	// ProblemMissingInfo is a folder without .info.json file. Repair creates it, the folder name is used as the name.
+	ProblemMissingInfo ProblemKind = "missingInfo"
+	// ProblemInvalidJSON is an entry or .info.json file that cannot be parsed.
+	// Repair moves the file into the quarantine folder inside the root, and creates a new .info.json for folders.
+	ProblemInvalidJSON ProblemKind = "invalidJSON"
+	// ProblemIDMismatch is an entry or a folder whose stored ID is different from its file name.
+	// Repair sets the ID from the file name, because the file name is used to find objects.
+	ProblemIDMismatch ProblemKind = "idMismatch"
+	// ProblemMissingTimestamp is an entry or a folder without the creation or update timestamp.
+	// Repair sets the missing timestamp from the other one, or to the current time.
+	ProblemMissingTimestamp ProblemKind = "missingTimestamp"
+	// ProblemLeftover is a temporary file or folder, or a journal record left by an interrupted operation.
+	// Repair finishes or rolls back the operation and removes temporary objects.
+	ProblemLeftover ProblemKind = "leftover"
+	// ProblemOrphanInfo is a metadata file of a binary without the binary itself. Repair removes it.
+	ProblemOrphanInfo ProblemKind = "orphanInfo"
+)
+
+type CheckOptions struct {
+	// Repair allows Check to fix found problems, otherwise the storage is not modified.
+	Repair bool
+}
+
+type CheckProblem struct {
+	Kind ProblemKind `json:"kind"`
+	// Path is a list of folder IDs from the root of the storage to the folder containing the object.
+	Path []string `json:"path"`
+	// Name is the name of the file or folder with the problem.
+	Name    string `json:"name"`
+	Message string `json:"message"`
+	// IsRepaired is set if the problem has been fixed.
+	IsRepaired bool `json:"isRepaired"`
+}
+
+type CheckReport struct {
+	// Folders, Entries and Binaries are the number of checked objects.
+	Folders  int            `json:"folders"`
+	Entries  int            `json:"entries"`
+	Binaries int            `json:"binaries"`
+	Problems []CheckProblem `json:"problems"`
+}
+
+type MigrateIDsOptions struct {
+	// DryRun only reports the IDs that would be changed, the storage is not modified.
+	DryRun bool
+}
+
+// IDChange is a change of an object ID made by MigrateIDs.
+type IDChange struct {
+	Kind ObjectKind `json:"kind"`
+	// Path is a list of folder IDs from the root of the storage to the folder containing the object.
+	// The IDs of the folders are already migrated.
+	Path  []string `json:"path"`
+	Name  string   `json:"name"`
+	OldID string   `json:"oldId"`
+	// NewID is empty if the object can't get the new ID, like when it is taken by another object,
+	// in this case Message describes the reason and the object keeps the old ID.
+	NewID   string `json:"newId"`
+	Message string `json:"message,omitempty"`
+	// IsApplied is set if the object has been renamed to the new ID.
+	IsApplied bool `json:"isApplied"`
+}
+
+// Location is the place of an object: the list of folder IDs or names from the root of the storage
+// to the folder containing the object, and the name of the object.
+type Location struct {
+	Path []string
+	Name string
+}
+
+type RelocateOptions struct {
+	// Copy leaves the source object in place and creates a copy at the destination, like Duplicate.
+	Copy bool
+	// Overwrite replaces an existing object of the same kind at the destination, otherwise ErrorExist is returned.
+	Overwrite bool
+}
+
+// PatchType is the format of a patch document.
+type PatchType uint8
+
+const (
+	// PatchMerge is a JSON Merge Patch (RFC 7386): an object whose fields replace the fields of the data,
+	// null values remove fields, and nested objects are merged recursively.
+	PatchMerge PatchType = iota + 1
+	// PatchJSON is a JSON Patch (RFC 6902): a list of add, remove, replace, move, copy and test operations.
+	// If a test operation fails, nothing is changed and fsentry_error.ErrorPatchTest is returned.
+	PatchJSON
+)
+
+// Patch is a change of the custom payload, which is applied to the stored data under the lock.
+type Patch struct {
+	Type     PatchType
+	Document json.RawMessage
+}
+
+// MergePatch returns a JSON Merge Patch with the document.
+func MergePatch(document []byte) Patch {
+	return Patch{
+		Type:     PatchMerge,
+		Document: document,
+	}
+}
+
+// JSONPatch returns a JSON Patch with the document.
+func JSONPatch(document []byte) Patch {
+	return Patch{
+		Type:     PatchJSON,
+		Document: document,
+	}
+}
+
+// BatchAction is the type of operation in a batch.
+type BatchAction uint8
+
+const (
+	BatchCreateEntry BatchAction = iota + 1
+	BatchUpdateEntry
+	BatchRemoveEntry
+	BatchCreateBinary
+	BatchUpdateBinary
+	BatchRemoveBinary
+)
+
+// BatchOp is one operation of Batch.
+type BatchOp struct {
+	Action BatchAction
+	Name   string
+	// Path is a list of folder IDs or names from the root of the storage to the folder containing the object.
+	Path []string
+	// Data is the payload of an entry, it's used by BatchCreateEntry and BatchUpdateEntry.
+	Data interface{}
+	// Binary is the content of a binary, it's used by BatchCreateBinary and BatchUpdateBinary.
+	Binary []byte
+}
+
+type BatchOptions struct {
+	// Workers is the number of operations running in parallel. Zero means the number of CPUs.
+	Workers int
+}
+
+// BatchResult is the result of the operation with the same index in the batch.
+type BatchResult struct {
+	// Entry is set for BatchCreateEntry and BatchUpdateEntry.
+	Entry *Entry
+	Err   error
+}
+
+// FileLockMode selects how processes sharing one root are synchronized with advisory file locks.
+type FileLockMode uint8
+
+const (
+	// FileLockNone disables file locks, only operations of the same process are synchronized.
+	FileLockNone FileLockMode = iota
+	// FileLockRoot uses one lock file for the whole root: reads are held shared and any write is exclusive,
+	// so there is only one writer across all processes.
+	FileLockRoot
+	// FileLockFolder uses a lock file for each folder: a folder is locked shared or exclusive and its parent
+	// folders are locked shared, so processes writing to different folders do not block each other.
+	FileLockFolder
+)
+
+// IDKind selects how IDs of new objects are generated.
+type IDKind uint8
+
+const (
+	// IDSlug derives the ID from the name: letters and digits in lowercase with spaces replaced by underscores.
+	// If the ID is taken by an object with another name, a short hash of the name is appended to it.
+	IDSlug IDKind = iota
+	// IDSlugHash always appends a short hash of the name to the slug, so different names never share an ID.
+	IDSlugHash
+	// IDUUIDv7 generates a random time-ordered UUID version 7.
+	IDUUIDv7
+	// IDULID generates a random time-ordered ULID in lowercase.
+	IDULID
+	// IDFunc calls IDStrategy.Func.
+	IDFunc
+)
+
+// IDStrategy defines how IDs of new objects are generated and whether renames keep them.
+//
+// If the ID does not always follow from the name, which is the case for IDUUIDv7, IDULID, IDFunc
+// and KeepIDOnRename, objects are found by reading the names of the objects in the folder, so the access
+// by name takes time proportional to the size of the folder. Objects can be accessed by their ID as well.
+type IDStrategy struct {
+	Kind IDKind
+	// Func returns the ID of a new object for IDFunc. The ID may contain only lowercase letters, digits,
+	// underscores and hyphens, otherwise the object is not created and fsentry_error.ErrorBadName is returned.
+	Func func(name string) (string, error)
+	// KeepIDOnRename keeps the ID of an object renamed inside its folder and updates only the name.
+	// IDUUIDv7 and IDULID always keep the ID. Objects relocated to another folder get a new ID.
+	// If the ID of a new object is kept by a renamed one, IDSlug appends a hash of the name to the ID,
+	// and other strategies return fsentry_error.ErrorNameCollision.
+	KeepIDOnRename bool
+}
+
 type Logger interface {
 	Debug(msg string, args ...any)
 	Info(msg string, args ...any)
@@ -48,27 +405,85 @@ type Logger interface {
 }
 
 type IFSEntry interface {
+	WithContext(ctx context.Context) IFSEntry
 	Init() error
 	Drop() error
+	Check(opts CheckOptions) (*CheckReport, error)
+	MigrateIDs(opts MigrateIDsOptions) ([]IDChange, error)
 	List(path ...string) (*List, error)
+	ListWithOptions(opts ListOptions, path ...string) (*List, error)
+	Walk(fn WalkFunc, path ...string) error
+	Tree(path ...string) (*TreeNode, error)
+	Tx(fn func(tx IFSEntryTx) error) error
+	Batch(ops []BatchOp, opts BatchOptions) []BatchResult
+	LookupID(kind ObjectKind, name string, path ...string) (string, error)
 
 	CreateFolder(name string, data interface{}, path ...string) (*FolderInfo, error)
 	GetFolder(name string, path ...string) (*FolderInfo, error)
 	MoveFolder(oldName, newName string, path ...string) (*FolderInfo, error)
 	UpdateFolder(name string, data interface{}, path ...string) (*FolderInfo, error)
+	UpdateFolderIf(name string, data interface{}, expectedRevision uint64, path ...string) (*FolderInfo, error)
+	PatchFolder(name string, patch Patch, path ...string) (*FolderInfo, error)
 	RemoveFolder(name string, path ...string) error
 	DuplicateFolder(srcName, dstName string, path ...string) (*FolderInfo, error)
 	UpdateFolderNameWithoutTimestamp(oldName, newName string, path ...string) (*FolderInfo, error)
+	RelocateFolder(src, dst Location, opts RelocateOptions) (*FolderInfo, error)
+
+	CreateEntry(name string, data interface{}, path ...string) (*Entry, error)
+	GetEntry(name string, path ...string) (*Entry, error)
+	MoveEntry(oldName, newName string, path ...string) (*Entry, error)
+	UpdateEntry(name string, data interface{}, path ...string) (*Entry, error)
+	UpdateEntryIf(name string, data interface{}, expectedRevision uint64, path ...string) (*Entry, error)
+	PatchEntry(name string, patch Patch, path ...string) (*Entry, error)
+	RemoveEntry(name string, path ...string) error
+	DuplicateEntry(srcName, dstName string, path ...string) (*Entry, error)
+	RelocateEntry(src, dst Location, opts RelocateOptions) (*Entry, error)
+
+	CreateBinary(name string, data []byte, path ...string) error
+	CreateBinaryWithOptions(name string, data []byte, opts BinaryOptions, path ...string) (*Binary, error)
+	GetBinary(name string, path ...string) ([]byte, error)
+	GetBinaryInfo(name string, path ...string) (*Binary, error)
+	CreateBinaryFrom(name string, r io.Reader, path ...string) error
+	OpenBinary(name string, path ...string) (io.ReadSeekCloser, error)
+	ReadBinaryRange(name string, offset, length int64, path ...string) ([]byte, error)
+	WriteBinary(name string, path ...string) (BinaryWriter, error)
+	MoveBinary(oldName, newName string, path ...string) error
+	UpdateBinary(name string, data []byte, path ...string) error
+	RemoveBinary(name string, path ...string) error
+	RelocateBinary(src, dst Location, opts RelocateOptions) error
+}
+
+// IFSEntryTx is a set of operations available inside a transaction. Changes are visible inside the transaction
+// right away, and are written to the storage only after the transaction function returns without an error.
+type IFSEntryTx interface {
+	LookupID(kind ObjectKind, name string, path ...string) (string, error)
+
+	CreateFolder(name string, data interface{}, path ...string) (*FolderInfo, error)
+	GetFolder(name string, path ...string) (*FolderInfo, error)
+	MoveFolder(oldName, newName string, path ...string) (*FolderInfo, error)
+	UpdateFolder(name string, data interface{}, path ...string) (*FolderInfo, error)
+	UpdateFolderIf(name string, data interface{}, expectedRevision uint64, path ...string) (*FolderInfo, error)
+	PatchFolder(name string, patch Patch, path ...string) (*FolderInfo, error)
+	RemoveFolder(name string, path ...string) error
+	DuplicateFolder(srcName, dstName string, path ...string) (*FolderInfo, error)
 
 	CreateEntry(name string, data interface{}, path ...string) (*Entry, error)
 	GetEntry(name string, path ...string) (*Entry, error)
 	MoveEntry(oldName, newName string, path ...string) (*Entry, error)
 	UpdateEntry(name string, data interface{}, path ...string) (*Entry, error)
+	UpdateEntryIf(name string, data interface{}, expectedRevision uint64, path ...string) (*Entry, error)
+	PatchEntry(name string, patch Patch, path ...string) (*Entry, error)
 	RemoveEntry(name string, path ...string) error
 	DuplicateEntry(srcName, dstName string, path ...string) (*Entry, error)
 
 	CreateBinary(name string, data []byte, path ...string) error
+	CreateBinaryWithOptions(name string, data []byte, opts BinaryOptions, path ...string) (*Binary, error)
 	GetBinary(name string, path ...string) ([]byte, error)
+	GetBinaryInfo(name string, path ...string) (*Binary, error)
+	CreateBinaryFrom(name string, r io.Reader, path ...string) error
+	OpenBinary(name string, path ...string) (io.ReadSeekCloser, error)
+	ReadBinaryRange(name string, offset, length int64, path ...string) ([]byte, error)
+	WriteBinary(name string, path ...string) (BinaryWriter, error)
 	MoveBinary(oldName, newName string, path ...string) error
 	UpdateBinary(name string, data []byte, path ...string) error
 	RemoveBinary(name string, path ...string) error
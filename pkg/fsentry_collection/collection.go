@@ -0,0 +1,173 @@
+// Package fsentry_collection is a typed API on top of fsentry, which encodes and decodes the custom payload
+// of entries and folders, so that callers don't have to work with json.RawMessage:
+//
+//	users := fsentry_collection.New[User](db, "users")
+//	user, err := users.Get("admin")
+//	fmt.Println(user.Data.Email)
+package fsentry_collection
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/HardDie/fsentry/pkg/fsentry"
+	"github.com/HardDie/fsentry/pkg/fsentry_error"
+)
+
+const (
+	// allPageSize is the number of entries read at once by All, so the storage is not locked for a long time.
+	allPageSize = 1000
+)
+
+// TypedEntry is an fsentry.Entry with the payload decoded into T.
+type TypedEntry[T any] struct {
+	ID        string
+	Name      string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	Revision  uint64
+	Data      T
+}
+
+// TypedFolder is an fsentry.FolderInfo with the payload decoded into T.
+type TypedFolder[T any] struct {
+	ID        string
+	Name      string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	Revision  uint64
+	Data      T
+}
+
+// Collection is a set of entries with the payload of type T, stored in one folder.
+type Collection[T any] struct {
+	db   fsentry.IFSEntry
+	path []string
+}
+
+// New returns a collection of entries in the folder on the path. The folder must exist.
+func New[T any](db fsentry.IFSEntry, path ...string) Collection[T] {
+	return Collection[T]{
+		db:   db,
+		path: path,
+	}
+}
+
+func (c Collection[T]) Create(name string, data T) (*TypedEntry[T], error) {
+	return DecodeEntry[T](c.db.CreateEntry(name, data, c.path...))
+}
+func (c Collection[T]) Get(name string) (*TypedEntry[T], error) {
+	return DecodeEntry[T](c.db.GetEntry(name, c.path...))
+}
+func (c Collection[T]) Update(name string, data T) (*TypedEntry[T], error) {
+	return DecodeEntry[T](c.db.UpdateEntry(name, data, c.path...))
+}
+
+// UpdateIf updates the entry only if its revision is equal to expectedRevision, see fsentry.IFSEntry.UpdateEntryIf.
+func (c Collection[T]) UpdateIf(name string, data T, expectedRevision uint64) (*TypedEntry[T], error) {
+	return DecodeEntry[T](c.db.UpdateEntryIf(name, data, expectedRevision, c.path...))
+}
+func (c Collection[T]) Remove(name string) error {
+	return c.db.RemoveEntry(name, c.path...)
+}
+
+// List returns one page of entries, folders and binaries in the folder are skipped.
+// The cursor of the next page is returned, it's empty on the last page.
+func (c Collection[T]) List(opts fsentry.ListOptions) ([]TypedEntry[T], string, error) {
+	opts.Kinds = fsentry.ListKindEntries
+	list, err := c.db.ListWithOptions(opts, c.path...)
+	if err != nil {
+		return nil, "", err
+	}
+	entries := make([]TypedEntry[T], 0, len(list.Entries))
+	for _, entry := range list.Entries {
+		typed, err := DecodeEntry[T](&entry, nil)
+		if err != nil {
+			return nil, "", err
+		}
+		entries = append(entries, *typed)
+	}
+	return entries, list.NextCursor, nil
+}
+
+// All returns all entries of the collection sorted by ID.
+func (c Collection[T]) All() ([]TypedEntry[T], error) {
+	var entries []TypedEntry[T]
+	opts := fsentry.ListOptions{
+		Limit: allPageSize,
+	}
+	for {
+		page, nextCursor, err := c.List(opts)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, page...)
+		if nextCursor == "" {
+			return entries, nil
+		}
+		opts.Cursor = nextCursor
+	}
+}
+
+// DecodeEntry decodes the payload of the entry into T. It takes the result of a method returning an entry as is,
+// so the error of the method is returned without changes. A payload that can't be decoded is an ErrorDecode.
+func DecodeEntry[T any](entry *fsentry.Entry, err error) (*TypedEntry[T], error) {
+	if err != nil {
+		return nil, err
+	}
+	data, err := decode[T](entry.Data, "entry", entry.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &TypedEntry[T]{
+		ID:        entry.ID,
+		Name:      entry.Name,
+		CreatedAt: entry.CreatedAt,
+		UpdatedAt: entry.UpdatedAt,
+		Revision:  entry.Revision,
+		Data:      data,
+	}, nil
+}
+
+// DecodeFolder decodes the payload of the folder into T, like DecodeEntry.
+func DecodeFolder[T any](info *fsentry.FolderInfo, err error) (*TypedFolder[T], error) {
+	if err != nil {
+		return nil, err
+	}
+	data, err := decode[T](info.Data, "folder", info.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &TypedFolder[T]{
+		ID:        info.ID,
+		Name:      info.Name,
+		CreatedAt: info.CreatedAt,
+		UpdatedAt: info.UpdatedAt,
+		Revision:  info.Revision,
+		Data:      data,
+	}, nil
+}
+
+func CreateFolder[T any](db fsentry.IFSEntry, name string, data T, path ...string) (*TypedFolder[T], error) {
+	return DecodeFolder[T](db.CreateFolder(name, data, path...))
+}
+func GetFolder[T any](db fsentry.IFSEntry, name string, path ...string) (*TypedFolder[T], error) {
+	return DecodeFolder[T](db.GetFolder(name, path...))
+}
+func UpdateFolder[T any](db fsentry.IFSEntry, name string, data T, path ...string) (*TypedFolder[T], error) {
+	return DecodeFolder[T](db.UpdateFolder(name, data, path...))
+}
+
+// decode unmarshals the payload. A missing payload is decoded as the zero value of T.
+func decode[T any](data json.RawMessage, kind, id string) (T, error) {
+	var res T
+	if len(data) == 0 {
+		return res, nil
+	}
+	err := json.Unmarshal(data, &res)
+	if err != nil {
+		return res, fsentry_error.Wrap(fmt.Errorf("decode data of %s %q into %T: %w", kind, id, res, err), fsentry_error.ErrorDecode)
+	}
+	return res, nil
+}
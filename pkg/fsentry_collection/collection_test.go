@@ -0,0 +1,114 @@
+package fsentry_collection_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/HardDie/fsentry"
+	"github.com/HardDie/fsentry/pkg/fsentry_collection"
+	"github.com/HardDie/fsentry/pkg/fsentry_error"
+	"github.com/HardDie/fsentry/pkg/memfs"
+)
+
+type user struct {
+	Email string `json:"email"`
+	Age   int    `json:"age"`
+}
+
+type group struct {
+	Title string `json:"title"`
+}
+
+func TestCollection(t *testing.T) {
+	db := fsentry.NewFSEntry("db", fsentry.WithStorage(memfs.New()))
+	err := db.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	folder, err := fsentry_collection.CreateFolder(db, "users", group{Title: "All users"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if folder.Data.Title != "All users" || folder.Revision != 1 {
+		t.Fatal("Bad folder", folder)
+	}
+	folder, err = fsentry_collection.UpdateFolder(db, "users", group{Title: "Users"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	folder, err = fsentry_collection.GetFolder[group](db, "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if folder.Data.Title != "Users" || folder.Revision != 2 {
+		t.Fatal("Bad folder", folder)
+	}
+
+	users := fsentry_collection.New[user](db, "users")
+	entry, err := users.Create("admin", user{Email: "admin@example.com", Age: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.ID != "admin" || entry.Data.Email != "admin@example.com" {
+		t.Fatal("Bad entry", entry)
+	}
+	_, err = users.UpdateIf("admin", user{Email: "root@example.com"}, entry.Revision)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = users.UpdateIf("admin", user{}, entry.Revision)
+	if !errors.Is(err, fsentry_error.ErrorConflict) {
+		t.Fatal("Expected conflict error, got", err)
+	}
+	entry, err = users.Get("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Data.Email != "root@example.com" || entry.Revision != 2 {
+		t.Fatal("Bad entry", entry)
+	}
+
+	for i := 0; i < 5; i++ {
+		_, err = users.Create(fmt.Sprintf("user%d", i), user{Age: i})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Other objects in the folder are not a part of the collection.
+	_, err = db.CreateFolder("sub", nil, "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := users.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 6 || all[0].ID != "admin" || all[5].Data.Age != 4 {
+		t.Fatal("Bad list", all)
+	}
+
+	err = users.Remove("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = users.Get("admin")
+	if !errors.Is(err, fsentry_error.ErrorNotExist) {
+		t.Fatal("Expected not exist error, got", err)
+	}
+
+	// The payload of another type can't be decoded.
+	_, err = db.CreateEntry("bad", "string", "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = users.Get("bad")
+	if !errors.Is(err, fsentry_error.ErrorDecode) {
+		t.Fatal("Expected decode error, got", err)
+	}
+	_, err = users.All()
+	if !errors.Is(err, fsentry_error.ErrorDecode) {
+		t.Fatal("Expected decode error, got", err)
+	}
+}
@@ -15,6 +15,16 @@ var (
 	ErrorNotDirectory    = fmt.Errorf("not directory")
 	ErrorInternal        = fmt.Errorf("internal error")
 	ErrorFolderCorrupted = fmt.Errorf("foler corrupted")
+	ErrorBadCursor       = fmt.Errorf("bad cursor")
+	ErrorReadOnly        = fmt.Errorf("read-only storage")
+	ErrorLockTimeout     = fmt.Errorf("lock wait timeout")
+	ErrorConflict        = fmt.Errorf("revision conflict")
+	ErrorCanceled        = fmt.Errorf("operation canceled")
+	ErrorDecode          = fmt.Errorf("decode error")
+	ErrorBadPatch        = fmt.Errorf("bad patch")
+	ErrorPatchTest       = fmt.Errorf("patch test failed")
+	ErrorBadRange        = fmt.Errorf("bad range")
+	ErrorNameCollision   = fmt.Errorf("name collision")
 	// windows.
 	ErrorIncorrectFunction = fmt.Errorf("incorrect function")
 	ErrorIsDirectory       = fmt.Errorf("is directory")
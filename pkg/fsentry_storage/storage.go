@@ -0,0 +1,83 @@
+// Package fsentry_storage describes the backend used by fsentry to store files and folders.
+//
+// The default backend works with the disk, any other implementation can be passed to NewFSEntry
+// with the WithStorage option. The storagetest package checks that a backend behaves the same way as the disk.
+package fsentry_storage
+
+import (
+	"context"
+	"io"
+	"os"
+)
+
+// Storage is a hierarchical file system. Paths are built with filepath.Join.
+//
+// Errors must be wrapped with the errors from the fsentry_error package, so that they can be checked with errors.Is:
+// ErrorExist, ErrorNotExist, ErrorNotDirectory, ErrorPermissions, ErrorBadPath and ErrorInternal for everything else.
+type Storage interface {
+	// CreateFile creates a new file with the data. The parent folder must exist, an existing object is an ErrorExist.
+	CreateFile(path string, data []byte) error
+	// ReadFile returns the content of the file. A missing object or a folder is an ErrorNotExist.
+	ReadFile(path string) ([]byte, error)
+	// UpdateFile replaces the content of an existing file. A missing object or a folder is an ErrorNotExist.
+	UpdateFile(path string, data []byte) error
+	// RemoveFile removes a file or an empty folder. A folder that is not empty is an ErrorExist.
+	RemoveFile(path string) error
+	// CreateFolder creates a new folder. The parent folder must exist, an existing object is an ErrorExist.
+	CreateFolder(path string) error
+	// CreateAllFolder creates the folder and all missing parents. An existing folder is not an error,
+	// but an existing file on the path is an ErrorExist.
+	CreateAllFolder(path string) error
+	// RemoveFolder removes the object with everything inside it. A missing object is not an error.
+	RemoveFolder(path string) error
+	// Rename moves the object to a new path, an existing file at the new path is replaced.
+	Rename(oldPath, newPath string) error
+	// CopyFolder recursively copies the folder, skipping temporary files of unfinished writes.
+	CopyFolder(srcPath, dstPath string) error
+	// List returns all objects inside the folder.
+	List(path string) ([]os.FileInfo, error)
+	// ListFunc calls fn for each object inside the folder and stops on the first error returned by fn.
+	ListFunc(path string, fn func(entry os.DirEntry) error) error
+	// IsFileExist reports whether the file exists. A folder at the path is an ErrorBadPath.
+	IsFileExist(path string) (isExist bool, err error)
+	// IsFolderExist reports whether the folder exists. A file at the path is an ErrorBadPath.
+	IsFolderExist(path string) (isExist bool, err error)
+	// CleanupTemp recursively removes temporary files of unfinished writes.
+	CleanupTemp(path string) error
+}
+
+// ContextCopier is an optional interface of a Storage, that allows to stop copying a large folder
+// when the context is canceled. Other storages are checked for cancellation only before copying.
+//
+// The error of the context must be wrapped with fsentry_error.ErrorCanceled. The partial copy is not removed,
+// the caller is responsible for it.
+type ContextCopier interface {
+	CopyFolderContext(ctx context.Context, srcPath, dstPath string) error
+}
+
+// FolderSyncer is an optional interface of a Storage, that allows to write many files into a folder
+// and flush the folder to the disk once, instead of after every file. It's used by Batch.
+type FolderSyncer interface {
+	// CreateFileNoSync and UpdateFileNoSync are like CreateFile and UpdateFile, but the folder is not flushed,
+	// so the file may be lost in a crash until SyncFolder is called.
+	CreateFileNoSync(path string, data []byte) error
+	UpdateFileNoSync(path string, data []byte) error
+	// SyncFolder flushes the folder, so that files created, updated or removed in it survive a crash.
+	SyncFolder(path string) error
+}
+
+// FileStreamer is an optional interface of a Storage, that allows to read and write large files
+// without keeping them in memory. Other storages read and write the whole file at once.
+type FileStreamer interface {
+	// OpenFile opens the file for reading. A missing object or a folder is an ErrorNotExist.
+	// The opened file keeps its content if the file is replaced or removed before it is closed.
+	OpenFile(path string) (io.ReadSeekCloser, error)
+	// CreateFileFrom and UpdateFileFrom are like CreateFile and UpdateFile, but the data is copied from the reader.
+	// An error of the reader is returned as is, and the file is not changed.
+	CreateFileFrom(path string, r io.Reader) error
+	UpdateFileFrom(path string, r io.Reader) error
+}
+
+// TempFilePrefix is a prefix of hidden temporary files used to write data atomically.
+// Such files are skipped on copying and removed by CleanupTemp.
+const TempFilePrefix = ".fsentry-tmp-"
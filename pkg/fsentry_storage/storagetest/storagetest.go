@@ -0,0 +1,390 @@
+// Package storagetest is a conformance test suite for implementations of fsentry_storage.Storage.
+//
+// The suite checks that a backend behaves like the disk storage and maps errors the same way:
+//
+//	func TestConformance(t *testing.T) {
+//		storagetest.Run(t, func(t *testing.T) fsentry_storage.Storage {
+//			return mybackend.New()
+//		})
+//	}
+//
+// Every test works inside a new folder returned by t.TempDir(), which is created in the backend
+// with CreateAllFolder. Access permissions are not checked, because they depend on the backend.
+package storagetest
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/HardDie/fsentry/pkg/fsentry_error"
+	"github.com/HardDie/fsentry/pkg/fsentry_storage"
+)
+
+// Run runs all conformance tests, newStorage is called for each test to get an empty backend.
+func Run(t *testing.T, newStorage func(t *testing.T) fsentry_storage.Storage) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s fsentry_storage.Storage, dir string)
+	}{
+		{"CreateFile", testCreateFile},
+		{"ReadFile", testReadFile},
+		{"UpdateFile", testUpdateFile},
+		{"RemoveFile", testRemoveFile},
+		{"CreateFolder", testCreateFolder},
+		{"CreateAllFolder", testCreateAllFolder},
+		{"RemoveFolder", testRemoveFolder},
+		{"Rename", testRename},
+		{"CopyFolder", testCopyFolder},
+		{"List", testList},
+		{"ListFunc", testListFunc},
+		{"IsExist", testIsExist},
+		{"CleanupTemp", testCleanupTemp},
+		{"FileStreamer", testFileStreamer},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			s := newStorage(t)
+			dir := t.TempDir()
+			err := s.CreateAllFolder(dir)
+			if err != nil {
+				t.Fatal("error creating test dir", err)
+			}
+			tc.fn(t, s, dir)
+		})
+	}
+}
+
+func testCreateFile(t *testing.T, s fsentry_storage.Storage, dir string) {
+	filePath := filepath.Join(dir, "file")
+	mustNoError(t, s.CreateFile(filePath, []byte("hello")))
+	mustReadFile(t, s, filePath, "hello")
+
+	// An existing file or folder is not replaced.
+	mustError(t, s.CreateFile(filePath, []byte("new")), fsentry_error.ErrorExist)
+	mustReadFile(t, s, filePath, "hello")
+	mustNoError(t, s.CreateFolder(filepath.Join(dir, "folder")))
+	mustError(t, s.CreateFile(filepath.Join(dir, "folder"), nil), fsentry_error.ErrorExist)
+
+	// The parent folder must exist.
+	mustError(t, s.CreateFile(filepath.Join(dir, "not_exist", "file"), nil), fsentry_error.ErrorNotExist)
+	mustError(t, s.CreateFile(filepath.Join(filePath, "file"), nil), fsentry_error.ErrorNotDirectory)
+}
+
+func testReadFile(t *testing.T, s fsentry_storage.Storage, dir string) {
+	filePath := filepath.Join(dir, "file")
+	mustNoError(t, s.CreateFile(filePath, nil))
+	mustReadFile(t, s, filePath, "")
+
+	_, err := s.ReadFile(filepath.Join(dir, "not_exist"))
+	mustError(t, err, fsentry_error.ErrorNotExist)
+
+	// A folder is not a file.
+	mustNoError(t, s.CreateFolder(filepath.Join(dir, "folder")))
+	_, err = s.ReadFile(filepath.Join(dir, "folder"))
+	mustError(t, err, fsentry_error.ErrorNotExist)
+}
+
+func testUpdateFile(t *testing.T, s fsentry_storage.Storage, dir string) {
+	filePath := filepath.Join(dir, "file")
+	mustNoError(t, s.CreateFile(filePath, []byte("hello")))
+
+	data := []byte("new")
+	mustNoError(t, s.UpdateFile(filePath, data))
+	// The stored data must not depend on the passed slice.
+	data[0] = 'N'
+	mustReadFile(t, s, filePath, "new")
+
+	mustError(t, s.UpdateFile(filepath.Join(dir, "not_exist"), nil), fsentry_error.ErrorNotExist)
+	mustNoError(t, s.CreateFolder(filepath.Join(dir, "folder")))
+	mustError(t, s.UpdateFile(filepath.Join(dir, "folder"), nil), fsentry_error.ErrorNotExist)
+}
+
+func testRemoveFile(t *testing.T, s fsentry_storage.Storage, dir string) {
+	filePath := filepath.Join(dir, "file")
+	mustNoError(t, s.CreateFile(filePath, nil))
+	mustNoError(t, s.RemoveFile(filePath))
+	mustError(t, s.RemoveFile(filePath), fsentry_error.ErrorNotExist)
+
+	// Only empty folders can be removed.
+	folderPath := filepath.Join(dir, "folder")
+	mustNoError(t, s.CreateAllFolder(filepath.Join(folderPath, "data")))
+	mustError(t, s.RemoveFile(folderPath), fsentry_error.ErrorExist)
+	mustNoError(t, s.RemoveFile(filepath.Join(folderPath, "data")))
+	mustNoError(t, s.RemoveFile(folderPath))
+}
+
+func testCreateFolder(t *testing.T, s fsentry_storage.Storage, dir string) {
+	folderPath := filepath.Join(dir, "folder")
+	mustNoError(t, s.CreateFolder(folderPath))
+	mustError(t, s.CreateFolder(folderPath), fsentry_error.ErrorExist)
+
+	mustNoError(t, s.CreateFile(filepath.Join(dir, "file"), nil))
+	mustError(t, s.CreateFolder(filepath.Join(dir, "file")), fsentry_error.ErrorExist)
+
+	mustError(t, s.CreateFolder(filepath.Join(dir, "not_exist", "folder")), fsentry_error.ErrorNotExist)
+}
+
+func testCreateAllFolder(t *testing.T, s fsentry_storage.Storage, dir string) {
+	folderPath := filepath.Join(dir, "middle", "folder")
+	mustNoError(t, s.CreateAllFolder(folderPath))
+	// If the specified folder already exists, there will be no error.
+	mustNoError(t, s.CreateAllFolder(folderPath))
+	mustFolderExist(t, s, folderPath, true)
+
+	filePath := filepath.Join(dir, "file")
+	mustNoError(t, s.CreateFile(filePath, nil))
+	mustError(t, s.CreateAllFolder(filePath), fsentry_error.ErrorExist)
+	mustError(t, s.CreateAllFolder(filepath.Join(filePath, "folder")), fsentry_error.ErrorExist)
+}
+
+func testRemoveFolder(t *testing.T, s fsentry_storage.Storage, dir string) {
+	folderPath := filepath.Join(dir, "folder")
+	mustNoError(t, s.CreateAllFolder(filepath.Join(folderPath, "middle")))
+	mustNoError(t, s.CreateFile(filepath.Join(folderPath, "middle", "file"), nil))
+	mustNoError(t, s.RemoveFolder(folderPath))
+	mustFolderExist(t, s, folderPath, false)
+
+	// A missing folder is not an error.
+	mustNoError(t, s.RemoveFolder(folderPath))
+
+	// Files can also be removed.
+	filePath := filepath.Join(dir, "file")
+	mustNoError(t, s.CreateFile(filePath, nil))
+	mustNoError(t, s.RemoveFolder(filePath))
+	mustFileExist(t, s, filePath, false)
+}
+
+func testRename(t *testing.T, s fsentry_storage.Storage, dir string) {
+	oldPath := filepath.Join(dir, "old")
+	newPath := filepath.Join(dir, "new")
+	mustNoError(t, s.CreateFile(oldPath, []byte("hello")))
+	mustNoError(t, s.Rename(oldPath, newPath))
+	mustFileExist(t, s, oldPath, false)
+	mustReadFile(t, s, newPath, "hello")
+
+	// An existing file is replaced.
+	mustNoError(t, s.CreateFile(oldPath, []byte("new")))
+	mustNoError(t, s.Rename(oldPath, newPath))
+	mustReadFile(t, s, newPath, "new")
+
+	// Folders are moved with their content.
+	mustNoError(t, s.CreateAllFolder(filepath.Join(dir, "folder")))
+	mustNoError(t, s.Rename(newPath, filepath.Join(dir, "folder", "file")))
+	mustNoError(t, s.Rename(filepath.Join(dir, "folder"), filepath.Join(dir, "moved")))
+	mustReadFile(t, s, filepath.Join(dir, "moved", "file"), "new")
+
+	err := s.Rename(filepath.Join(dir, "not_exist"), newPath)
+	mustError(t, err, fsentry_error.ErrorInternal)
+}
+
+func testCopyFolder(t *testing.T, s fsentry_storage.Storage, dir string) {
+	srcPath := filepath.Join(dir, "src")
+	mustNoError(t, s.CreateAllFolder(filepath.Join(srcPath, "middle")))
+	mustNoError(t, s.CreateFile(filepath.Join(srcPath, "middle", "file"), []byte("hello")))
+	mustNoError(t, s.CreateFile(filepath.Join(srcPath, fsentry_storage.TempFilePrefix+"1234"), nil))
+
+	dstPath := filepath.Join(dir, "dst")
+	mustNoError(t, s.CopyFolder(srcPath, dstPath))
+	mustReadFile(t, s, filepath.Join(dstPath, "middle", "file"), "hello")
+	// Temporary files of unfinished writes are not copied.
+	mustFileExist(t, s, filepath.Join(dstPath, fsentry_storage.TempFilePrefix+"1234"), false)
+
+	// The copy does not share data with the source.
+	mustNoError(t, s.UpdateFile(filepath.Join(dstPath, "middle", "file"), []byte("new")))
+	mustReadFile(t, s, filepath.Join(srcPath, "middle", "file"), "hello")
+
+	err := s.CopyFolder(filepath.Join(dir, "not_exist"), filepath.Join(dir, "copy"))
+	mustError(t, err, fsentry_error.ErrorInternal)
+}
+
+func testList(t *testing.T, s fsentry_storage.Storage, dir string) {
+	mustNoError(t, s.CreateFile(filepath.Join(dir, "file"), []byte("hello")))
+	mustNoError(t, s.CreateFolder(filepath.Join(dir, "folder")))
+
+	files, err := s.List(dir)
+	mustNoError(t, err)
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name() < files[j].Name()
+	})
+	if len(files) != 2 {
+		t.Fatalf("bad list; got: %d objects, want: 2", len(files))
+	}
+	if files[0].Name() != "file" || files[0].IsDir() || files[0].Size() != 5 {
+		t.Fatalf("bad file info; got: %q, dir: %t, size: %d", files[0].Name(), files[0].IsDir(), files[0].Size())
+	}
+	if files[1].Name() != "folder" || !files[1].IsDir() {
+		t.Fatalf("bad folder info; got: %q, dir: %t", files[1].Name(), files[1].IsDir())
+	}
+
+	_, err = s.List(filepath.Join(dir, "not_exist"))
+	mustError(t, err, fsentry_error.ErrorNotExist)
+}
+
+func testListFunc(t *testing.T, s fsentry_storage.Storage, dir string) {
+	for _, name := range []string{"a", "b", "c"} {
+		mustNoError(t, s.CreateFile(filepath.Join(dir, name), nil))
+	}
+	mustNoError(t, s.CreateFolder(filepath.Join(dir, "d")))
+
+	var names []string
+	err := s.ListFunc(dir, func(entry os.DirEntry) error {
+		name := entry.Name()
+		if entry.IsDir() {
+			name += "/"
+		}
+		names = append(names, name)
+		return nil
+	})
+	mustNoError(t, err)
+	sort.Strings(names)
+	if strings.Join(names, ",") != "a,b,c,d/" {
+		t.Fatalf("bad list; got: %q", names)
+	}
+
+	// Listing stops on the first error.
+	errStop := errors.New("stop")
+	calls := 0
+	err = s.ListFunc(dir, func(entry os.DirEntry) error {
+		calls++
+		return errStop
+	})
+	if !errors.Is(err, errStop) || calls != 1 {
+		t.Fatalf("listing must stop; got: %q after %d calls", err, calls)
+	}
+
+	err = s.ListFunc(filepath.Join(dir, "not_exist"), func(entry os.DirEntry) error { return nil })
+	mustError(t, err, fsentry_error.ErrorNotExist)
+	err = s.ListFunc(filepath.Join(dir, "a"), func(entry os.DirEntry) error { return nil })
+	mustError(t, err, fsentry_error.ErrorNotDirectory)
+}
+
+func testIsExist(t *testing.T, s fsentry_storage.Storage, dir string) {
+	filePath := filepath.Join(dir, "file")
+	folderPath := filepath.Join(dir, "folder")
+	mustNoError(t, s.CreateFile(filePath, nil))
+	mustNoError(t, s.CreateFolder(folderPath))
+
+	mustFileExist(t, s, filePath, true)
+	mustFileExist(t, s, filepath.Join(dir, "not_exist"), false)
+	_, err := s.IsFileExist(folderPath)
+	mustError(t, err, fsentry_error.ErrorBadPath)
+
+	mustFolderExist(t, s, folderPath, true)
+	mustFolderExist(t, s, filepath.Join(dir, "not_exist"), false)
+	_, err = s.IsFolderExist(filePath)
+	mustError(t, err, fsentry_error.ErrorBadPath)
+}
+
+func testCleanupTemp(t *testing.T, s fsentry_storage.Storage, dir string) {
+	tmpPath := filepath.Join(dir, "folder", fsentry_storage.TempFilePrefix+"1234")
+	filePath := filepath.Join(dir, "folder", "file")
+	mustNoError(t, s.CreateFolder(filepath.Join(dir, "folder")))
+	mustNoError(t, s.CreateFile(tmpPath, nil))
+	mustNoError(t, s.CreateFile(filePath, nil))
+
+	mustNoError(t, s.CleanupTemp(dir))
+	mustFileExist(t, s, tmpPath, false)
+	mustFileExist(t, s, filePath, true)
+}
+
+func testFileStreamer(t *testing.T, s fsentry_storage.Storage, dir string) {
+	streamer, ok := s.(fsentry_storage.FileStreamer)
+	if !ok {
+		t.Skip("the storage does not implement FileStreamer")
+	}
+
+	filePath := filepath.Join(dir, "file")
+	mustNoError(t, streamer.CreateFileFrom(filePath, strings.NewReader("hello")))
+	mustReadFile(t, s, filePath, "hello")
+	mustError(t, streamer.CreateFileFrom(filePath, strings.NewReader("new")), fsentry_error.ErrorExist)
+
+	// The opened file keeps its content after the update.
+	file, err := streamer.OpenFile(filePath)
+	mustNoError(t, err)
+	defer file.Close()
+	mustNoError(t, streamer.UpdateFileFrom(filePath, strings.NewReader("new")))
+	mustReadFile(t, s, filePath, "new")
+	data, err := io.ReadAll(file)
+	mustNoError(t, err)
+	if string(data) != "hello" {
+		t.Fatalf("opened file: got %q, want %q", data, "hello")
+	}
+
+	// An error of the reader is returned as is and the file is not changed.
+	errRead := errors.New("read error")
+	err = streamer.UpdateFileFrom(filePath, io.MultiReader(strings.NewReader("partial"), &errReader{err: errRead}))
+	mustError(t, err, errRead)
+	mustReadFile(t, s, filePath, "new")
+
+	_, err = streamer.OpenFile(filepath.Join(dir, "not_exist"))
+	mustError(t, err, fsentry_error.ErrorNotExist)
+	mustNoError(t, s.CreateFolder(filepath.Join(dir, "folder")))
+	_, err = streamer.OpenFile(filepath.Join(dir, "folder"))
+	mustError(t, err, fsentry_error.ErrorNotExist)
+	mustError(t, streamer.UpdateFileFrom(filepath.Join(dir, "not_exist"), strings.NewReader("")), fsentry_error.ErrorNotExist)
+}
+
+type errReader struct {
+	err error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+func mustNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustError(t *testing.T, err, want error) {
+	t.Helper()
+	if err == nil {
+		t.Fatalf("error wait: %q; got: nil", want)
+	}
+	if !errors.Is(err, want) {
+		t.Fatalf("error wait: %q; got: %q", want, err)
+	}
+}
+
+func mustReadFile(t *testing.T, s fsentry_storage.Storage, path, want string) {
+	t.Helper()
+	data, err := s.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual([]byte(want), data) && !(len(want) == 0 && len(data) == 0) {
+		t.Fatalf("bad data readed; got: %q, want: %q", string(data), want)
+	}
+}
+
+func mustFileExist(t *testing.T, s fsentry_storage.Storage, path string, want bool) {
+	t.Helper()
+	isExist, err := s.IsFileExist(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isExist != want {
+		t.Fatalf("file %q exist: %t, want: %t", path, isExist, want)
+	}
+}
+
+func mustFolderExist(t *testing.T, s fsentry_storage.Storage, path string, want bool) {
+	t.Helper()
+	isExist, err := s.IsFolderExist(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isExist != want {
+		t.Fatalf("folder %q exist: %t, want: %t", path, isExist, want)
+	}
+}
@@ -0,0 +1,555 @@
+// Package memfs is an in-memory implementation of the storage used by fsentry.
+//
+// It keeps the whole tree of files and folders in memory and returns the same errors as the disk storage,
+// so it can be used in tests instead of real folders:
+//
+//	db := fsentry.NewFSEntry("db", fsentry.WithStorage(memfs.New()))
+package memfs
+
+import (
+	"errors"
+	iofs "io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HardDie/fsentry/internal/fs/storage"
+	"github.com/HardDie/fsentry/pkg/fsentry_error"
+	"github.com/HardDie/fsentry/pkg/fsentry_storage"
+)
+
+var (
+	// validate interface.
+	_ fsentry_storage.Storage = &FS{}
+)
+
+var (
+	errNotDirectory = errors.New("not a directory")
+	errIsDirectory  = errors.New("is a directory")
+	errNotEmpty     = errors.New("directory not empty")
+	errInvalid      = errors.New("invalid argument")
+)
+
+type node struct {
+	name     string
+	isDir    bool
+	perm     os.FileMode
+	modTime  time.Time
+	data     []byte
+	children map[string]*node
+}
+
+// FS is a file system tree stored in memory. Relative and absolute paths are resolved from the same root.
+// It is safe for concurrent use.
+type FS struct {
+	rwm  sync.RWMutex
+	root *node
+}
+
+func New() *FS {
+	return &FS{
+		root: newFolder(""),
+	}
+}
+
+// CreateFile allows you to create a file and fill it with some binary data.
+func (r *FS) CreateFile(path string, data []byte) error {
+	r.rwm.Lock()
+	defer r.rwm.Unlock()
+
+	parent, name, err := r.lookupParent("open", path)
+	if err != nil {
+		return err
+	}
+	if _, ok := parent.children[name]; ok {
+		return pathError("open", path, iofs.ErrExist, fsentry_error.ErrorExist)
+	}
+	parent.children[name] = newFile(name, data, storage.CreateFilePerm)
+	return nil
+}
+
+// ReadFile returns a copy of all binary data from the desired file.
+func (r *FS) ReadFile(path string) ([]byte, error) {
+	r.rwm.RLock()
+	defer r.rwm.RUnlock()
+
+	n, err := r.lookup("open", path)
+	if err != nil {
+		return nil, err
+	}
+	if n.isDir {
+		return nil, pathError("read", path, errIsDirectory, fsentry_error.ErrorNotExist)
+	}
+	return append([]byte{}, n.data...), nil
+}
+
+// UpdateFile allows you to replace the content of an existing file.
+func (r *FS) UpdateFile(path string, data []byte) error {
+	r.rwm.Lock()
+	defer r.rwm.Unlock()
+
+	n, err := r.lookup("open", path)
+	if err != nil {
+		return err
+	}
+	if n.isDir {
+		return pathError("open", path, errIsDirectory, fsentry_error.ErrorNotExist)
+	}
+	n.data = append([]byte{}, data...)
+	n.modTime = time.Now()
+	return nil
+}
+
+// RemoveFile allows you to delete a file or an empty folder.
+// If the folder is not empty, an ErrorExist error will be returned.
+func (r *FS) RemoveFile(path string) error {
+	r.rwm.Lock()
+	defer r.rwm.Unlock()
+
+	parent, name, err := r.lookupParent("remove", path)
+	if err != nil {
+		return err
+	}
+	n, ok := parent.children[name]
+	if !ok {
+		return pathError("remove", path, iofs.ErrNotExist, fsentry_error.ErrorNotExist)
+	}
+	if n.isDir && len(n.children) > 0 {
+		return pathError("remove", path, errNotEmpty, fsentry_error.ErrorExist)
+	}
+	delete(parent.children, name)
+	return nil
+}
+
+// CreateFolder allows you to create a folder, the parent folder must exist.
+func (r *FS) CreateFolder(path string) error {
+	r.rwm.Lock()
+	defer r.rwm.Unlock()
+
+	parent, name, err := r.lookupParent("mkdir", path)
+	if err != nil {
+		return err
+	}
+	if _, ok := parent.children[name]; ok {
+		return pathError("mkdir", path, iofs.ErrExist, fsentry_error.ErrorExist)
+	}
+	parent.children[name] = newFolder(name)
+	return nil
+}
+
+// CreateAllFolder allows you to create a folder with all the missing intermediate folders.
+// If the specified folder already exists, there will be no error.
+func (r *FS) CreateAllFolder(path string) error {
+	r.rwm.Lock()
+	defer r.rwm.Unlock()
+
+	_, err := r.createAllFolder(path)
+	return err
+}
+
+// RemoveFolder will delete the desired folder even if it is not empty with all the data it contains.
+// If the folder does not exist, there will be no error.
+func (r *FS) RemoveFolder(path string) error {
+	r.rwm.Lock()
+	defer r.rwm.Unlock()
+
+	parent, name, err := r.lookupParent("unlinkat", path)
+	if err != nil {
+		if errors.Is(err, fsentry_error.ErrorNotExist) {
+			return nil
+		}
+		return err
+	}
+	delete(parent.children, name)
+	return nil
+}
+
+// Rename allows you to rename a file/directory or move it to another path.
+// An existing file or an empty folder at the destination path is replaced.
+func (r *FS) Rename(oldPath, newPath string) error {
+	r.rwm.Lock()
+	defer r.rwm.Unlock()
+
+	err := r.rename(oldPath, newPath)
+	if err != nil {
+		return fsentry_error.Wrap(err, fsentry_error.ErrorInternal)
+	}
+	return nil
+}
+
+// CopyFolder will recursively copy the source folder to the desired destination path.
+// Missing folders of the destination path are created, existing files are overwritten.
+func (r *FS) CopyFolder(srcPath, dstPath string) error {
+	r.rwm.Lock()
+	defer r.rwm.Unlock()
+
+	err := r.copyFolder(srcPath, dstPath)
+	if err != nil {
+		return fsentry_error.Wrap(err, fsentry_error.ErrorInternal)
+	}
+	return nil
+}
+
+// List returns the complete list of objects on the specified path sorted by name.
+func (r *FS) List(path string) ([]os.FileInfo, error) {
+	r.rwm.RLock()
+	defer r.rwm.RUnlock()
+
+	n, err := r.lookupFolder("open", path)
+	if err != nil {
+		return nil, err
+	}
+	return n.list(), nil
+}
+
+// ListFunc calls fn for each object on the specified path in order of names.
+// The list is taken before the first call, so fn is allowed to use and modify the file system.
+// If fn returns an error, listing stops and that error is returned.
+func (r *FS) ListFunc(path string, fn func(entry os.DirEntry) error) error {
+	r.rwm.RLock()
+	n, err := r.lookupFolder("open", path)
+	var files []os.FileInfo
+	if err == nil {
+		files = n.list()
+	}
+	r.rwm.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if err = fn(iofs.FileInfoToDirEntry(file)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CleanupTemp recursively removes temporary files left in the folder after interrupted writes.
+// Writes to the memory are never interrupted, but such files may be created by copying.
+func (r *FS) CleanupTemp(path string) error {
+	r.rwm.Lock()
+	defer r.rwm.Unlock()
+
+	n, err := r.lookupFolder("lstat", path)
+	if err != nil {
+		return err
+	}
+	n.cleanupTemp()
+	return nil
+}
+
+// IsFileExist checks if an object that is a file, not a folder, exists at the specified path.
+func (r *FS) IsFileExist(path string) (isExist bool, err error) {
+	r.rwm.RLock()
+	defer r.rwm.RUnlock()
+
+	n, err := r.lookup("stat", path)
+	if err != nil {
+		if errors.Is(err, fsentry_error.ErrorNotExist) {
+			return false, nil
+		}
+		return false, fsentry_error.Wrap(err, fsentry_error.ErrorInternal)
+	}
+	if n.isDir {
+		return false, fsentry_error.ErrorBadPath
+	}
+	return true, nil
+}
+
+// IsFolderExist checks if an object that is a folder, exists at the specified path.
+func (r *FS) IsFolderExist(path string) (isExist bool, err error) {
+	r.rwm.RLock()
+	defer r.rwm.RUnlock()
+
+	n, err := r.lookup("stat", path)
+	if err != nil {
+		if errors.Is(err, fsentry_error.ErrorNotExist) {
+			return false, nil
+		}
+		return false, fsentry_error.Wrap(err, fsentry_error.ErrorInternal)
+	}
+	if !n.isDir {
+		return false, fsentry_error.ErrorBadPath
+	}
+	return true, nil
+}
+
+func (r *FS) rename(oldPath, newPath string) error {
+	oldParent, oldName, err := r.lookupParent("rename", oldPath)
+	if err != nil {
+		return err
+	}
+	src, ok := oldParent.children[oldName]
+	if !ok {
+		return pathError("rename", oldPath, iofs.ErrNotExist, fsentry_error.ErrorNotExist)
+	}
+	newParent, newName, err := r.lookupParent("rename", newPath)
+	if err != nil {
+		return err
+	}
+	if src.isDir && isSubPath(oldPath, newPath) {
+		// A folder cannot be moved inside itself.
+		return pathError("rename", newPath, errInvalid, fsentry_error.ErrorBadPath)
+	}
+
+	if dst, ok := newParent.children[newName]; ok {
+		switch {
+		case dst == src:
+			return nil
+		case src.isDir && !dst.isDir:
+			return pathError("rename", newPath, errNotDirectory, fsentry_error.ErrorNotDirectory)
+		case !src.isDir && dst.isDir:
+			return pathError("rename", newPath, errIsDirectory, fsentry_error.ErrorExist)
+		case dst.isDir && len(dst.children) > 0:
+			return pathError("rename", newPath, errNotEmpty, fsentry_error.ErrorExist)
+		}
+	}
+
+	delete(oldParent.children, oldName)
+	src.name = newName
+	newParent.children[newName] = src
+	return nil
+}
+
+func (r *FS) copyFolder(srcPath, dstPath string) error {
+	src, err := r.lookup("lstat", srcPath)
+	if err != nil {
+		return err
+	}
+	if !src.isDir {
+		parent, name, err := r.createParent(dstPath)
+		if err != nil {
+			return err
+		}
+		if dst, ok := parent.children[name]; ok && dst.isDir {
+			return pathError("open", dstPath, errIsDirectory, fsentry_error.ErrorExist)
+		}
+		parent.children[name] = newFile(name, src.data, src.perm)
+		return nil
+	}
+	if isSubPath(srcPath, dstPath) {
+		// Copying a folder inside itself would never end.
+		return pathError("copy", dstPath, errInvalid, fsentry_error.ErrorBadPath)
+	}
+
+	dst, err := r.createAllFolder(dstPath)
+	if err != nil {
+		return err
+	}
+	return copyChildren(src, dst, dstPath)
+}
+
+// copyChildren recursively copies the content of the src folder into the dst folder.
+func copyChildren(src, dst *node, dstPath string) error {
+	for name, child := range src.children {
+		// Do not copy files of unfinished writes.
+		if !child.isDir && strings.HasPrefix(name, fsentry_storage.TempFilePrefix) {
+			continue
+		}
+
+		existing, ok := dst.children[name]
+		if !child.isDir {
+			if ok && existing.isDir {
+				return pathError("open", filepath.Join(dstPath, name), errIsDirectory, fsentry_error.ErrorExist)
+			}
+			dst.children[name] = newFile(name, child.data, child.perm)
+			continue
+		}
+
+		if !ok {
+			existing = newFolder(name)
+			dst.children[name] = existing
+		} else if !existing.isDir {
+			return pathError("mkdir", filepath.Join(dstPath, name), errNotDirectory, fsentry_error.ErrorNotDirectory)
+		}
+		err := copyChildren(child, existing, filepath.Join(dstPath, name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createAllFolder creates the folder and all missing parent folders and returns it.
+func (r *FS) createAllFolder(path string) (*node, error) {
+	n := r.root
+	for _, name := range splitPath(path) {
+		child, ok := n.children[name]
+		if !ok {
+			child = newFolder(name)
+			n.children[name] = child
+		}
+		if !child.isDir {
+			return nil, pathError("mkdir", path, errNotDirectory, fsentry_error.ErrorExist)
+		}
+		n = child
+	}
+	return n, nil
+}
+
+// createParent creates all missing parent folders of the path and returns the parent folder and the name.
+func (r *FS) createParent(path string) (*node, string, error) {
+	parts := splitPath(path)
+	if len(parts) == 0 {
+		return nil, "", pathError("open", path, errIsDirectory, fsentry_error.ErrorExist)
+	}
+	parent, err := r.createAllFolder(filepath.Dir(filepath.Clean(path)))
+	if err != nil {
+		return nil, "", err
+	}
+	return parent, parts[len(parts)-1], nil
+}
+
+// lookup returns the object at the path.
+func (r *FS) lookup(op, path string) (*node, error) {
+	n := r.root
+	for _, name := range splitPath(path) {
+		if !n.isDir {
+			return nil, pathError(op, path, errNotDirectory, fsentry_error.ErrorNotDirectory)
+		}
+		child, ok := n.children[name]
+		if !ok {
+			return nil, pathError(op, path, iofs.ErrNotExist, fsentry_error.ErrorNotExist)
+		}
+		n = child
+	}
+	return n, nil
+}
+
+// lookupFolder returns the object at the path and checks that it is a folder.
+func (r *FS) lookupFolder(op, path string) (*node, error) {
+	n, err := r.lookup(op, path)
+	if err != nil {
+		return nil, err
+	}
+	if !n.isDir {
+		return nil, pathError(op, path, errNotDirectory, fsentry_error.ErrorNotDirectory)
+	}
+	return n, nil
+}
+
+// lookupParent returns the existing parent folder of the path and the name of the object inside it.
+func (r *FS) lookupParent(op, path string) (*node, string, error) {
+	parts := splitPath(path)
+	if len(parts) == 0 {
+		// The root folder always exists and cannot be replaced.
+		return nil, "", pathError(op, path, iofs.ErrExist, fsentry_error.ErrorExist)
+	}
+	parent, err := r.lookupFolder(op, filepath.Dir(filepath.Clean(path)))
+	if err != nil {
+		return nil, "", err
+	}
+	return parent, parts[len(parts)-1], nil
+}
+
+func (n *node) list() []os.FileInfo {
+	res := make([]os.FileInfo, 0, len(n.children))
+	for _, child := range n.children {
+		res = append(res, fileInfo{
+			name:    child.name,
+			size:    int64(len(child.data)),
+			mode:    child.mode(),
+			modTime: child.modTime,
+		})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name() < res[j].Name()
+	})
+	return res
+}
+
+func (n *node) cleanupTemp() {
+	for name, child := range n.children {
+		if child.isDir {
+			child.cleanupTemp()
+			continue
+		}
+		if strings.HasPrefix(name, fsentry_storage.TempFilePrefix) {
+			delete(n.children, name)
+		}
+	}
+}
+
+func (n *node) mode() os.FileMode {
+	if n.isDir {
+		return os.ModeDir | n.perm
+	}
+	return n.perm
+}
+
+func newFile(name string, data []byte, perm os.FileMode) *node {
+	return &node{
+		name:    name,
+		perm:    perm,
+		modTime: time.Now(),
+		data:    append([]byte{}, data...),
+	}
+}
+
+func newFolder(name string) *node {
+	return &node{
+		name:     name,
+		isDir:    true,
+		perm:     storage.CreateDirPerm,
+		modTime:  time.Now(),
+		children: make(map[string]*node),
+	}
+}
+
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (i fileInfo) Name() string       { return i.name }
+func (i fileInfo) Size() int64        { return i.size }
+func (i fileInfo) Mode() os.FileMode  { return i.mode }
+func (i fileInfo) ModTime() time.Time { return i.modTime }
+func (i fileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i fileInfo) Sys() any           { return nil }
+
+// splitPath returns the names of folders from the root to the object. The volume name and
+// the leading separator are dropped, so "/a/b" and "a/b" point to the same object.
+func splitPath(path string) []string {
+	path = filepath.Clean(path)
+	path = strings.TrimPrefix(path, filepath.VolumeName(path))
+
+	var res []string
+	for _, name := range strings.Split(filepath.ToSlash(path), "/") {
+		switch name {
+		case "", ".":
+		case "..":
+			if len(res) > 0 {
+				res = res[:len(res)-1]
+			}
+		default:
+			res = append(res, name)
+		}
+	}
+	return res
+}
+
+// isSubPath reports whether the path is inside the folder.
+func isSubPath(folder, path string) bool {
+	folderParts := splitPath(folder)
+	pathParts := splitPath(path)
+	if len(pathParts) <= len(folderParts) {
+		return false
+	}
+	for i, name := range folderParts {
+		if pathParts[i] != name {
+			return false
+		}
+	}
+	return true
+}
+
+func pathError(op, path string, err, localErr error) error {
+	return fsentry_error.Wrap(&iofs.PathError{Op: op, Path: path, Err: err}, localErr)
+}
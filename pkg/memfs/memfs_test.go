@@ -0,0 +1,229 @@
+package memfs
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/HardDie/fsentry/pkg/fsentry_error"
+	"github.com/HardDie/fsentry/pkg/fsentry_storage"
+	"github.com/HardDie/fsentry/pkg/fsentry_storage/storagetest"
+)
+
+func TestFile(t *testing.T) {
+	f := New()
+	err := f.CreateAllFolder("/root/folder")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("create", func(t *testing.T) {
+		err := f.CreateFile("/root/file", []byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.CreateFile("/root/file", []byte("hello"))
+		if !errors.Is(err, fsentry_error.ErrorExist) {
+			t.Fatalf("error wait: %q; got: %q", fsentry_error.ErrorExist, err)
+		}
+		err = f.CreateFile("/root/folder", []byte("hello"))
+		if !errors.Is(err, fsentry_error.ErrorExist) {
+			t.Fatalf("error wait: %q; got: %q", fsentry_error.ErrorExist, err)
+		}
+		err = f.CreateFile("/root/not_exist/file", nil)
+		if !errors.Is(err, fsentry_error.ErrorNotExist) {
+			t.Fatalf("error wait: %q; got: %q", fsentry_error.ErrorNotExist, err)
+		}
+		err = f.CreateFile("/root/file/file", nil)
+		if !errors.Is(err, fsentry_error.ErrorNotDirectory) {
+			t.Fatalf("error wait: %q; got: %q", fsentry_error.ErrorNotDirectory, err)
+		}
+	})
+
+	t.Run("read_update", func(t *testing.T) {
+		data := []byte("new")
+		err := f.UpdateFile("/root/file", data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The stored data must not depend on the passed slice.
+		data[0] = 'N'
+		resp, err := f.ReadFile("/root/file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual([]byte("new"), resp) {
+			t.Fatalf("bad data readed; got: %q, want: %q", string(resp), "new")
+		}
+
+		_, err = f.ReadFile("/root/folder")
+		if !errors.Is(err, fsentry_error.ErrorNotExist) {
+			t.Fatalf("error wait: %q; got: %q", fsentry_error.ErrorNotExist, err)
+		}
+		err = f.UpdateFile("/root/folder", nil)
+		if !errors.Is(err, fsentry_error.ErrorNotExist) {
+			t.Fatalf("error wait: %q; got: %q", fsentry_error.ErrorNotExist, err)
+		}
+		err = f.UpdateFile("/root/not_exist", nil)
+		if !errors.Is(err, fsentry_error.ErrorNotExist) {
+			t.Fatalf("error wait: %q; got: %q", fsentry_error.ErrorNotExist, err)
+		}
+	})
+
+	t.Run("exist", func(t *testing.T) {
+		isExist, err := f.IsFileExist("/root/file")
+		if err != nil || !isExist {
+			t.Fatal("file must exist", err)
+		}
+		_, err = f.IsFileExist("/root/folder")
+		if !errors.Is(err, fsentry_error.ErrorBadPath) {
+			t.Fatalf("error wait: %q; got: %q", fsentry_error.ErrorBadPath, err)
+		}
+		isExist, err = f.IsFolderExist("/root/not_exist")
+		if err != nil || isExist {
+			t.Fatal("folder must not exist", err)
+		}
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		err := f.CreateFile("/root/folder/file", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.RemoveFile("/root/folder")
+		if !errors.Is(err, fsentry_error.ErrorExist) {
+			t.Fatalf("error wait: %q; got: %q", fsentry_error.ErrorExist, err)
+		}
+		err = f.RemoveFile("/root/folder/file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.RemoveFile("/root/folder/file")
+		if !errors.Is(err, fsentry_error.ErrorNotExist) {
+			t.Fatalf("error wait: %q; got: %q", fsentry_error.ErrorNotExist, err)
+		}
+		err = f.RemoveFile("/root/folder")
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestFolder(t *testing.T) {
+	f := New()
+
+	t.Run("create", func(t *testing.T) {
+		err := f.CreateFolder("root/folder")
+		if !errors.Is(err, fsentry_error.ErrorNotExist) {
+			t.Fatalf("error wait: %q; got: %q", fsentry_error.ErrorNotExist, err)
+		}
+		err = f.CreateAllFolder("root/folder")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.CreateAllFolder("root/folder")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.CreateFolder("root/folder")
+		if !errors.Is(err, fsentry_error.ErrorExist) {
+			t.Fatalf("error wait: %q; got: %q", fsentry_error.ErrorExist, err)
+		}
+		err = f.CreateFile("root/file", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.CreateAllFolder("root/file/folder")
+		if !errors.Is(err, fsentry_error.ErrorExist) {
+			t.Fatalf("error wait: %q; got: %q", fsentry_error.ErrorExist, err)
+		}
+	})
+
+	t.Run("copy_rename", func(t *testing.T) {
+		err := f.CreateFile("root/folder/data", []byte("data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.CreateFile("root/folder/.fsentry-tmp-1234", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.CopyFolder("root/folder", "root/copy")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.Rename("root/copy", "root/moved")
+		if err != nil {
+			t.Fatal(err)
+		}
+		files, err := f.List("root/moved")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 1 || files[0].Name() != "data" {
+			t.Fatal("temp files must not be copied", files)
+		}
+		err = f.Rename("root/moved", "root/moved/inside")
+		if !errors.Is(err, fsentry_error.ErrorInternal) {
+			t.Fatalf("error wait: %q; got: %q", fsentry_error.ErrorInternal, err)
+		}
+		err = f.Rename("root/not_exist", "root/new")
+		if !errors.Is(err, fsentry_error.ErrorInternal) {
+			t.Fatalf("error wait: %q; got: %q", fsentry_error.ErrorInternal, err)
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		var names []string
+		err := f.ListFunc("root", func(entry os.DirEntry) error {
+			names = append(names, entry.Name())
+			// The file system can be modified while listing.
+			return f.CreateAllFolder("root/moved/" + entry.Name())
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(names, ",") != "file,folder,moved" {
+			t.Fatal("bad list", names)
+		}
+		err = f.ListFunc("root/file", func(entry os.DirEntry) error { return nil })
+		if !errors.Is(err, fsentry_error.ErrorNotDirectory) {
+			t.Fatalf("error wait: %q; got: %q", fsentry_error.ErrorNotDirectory, err)
+		}
+		_, err = f.List("root/not_exist")
+		if !errors.Is(err, fsentry_error.ErrorNotExist) {
+			t.Fatalf("error wait: %q; got: %q", fsentry_error.ErrorNotExist, err)
+		}
+	})
+
+	t.Run("cleanup_remove", func(t *testing.T) {
+		err := f.CleanupTemp("root")
+		if err != nil {
+			t.Fatal(err)
+		}
+		isExist, err := f.IsFileExist("root/folder/.fsentry-tmp-1234")
+		if err != nil || isExist {
+			t.Fatal("temp file must be removed", err)
+		}
+		err = f.RemoveFolder("root")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.RemoveFolder("root")
+		if err != nil {
+			t.Fatal(err)
+		}
+		isExist, err = f.IsFolderExist("root")
+		if err != nil || isExist {
+			t.Fatal("folder must be removed", err)
+		}
+	})
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) fsentry_storage.Storage {
+		return New()
+	})
+}
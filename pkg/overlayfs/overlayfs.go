@@ -0,0 +1,834 @@
+// Package overlayfs is a copy-on-write storage for fsentry that layers a writable upper storage over a lower one.
+//
+// Reads fall through to the lower storage, which is never modified, and all changes are written to the upper one:
+//
+//	template := rofs.New(os.DirFS("/usr/share/app/template"))
+//	db := fsentry.NewFSEntry("db", fsentry.WithStorage(overlayfs.New(template, memfs.New())))
+//
+// Removed lower objects are hidden with whiteout markers, and folders that replace lower folders are marked
+// as opaque, so that the lower content does not show through. A moved lower folder is not copied: the new upper
+// folder gets a redirect marker with the old path, where its lower content is found. Markers are hidden files
+// in the upper storage and are never listed.
+//
+// A single operation of the overlay consists of several operations on both storages, so all modifications
+// are serialized.
+package overlayfs
+
+import (
+	"context"
+	"errors"
+	iofs "io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/HardDie/fsentry/pkg/fsentry_error"
+	"github.com/HardDie/fsentry/pkg/fsentry_storage"
+)
+
+const (
+	// WhiteoutPrefix is a prefix of the marker files in the upper storage, which hide the lower object
+	// with the same name after the prefix.
+	WhiteoutPrefix = ".fsentry-whiteout-"
+	// OpaqueMarker is a marker file in the upper folder, which hides all lower objects inside the folder.
+	OpaqueMarker = ".fsentry-opaque"
+	// RedirectMarker is a marker file in the upper folder, which contains the path of the lower folder
+	// to show inside it instead of the lower folder with the same path.
+	RedirectMarker = ".fsentry-redirect"
+)
+
+var (
+	// validate interface.
+	_ fsentry_storage.Storage = &FS{}
+)
+
+type objectKind uint8
+
+const (
+	objectNone objectKind = iota
+	objectFile
+	objectFolder
+)
+
+// object is the state of a path in both storages. If the object is hidden in the lower storage, lower is objectNone.
+// lowerPath differs from the path if the object is inside a redirected folder.
+type object struct {
+	upper     objectKind
+	lower     objectKind
+	lowerPath string
+}
+
+// kind returns the kind of the visible object, the upper storage takes precedence.
+func (o object) kind() objectKind {
+	if o.upper != objectNone {
+		return o.upper
+	}
+	return o.lower
+}
+
+type FS struct {
+	rwm   sync.RWMutex
+	lower fsentry_storage.Storage
+	upper fsentry_storage.Storage
+}
+
+func New(lower, upper fsentry_storage.Storage) *FS {
+	return &FS{
+		lower: lower,
+		upper: upper,
+	}
+}
+
+// CreateFile creates a new file in the upper storage, the parent folder must exist in any storage.
+func (r *FS) CreateFile(path string, data []byte) error {
+	r.rwm.Lock()
+	defer r.rwm.Unlock()
+	return r.createFile(path, data)
+}
+
+// ReadFile reads the file from the upper storage, or from the lower one if there is no such file in the upper storage.
+func (r *FS) ReadFile(path string) ([]byte, error) {
+	r.rwm.RLock()
+	defer r.rwm.RUnlock()
+	return r.readFile(path)
+}
+
+// UpdateFile writes the new content into the upper storage, a lower file is copied up.
+func (r *FS) UpdateFile(path string, data []byte) error {
+	r.rwm.Lock()
+	defer r.rwm.Unlock()
+	return r.updateFile(path, data)
+}
+
+// RemoveFile removes a file or an empty folder. A lower object is hidden with a whiteout marker.
+// If the folder is not empty, an ErrorExist error will be returned.
+func (r *FS) RemoveFile(path string) error {
+	r.rwm.Lock()
+	defer r.rwm.Unlock()
+	return r.removeFile(path)
+}
+
+// CreateFolder creates a new folder in the upper storage, the parent folder must exist in any storage.
+func (r *FS) CreateFolder(path string) error {
+	r.rwm.Lock()
+	defer r.rwm.Unlock()
+	return r.createNewFolder(path)
+}
+
+// CreateAllFolder creates the folder and all missing parent folders in the upper storage.
+// If the specified folder already exists, there will be no error.
+func (r *FS) CreateAllFolder(path string) error {
+	r.rwm.Lock()
+	defer r.rwm.Unlock()
+	return r.createAllFolder(path)
+}
+
+// RemoveFolder removes the object with everything inside it. A lower object is hidden with a whiteout marker.
+// If the folder does not exist, there will be no error.
+func (r *FS) RemoveFolder(path string) error {
+	r.rwm.Lock()
+	defer r.rwm.Unlock()
+	return r.removeFolder(path)
+}
+
+// ListFunc calls fn for each object of the upper storage and then for each visible object of the lower one.
+// The list is taken before the first call, so fn is allowed to use and modify the storage.
+// If fn returns an error, listing stops and that error is returned.
+func (r *FS) ListFunc(path string, fn func(entry os.DirEntry) error) error {
+	var entries []os.DirEntry
+	r.rwm.RLock()
+	err := r.listFunc(path, func(entry os.DirEntry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	r.rwm.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if err = fn(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CleanupTemp removes temporary files from the upper storage, the lower storage is never modified.
+func (r *FS) CleanupTemp(path string) error {
+	r.rwm.Lock()
+	defer r.rwm.Unlock()
+	return r.cleanupTemp(path)
+}
+
+// IsFileExist checks if an object that is a file, not a folder, exists at the specified path.
+func (r *FS) IsFileExist(path string) (isExist bool, err error) {
+	r.rwm.RLock()
+	defer r.rwm.RUnlock()
+	return r.isFileExist(path)
+}
+
+// IsFolderExist checks if an object that is a folder, exists at the specified path.
+func (r *FS) IsFolderExist(path string) (isExist bool, err error) {
+	r.rwm.RLock()
+	defer r.rwm.RUnlock()
+	return r.isFolderExist(path)
+}
+
+// Rename moves the object to a new path in the upper storage. A lower file is copied up first, a lower folder
+// is not copied, the new folder is redirected to it. Then the lower object is hidden with a whiteout marker.
+func (r *FS) Rename(oldPath, newPath string) error {
+	r.rwm.Lock()
+	defer r.rwm.Unlock()
+
+	err := r.rename(oldPath, newPath)
+	if err != nil {
+		return fsentry_error.Wrap(err, fsentry_error.ErrorInternal)
+	}
+	return nil
+}
+
+// CopyFolder recursively copies the visible content of the source folder into the upper storage.
+func (r *FS) CopyFolder(srcPath, dstPath string) error {
+	return r.CopyFolderContext(context.Background(), srcPath, dstPath)
+}
+
+// CopyFolderContext is like CopyFolder, but stops copying before the next object when the context is canceled.
+func (r *FS) CopyFolderContext(ctx context.Context, srcPath, dstPath string) error {
+	r.rwm.Lock()
+	defer r.rwm.Unlock()
+
+	obj, err := r.lookup(srcPath)
+	if err == nil && obj.kind() == objectNone {
+		err = pathError("copy", srcPath, iofs.ErrNotExist, fsentry_error.ErrorNotExist)
+	}
+	if err == nil && obj.kind() == objectFolder && isSubPath(srcPath, dstPath) {
+		// Copying a folder inside itself would never end.
+		err = pathError("copy", dstPath, errInvalid, fsentry_error.ErrorBadPath)
+	}
+	if err == nil {
+		err = r.copy(ctx, srcPath, dstPath, obj.kind())
+	}
+	if ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+		return fsentry_error.Wrap(err, fsentry_error.ErrorCanceled)
+	}
+	if err != nil {
+		return fsentry_error.Wrap(err, fsentry_error.ErrorInternal)
+	}
+	return nil
+}
+
+// List returns the objects of both storages on the specified path, without hidden lower objects and markers.
+func (r *FS) List(path string) ([]os.FileInfo, error) {
+	var res []os.FileInfo
+	err := r.ListFunc(path, func(entry os.DirEntry) error {
+		info, err := entry.Info()
+		if err != nil {
+			return fsentry_error.Wrap(err, fsentry_error.ErrorInternal)
+		}
+		res = append(res, info)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (r *FS) createFile(path string, data []byte) error {
+	err := r.checkCreate("open", path)
+	if err != nil {
+		return err
+	}
+	err = r.upper.CreateAllFolder(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	err = r.upper.RemoveFolder(whiteoutPath(path))
+	if err != nil {
+		return err
+	}
+	return r.upper.CreateFile(path, data)
+}
+
+func (r *FS) readFile(path string) ([]byte, error) {
+	obj, err := r.lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case obj.upper == objectFile:
+		return r.upper.ReadFile(path)
+	case obj.upper == objectNone && obj.lower == objectFile:
+		return r.lower.ReadFile(obj.lowerPath)
+	}
+	return nil, pathError("open", path, iofs.ErrNotExist, fsentry_error.ErrorNotExist)
+}
+
+func (r *FS) updateFile(path string, data []byte) error {
+	obj, err := r.lookup(path)
+	if err != nil {
+		return err
+	}
+	switch {
+	case obj.upper == objectFile:
+		return r.upper.UpdateFile(path, data)
+	case obj.upper == objectNone && obj.lower == objectFile:
+		err = r.upper.CreateAllFolder(filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		return r.upper.CreateFile(path, data)
+	}
+	return pathError("open", path, iofs.ErrNotExist, fsentry_error.ErrorNotExist)
+}
+
+func (r *FS) removeFile(path string) error {
+	obj, err := r.lookup(path)
+	if err != nil {
+		return err
+	}
+	switch obj.kind() {
+	case objectNone:
+		return pathError("remove", path, iofs.ErrNotExist, fsentry_error.ErrorNotExist)
+	case objectFolder:
+		isEmpty, err := r.isEmpty(path)
+		if err != nil {
+			return err
+		}
+		if !isEmpty {
+			return pathError("remove", path, errNotEmpty, fsentry_error.ErrorExist)
+		}
+	}
+	return r.remove(path, obj)
+}
+
+func (r *FS) createNewFolder(path string) error {
+	err := r.checkCreate("mkdir", path)
+	if err != nil {
+		return err
+	}
+	return r.createFolder(path)
+}
+
+func (r *FS) createAllFolder(path string) error {
+	for _, p := range splitPath(path) {
+		obj, err := r.lookup(p)
+		if err != nil {
+			return err
+		}
+		switch obj.kind() {
+		case objectFile:
+			return pathError("mkdir", path, errNotDirectory, fsentry_error.ErrorExist)
+		case objectNone:
+			err = r.createFolder(p)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *FS) removeFolder(path string) error {
+	obj, err := r.lookup(path)
+	if err != nil {
+		return err
+	}
+	if obj.kind() == objectNone {
+		return nil
+	}
+	return r.remove(path, obj)
+}
+
+func (r *FS) listFunc(path string, fn func(entry os.DirEntry) error) error {
+	obj, err := r.lookup(path)
+	if err != nil {
+		return err
+	}
+	switch obj.kind() {
+	case objectNone:
+		return pathError("open", path, iofs.ErrNotExist, fsentry_error.ErrorNotExist)
+	case objectFile:
+		return pathError("readdirent", path, errNotDirectory, fsentry_error.ErrorNotDirectory)
+	}
+
+	// Names of the upper objects hide the lower objects with the same names.
+	hidden := make(map[string]struct{})
+	isOpaque := false
+	if obj.upper == objectFolder {
+		err = r.upper.ListFunc(path, func(entry os.DirEntry) error {
+			name := entry.Name()
+			switch {
+			case name == OpaqueMarker:
+				isOpaque = true
+				return nil
+			case name == RedirectMarker:
+				return nil
+			case strings.HasPrefix(name, WhiteoutPrefix):
+				hidden[strings.TrimPrefix(name, WhiteoutPrefix)] = struct{}{}
+				return nil
+			}
+			hidden[name] = struct{}{}
+			return fn(entry)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if obj.lower != objectFolder || isOpaque {
+		return nil
+	}
+	return r.lower.ListFunc(obj.lowerPath, func(entry os.DirEntry) error {
+		if _, ok := hidden[entry.Name()]; ok {
+			return nil
+		}
+		return fn(entry)
+	})
+}
+
+func (r *FS) cleanupTemp(path string) error {
+	obj, err := r.lookup(path)
+	if err != nil {
+		return err
+	}
+	switch obj.kind() {
+	case objectNone:
+		return pathError("lstat", path, iofs.ErrNotExist, fsentry_error.ErrorNotExist)
+	case objectFile:
+		return pathError("lstat", path, errNotDirectory, fsentry_error.ErrorNotDirectory)
+	}
+	if obj.upper != objectFolder {
+		return nil
+	}
+	return r.upper.CleanupTemp(path)
+}
+
+func (r *FS) isFileExist(path string) (isExist bool, err error) {
+	obj, err := r.lookup(path)
+	if err != nil {
+		return false, err
+	}
+	switch obj.kind() {
+	case objectFolder:
+		return false, fsentry_error.ErrorBadPath
+	case objectFile:
+		return true, nil
+	}
+	return false, nil
+}
+
+func (r *FS) isFolderExist(path string) (isExist bool, err error) {
+	obj, err := r.lookup(path)
+	if err != nil {
+		return false, err
+	}
+	switch obj.kind() {
+	case objectFile:
+		return false, fsentry_error.ErrorBadPath
+	case objectFolder:
+		return true, nil
+	}
+	return false, nil
+}
+
+// lookup finds the object in both storages. The path is resolved from the top, so a file or
+// a whiteout marker in the upper storage hides all lower objects under it, an opaque folder hides
+// all lower objects inside it, and a redirected folder shows the lower objects from its redirect path.
+func (r *FS) lookup(path string) (object, error) {
+	// The root of the file system exists in both storages.
+	obj := object{upper: objectFolder, lower: objectFolder, lowerPath: path}
+	for i, p := range splitPath(path) {
+		var err error
+		lowerPath := p
+		if i > 0 {
+			lowerPath = filepath.Join(obj.lowerPath, filepath.Base(p))
+		}
+		if obj.upper == objectFolder && obj.lower == objectFolder {
+			isHidden, err := r.isLowerHidden(p)
+			if err != nil {
+				return object{}, err
+			}
+			if isHidden {
+				obj.lower = objectNone
+			}
+		}
+
+		if obj.upper == objectFolder {
+			obj.upper, err = statStorage(r.upper, p)
+			if err != nil {
+				return object{}, err
+			}
+		} else {
+			obj.upper = objectNone
+		}
+		if obj.lower == objectFolder {
+			obj.lower, err = statStorage(r.lower, lowerPath)
+			if err != nil {
+				return object{}, err
+			}
+		} else {
+			obj.lower = objectNone
+		}
+		if obj.upper == objectFolder {
+			// A moved folder shows the lower content of its old path, even if the lower object on the path is hidden.
+			redirect, err := r.redirect(p)
+			if err != nil {
+				return object{}, err
+			}
+			if redirect != "" {
+				lowerPath = redirect
+				obj.lower, err = statStorage(r.lower, lowerPath)
+				if err != nil {
+					return object{}, err
+				}
+			}
+		}
+		obj.lowerPath = lowerPath
+
+		// The upper object takes precedence, so a lower object of the other kind can never be seen.
+		if obj.upper != objectNone && obj.upper != obj.lower {
+			obj.lower = objectNone
+		}
+	}
+	return obj, nil
+}
+
+// redirect returns the lower path of the redirected upper folder, or an empty string.
+func (r *FS) redirect(path string) (string, error) {
+	data, err := r.upper.ReadFile(filepath.Join(path, RedirectMarker))
+	if errors.Is(err, fsentry_error.ErrorNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// isLowerHidden checks the markers in the upper parent folder, that hide the lower object.
+func (r *FS) isLowerHidden(path string) (bool, error) {
+	kind, err := statStorage(r.upper, filepath.Join(filepath.Dir(path), OpaqueMarker))
+	if err != nil || kind != objectNone {
+		return true, err
+	}
+	kind, err = statStorage(r.upper, whiteoutPath(path))
+	if err != nil || kind != objectNone {
+		return true, err
+	}
+	return false, nil
+}
+
+// checkCreate checks that a new object can be created: the parent folder exists and the path is free.
+func (r *FS) checkCreate(op, path string) error {
+	parent, err := r.lookup(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	switch parent.kind() {
+	case objectNone:
+		return pathError(op, path, iofs.ErrNotExist, fsentry_error.ErrorNotExist)
+	case objectFile:
+		return pathError(op, path, errNotDirectory, fsentry_error.ErrorNotDirectory)
+	}
+
+	obj, err := r.lookup(path)
+	if err != nil {
+		return err
+	}
+	if obj.kind() != objectNone {
+		return pathError(op, path, iofs.ErrExist, fsentry_error.ErrorExist)
+	}
+	return nil
+}
+
+// createFolder creates the folder in the upper storage. If a lower object has been removed from this path,
+// the new folder is marked as opaque, so that the removed lower content does not appear in it.
+func (r *FS) createFolder(path string) error {
+	err := r.upper.CreateAllFolder(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	kind, err := statStorage(r.upper, whiteoutPath(path))
+	if err != nil {
+		return err
+	}
+	err = r.upper.CreateFolder(path)
+	if err != nil {
+		return err
+	}
+	if kind == objectNone {
+		return nil
+	}
+	err = r.markOpaque(path)
+	if err != nil {
+		return err
+	}
+	return r.upper.RemoveFolder(whiteoutPath(path))
+}
+
+// remove removes the upper object and hides the lower one.
+func (r *FS) remove(path string, obj object) error {
+	if obj.upper != objectNone {
+		// The upper folder may contain markers, so it is removed recursively.
+		err := r.upper.RemoveFolder(path)
+		if err != nil {
+			return err
+		}
+	}
+	if obj.lower == objectNone {
+		return nil
+	}
+	err := r.upper.CreateAllFolder(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	err = r.upper.CreateFile(whiteoutPath(path), nil)
+	if err != nil && !errors.Is(err, fsentry_error.ErrorExist) {
+		return err
+	}
+	return nil
+}
+
+func (r *FS) rename(oldPath, newPath string) error {
+	src, err := r.lookup(oldPath)
+	if err != nil {
+		return err
+	}
+	if src.kind() == objectNone {
+		return pathError("rename", oldPath, iofs.ErrNotExist, fsentry_error.ErrorNotExist)
+	}
+	if filepath.Clean(oldPath) == filepath.Clean(newPath) {
+		return nil
+	}
+	if src.kind() == objectFolder && isSubPath(oldPath, newPath) {
+		// A folder cannot be moved inside itself.
+		return pathError("rename", newPath, errInvalid, fsentry_error.ErrorBadPath)
+	}
+
+	parent, err := r.lookup(filepath.Dir(newPath))
+	if err != nil {
+		return err
+	}
+	if parent.kind() != objectFolder {
+		return pathError("rename", newPath, iofs.ErrNotExist, fsentry_error.ErrorNotExist)
+	}
+	dst, err := r.lookup(newPath)
+	if err != nil {
+		return err
+	}
+	switch {
+	case src.kind() == objectFolder && dst.kind() == objectFile:
+		return pathError("rename", newPath, errNotDirectory, fsentry_error.ErrorNotDirectory)
+	case src.kind() == objectFile && dst.kind() == objectFolder:
+		return pathError("rename", newPath, errIsDirectory, fsentry_error.ErrorExist)
+	case dst.kind() == objectFolder:
+		isEmpty, err := r.isEmpty(newPath)
+		if err != nil {
+			return err
+		}
+		if !isEmpty {
+			return pathError("rename", newPath, errNotEmpty, fsentry_error.ErrorExist)
+		}
+	}
+
+	if src.kind() == objectFile && src.lower != objectNone {
+		// The file is moved to the upper storage, so that it can be renamed there.
+		err = r.copyUp(oldPath, src)
+		if err != nil {
+			return err
+		}
+	}
+	err = r.upper.CreateAllFolder(filepath.Dir(newPath))
+	if err != nil {
+		return err
+	}
+	if dst.upper == objectFolder {
+		// The folder is empty, but may contain markers.
+		err = r.upper.RemoveFolder(newPath)
+		if err != nil {
+			return err
+		}
+	}
+	if src.kind() == objectFolder && src.upper == objectNone {
+		err = r.upper.CreateFolder(newPath)
+	} else {
+		err = r.upper.Rename(oldPath, newPath)
+	}
+	if err != nil {
+		return err
+	}
+	err = r.upper.RemoveFolder(whiteoutPath(newPath))
+	if err != nil {
+		return err
+	}
+	switch {
+	case src.kind() == objectFolder && src.lower != objectNone:
+		// The lower content stays in place and replaces the lower folder on the new path.
+		err = r.upper.CreateFile(filepath.Join(newPath, RedirectMarker), []byte(src.lowerPath))
+		if errors.Is(err, fsentry_error.ErrorExist) {
+			// The folder has been moved before, the redirect stays the same.
+			err = nil
+		}
+	case src.kind() == objectFolder && dst.lower != objectNone:
+		err = r.markOpaque(newPath)
+	}
+	if err != nil {
+		return err
+	}
+	if src.lower == objectNone {
+		return nil
+	}
+	return r.remove(oldPath, object{lower: src.lower})
+}
+
+// copyUp copies the lower file into the upper storage.
+func (r *FS) copyUp(path string, obj object) error {
+	if obj.upper == objectFile {
+		return nil
+	}
+	data, err := r.lower.ReadFile(obj.lowerPath)
+	if err != nil {
+		return err
+	}
+	err = r.upper.CreateAllFolder(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	return r.upper.CreateFile(path, data)
+}
+
+// copy recursively copies the visible object with the overlay operations, skipping temporary files.
+func (r *FS) copy(ctx context.Context, srcPath, dstPath string, kind objectKind) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if kind == objectFile {
+		data, err := r.readFile(srcPath)
+		if err != nil {
+			return err
+		}
+		err = r.createAllFolder(filepath.Dir(dstPath))
+		if err != nil {
+			return err
+		}
+		isExist, err := r.isFileExist(dstPath)
+		if err != nil {
+			return err
+		}
+		if isExist {
+			return r.updateFile(dstPath, data)
+		}
+		return r.createFile(dstPath, data)
+	}
+
+	err := r.createAllFolder(dstPath)
+	if err != nil {
+		return err
+	}
+	type child struct {
+		name string
+		kind objectKind
+	}
+	var children []child
+	err = r.listFunc(srcPath, func(entry os.DirEntry) error {
+		if !entry.IsDir() && strings.HasPrefix(entry.Name(), fsentry_storage.TempFilePrefix) {
+			// Do not copy files of unfinished writes.
+			return nil
+		}
+		kind := objectFile
+		if entry.IsDir() {
+			kind = objectFolder
+		}
+		children = append(children, child{name: entry.Name(), kind: kind})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, c := range children {
+		err = r.copy(ctx, filepath.Join(srcPath, c.name), filepath.Join(dstPath, c.name), c.kind)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isEmpty reports whether the visible folder has no objects.
+func (r *FS) isEmpty(path string) (bool, error) {
+	errStop := errors.New("stop")
+	err := r.listFunc(path, func(entry os.DirEntry) error {
+		return errStop
+	})
+	if errors.Is(err, errStop) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (r *FS) markOpaque(path string) error {
+	err := r.upper.CreateFile(filepath.Join(path, OpaqueMarker), nil)
+	if err != nil && !errors.Is(err, fsentry_error.ErrorExist) {
+		return err
+	}
+	return nil
+}
+
+// statStorage returns the kind of the object in a single storage.
+func statStorage(s fsentry_storage.Storage, path string) (objectKind, error) {
+	isExist, err := s.IsFolderExist(path)
+	if err != nil {
+		if errors.Is(err, fsentry_error.ErrorBadPath) {
+			return objectFile, nil
+		}
+		return objectNone, err
+	}
+	if isExist {
+		return objectFolder, nil
+	}
+	return objectNone, nil
+}
+
+func whiteoutPath(path string) string {
+	return filepath.Join(filepath.Dir(path), WhiteoutPrefix+filepath.Base(path))
+}
+
+// splitPath returns the path and all its parents from the top, without the root of the file system.
+func splitPath(path string) []string {
+	var res []string
+	for p := filepath.Clean(path); ; p = filepath.Dir(p) {
+		if filepath.Dir(p) == p {
+			break
+		}
+		res = append(res, p)
+	}
+	for i, j := 0, len(res)-1; i < j; i, j = i+1, j-1 {
+		res[i], res[j] = res[j], res[i]
+	}
+	return res
+}
+
+// isSubPath reports whether the path is inside the folder.
+func isSubPath(folder, path string) bool {
+	rel, err := filepath.Rel(folder, path)
+	if err != nil {
+		return false
+	}
+	return rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+var (
+	errNotDirectory = errors.New("not a directory")
+	errIsDirectory  = errors.New("is a directory")
+	errNotEmpty     = errors.New("directory not empty")
+	errInvalid      = errors.New("invalid argument")
+)
+
+func pathError(op, path string, err, localErr error) error {
+	return fsentry_error.Wrap(&iofs.PathError{Op: op, Path: path, Err: err}, localErr)
+}
@@ -0,0 +1,208 @@
+package overlayfs_test
+
+import (
+	"errors"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/HardDie/fsentry"
+	pkgFsentry "github.com/HardDie/fsentry/pkg/fsentry"
+	"github.com/HardDie/fsentry/pkg/fsentry_error"
+	"github.com/HardDie/fsentry/pkg/fsentry_storage"
+	"github.com/HardDie/fsentry/pkg/fsentry_storage/storagetest"
+	"github.com/HardDie/fsentry/pkg/memfs"
+	"github.com/HardDie/fsentry/pkg/overlayfs"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) fsentry_storage.Storage {
+		return overlayfs.New(memfs.New(), memfs.New())
+	})
+}
+
+func TestOverlay(t *testing.T) {
+	// Prepare the template in the lower storage.
+	lower := memfs.New()
+	template := fsentry.NewFSEntry("db", fsentry.WithStorage(lower))
+	err := template.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = template.CreateFolder("f1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = template.CreateFolder("f2", nil, "f1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = template.CreateEntry("e1", "lower", "f1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = template.CreateEntry("e2", "lower", "f1", "f2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upper := memfs.New()
+	db := fsentry.NewFSEntry("db", fsentry.WithStorage(overlayfs.New(lower, upper)))
+	err = db.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listNames := func(db pkgFsentry.IFSEntry, path ...string) string {
+		t.Helper()
+		list, err := db.List(path...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, folder := range list.Folders {
+			names = append(names, folder.Name+"/")
+		}
+		for _, entry := range list.Entries {
+			names = append(names, entry.Name)
+		}
+		sort.Strings(names)
+		return strings.Join(names, ",")
+	}
+
+	t.Run("read", func(t *testing.T) {
+		entry, err := db.GetEntry("e1", "f1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(entry.Data) != `"lower"` {
+			t.Fatal("Bad entry data", string(entry.Data))
+		}
+	})
+
+	t.Run("update", func(t *testing.T) {
+		_, err := db.UpdateEntry("e1", "upper", "f1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry, err := db.GetEntry("e1", "f1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(entry.Data) != `"upper"` {
+			t.Fatal("Bad entry data", string(entry.Data))
+		}
+	})
+
+	t.Run("duplicate", func(t *testing.T) {
+		_, err := db.DuplicateFolder("f1", "f3")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := listNames(db, "f3"); got != "e1,f2/" {
+			t.Fatal("Bad list", got)
+		}
+		if got := listNames(db, "f3", "f2"); got != "e2" {
+			t.Fatal("Bad list", got)
+		}
+	})
+
+	t.Run("move", func(t *testing.T) {
+		_, err := db.MoveFolder("f2", "f4", "f1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := listNames(db, "f1"); got != "e1,f4/" {
+			t.Fatal("Bad list", got)
+		}
+		if got := listNames(db, "f1", "f4"); got != "e2" {
+			t.Fatal("Bad list", got)
+		}
+		_, err = db.GetFolder("f2", "f1")
+		if !errors.Is(err, fsentry_error.ErrorNotExist) {
+			t.Fatalf("error wait: %q; got: %q", fsentry_error.ErrorNotExist, err)
+		}
+
+		// The lower content of the moved folder must not be copied.
+		isExist, err := upper.IsFileExist(filepath.Join("db", "f1", "f4", "e2.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isExist {
+			t.Fatal("Lower entry must not be copied")
+		}
+
+		// The moved folder can be moved again.
+		_, err = db.UpdateEntry("e2", "upper", "f1", "f4")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.MoveFolder("f4", "f5", "f1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.MoveFolder("f5", "f4", "f1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry, err := db.GetEntry("e2", "f1", "f4")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(entry.Data) != `"upper"` {
+			t.Fatal("Bad entry data", string(entry.Data))
+		}
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		err := db.RemoveEntry("e2", "f1", "f4")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := listNames(db, "f1", "f4"); got != "" {
+			t.Fatal("Bad list", got)
+		}
+
+		err = db.RemoveFolder("f1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := listNames(db); got != "f3/" {
+			t.Fatal("Bad list", got)
+		}
+
+		// The new folder must not show the removed lower content.
+		_, err = db.CreateFolder("f1", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := listNames(db, "f1"); got != "" {
+			t.Fatal("Bad list", got)
+		}
+	})
+
+	t.Run("check", func(t *testing.T) {
+		report, err := db.Check(pkgFsentry.CheckOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Problems) != 0 {
+			t.Fatal("Storage must be consistent", report.Problems)
+		}
+	})
+
+	t.Run("lower", func(t *testing.T) {
+		// The lower storage must not be modified.
+		if got := listNames(template, "f1"); got != "e1,f2/" {
+			t.Fatal("Bad list", got)
+		}
+		entry, err := template.GetEntry("e1", "f1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(entry.Data) != `"lower"` {
+			t.Fatal("Bad entry data", string(entry.Data))
+		}
+	})
+}
@@ -0,0 +1,233 @@
+// Package rofs is a read-only storage for fsentry over any io/fs.FS, like embed.FS, zip.Reader or os.DirFS.
+//
+// It allows to open a tree of folders and entries packaged with the binary without extracting it:
+//
+//	//go:embed all:seed
+//	var seed embed.FS
+//
+//	db := fsentry.NewFSEntry("seed", fsentry.WithStorage(rofs.New(seed)))
+//
+// The "all:" prefix is required, go:embed skips files starting with a dot without it, like .info.json
+// of folders and the metadata of binaries.
+//
+// All calls that modify the storage return fsentry_error.ErrorReadOnly.
+package rofs
+
+import (
+	"errors"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/HardDie/fsentry/pkg/fsentry_error"
+	"github.com/HardDie/fsentry/pkg/fsentry_storage"
+)
+
+const (
+	ListBatchSize = 256
+)
+
+var (
+	// validate interface.
+	_ fsentry_storage.Storage = FS{}
+)
+
+type FS struct {
+	fsys iofs.FS
+}
+
+func New(fsys iofs.FS) FS {
+	return FS{
+		fsys: fsys,
+	}
+}
+
+func (r FS) CreateFile(path string, data []byte) error {
+	return readOnlyError("create", path)
+}
+func (r FS) UpdateFile(path string, data []byte) error {
+	return readOnlyError("update", path)
+}
+func (r FS) RemoveFile(path string) error {
+	return readOnlyError("remove", path)
+}
+func (r FS) CreateFolder(path string) error {
+	return readOnlyError("mkdir", path)
+}
+func (r FS) CreateAllFolder(path string) error {
+	return readOnlyError("mkdir", path)
+}
+func (r FS) RemoveFolder(path string) error {
+	return readOnlyError("remove", path)
+}
+func (r FS) Rename(oldPath, newPath string) error {
+	return readOnlyError("rename", oldPath)
+}
+func (r FS) CopyFolder(srcPath, dstPath string) error {
+	return readOnlyError("copy", dstPath)
+}
+
+// CleanupTemp does nothing, temporary files cannot appear in a read-only storage.
+func (r FS) CleanupTemp(path string) error {
+	return nil
+}
+
+// ReadFile reads all binary data from the desired file. A folder is reported as a missing file.
+func (r FS) ReadFile(path string) ([]byte, error) {
+	name, err := toName(path)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := iofs.Stat(r.fsys, name)
+	if err != nil {
+		return nil, mapError(err)
+	}
+	if stat.IsDir() {
+		return nil, fsentry_error.Wrap(&iofs.PathError{Op: "read", Path: path, Err: iofs.ErrInvalid}, fsentry_error.ErrorNotExist)
+	}
+	data, err := iofs.ReadFile(r.fsys, name)
+	if err != nil {
+		return nil, mapError(err)
+	}
+	return data, nil
+}
+
+// List will read the complete list of objects on the specified path and return them.
+func (r FS) List(path string) ([]os.FileInfo, error) {
+	var res []os.FileInfo
+	err := r.ListFunc(path, func(entry os.DirEntry) error {
+		info, err := entry.Info()
+		if err != nil {
+			return mapError(err)
+		}
+		res = append(res, info)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// ListFunc reads objects on the specified path and calls fn for each of them. If the file system allows it,
+// objects are read in batches of ListBatchSize. If fn returns an error, reading stops and that error is returned.
+func (r FS) ListFunc(path string, fn func(entry os.DirEntry) error) error {
+	name, err := toName(path)
+	if err != nil {
+		return err
+	}
+	stat, err := iofs.Stat(r.fsys, name)
+	if err != nil {
+		return mapError(err)
+	}
+	if !stat.IsDir() {
+		return fsentry_error.Wrap(&iofs.PathError{Op: "readdir", Path: path, Err: iofs.ErrInvalid}, fsentry_error.ErrorNotDirectory)
+	}
+
+	f, err := r.fsys.Open(name)
+	if err != nil {
+		return mapError(err)
+	}
+	defer f.Close()
+
+	dir, ok := f.(iofs.ReadDirFile)
+	if !ok {
+		// The file system does not allow to read a folder in parts.
+		entries, err := iofs.ReadDir(r.fsys, name)
+		if err != nil {
+			return mapError(err)
+		}
+		for _, entry := range entries {
+			if e := fn(entry); e != nil {
+				return e
+			}
+		}
+		return nil
+	}
+
+	for {
+		entries, err := dir.ReadDir(ListBatchSize)
+		for _, entry := range entries {
+			if e := fn(entry); e != nil {
+				return e
+			}
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return mapError(err)
+		}
+		if len(entries) == 0 {
+			return nil
+		}
+	}
+}
+
+// IsFileExist checks if an object that is a file, not a folder, exists at the specified path.
+func (r FS) IsFileExist(path string) (isExist bool, err error) {
+	stat, isExist, err := r.stat(path)
+	if err != nil || !isExist {
+		return false, err
+	}
+	if stat.IsDir() {
+		return false, fsentry_error.ErrorBadPath
+	}
+	return true, nil
+}
+
+// IsFolderExist checks if an object that is a folder, exists at the specified path.
+func (r FS) IsFolderExist(path string) (isExist bool, err error) {
+	stat, isExist, err := r.stat(path)
+	if err != nil || !isExist {
+		return false, err
+	}
+	if !stat.IsDir() {
+		return false, fsentry_error.ErrorBadPath
+	}
+	return true, nil
+}
+
+func (r FS) stat(path string) (os.FileInfo, bool, error) {
+	name, err := toName(path)
+	if err != nil {
+		return nil, false, err
+	}
+	stat, err := iofs.Stat(r.fsys, name)
+	if err != nil {
+		if errors.Is(err, iofs.ErrNotExist) {
+			return nil, false, nil
+		}
+		return nil, false, fsentry_error.Wrap(err, fsentry_error.ErrorInternal)
+	}
+	return stat, true, nil
+}
+
+// toName converts a file path into the slash-separated unrooted name used by io/fs.
+func toName(path string) (string, error) {
+	name := filepath.ToSlash(filepath.Clean(path))
+	name = strings.TrimPrefix(name, "/")
+	if name == "" {
+		name = "."
+	}
+	if !iofs.ValidPath(name) {
+		return "", fsentry_error.Wrap(&iofs.PathError{Op: "open", Path: path, Err: iofs.ErrInvalid}, fsentry_error.ErrorBadPath)
+	}
+	return name, nil
+}
+
+func mapError(err error) error {
+	switch {
+	case errors.Is(err, iofs.ErrNotExist):
+		return fsentry_error.Wrap(err, fsentry_error.ErrorNotExist)
+	case errors.Is(err, iofs.ErrPermission):
+		return fsentry_error.Wrap(err, fsentry_error.ErrorPermissions)
+	}
+	return fsentry_error.Wrap(err, fsentry_error.ErrorInternal)
+}
+
+func readOnlyError(op, path string) error {
+	return fsentry_error.Wrap(&iofs.PathError{Op: op, Path: path, Err: iofs.ErrPermission}, fsentry_error.ErrorReadOnly)
+}
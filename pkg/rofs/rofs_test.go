@@ -0,0 +1,212 @@
+package rofs
+
+import (
+	"embed"
+	"errors"
+	"os"
+	"testing"
+	"testing/fstest"
+
+	"github.com/HardDie/fsentry"
+	pkgFsentry "github.com/HardDie/fsentry/pkg/fsentry"
+	"github.com/HardDie/fsentry/pkg/fsentry_error"
+)
+
+var (
+	// seed is a storage created by the disk storage, hidden files are embedded only with the "all:" prefix.
+	//go:embed all:testdata/seed
+	seed embed.FS
+	//go:embed testdata/seed
+	seedWithoutHidden embed.FS
+)
+
+func TestFS(t *testing.T) {
+	f := New(fstest.MapFS{
+		"root/file":          {Data: []byte("hello")},
+		"root/folder/nested": {Data: []byte("nested")},
+	})
+
+	data, err := f.ReadFile("root/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("bad data readed; got: %q, want: %q", string(data), "hello")
+	}
+	_, err = f.ReadFile("root/folder")
+	if !errors.Is(err, fsentry_error.ErrorNotExist) {
+		t.Fatalf("error wait: %q; got: %q", fsentry_error.ErrorNotExist, err)
+	}
+	_, err = f.ReadFile("/root/not_exist")
+	if !errors.Is(err, fsentry_error.ErrorNotExist) {
+		t.Fatalf("error wait: %q; got: %q", fsentry_error.ErrorNotExist, err)
+	}
+
+	files, err := f.List("root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0].Name() != "file" || !files[1].IsDir() {
+		t.Fatal("bad list", files)
+	}
+	err = f.ListFunc("root/file", func(entry os.DirEntry) error { return nil })
+	if !errors.Is(err, fsentry_error.ErrorNotDirectory) {
+		t.Fatalf("error wait: %q; got: %q", fsentry_error.ErrorNotDirectory, err)
+	}
+
+	isExist, err := f.IsFolderExist("./root/folder")
+	if err != nil || !isExist {
+		t.Fatal("folder must exist", err)
+	}
+	_, err = f.IsFileExist("root/folder")
+	if !errors.Is(err, fsentry_error.ErrorBadPath) {
+		t.Fatalf("error wait: %q; got: %q", fsentry_error.ErrorBadPath, err)
+	}
+	_, err = f.IsFileExist("../root")
+	if !errors.Is(err, fsentry_error.ErrorBadPath) {
+		t.Fatalf("error wait: %q; got: %q", fsentry_error.ErrorBadPath, err)
+	}
+
+	for _, err := range []error{
+		f.CreateFile("root/new", nil),
+		f.UpdateFile("root/file", nil),
+		f.RemoveFile("root/file"),
+		f.CreateFolder("root/new"),
+		f.CreateAllFolder("root/new"),
+		f.RemoveFolder("root/folder"),
+		f.Rename("root/file", "root/new"),
+		f.CopyFolder("root/folder", "root/new"),
+	} {
+		if !errors.Is(err, fsentry_error.ErrorReadOnly) {
+			t.Fatalf("error wait: %q; got: %q", fsentry_error.ErrorReadOnly, err)
+		}
+	}
+}
+
+func TestFSEntry(t *testing.T) {
+	dir := t.TempDir()
+
+	// Prepare the data with the disk storage.
+	db := fsentry.NewFSEntry(dir)
+	err := db.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateFolder("f1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateEntry("e1", "data", "f1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.CreateBinary("b1", []byte("binary"), "f1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roDB := fsentry.NewFSEntry(".", fsentry.WithStorage(New(os.DirFS(dir))))
+	err = roDB.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	folder, err := roDB.GetFolder("f1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if folder.Name != "f1" {
+		t.Fatal("Bad folder name", folder.Name)
+	}
+	entry, err := roDB.GetEntry("e1", "f1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(entry.Data) != `"data"` {
+		t.Fatal("Bad entry data", string(entry.Data))
+	}
+	data, err := roDB.GetBinary("b1", "f1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "binary" {
+		t.Fatal("Bad binary data", string(data))
+	}
+	list, err := roDB.List("f1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Entries) != 1 || len(list.Binaries) != 1 {
+		t.Fatal("Bad list", list)
+	}
+	report, err := roDB.Check(pkgFsentry.CheckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 0 {
+		t.Fatal("Storage must be consistent", report.Problems)
+	}
+
+	_, err = roDB.CreateEntry("e2", nil, "f1")
+	if !errors.Is(err, fsentry_error.ErrorReadOnly) {
+		t.Fatalf("error wait: %q; got: %q", fsentry_error.ErrorReadOnly, err)
+	}
+	err = roDB.RemoveFolder("f1")
+	if !errors.Is(err, fsentry_error.ErrorReadOnly) {
+		t.Fatalf("error wait: %q; got: %q", fsentry_error.ErrorReadOnly, err)
+	}
+}
+
+func TestEmbedFS(t *testing.T) {
+	db := fsentry.NewFSEntry("testdata/seed", fsentry.WithStorage(New(seed)))
+	err := db.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := db.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Folders) != 1 || len(list.CorruptedFolder) != 0 {
+		t.Fatal("Bad list", list)
+	}
+	folder, err := db.GetFolder("f1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(folder.Data) != `{"title":"Folder"}` {
+		t.Fatal("Bad folder data", string(folder.Data))
+	}
+	entry, err := db.GetEntry("e1", "f1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(entry.Data) != `"data"` {
+		t.Fatal("Bad entry data", string(entry.Data))
+	}
+	info, err := db.GetBinaryInfo("b1", "f1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "b1" || info.Size != int64(len("binary")) {
+		t.Fatal("Bad binary info", info)
+	}
+	report, err := db.Check(pkgFsentry.CheckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 0 {
+		t.Fatal("Storage must be consistent", report.Problems)
+	}
+
+	// Without the "all:" prefix the descriptions of folders are lost.
+	db = fsentry.NewFSEntry("testdata/seed", fsentry.WithStorage(New(seedWithoutHidden)))
+	list, err = db.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.CorruptedFolder) != 1 {
+		t.Fatal("Folder without .info.json must be corrupted", list)
+	}
+}